@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	dashconfig "tinyproxy/internal/dashboard/config"
+	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/config"
+)
+
+// balancer returns the load balancer of scope, as listed by upstreamStats,
+// or nil.
+func (vh *VHostHandler) balancer(scope string) *loadbalancer.LoadBalancer {
+	vh.mu.RLock()
+	subs := vh.subs
+	vh.mu.RUnlock()
+
+	if up := subs.upstreams[scope]; up != nil {
+		return up.lb
+	}
+	return nil
+}
+
+// removeBackend removes the backend with url from the load balancer of
+// scope, and drops its proxy from every scope sharing that load balancer.
+func (vh *VHostHandler) removeBackend(scope, url string) error {
+	vh.mu.RLock()
+	subs := vh.subs
+	vh.mu.RUnlock()
+
+	up := subs.upstreams[scope]
+	if up == nil || up.lb == nil {
+		return fmt.Errorf("no load balancer for %q", scope)
+	}
+	if err := up.lb.RemoveBackend(url); err != nil {
+		return err
+	}
+	for _, other := range subs.upstreams {
+		if other.lb == up.lb {
+			other.backends.Remove(url)
+		}
+	}
+	return nil
+}
+
+// saveBackends returns a function that writes the backends of a scope's
+// load balancer, as changed at runtime, to the upstream block of the config
+// file at path. The file isn't reloaded, so the backends keep their health
+// state.
+func (vh *VHostHandler) saveBackends(path string) func(scope string) error {
+	return func(scope string) error {
+		vh.mu.RLock()
+		cfg, subs := vh.config, vh.subs
+		vh.mu.RUnlock()
+
+		up := subs.upstreams[scope]
+		if up == nil || up.lb == nil {
+			return fmt.Errorf("no load balancer for %q", scope)
+		}
+		host, location, ok := "", "", false
+		for name, vhost := range cfg.VHosts {
+			if name == scope {
+				host, ok = name, true
+				break
+			}
+			for _, loc := range vhost.Locations {
+				if scopeKey(name, loc) == scope {
+					// One without an upstream of its own shares the vhost's.
+					host, ok = name, true
+					if loc.OwnBackend {
+						location = loc.String()
+					}
+					break
+				}
+			}
+		}
+		if !ok {
+			return fmt.Errorf("no vhost or location %q", scope)
+		}
+
+		vh.saveMu.Lock()
+		defer vh.saveMu.Unlock()
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		edited, err := config.SetUpstreamBackends(string(raw), host, location, up.lb.BackendConfigs())
+		if err != nil {
+			return err
+		}
+		if _, err := config.NewParser(strings.NewReader(edited)).Parse(); err != nil {
+			return fmt.Errorf("edited config does not parse: %w", err)
+		}
+		return dashconfig.WriteFile(path, []byte(edited))
+	}
+}
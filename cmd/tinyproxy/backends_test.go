@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/config"
+)
+
+func TestRuntimeBackends(t *testing.T) {
+	var hits [2]int
+	var backends [2]*httptest.Server
+	for i := range backends {
+		backends[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				hits[i]++
+			}
+		}))
+		defer backends[i].Close()
+	}
+
+	conf := `vhosts {
+    example.com {
+        upstream {
+            # app servers
+            backend ` + backends[0].URL + `
+            health_check {
+                path /healthz
+                interval 10ms
+                pass_threshold 1
+            }
+        }
+        location /api {
+            max_body_size 1MB
+        }
+        location /other {
+            upstream {
+                backend ` + backends[0].URL + `
+            }
+        }
+    }
+}
+`
+	vh, path := newTestHandler(t, conf)
+
+	// The location without an upstream of its own shares the vhost's load
+	// balancer and isn't listed apart; the one with its own upstream is.
+	if vh.balancer("example.com location /api") != vh.balancer("example.com") {
+		t.Error("location inheriting the upstream has a load balancer of its own")
+	}
+	var scopes []string
+	for _, st := range vh.upstreamStats() {
+		scopes = append(scopes, st.Scope)
+	}
+	if strings.Join(scopes, ",") != "example.com,example.com location /other" {
+		t.Errorf("upstreamStats scopes = %q", scopes)
+	}
+
+	// Move the vhost to the second backend: add it, drain the first, then
+	// remove it.
+	lb := vh.balancer("example.com")
+	if _, err := lb.AddBackend(loadbalancer.BackendConfig{URL: backends[1].URL, Weight: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// It gets requests once it passes a health check.
+	time.Sleep(50 * time.Millisecond)
+	if err := lb.SetState(backends[0].URL, loadbalancer.StateDraining); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/", "/api/users"} {
+		if rec := get(vh, "", p); rec.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d", p, rec.Code)
+		}
+	}
+	if hits != [2]int{0, 2} {
+		t.Errorf("hits = %v, want all on the second backend", hits)
+	}
+	if err := vh.removeBackend("example.com", backends[0].URL); err != nil {
+		t.Fatal(err)
+	}
+	if lb.Backend(backends[0].URL) != nil {
+		t.Error("removed backend still in the load balancer")
+	}
+
+	if err := vh.saveBackends(path)("example.com"); err != nil {
+		t.Fatalf("saveBackends: %v", err)
+	}
+	raw, _ := os.ReadFile(path)
+	want := strings.Replace(conf, "            backend "+backends[0].URL+"\n", "            backend "+backends[1].URL+" weight 2\n", 1)
+	if string(raw) != want {
+		t.Errorf("saved config:\n%s\nwant:\n%s", raw, want)
+	}
+	cfg, err := config.NewParser(strings.NewReader(string(raw))).Parse()
+	if err != nil {
+		t.Fatalf("saved config does not parse: %v", err)
+	}
+	if got := cfg.VHosts["example.com"].Locations[1].VHost.Upstream.Backends[0].URL; got != backends[0].URL {
+		t.Errorf("location /other backend = %s, want unchanged", got)
+	}
+	if err := vh.saveBackends(path)("missing.example.com"); err == nil {
+		t.Error("saving an unknown scope: expected an error")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -11,10 +13,12 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -26,13 +30,21 @@ import (
 	dashstats "tinyproxy/internal/dashboard/stats"
 	"tinyproxy/internal/fastcgi"
 	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/auth"
 	"tinyproxy/internal/server/botdetect"
 	"tinyproxy/internal/server/compression"
 	"tinyproxy/internal/server/config"
+	"tinyproxy/internal/server/errorpage"
 	"tinyproxy/internal/server/fingerprint"
+	"tinyproxy/internal/server/geoip"
+	"tinyproxy/internal/server/middleware"
 	"tinyproxy/internal/server/proxy"
+	"tinyproxy/internal/server/realip"
+	"tinyproxy/internal/server/redirect"
+	"tinyproxy/internal/server/rewrite"
 	"tinyproxy/internal/server/security"
 	"tinyproxy/internal/server/security/certmanager"
+	"tinyproxy/internal/server/waf"
 )
 
 // maxTLSRecordBody is the maximum TLS record payload size per RFC 5246 §6.2.1.
@@ -83,8 +95,8 @@ func (l *sniffingListener) Accept() (net.Conn, error) {
 		}
 
 		if hdr[0] != 0x16 {
-			// Plain HTTP — send redirect and loop.
-			fmt.Fprint(conn, "HTTP/1.1 301 Moved Permanently\r\nLocation: https://localhost:8080\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			// Plain HTTP — redirect to the same host and URI over TLS, and loop.
+			writeHTTPSRedirect(conn, hdr)
 			conn.Close()
 			continue
 		}
@@ -117,6 +129,20 @@ func (l *sniffingListener) Accept() (net.Conn, error) {
 	}
 }
 
+// writeHTTPSRedirect reads the plain-HTTP request whose first bytes are in
+// prefix and answers it with a redirect to the HTTPS equivalent.
+func writeHTTPSRedirect(conn net.Conn, prefix []byte) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(bytes.NewReader(prefix), conn)))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 301 Moved Permanently\r\nLocation: https://%s%s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		req.Host, req.URL.RequestURI())
+}
+
 func (l *sniffingListener) Close() error   { return l.inner.Close() }
 func (l *sniffingListener) Addr() net.Addr { return l.inner.Addr() }
 
@@ -145,40 +171,408 @@ type VHostHandler struct {
 	mu        sync.RWMutex
 	config    *config.ServerConfig
 	blocklist map[string]struct{}
-	caches    map[string]*cache.Cache
-	balancers map[string]*loadbalancer.LoadBalancer
+	subs      *subsystems
 	stats     *dashstats.Collector // nil when dashboard is disabled
+	saveMu    sync.Mutex           // serializes backend changes written to the config file
+}
+
+// subsystems are the per-vhost runtime instances built from one config. A
+// reload builds a new set and swaps it in whole, so a request only ever sees
+// instances from a single config.
+type subsystems struct {
+	caches     map[string]*cache.Cache
+	upstreams  map[string]*upstream
+	errorPages map[string]*errorpage.Pages
+	basicAuth  map[string]*auth.Basic
+	authReq    map[string]*auth.Request
+	jwt        map[string]*auth.JWT
+	connLimits map[string]*security.ConnLimiter
+	access     map[string]*security.Access
+	geoRules   map[string]geoip.Rules
+	waf        map[string]*waf.Engine
+	rateLimits map[string]*security.RateLimiter
+	rateZones  map[string]*security.RateLimiter // by rate_limit_zone name
+	kept       map[*security.RateLimiter]bool   // rate limiters taken over on reload
+	redis      *security.RedisStore             // nil when rate_limit_redis is not configured
+	redisKept  bool                             // redis taken over on reload
+	realIP     *realip.Resolver
+	geo        *geoip.DB // nil when geoip is not configured or failed to load
 }
 
-// initSubsystems builds per-vhost caches and load balancers from the current config.
+// upstream holds the proxies of a vhost or location, built once so backend
+// connections are kept alive across requests.
+type upstream struct {
+	lb       *loadbalancer.LoadBalancer
+	backends *proxy.Upstream    // with lb
+	retry    loadbalancer.RetryConfig
+	pass     *proxy.ReverseProxy // proxy_pass
+}
+
+// initSubsystems builds the subsystems for the current config.
 func (vh *VHostHandler) initSubsystems() {
-	vh.caches = make(map[string]*cache.Cache)
-	vh.balancers = make(map[string]*loadbalancer.LoadBalancer)
+	vh.subs = newSubsystems(vh.config, nil)
+}
 
-	for name, vhost := range vh.config.VHosts {
-		if vhost.Cache.Enabled {
-			vh.caches[name] = cache.New(vhost.Cache.MaxSize)
-			log.Printf("cache enabled for vhost %q (max %d bytes, TTL %s)",
-				name, vhost.Cache.MaxSize, vhost.Cache.DefaultTTL)
+// newSubsystems builds per-vhost caches, proxies and load balancers for cfg.
+// Locations get their own instances, keyed by scopeKey. The Redis store of
+// prev, if any, is reused when its settings are unchanged, so requests
+// still using prev keep their connections.
+func newSubsystems(cfg *config.ServerConfig, prev *subsystems) *subsystems {
+	s := &subsystems{
+		caches:     make(map[string]*cache.Cache),
+		upstreams:  make(map[string]*upstream),
+		errorPages: make(map[string]*errorpage.Pages),
+		basicAuth:  make(map[string]*auth.Basic),
+		authReq:    make(map[string]*auth.Request),
+		jwt:        make(map[string]*auth.JWT),
+		connLimits: make(map[string]*security.ConnLimiter),
+		access:     make(map[string]*security.Access),
+		geoRules:   make(map[string]geoip.Rules),
+		waf:        make(map[string]*waf.Engine),
+		rateLimits: make(map[string]*security.RateLimiter),
+		rateZones:  make(map[string]*security.RateLimiter),
+		realIP:     realip.New(cfg.TrustedProxies),
+	}
+	if cfg.RateLimitRedis.Address != "" {
+		s.redis = security.NewRedisStore(cfg.RateLimitRedis)
+		if prev != nil && prev.redis != nil && prev.redis.Config() == s.redis.Config() {
+			s.redis = prev.redis
 		}
-		if len(vhost.Upstream.Backends) > 0 {
-			lb, err := loadbalancer.New(vhost.Upstream)
-			if err != nil {
-				log.Printf("WARNING: failed to init load balancer for vhost %q: %v", name, err)
-				continue
+	}
+	for name, zone := range cfg.RateLimitZones {
+		s.rateZones[name] = s.newRateLimiter("zone:"+name, zone)
+	}
+	if cfg.GeoIP != (geoip.Config{}) {
+		db, err := geoip.Open(cfg.GeoIP)
+		if err != nil {
+			log.Printf("WARNING: failed to load geoip databases: %v", err)
+		} else {
+			s.geo = db
+		}
+	}
+	for name, vhost := range cfg.VHosts {
+		s.initScope(name, name, vhost)
+		for _, loc := range vhost.Locations {
+			key := scopeKey(name, loc)
+			s.initScope(name, key, loc.VHost)
+			// A location without limits of its own counts against the vhost's.
+			if loc.VHost.LimitConn == vhost.LimitConn && s.connLimits[name] != nil {
+				s.connLimits[key] = s.connLimits[name]
+			}
+			// Likewise for the rate limit: a client's requests to the vhost
+			// and to such a location are counted together.
+			if loc.VHost.Security.RateLimit == vhost.Security.RateLimit && s.rateLimits[name] != nil {
+				s.rateLimits[key].Stop()
+				s.rateLimits[key] = s.rateLimits[name]
+			}
+			// A location that inherits the vhost's upstream shares its load
+			// balancer, so backend state and runtime changes apply to both.
+			if up, vup := s.upstreams[key], s.upstreams[name]; !loc.OwnBackend && up != nil && up.lb != nil && vup != nil && vup.lb != nil {
+				up.lb.Stop()
+				up.lb = vup.lb
+			}
+		}
+	}
+	return s
+}
+
+// initScope builds the cache, proxies, load balancer, error pages and access
+// checks for a single vhost or location of host.
+func (s *subsystems) initScope(host, name string, vhost *config.VirtualHost) {
+	if len(vhost.Access.Rules) > 0 {
+		a, err := security.LoadAccess(vhost.Access)
+		if err != nil {
+			// Fail closed: a missing allow list must not open the vhost up.
+			log.Printf("WARNING: failed to load access list for vhost %q, refusing all requests: %v", name, err)
+			a = security.NewAccess([]security.AccessRule{{All: true}})
+		}
+		s.access[name] = a
+	}
+	if !vhost.GeoIP.Empty() {
+		if s.geo != nil {
+			s.geoRules[name] = vhost.GeoIP
+		} else {
+			// Fail closed: without the databases blocked clients can't be told apart.
+			log.Printf("WARNING: geoip unavailable for vhost %q, refusing all requests", name)
+			s.access[name] = security.NewAccess([]security.AccessRule{{All: true}})
+		}
+	}
+	if vhost.WAF.Mode != "" {
+		e, err := waf.Load(vhost.WAF)
+		switch {
+		case err == nil:
+			s.waf[name] = e
+		case vhost.WAF.Mode == waf.ModeBlock:
+			// Fail closed: requests the rules would block can't be told apart.
+			log.Printf("WARNING: failed to load waf rules for vhost %q, refusing all requests: %v", name, err)
+			s.access[name] = security.NewAccess([]security.AccessRule{{All: true}})
+		default:
+			log.Printf("WARNING: failed to load waf rules for vhost %q, not inspecting requests: %v", name, err)
+		}
+	}
+	if vhost.AuthBasic.UserFile != "" {
+		b, err := auth.LoadBasic(vhost.AuthBasic)
+		if err != nil {
+			// Fail closed: with no users every request is refused.
+			log.Printf("WARNING: failed to load auth_basic users for vhost %q, refusing all requests: %v", name, err)
+			b = auth.NewBasic(vhost.AuthBasic.Realm, nil)
+		}
+		s.basicAuth[name] = b
+	}
+	if vhost.AuthRequest.URL != "" {
+		s.authReq[name] = auth.NewRequest(vhost.AuthRequest)
+	}
+	if vhost.LimitConn != (security.ConnLimitConfig{}) {
+		s.connLimits[name] = security.NewConnLimiter(vhost.LimitConn)
+	}
+	if vhost.Security.RateLimit.Requests > 0 {
+		s.rateLimits[name] = s.newRateLimiter("vhost:"+name, vhost.Security.RateLimit)
+	}
+	if vhost.JWT.Keys != "" {
+		j, err := auth.LoadJWT(vhost.JWT)
+		if err != nil {
+			// Fail closed: without keys no token validates.
+			log.Printf("WARNING: failed to load jwt keys for vhost %q, refusing all requests: %v", name, err)
+			j = auth.NewJWT(vhost.JWT)
+		}
+		s.jwt[name] = j
+	}
+	if len(vhost.ErrorPages.Pages) > 0 {
+		pages, err := errorpage.Load(vhost.ErrorPages, vhost.Root)
+		if err != nil {
+			log.Printf("WARNING: failed to load error pages for vhost %q: %v", name, err)
+		} else {
+			s.errorPages[name] = pages
+		}
+	}
+	if vhost.Cache.Enabled {
+		s.caches[name] = cache.New(vhost.Cache.MaxSize)
+		log.Printf("cache enabled for vhost %q (max %d bytes, TTL %s)",
+			name, vhost.Cache.MaxSize, vhost.Cache.DefaultTTL)
+	}
+	up := &upstream{}
+	if len(vhost.Upstream.Backends) > 0 {
+		lb, err := loadbalancer.New(vhost.Upstream)
+		if err != nil {
+			log.Printf("WARNING: failed to init load balancer for vhost %q: %v", name, err)
+		} else {
+			up.lb = lb
+			up.backends = proxy.NewUpstream(vhost.Headers, vhost.Timeouts, vhost.Keepalive)
+			up.retry = vhost.Upstream.Retry
+			for _, b := range lb.Backends() {
+				if _, err := up.backends.Backend(b.URL); err != nil {
+					log.Printf("WARNING: invalid backend %q for vhost %q: %v", b.URL, name, err)
+				}
 			}
-			vh.balancers[name] = lb
 			log.Printf("load balancer enabled for vhost %q (strategy %s, %d backends)",
 				name, vhost.Upstream.Strategy, len(vhost.Upstream.Backends))
 		}
 	}
+	if vhost.ProxyPass != "" {
+		rp, err := proxy.NewReverseProxy([]proxy.VHost{
+			{
+				Domain:     host,
+				TargetURL:  vhost.ProxyPass,
+				Socks5Addr: vhost.SOCKS5.Address,
+				Headers:    vhost.Headers,
+				Timeouts:   vhost.Timeouts,
+				Keepalive:  vhost.Keepalive,
+			},
+		})
+		if err != nil {
+			log.Printf("WARNING: failed to init proxy for vhost %q: %v", name, err)
+		} else {
+			up.pass = rp
+		}
+	}
+	if up.lb != nil || up.pass != nil {
+		s.upstreams[name] = up
+	}
 }
 
-// stopSubsystems shuts down health checkers for all active load balancers.
-func (vh *VHostHandler) stopSubsystems() {
-	for _, lb := range vh.balancers {
-		lb.Stop()
+// protect wraps h with the access checks of scope: the allow/deny list
+// first, then country and ASN blocking, the WAF, basic auth, JWT validation
+// and the auth subrequest.
+func (s *subsystems) protect(scope string, h http.Handler) http.Handler {
+	if a, ok := s.authReq[scope]; ok {
+		h = a.Wrap(h)
+	}
+	if j, ok := s.jwt[scope]; ok {
+		h = j.Wrap(h)
+	}
+	if b, ok := s.basicAuth[scope]; ok {
+		h = b.Wrap(h)
+	}
+	if e, ok := s.waf[scope]; ok {
+		h = e.Wrap(h)
+	}
+	if g, ok := s.geoRules[scope]; ok {
+		h = g.Wrap(h)
+	}
+	if a, ok := s.access[scope]; ok {
+		h = a.Wrap(h)
+	}
+	return h
+}
+
+// newRateLimiter creates the limiter enforcing cfg. Limits with store redis
+// count under name in Redis, so every instance with the same config shares
+// them.
+func (s *subsystems) newRateLimiter(name string, cfg security.RateLimitConfig) *security.RateLimiter {
+	if cfg.Store == security.RateLimitStoreRedis && s.redis != nil {
+		return security.NewRedisRateLimiter(cfg, s.redis, name)
+	}
+	return security.NewRateLimiter(cfg)
+}
+
+// stop shuts down health checkers and closes idle backend connections.
+// Requests still using s finish normally.
+func (s *subsystems) stop() {
+	for _, a := range s.authReq {
+		a.Close()
+	}
+	for _, b := range s.basicAuth {
+		b.Stop()
+	}
+	for _, limits := range []map[string]*security.RateLimiter{s.rateLimits, s.rateZones} {
+		for _, l := range limits {
+			if !s.kept[l] {
+				l.Stop()
+			}
+		}
+	}
+	if s.redis != nil && !s.redisKept {
+		s.redis.Close()
+	}
+	stopped := make(map[*loadbalancer.LoadBalancer]bool)
+	for _, up := range s.upstreams {
+		if up.lb != nil {
+			if !stopped[up.lb] {
+				stopped[up.lb] = true
+				up.lb.Stop()
+			}
+			up.backends.Close()
+		}
+		if up.pass != nil {
+			up.pass.Close()
+		}
+	}
+}
+
+// keepRateLimits carries the rate limiters of old whose settings are
+// unchanged over to s, so a reload doesn't reset the clients' counts. The
+// limiters s replaces are stopped, and old.stop leaves the kept ones running.
+// Limiters counting in Redis are not carried over: their counts outlive
+// them.
+func (s *subsystems) keepRateLimits(old *subsystems) {
+	old.kept = make(map[*security.RateLimiter]bool)
+	for _, maps := range [][2]map[string]*security.RateLimiter{
+		{s.rateLimits, old.rateLimits},
+		{s.rateZones, old.rateZones},
+	} {
+		cur, prev := maps[0], maps[1]
+		// Decide per limiter, so scopes sharing one keep sharing.
+		replaced := make(map[*security.RateLimiter]*security.RateLimiter)
+		for k, l := range cur {
+			if _, ok := replaced[l]; ok {
+				continue
+			}
+			if l.Config().Store == security.RateLimitStoreRedis {
+				continue
+			}
+			if p, ok := prev[k]; ok && p.Config() == l.Config() {
+				replaced[l] = p
+			}
+		}
+		for k, l := range cur {
+			if p, ok := replaced[l]; ok {
+				cur[k] = p
+				old.kept[p] = true
+			}
+		}
+		for l := range replaced {
+			l.Stop()
+		}
+	}
+}
+
+// keepConnLimits carries the connection limiters of old whose limits are
+// unchanged over to s, so a reload doesn't reset the counts of requests and
+// connections still open.
+func (s *subsystems) keepConnLimits(old *subsystems) {
+	// Decide per limiter, so scopes sharing one keep sharing.
+	replaced := make(map[*security.ConnLimiter]*security.ConnLimiter)
+	for k, l := range s.connLimits {
+		if _, ok := replaced[l]; ok {
+			continue
+		}
+		if p, ok := old.connLimits[k]; ok && p.Config() == l.Config() {
+			replaced[l] = p
+		}
+	}
+	for k, l := range s.connLimits {
+		if p, ok := replaced[l]; ok {
+			s.connLimits[k] = p
+		}
+	}
+}
+
+// scopeKey identifies a location's subsystems, e.g. "example.com location /api".
+func scopeKey(host string, loc *config.Location) string {
+	return host + " " + loc.String()
+}
+
+// maxRewriteCycles bounds how often a rewrite can send a request back to
+// location matching, matching nginx's limit of 10.
+const maxRewriteCycles = 10
+
+// resolveVHost returns the settings that apply to r and the key of its
+// caches and balancers. A matching location replaces the vhost settings for
+// the rest of the request. exists is false when r falls through to the
+// built-in default vhost.
+//
+// Rewrite rules run along the way and may modify r.URL: the vhost's rules
+// before location matching, then the matched location's, matching again
+// while they rewrite the URI. redir is set when a rule answers the request
+// with a redirect, or with a 500 if rewrites keep cycling.
+func resolveVHost(cfg *config.ServerConfig, r *http.Request) (vhost *config.VirtualHost, scope string, exists bool, redir *rewrite.Result) {
+	parent, exists := cfg.VHosts[r.Host]
+	if !exists {
+		return cfg.VHosts["default"], r.Host, false, nil
+	}
+	if res := rewrite.Apply(parent.Rewrites, r); res.Outcome == rewrite.Redirect {
+		return parent, r.Host, true, &res
+	}
+	for i := 0; i < maxRewriteCycles; i++ {
+		loc := parent.MatchLocation(r.URL.Path)
+		if loc == nil {
+			return parent, r.Host, true, nil
+		}
+		res := rewrite.Apply(loc.VHost.Rewrites, r)
+		switch res.Outcome {
+		case rewrite.Redirect:
+			return loc.VHost, scopeKey(r.Host, loc), true, &res
+		case rewrite.Rewritten:
+			continue
+		}
+		return loc.VHost, scopeKey(r.Host, loc), true, nil
 	}
+	log.Printf("rewrite: cycle for %s%s", r.Host, r.URL.Path)
+	return parent, r.Host, true, &rewrite.Result{Outcome: rewrite.Redirect, Code: http.StatusInternalServerError}
+}
+
+// writeRewriteRedirect answers r with the redirect chosen by a rewrite rule.
+func writeRewriteRedirect(w http.ResponseWriter, r *http.Request, res *rewrite.Result) {
+	if res.Location == "" {
+		http.Error(w, http.StatusText(res.Code), res.Code)
+		return
+	}
+	http.Redirect(w, r, res.Location, res.Code)
+}
+
+// stopSubsystems shuts down the current subsystems.
+func (vh *VHostHandler) stopSubsystems() {
+	vh.subs.stop()
 }
 
 func (vh *VHostHandler) reload(configPath string) error {
@@ -191,11 +585,19 @@ func (vh *VHostHandler) reload(configPath string) error {
 	if err != nil {
 		return err
 	}
+	vh.mu.RLock()
+	prev := vh.subs
+	vh.mu.RUnlock()
+	subs := newSubsystems(newCfg, prev)
 	vh.mu.Lock()
-	vh.stopSubsystems()
+	old := vh.subs
+	old.redisKept = old.redis == subs.redis
+	subs.keepRateLimits(old)
+	subs.keepConnLimits(old)
 	vh.config = newCfg
-	vh.initSubsystems()
+	vh.subs = subs
 	vh.mu.Unlock()
+	old.stop()
 	return nil
 }
 
@@ -206,21 +608,28 @@ func (vh *VHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vh.mu.RLock()
 	cfg := vh.config
 	bl := vh.blocklist
-	caches := vh.caches
-	balancers := vh.balancers
+	subs := vh.subs
 	collector := vh.stats
 	vh.mu.RUnlock()
 
-	host := r.Host
-	vhost, exists := cfg.VHosts[host]
-	if !exists {
-		vhost = cfg.VHosts["default"]
+	r = subs.realIP.Resolve(r)
+	var geo geoip.Info
+	if subs.geo != nil {
+		if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			geo = subs.geo.Lookup(ap.Addr())
+		}
+		r = r.WithContext(geoip.WithInfo(r.Context(), geo))
 	}
+	path := r.URL.Path
+	vhost, scope, exists, redir := resolveVHost(cfg, r)
+	ew, r := errorpage.Wrap(rw, r, subs.errorPages[scope])
+	r, wafResult := waf.Track(r)
+	r, retries := withRetryCount(r)
 
 	fp := fingerprint.FromContext(r.Context())
 	if fingerprint.IsBlocked(bl, fp) {
 		log.Printf("BLOCKING TLS fingerprint: %s %s JA3=%s JA4=%s", r.Method, r.URL.Path, fp.JA3, fp.JA4)
-		botdetect.Block(rw, r, vhost.BotProtection.Honeypot)
+		botdetect.Block(ew, r, vhost.BotProtection.Honeypot)
 		return
 	}
 
@@ -233,6 +642,18 @@ func (vh *VHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		BlockedPaths:  vhost.BotProtection.BlockedPaths,
 	}
 
+	var limiters []*security.RateLimiter
+	rateScope := scope
+	if !exists {
+		rateScope = "default"
+	}
+	if l, ok := subs.rateLimits[rateScope]; ok {
+		limiters = append(limiters, l)
+	}
+	for _, z := range vhost.RateLimitZones {
+		limiters = append(limiters, subs.rateZones[z])
+	}
+
 	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vh.setSecurityHeaders(w, vhost)
 		if fp.JA3 != "" {
@@ -244,53 +665,191 @@ func (vh *VHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if redir != nil {
+			writeRewriteRedirect(w, r, redir)
+			return
+		}
+		if vhost.Return.Code != 0 {
+			redirect.Return(w, r, vhost.Return.Code, vhost.Return.Target)
+			return
+		}
+
 		// Build the core handler (compression wrapping handleVHost)
 		var coreHandler http.Handler
 		if vhost.Compression {
 			coreHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				compression.Compress(func(w http.ResponseWriter, r *http.Request) {
-					vh.handleVHost(w, r, vhost, balancers[host])
+					vh.handleVHost(w, r, cfg, subs, vhost, subs.upstreams[scope])
 				})(w, r)
 			})
 		} else {
 			coreHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				vh.handleVHost(w, r, vhost, balancers[host])
+				vh.handleVHost(w, r, cfg, subs, vhost, subs.upstreams[scope])
 			})
 		}
 
 		// Wrap with cache middleware if enabled
-		if c, ok := caches[host]; ok {
+		if c, ok := subs.caches[scope]; ok {
 			coreHandler = cache.Handler(vhost.Cache, c)(coreHandler)
 		}
 
-		coreHandler.ServeHTTP(w, r)
+		// Authenticate before anything, cached responses included, is served
+		coreHandler = limitRate(limiters, true, coreHandler)
+		subs.protect(scope, coreHandler).ServeHTTP(w, r)
 	})
 
 	botHandler := botdetect.BotDetect(botCfg)(inner)
 
-	security.RateLimit(
-		vhost.Security.RateLimit.Requests,
-		vhost.Security.RateLimit.Window,
-	)(botHandler).ServeHTTP(rw, r)
+	handler := limitRate(limiters, false, botHandler)
+	if cl, ok := subs.connLimits[scope]; ok {
+		handler = cl.Wrap(handler)
+	}
+	// As in nginx, an oversized body is refused before any other check.
+	handler = security.MaxBodySize(vhost.MaxBodySize)(handler)
+	handler.ServeHTTP(ew, r)
 
 	if collector != nil {
 		host := r.Host
 		if i := strings.LastIndex(host, ":"); i > 0 {
 			host = host[:i]
 		}
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
 		collector.Record(dashstats.RequestRecord{
-			TS:      time.Now().UnixMilli(),
-			VHost:   host,
-			Method:  r.Method,
-			Path:    r.URL.Path,
-			Status:  rw.status,
-			Latency: time.Since(start).Microseconds(),
-			Bytes:   rw.bytes,
-			Remote:  r.RemoteAddr,
+			TS:       time.Now().UnixMilli(),
+			VHost:    host,
+			Method:   r.Method,
+			Path:     path,
+			Status:   rw.status,
+			Latency:  time.Since(start).Microseconds(),
+			Bytes:    rw.bytes,
+			Remote:   remote,
+			Country:  geo.Country,
+			ASN:      geo.ASN,
+			WAF:      wafResult.Action(),
+			WAFRules: wafResult.RuleIDs(),
+			Retries:  *retries,
 		})
 	}
 }
 
+// limitRate wraps h with the limiters whose keys are known only after
+// authentication when afterAuth is set, or with the others when it isn't.
+// They apply in order.
+func limitRate(limiters []*security.RateLimiter, afterAuth bool, h http.Handler) http.Handler {
+	for i := len(limiters) - 1; i >= 0; i-- {
+		if limiters[i].AfterAuth() == afterAuth {
+			h = limiters[i].Wrap(h)
+		}
+	}
+	return h
+}
+
+// trustedProxy reports whether addr is one of the current trusted_proxies,
+// for the PROXY protocol listener.
+func (vh *VHostHandler) trustedProxy(addr netip.Addr) bool {
+	vh.mu.RLock()
+	subs := vh.subs
+	vh.mu.RUnlock()
+	return subs.realIP.Trusted(addr)
+}
+
+// listen opens a TCP listener on addr that reads PROXY protocol headers
+// when proxy_protocol is on.
+func (vh *VHostHandler) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	vh.mu.RLock()
+	on := vh.config.ProxyProtocol
+	vh.mu.RUnlock()
+	if on {
+		return &realip.Listener{Listener: ln, Trusted: vh.trustedProxy}, nil
+	}
+	return ln, nil
+}
+
+// connStats reports the in-flight request counts of every limit_conn scope,
+// for the dashboard.
+func (vh *VHostHandler) connStats() []security.ConnStats {
+	vh.mu.RLock()
+	subs := vh.subs
+	vh.mu.RUnlock()
+
+	// Sorted, a vhost comes before its locations, so a limiter they share is
+	// listed under the vhost.
+	scopes := make([]string, 0, len(subs.connLimits))
+	for scope := range subs.connLimits {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	seen := make(map[*security.ConnLimiter]bool)
+	var out []security.ConnStats
+	for _, scope := range scopes {
+		cl := subs.connLimits[scope]
+		if !seen[cl] {
+			seen[cl] = true
+			out = append(out, cl.Stats(scope, 10))
+		}
+	}
+	return out
+}
+
+// upstreamStats reports the state of the backends of every load-balanced
+// vhost and location.
+func (vh *VHostHandler) upstreamStats() []loadbalancer.UpstreamStats {
+	vh.mu.RLock()
+	subs := vh.subs
+	vh.mu.RUnlock()
+
+	// Sorted, a vhost comes before its locations, so a load balancer they
+	// share is listed under the vhost.
+	scopes := make([]string, 0, len(subs.upstreams))
+	for scope, up := range subs.upstreams {
+		if up.lb != nil {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+
+	seen := make(map[*loadbalancer.LoadBalancer]bool)
+	out := make([]loadbalancer.UpstreamStats, 0, len(scopes))
+	for _, scope := range scopes {
+		lb := subs.upstreams[scope].lb
+		if !seen[lb] {
+			seen[lb] = true
+			out = append(out, lb.Stats(scope))
+		}
+	}
+	return out
+}
+
+// serveHTTPRedirect handles requests on the plain-HTTP port. A vhost or
+// location with a return directive, or a rewrite rule that redirects,
+// answers directly, so canonical-host redirects take a single hop;
+// everything else is sent to HTTPS. Internal rewrites are resolved on a
+// copy of r and never show up in the HTTPS redirect.
+func (vh *VHostHandler) serveHTTPRedirect(w http.ResponseWriter, r *http.Request) {
+	vh.mu.RLock()
+	cfg := vh.config
+	vh.mu.RUnlock()
+
+	vhost, _, exists, redir := resolveVHost(cfg, r.Clone(r.Context()))
+	if redir != nil && redir.Location != "" {
+		writeRewriteRedirect(w, r, redir)
+		return
+	}
+	if exists && vhost.Return.Code != 0 {
+		redirect.Return(w, r, vhost.Return.Code, vhost.Return.Target)
+		return
+	}
+	redirect.ToHTTPS(w, r)
+}
+
 func (vh *VHostHandler) setSecurityHeaders(w http.ResponseWriter, vhost *config.VirtualHost) {
 	w.Header().Set("X-Frame-Options", vhost.Security.Headers.FrameOptions)
 	w.Header().Set("X-Content-Type-Options", vhost.Security.Headers.ContentType)
@@ -299,50 +858,30 @@ func (vh *VHostHandler) setSecurityHeaders(w http.ResponseWriter, vhost *config.
 	w.Header().Set("Strict-Transport-Security", vhost.Security.Headers.HSTS)
 }
 
-func (vh *VHostHandler) handleVHost(w http.ResponseWriter, r *http.Request, vhost *config.VirtualHost, lb *loadbalancer.LoadBalancer) {
+func (vh *VHostHandler) handleVHost(w http.ResponseWriter, r *http.Request, cfg *config.ServerConfig, subs *subsystems, vhost *config.VirtualHost, up *upstream) {
+	if len(vhost.TryFiles) > 0 {
+		vh.tryFiles(w, r, cfg, subs, vhost)
+		return
+	}
+
 	if vhost.FastCGI.Pass != "" {
 		fastcgi.Handler(w, r, vhost.FastCGI.Pass, vhost.Root, vhost.FastCGI.Index)
 		return
 	}
 
 	// Load-balanced upstream: pick a backend and proxy to it
-	if lb != nil {
-		backend, err := lb.Next(r)
-		if err != nil {
-			log.Printf("load balancer error: %v", err)
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-			return
-		}
-		lb.MarkActive(backend)
-		defer lb.MarkDone(backend)
-
-		// Set sticky-session cookie if strategy requires it
-		lb.SetAffinityCookie(w, backend)
-
-		backendProxy, err := proxy.NewSingleBackendProxy(backend.URL)
-		if err != nil {
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
-			return
-		}
-		backendProxy.ServeHTTP(w, r)
+	if up != nil && up.lb != nil {
+		serveUpstream(w, r, up)
 		return
 	}
 
 	// Single proxy_pass backend
 	if vhost.ProxyPass != "" {
-		vhosts := []proxy.VHost{
-			{
-				Domain:     r.Host,
-				TargetURL:  vhost.ProxyPass,
-				Socks5Addr: vhost.SOCKS5.Address,
-			},
-		}
-		reverseProxy, err := proxy.NewReverseProxy(vhosts)
-		if err != nil {
+		if up == nil || up.pass == nil {
 			http.Error(w, "Proxy configuration error", http.StatusInternalServerError)
 			return
 		}
-		reverseProxy.ServeHTTP(w, r)
+		up.pass.ServeHTTP(w, r)
 		return
 	}
 	http.FileServer(http.Dir(vhost.Root)).ServeHTTP(w, r)
@@ -474,7 +1013,12 @@ func runServer() {
 		dashCfg := dashboard.Config{
 			Host: dc.Host, Port: dc.Port, CredsFile: dc.Creds,
 			DBPath: dc.DBPath, TLSCert: dc.TLSCert, TLSKey: dc.TLSKey,
-			ConfigPath: path,
+			ConfigPath:    path,
+			ConnStats:     handler.connStats,
+			UpstreamStats: handler.upstreamStats,
+			Balancer:      handler.balancer,
+			RemoveBackend: handler.removeBackend,
+			SaveBackends:  handler.saveBackends(path),
 		}
 		dashSrv, err = dashboard.New(dashCfg, db, logbuf, reloadCh)
 		if err != nil {
@@ -501,9 +1045,12 @@ func runServer() {
 		}
 	}()
 
+	// Open connections are tracked for limit_conn connections_per_ip.
+	conns := security.NewConns()
 	server := &http.Server{
-		Handler: handler,
+		Handler: middleware.RequestID(handler),
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx = conns.ConnContext(ctx, c)
 			if tc, ok := c.(*tls.Conn); ok {
 				if fc, ok := tc.NetConn().(*fingerprintConn); ok {
 					return fingerprint.WithFingerprints(ctx, fc.fp)
@@ -511,6 +1058,7 @@ func runServer() {
 			}
 			return ctx
 		},
+		ConnState: conns.ConnState,
 	}
 
 	quit := make(chan os.Signal, 1)
@@ -525,7 +1073,7 @@ func runServer() {
 		tlsCfg.Certificates = []tls.Certificate{cert}
 		server.TLSConfig = tlsCfg
 
-		tcpLn, err := net.Listen("tcp", ":8080")
+		tcpLn, err := handler.listen(":8080")
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -543,14 +1091,22 @@ func runServer() {
 		server.TLSConfig = mgr.TLSConfig()
 
 		go func() {
-			if err := http.ListenAndServe(":80", mgr.HTTPHandler(nil)); err != nil {
+			ln, err := handler.listen(":80")
+			if err == nil {
+				err = http.Serve(ln, mgr.HTTPHandler(http.HandlerFunc(handler.serveHTTPRedirect)))
+			}
+			if err != nil {
 				log.Printf("HTTP listener: %v", err)
 			}
 		}()
 
 		fmt.Printf("Production mode: Listening on %s\n", server.Addr)
 		go func() {
-			if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			ln, err := handler.listen(server.Addr)
+			if err == nil {
+				err = server.ServeTLS(ln, "", "")
+			}
+			if err != nil && err != http.ErrServerClosed {
 				log.Println("Prod server error:", err)
 			}
 		}()
@@ -0,0 +1,949 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	dashstats "tinyproxy/internal/dashboard/stats"
+	"tinyproxy/internal/server/geoip/geoiptest"
+)
+
+// newTestHandler writes conf to a file, loads it the way the server does
+// and returns a handler running it, stopped when the test ends, along with
+// the file's path for reloads.
+func newTestHandler(t *testing.T, conf string) (*VHostHandler, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vhosts.conf")
+	writeFile(t, path, conf)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	vh := &VHostHandler{config: cfg}
+	vh.initSubsystems()
+	t.Cleanup(vh.stopSubsystems)
+	return vh, path
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve has vh handle req and returns the response.
+func serve(vh *VHostHandler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	vh.ServeHTTP(rec, req)
+	return rec
+}
+
+// get has vh handle a GET for path on example.com, from remote unless it
+// is empty.
+func get(vh *VHostHandler, remote, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	if remote != "" {
+		req.RemoteAddr = remote
+	}
+	return serve(vh, req)
+}
+
+func TestResolveVHost_Rewrites(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "legacy "+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://127.0.0.1:1
+        rewrite ^/shop/item/(\d+)$ /app/products/$1 last
+        rewrite ^/docs/(.*)$ https://docs.example.com/$1 permanent
+        location /app {
+            rewrite ^/app/(.*)$ /legacy/$1
+        }
+        location /legacy {
+            proxy_pass ` + backend.URL + `
+        }
+        location /loop {
+            rewrite ^/loop(.*)$ /loop/x$1
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	cases := []struct {
+		path     string
+		wantCode int
+		wantBody string
+		wantLoc  string
+	}{
+		{"/shop/item/42?ref=ad", 200, "legacy /legacy/products/42?ref=ad", ""},
+		{"/docs/install", 301, "", "https://docs.example.com/install"},
+		{"/loop", 500, "", ""},
+	}
+	for _, c := range cases {
+		rec := get(vh, "", c.path)
+		if rec.Code != c.wantCode {
+			t.Errorf("GET %s: status %d, want %d", c.path, rec.Code, c.wantCode)
+		}
+		if c.wantBody != "" && rec.Body.String() != c.wantBody {
+			t.Errorf("GET %s: body %q, want %q", c.path, rec.Body.String(), c.wantBody)
+		}
+		if loc := rec.Header().Get("Location"); loc != c.wantLoc {
+			t.Errorf("GET %s: Location %q, want %q", c.path, loc, c.wantLoc)
+		}
+	}
+}
+
+func TestServeHTTPRedirect_Rewrites(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://127.0.0.1:1
+        rewrite ^/pretty/(.*)$ /index.php?q=$1 last
+        rewrite ^/docs/(.*)$ https://docs.example.com/$1 permanent
+        location /loop {
+            rewrite ^/loop(.*)$ /loop/x$1
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	cases := []struct {
+		path    string
+		wantLoc string
+	}{
+		{"/pretty/abc", "https://example.com/pretty/abc"},
+		{"/docs/install", "https://docs.example.com/install"},
+		{"/loop", "https://example.com/loop"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		vh.serveHTTPRedirect(rec, httptest.NewRequest("GET", "http://example.com"+c.path, nil))
+		if rec.Code != http.StatusMovedPermanently {
+			t.Errorf("GET %s: status %d, want %d", c.path, rec.Code, http.StatusMovedPermanently)
+		}
+		if loc := rec.Header().Get("Location"); loc != c.wantLoc {
+			t.Errorf("GET %s: Location %q, want %q", c.path, loc, c.wantLoc)
+		}
+	}
+}
+
+func TestServeHTTP_ErrorPages(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream exploded", http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	page := filepath.Join(dir, "5xx.html.tmpl")
+	writeFile(t, page, "<p>{{.Status}} at {{.VHost}}</p>")
+
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://127.0.0.1:1
+        error_page 500 502 ` + page + `
+        location /app {
+            proxy_pass ` + backend.URL + `
+        }
+        location /intercept {
+            proxy_pass ` + backend.URL + `
+            intercept_errors on
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	cases := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/", 502, "<p>502 at example.com</p>"},
+		{"/app", 500, "upstream exploded\n"},
+		{"/intercept", 500, "<p>500 at example.com</p>"},
+	}
+	for _, c := range cases {
+		rec := get(vh, "", c.path)
+		if rec.Code != c.code || rec.Body.String() != c.body {
+			t.Errorf("GET %s = %d %q, want %d %q", c.path, rec.Code, rec.Body.String(), c.code, c.body)
+		}
+	}
+}
+
+func TestServeHTTP_MaxBodySize(t *testing.T) {
+	var received atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Add(n)
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	page := filepath.Join(dir, "413.html")
+	writeFile(t, page, "<p>too large</p>")
+
+	input := `
+vhosts {
+    example.com {
+        proxy_pass ` + backend.URL + `
+        max_body_size 1KB
+        error_page 413 ` + page + `
+        location /upload {
+            max_body_size 1MB
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+	srv := httptest.NewServer(vh)
+	defer srv.Close()
+
+	body := strings.Repeat("x", 2048)
+	post := func(path string, r io.Reader) (int, string) {
+		req, _ := http.NewRequest("POST", srv.URL+path, r)
+		req.Host = "example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, got := post("/", strings.NewReader(body)); code != 413 || got != "<p>too large</p>" {
+		t.Errorf("POST / = %d %q, want 413 with the error page", code, got)
+	}
+	if n := received.Load(); n != 0 {
+		t.Errorf("backend received %d bytes of a refused body", n)
+	}
+	// Without a Content-Length the body is cut off at the limit.
+	if code, _ := post("/", io.MultiReader(strings.NewReader(body))); code != 413 {
+		t.Errorf("chunked POST / = %d, want 413", code)
+	}
+	if code, _ := post("/upload", strings.NewReader(body)); code != 200 {
+		t.Errorf("POST /upload = %d, want 200", code)
+	}
+
+	// A client waiting on Expect: 100-continue is refused before it sends
+	// the body.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2048\r\nExpect: 100-continue\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 413") {
+		t.Errorf("Expect: 100-continue: status line %q, %v; want 413", status, err)
+	}
+}
+
+func TestReload_SwapsProxies(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	a, b := newBackend("a"), newBackend("b")
+	defer a.Close()
+	defer b.Close()
+
+	conf := func(backend string) string {
+		return "vhosts {\n    example.com {\n        proxy_pass " + backend + "\n    }\n}\n"
+	}
+	vh, path := newTestHandler(t, conf(a.URL))
+
+	if got := get(vh, "", "/").Body.String(); got != "a" {
+		t.Fatalf("before reload: body %q, want a", got)
+	}
+	first := vh.subs.upstreams["example.com"].pass
+	if got := get(vh, "", "/").Body.String(); got != "a" || vh.subs.upstreams["example.com"].pass != first {
+		t.Fatal("proxy rebuilt between requests")
+	}
+
+	writeFile(t, path, conf(b.URL))
+	if err := vh.reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(vh, "", "/").Body.String(); got != "b" {
+		t.Errorf("after reload: body %q, want b", got)
+	}
+}
+
+func TestReload_KeepsConnLimits(t *testing.T) {
+	conf := `
+vhosts {
+    example.com {
+        proxy_pass http://127.0.0.1:1
+        limit_conn {
+            per_ip 20
+        }
+        location /upload {
+            proxy_pass http://127.0.0.1:1
+        }
+    }
+}`
+	vh, path := newTestHandler(t, conf)
+	before := vh.subs.connLimits["example.com"]
+
+	// Unchanged limits keep their counts, and the location still shares them.
+	if err := vh.reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if l := vh.subs.connLimits["example.com"]; l != before {
+		t.Error("limiter replaced by a reload leaving it unchanged")
+	}
+	if vh.subs.connLimits["example.com location /upload"] != before {
+		t.Error("location no longer shares the vhost's limiter")
+	}
+
+	writeFile(t, path, strings.Replace(conf, "per_ip 20", "per_ip 10", 1))
+	if err := vh.reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if l := vh.subs.connLimits["example.com"]; l == before || l.Config().PerIP != 10 {
+		t.Error("limiter kept after its limits changed")
+	}
+}
+
+func TestReload_KeepsRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	conf := `
+rate_limit_redis {
+    address ` + mr.Addr() + `
+    on_error deny
+}
+vhosts {
+    example.com {
+        proxy_pass http://127.0.0.1:1
+        security {
+            rate_limit {
+                requests 100
+                window 1m
+                store redis
+            }
+        }
+    }
+}`
+	vh, path := newTestHandler(t, conf)
+	old := vh.subs
+
+	// Requests that started before the reload still use old's limiter.
+	if err := vh.reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if vh.subs.redis != old.redis {
+		t.Error("redis store replaced by a reload leaving it unchanged")
+	}
+	h := old.rateLimits["example.com"].Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	if rec.Code != 200 {
+		t.Errorf("in-flight request after reload: status %d, want 200", rec.Code)
+	}
+
+	writeFile(t, path, strings.Replace(conf, "on_error deny", "on_error allow", 1))
+	if err := vh.reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if vh.subs.redis == old.redis || vh.subs.redis.Config().FailClosed {
+		t.Error("redis store kept after its settings changed")
+	}
+}
+
+func TestServeHTTP_AuthBasic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "staging "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	users := filepath.Join(t.TempDir(), "staging.htpasswd")
+	writeFile(t, users, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+
+	input := `
+vhosts {
+    staging.example.com {
+        proxy_pass ` + backend.URL + `
+        auth_basic {
+            realm Staging
+            user_file ` + users + `
+        }
+        location /health {
+            auth_basic off
+        }
+    }
+    broken.example.com {
+        proxy_pass ` + backend.URL + `
+        auth_basic {
+            user_file /nonexistent/htpasswd
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	cases := []struct {
+		host, path, user, pass string
+		code                   int
+	}{
+		{"staging.example.com", "/", "", "", 401},
+		{"staging.example.com", "/", "alice", "secret", 200},
+		{"staging.example.com", "/health", "", "", 200},
+		{"broken.example.com", "/", "alice", "secret", 401},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://"+c.host+c.path, nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		if rec := serve(vh, req); rec.Code != c.code {
+			t.Errorf("GET %s%s as %q: status %d, want %d", c.host, c.path, c.user, rec.Code, c.code)
+		}
+	}
+}
+
+func TestServeHTTP_TrustedProxies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Real-IP")+" | "+r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	input := `
+trusted_proxies 10.0.0.0/8
+vhosts {
+    example.com {
+        proxy_pass ` + backend.URL + `
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	cases := []struct {
+		remote, xff, want string
+	}{
+		{"10.0.0.5:4000", "198.51.100.7", "198.51.100.7 | 198.51.100.7, 10.0.0.5"},
+		{"203.0.113.9:4000", "198.51.100.7", "203.0.113.9 | 198.51.100.7, 203.0.113.9"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("X-Forwarded-For", c.xff)
+		if got := serve(vh, req).Body.String(); got != c.want {
+			t.Errorf("from %s: backend saw %q, want %q", c.remote, got, c.want)
+		}
+	}
+}
+
+func TestServeHTTP_Access(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	list := filepath.Join(t.TempDir(), "office.list")
+	writeFile(t, list, "allow 192.0.2.0/24\n")
+	vh, path := newTestHandler(t, `
+vhosts {
+    example.com {
+        proxy_pass `+backend.URL+`
+        location /admin {
+            access {
+                include `+list+`
+                deny all
+            }
+        }
+    }
+}`)
+	if code := get(vh, "192.0.2.10:5000", "/admin").Code; code != 200 {
+		t.Errorf("office client: status %d, want 200", code)
+	}
+	if code := get(vh, "198.51.100.1:5000", "/admin").Code; code != 403 {
+		t.Errorf("outside client: status %d, want 403", code)
+	}
+	if code := get(vh, "198.51.100.1:5000", "/").Code; code != 200 {
+		t.Errorf("outside client on /: status %d, want 200", code)
+	}
+
+	// The list is read again on reload.
+	writeFile(t, list, "allow 198.51.100.0/24\n")
+	if err := vh.reload(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if code := get(vh, "198.51.100.1:5000", "/admin").Code; code != 200 {
+		t.Errorf("after reload: status %d, want 200", code)
+	}
+	if code := get(vh, "192.0.2.10:5000", "/admin").Code; code != 403 {
+		t.Errorf("after reload, removed range: status %d, want 403", code)
+	}
+
+	// A list that can't be read refuses everyone.
+	os.Remove(list)
+	if err := vh.reload(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if code := get(vh, "198.51.100.1:5000", "/admin").Code; code != 403 {
+		t.Errorf("missing list: status %d, want 403", code)
+	}
+}
+
+func TestServeHTTP_RateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	// No rate_limit: the default of 100 requests per minute per client.
+	conf := `
+vhosts {
+    example.com {
+        proxy_pass ` + backend.URL + `
+        location /api {
+            proxy_pass ` + backend.URL + `
+        }
+    }
+}`
+	vh, path := newTestHandler(t, conf)
+
+	// The location shares the vhost's limit.
+	for i := 1; i <= 100; i++ {
+		p := "/"
+		if i%2 == 0 {
+			p = "/api"
+		}
+		if rec := get(vh, "192.0.2.10:5000", p); rec.Code != 200 {
+			t.Fatalf("request %d: status %d, want 200", i, rec.Code)
+		}
+	}
+	rec := get(vh, "192.0.2.10:5000", "/")
+	if rec.Code != 429 {
+		t.Fatalf("request 101: status %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	if rec := get(vh, "192.0.2.11:5000", "/"); rec.Code != 200 {
+		t.Errorf("other client: status %d, want 200", rec.Code)
+	}
+
+	// Counts survive a reload that leaves the limit alone...
+	if err := vh.reload(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if rec := get(vh, "192.0.2.10:5000", "/api"); rec.Code != 429 {
+		t.Errorf("after reload: status %d, want 429", rec.Code)
+	}
+
+	// ...and start over when it changes.
+	writeFile(t, path, strings.Replace(conf, "proxy_pass "+backend.URL+"\n        location", "proxy_pass "+backend.URL+"\n        security {\n            rate_limit {\n                requests 200\n            }\n        }\n        location", 1))
+	if err := vh.reload(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if rec := get(vh, "192.0.2.10:5000", "/"); rec.Code != 200 {
+		t.Errorf("after raising the limit: status %d, want 200", rec.Code)
+	}
+}
+
+func TestServeHTTP_RateLimitZones(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	input := `
+rate_limit_zone per_client {
+    requests 2
+    window 1m
+}
+vhosts {
+    example.com {
+        proxy_pass ` + backend.URL + `
+        rate_limit_zones per_client
+        location /health {
+            rate_limit_zones off
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	const client = "192.0.2.10:5000"
+	// The zone's counters are shared by every path that uses it.
+	for _, path := range []string{"/a", "/b"} {
+		if rec := get(vh, client, path); rec.Code != 200 {
+			t.Fatalf("GET %s: status %d, want 200", path, rec.Code)
+		}
+	}
+	rec := get(vh, client, "/c")
+	if rec.Code != 429 {
+		t.Fatalf("third request: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if rec := get(vh, client, "/health"); rec.Code != 200 {
+		t.Errorf("GET /health: status %d, want 200", rec.Code)
+	}
+}
+
+func TestServeHTTP_RateLimitRedis(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	mr := miniredis.RunT(t)
+
+	input := `
+rate_limit_redis {
+    address ` + mr.Addr() + `
+}
+vhosts {
+    example.com {
+        proxy_pass ` + backend.URL + `
+        security {
+            rate_limit {
+                requests 3
+                window 1m
+                store redis
+            }
+        }
+    }
+}`
+	// Two instances behind one load balancer share the limit.
+	var instances []*VHostHandler
+	for range 2 {
+		vh, _ := newTestHandler(t, input)
+		instances = append(instances, vh)
+	}
+	for i, vh := range []*VHostHandler{instances[0], instances[1], instances[0]} {
+		if code := get(vh, "192.0.2.10:5000", "/").Code; code != 200 {
+			t.Fatalf("request %d: status %d, want 200", i+1, code)
+		}
+	}
+	if code := get(instances[1], "192.0.2.10:5000", "/").Code; code != 429 {
+		t.Errorf("fourth request: status %d, want 429", code)
+	}
+}
+
+func TestServeHTTP_GeoIP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Country-Code"))
+	}))
+	defer backend.Close()
+
+	// 192.0.2.0/24 is RU, 198.51.100.0/24 DE and 203.0.113.0/25 AS14061.
+	countryDB := geoiptest.CountryDB(t)
+	asnDB := geoiptest.ASNDB(t)
+	input := `
+geoip {
+    country_db ` + countryDB + `
+    asn_db ` + asnDB + `
+}
+vhosts {
+    example.com {
+        proxy_pass ` + backend.URL + `
+        block_countries RU
+        block_asn 14061
+        location /public {
+            block_countries off
+            block_asn off
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	cases := []struct {
+		remote, path string
+		code         int
+		country      string
+	}{
+		{"192.0.2.10:5000", "/", 403, ""},
+		{"203.0.113.5:5000", "/", 403, ""},
+		{"198.51.100.1:5000", "/", 200, "DE"},
+		{"192.0.2.10:5000", "/public", 200, "RU"},
+		// Addresses the databases don't cover are let through without a country.
+		{"100.64.0.1:5000", "/", 200, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://example.com"+c.path, nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("X-Country-Code", "US") // forged by the client
+		rec := serve(vh, req)
+		if rec.Code != c.code {
+			t.Errorf("GET %s from %s: status %d, want %d", c.path, c.remote, rec.Code, c.code)
+			continue
+		}
+		if c.code == 200 && rec.Body.String() != c.country {
+			t.Errorf("GET %s from %s: backend saw X-Country-Code %q, want %q", c.path, c.remote, rec.Body.String(), c.country)
+		}
+	}
+}
+
+func TestServeHTTP_GeoIPUnavailable(t *testing.T) {
+	input := `
+geoip {
+    country_db ` + filepath.Join(t.TempDir(), "missing.mmdb") + `
+}
+vhosts {
+    example.com {
+        proxy_pass http://127.0.0.1:1
+        block_countries RU
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	if rec := get(vh, "198.51.100.1:5000", "/"); rec.Code != 403 {
+		t.Errorf("status %d, want 403 when the database can't be loaded", rec.Code)
+	}
+}
+
+func TestServeHTTP_WAF(t *testing.T) {
+	var served atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	input := `
+vhosts {
+    example.com {
+        proxy_pass ` + backend.URL + `
+        waf {
+            mode block
+        }
+        location /search {
+            waf {
+                mode detect
+            }
+        }
+        location /admin {
+            waf off
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+	vh.stats = dashstats.NewCollector(16)
+
+	attack := "?id=" + url.QueryEscape("1' UNION SELECT password FROM users--")
+	cases := []struct {
+		method, target, body string
+		code                 int
+		action               string
+	}{
+		{"GET", "/?q=shoes", "", 200, ""},
+		{"GET", "/" + attack, "", 403, "block"},
+		{"POST", "/", "comment=" + url.QueryEscape("<script>alert(1)</script>"), 403, "block"},
+		{"GET", "/search" + attack, "", 200, "detect"},
+		{"GET", "/admin" + attack, "", 200, ""},
+	}
+	for _, c := range cases {
+		served.Store(0)
+		req := httptest.NewRequest(c.method, "http://example.com"+c.target, strings.NewReader(c.body))
+		if c.body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := serve(vh, req)
+		if rec.Code != c.code {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.target, rec.Code, c.code)
+		}
+		if got := served.Load() == 1; got != (c.code == 200) {
+			t.Errorf("%s %s: reached the backend = %v, want %v", c.method, c.target, got, c.code == 200)
+		}
+		rr := <-vh.stats.Chan()
+		if rr.WAF != c.action {
+			t.Errorf("%s %s: recorded WAF %q, want %q", c.method, c.target, rr.WAF, c.action)
+		}
+		if c.action != "" && len(rr.WAFRules) == 0 {
+			t.Errorf("%s %s: no rule IDs recorded", c.method, c.target)
+		}
+	}
+}
+
+func TestServeHTTP_UpstreamPassiveChecks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	input := `
+vhosts {
+    example.com {
+        upstream {
+            backend ` + backend.URL + `
+            backend ` + down.URL + `
+            max_fails 2 within 30s
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	// Round robin sends every other request to the dead backend until it
+	// has failed twice; from then on it gets none.
+	var failed int
+	for i := 0; i < 10; i++ {
+		if get(vh, "", "/").Code == http.StatusBadGateway {
+			failed++
+			if i > 4 {
+				t.Errorf("request %d: 502 after the backend should have been ejected", i+1)
+			}
+		}
+	}
+	if failed != 2 {
+		t.Errorf("%d requests failed, want 2", failed)
+	}
+}
+
+func TestServeHTTP_UpstreamCircuitBreaker(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	input := `
+vhosts {
+    example.com {
+        upstream {
+            backend ` + failing.URL + `
+            backend ` + healthy.URL + `
+            circuit_breaker {
+                min_requests 2
+                error_rate 50%
+                open_time 1m
+            }
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+
+	// The failing backend answers, so it isn't ejected, but its breaker
+	// opens after two 500s and it gets no more requests.
+	var failed int
+	for i := 0; i < 10; i++ {
+		if get(vh, "", "/").Code == http.StatusInternalServerError {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Errorf("%d requests failed, want 2", failed)
+	}
+
+	stats := vh.upstreamStats()
+	if len(stats) != 1 || stats[0].Scope != "example.com" || len(stats[0].Backends) != 2 {
+		t.Fatalf("upstreamStats = %+v", stats)
+	}
+	if got := stats[0].Backends[0].Breaker; got != "open" {
+		t.Errorf("failing backend breaker = %q, want open", got)
+	}
+	if got := stats[0].Backends[1].Breaker; got != "closed" {
+		t.Errorf("healthy backend breaker = %q, want closed", got)
+	}
+}
+
+func TestServeHTTP_UpstreamRetry(t *testing.T) {
+	var failing atomic.Int64
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failing.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-From", "unavailable")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer healthy.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	input := `
+vhosts {
+    example.com {
+        upstream {
+            backend ` + unavailable.URL + `
+            backend ` + down.URL + `
+            backend ` + healthy.URL + `
+            max_fails off
+            retry {
+                attempts 2
+                on connect_error 503
+                methods GET PUT
+                budget 200%
+                body_limit 1KB
+            }
+        }
+    }
+}`
+	vh, _ := newTestHandler(t, input)
+	vh.stats = dashstats.NewCollector(16)
+
+	do := func(method, body string) (*httptest.ResponseRecorder, dashstats.RequestRecord) {
+		rec := serve(vh, httptest.NewRequest(method, "http://example.com/", strings.NewReader(body)))
+		return rec, <-vh.stats.Chan()
+	}
+
+	// Whichever backend round robin starts on, at most two retries reach
+	// the healthy one, and the body is sent again each time. Each try on
+	// the unavailable backend is a retry.
+	total := 0
+	for i := 0; i < 3; i++ {
+		rec, rr := do("PUT", "payload")
+		if rec.Code != 200 || rec.Body.String() != "payload" {
+			t.Errorf("PUT %d: %d %q, want 200 with the body echoed", i+1, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("X-From") != "" {
+			t.Errorf("PUT %d: headers of a dropped try were sent", i+1)
+		}
+		if rr.Retries > 2 {
+			t.Errorf("PUT %d: recorded %d retries, want at most 2", i+1, rr.Retries)
+		}
+		total += rr.Retries
+	}
+	if n := failing.Load(); n == 0 || int64(total) < n {
+		t.Errorf("recorded %d retries for %d tries on the unavailable backend", total, n)
+	}
+
+	// A method that isn't retried gets the first backend's answer.
+	failing.Store(0)
+	var codes []int
+	for i := 0; i < 3; i++ {
+		rec, rr := do("POST", "payload")
+		codes = append(codes, rec.Code)
+		if rr.Retries != 0 {
+			t.Errorf("POST: recorded %d retries, want 0", rr.Retries)
+		}
+	}
+	if failing.Load() != 1 || !slices.Contains(codes, 502) || !slices.Contains(codes, 503) {
+		t.Errorf("POST statuses = %v, want one each of 503, 502 and 200 without retries", codes)
+	}
+
+	// A body over body_limit can't be replayed, so it isn't retried.
+	failing.Store(0)
+	big := strings.Repeat("x", 2048)
+	for i := 0; i < 3; i++ {
+		if rec, _ := do("PUT", big); rec.Code == 200 && rec.Body.Len() != len(big) {
+			t.Errorf("large PUT: backend got %d bytes, want %d", rec.Body.Len(), len(big))
+		}
+	}
+	if failing.Load() != 1 {
+		t.Errorf("large PUT reached the unavailable backend %d times, want 1", failing.Load())
+	}
+}
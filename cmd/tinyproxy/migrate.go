@@ -4,18 +4,29 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	crossplane "github.com/nginxinc/nginx-go-crossplane"
+
+	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/geoip"
+	"tinyproxy/internal/server/realip"
+	"tinyproxy/internal/server/rewrite"
+	"tinyproxy/internal/server/variables"
 )
 
 // ── Types ─────────────────────────────────────────────────────────────────────
 
 type migrateConf struct {
-	vhosts []*vhostConf
-	report reportConf
+	vhosts         []*vhostConf
+	trustedProxies []string // set_real_ip_from addresses, from any level
+	proxyProtocol  bool     // a listen directive has the proxy_protocol flag
+	geoip          geoip.Config
+	rateZones      []rateZoneConf // rate_limit_zone blocks, in order of first use
+	report         reportConf
 }
 
 type vhostConf struct {
@@ -29,9 +40,43 @@ type vhostConf struct {
 	fastcgi     *fastcgiConf
 	upstream    *upstreamConf
 	maxBodySize string // e.g. "20MB"; empty = not set
+	ret         string // arguments of a return directive, e.g. "301 https://example.com$request_uri"
+	tryFiles    []string
+	rewrites    []string // arguments of each rewrite directive, in order
+	headers     []string // headers block lines, e.g. "request_set Host $host"
+	errorPages  []string // arguments of each error_page directive
+	intercept   string   // "on" | "off" | ""
+	timeouts    []string // timeouts block lines, e.g. "read 60s"
+	keepalive   []string // keepalive block lines, e.g. "max_idle_per_host 32"
+	limitConn   limitConnConf
+	rateZones   []string // rate_limit_zone names from limit_req, in order
+	access      []string // access block lines from allow and deny, e.g. "deny all"
+	authBasic   authConf // auth_basic and auth_basic_user_file
+	authJWT     authConf // auth_jwt and auth_jwt_key_file
+	authReq     string   // auth_request URI, resolved to a URL; or "off"
+	authReqDir  *crossplane.Directive
+	internal    bool // location marked internal
+	locations   []*locationConf
+	isLocation  bool // body of a location block rather than a server block
 	stubs       []inlineStub
 }
 
+// authConf is an nginx auth module setting made of a directive that turns it
+// on with a realm or off, and a directive naming its key or user file.
+type authConf struct {
+	realm string // realm, or "off"
+	file  string
+	dir   *crossplane.Directive // the realm directive, for stubbing
+}
+
+// locationConf is a converted nginx location block. Its body reuses vhostConf
+// for the directives tinyproxy allows inside a location.
+type locationConf struct {
+	modifier string // "", "=", "~", "~*" or "^~"
+	path     string
+	body     *vhostConf
+}
+
 type sslConf struct{ cert, key string }
 
 type secConf struct {
@@ -40,8 +85,7 @@ type secConf struct {
 	xssProtection string
 	csp           string
 	hsts          string
-	rateReqs      int
-	rateWin       string
+	rateOff       bool // turn off the built-in per-IP limit where limit_req applies
 }
 
 type fastcgiConf struct {
@@ -51,9 +95,13 @@ type fastcgiConf struct {
 }
 
 type upstreamConf struct {
-	strategy string
-	backends []string // "http://host:port [weight N]"
-	stubs    []inlineStub
+	strategy  string
+	backends  []string // "http://host:port [weight N]"
+	keepalive []string // keepalive block lines from keepalive and keepalive_timeout
+	idle      string   // keepalive_timeout, as a timeouts idle duration
+	passive   []string // upstream lines from server max_fails and fail_timeout
+	slowStart string   // server slow_start, as an upstream slow_start duration
+	stubs     []inlineStub
 }
 
 type inlineStub struct {
@@ -63,9 +111,31 @@ type inlineStub struct {
 	anchor string
 }
 
+// rateLimitConf is a limit_req_zone, and once a limit_req uses it, the
+// burst and delay that limit_req sets, in tinyproxy terms.
 type rateLimitConf struct {
 	requests int
 	window   string
+	key      string // e.g. "ip" or "header X-Api-Key"; empty when the nginx key has no equivalent
+	nginxKey string
+	burst    int // requests admitted at once: nginx burst + 1
+	delay    int // requests of a burst served without delay; -1 for nodelay
+}
+
+// rateZoneConf is a rendered rate_limit_zone.
+type rateZoneConf struct {
+	name      string
+	nginxZone string
+	conf      rateLimitConf
+}
+
+// limitConnConf collects the limit_conn and limit_conn_status directives of
+// one level. A zone keyed on the client address becomes per_ip and one keyed
+// on the server name becomes per_vhost.
+type limitConnConf struct {
+	perIP    int
+	perVHost int
+	status   string
 }
 
 type reportConf struct {
@@ -87,35 +157,29 @@ type reportEntry struct {
 // ── Unsupported directive table ───────────────────────────────────────────────
 
 var unsupportedDirectives = map[string][2]string{
-	"location":              {"No URL routing in tinyproxy", "url-routing"},
-	"rewrite":               {"URL rewriting not supported", "rewrites"},
-	"map":                   {"map directive not supported", "map"},
-	"if":                    {"if blocks not supported", "conditionals"},
-	"try_files":             {"try_files not supported", "try-files"},
-	"return":                {"Redirects (return) not supported", "redirects"},
-	"error_page":            {"Custom error pages not supported", "error-pages"},
-	"auth_basic":            {"HTTP basic auth not supported", "auth-basic"},
-	"auth_basic_user_file":  {"HTTP basic auth not supported", "auth-basic"},
-	"auth_request":          {"auth_request not supported", "auth-request"},
-	"limit_conn":            {"Connection limiting not supported", "limit-conn"},
-	"limit_conn_zone":       {"Connection limiting not supported", "limit-conn"},
-	"proxy_set_header":      {"Request header manipulation not supported", "proxy-set-header"},
-	"proxy_hide_header":     {"Response header manipulation not supported", "proxy-set-header"},
-	"proxy_read_timeout":    {"Upstream timeouts not supported", "timeouts"},
-	"proxy_send_timeout":    {"Upstream timeouts not supported", "timeouts"},
-	"proxy_connect_timeout": {"Upstream timeouts not supported", "timeouts"},
-	"access_log":            {"Per-vhost logging config not supported", "logging"},
-	"error_log":             {"Per-vhost logging config not supported", "logging"},
-	"geo":                   {"geo module not supported", "geo"},
-	"sub_filter":            {"sub_filter not supported", "sub-filter"},
-	"mirror":                {"mirror not supported", "mirror"},
-	"stream":                {"stream blocks not supported", "stream"},
-	"mail":                  {"mail blocks not supported", "mail"},
-	"health_check":          {"nginx Plus active health_check not supported", "health-check-plus"},
-	"auth_jwt":              {"nginx Plus JWT auth not supported", "jwt"},
-	"auth_jwt_key_file":     {"nginx Plus JWT auth not supported", "jwt"},
-	"js_include":            {"njs not supported", "njs"},
-	"js_content":            {"njs not supported", "njs"},
+	"map":                    {"map directive not supported", "map"},
+	"if":                     {"if blocks not supported", "conditionals"},
+	"auth_request_set":       {"Use auth_request_headers to pass auth response headers upstream", "auth-request"},
+	"access_log":             {"Per-vhost logging config not supported", "logging"},
+	"error_log":              {"Per-vhost logging config not supported", "logging"},
+	"geo":                    {"geo variables not supported; use access for address lists or block_countries with geoip", "geo"},
+	"sub_filter":             {"sub_filter not supported", "sub-filter"},
+	"mirror":                 {"mirror not supported", "mirror"},
+	"stream":                 {"stream blocks not supported", "stream"},
+	"mail":                   {"mail blocks not supported", "mail"},
+	"health_check":           {"nginx Plus active health_check not supported", "health-check-plus"},
+	"auth_jwt_key_request":   {"Remote JWKS not supported; download the keys to a file", "jwt"},
+	"auth_jwt_claim_set":     {"Use claims_to_headers in the jwt block", "jwt"},
+	"js_include":             {"njs not supported", "njs"},
+	"js_content":             {"njs not supported", "njs"},
+	"modsecurity":            {"ModSecurity not supported; use the waf block and port rules to its SecRule subset", "waf"},
+	"modsecurity_rules_file": {"ModSecurity not supported; use the waf block and port rules to its SecRule subset", "waf"},
+	"modsecurity_rules":      {"ModSecurity not supported; use the waf block and port rules to its SecRule subset", "waf"},
+
+	// Retries are set per upstream rather than per location.
+	"proxy_next_upstream":         {"Use a retry block in the upstream", "retries"},
+	"proxy_next_upstream_tries":   {"Use retry attempts in the upstream; nginx counts the first try", "retries"},
+	"proxy_next_upstream_timeout": {"Retries have no time limit", "retries"},
 }
 
 var silentDirectives = map[string]bool{
@@ -179,6 +243,7 @@ func convertNginxFile(filename string) (*migrateConf, error) {
 func (mc *migrateConf) convertHTTPBlock(dirs crossplane.Directives) {
 	upstreams := map[string]crossplane.Directives{}
 	rateZones := map[string]rateLimitConf{}
+	connZones := map[string]string{}
 	var httpGzip string
 
 	for _, d := range dirs {
@@ -191,27 +256,79 @@ func (mc *migrateConf) convertHTTPBlock(dirs crossplane.Directives) {
 			if name, rl, ok := parseLimitReqZone(d.Args); ok {
 				rateZones[name] = rl
 			}
+		case "limit_conn_zone":
+			if name, kind, ok := parseLimitConnZone(d.Args); ok {
+				connZones[name] = kind
+			}
 		case "gzip":
 			if len(d.Args) > 0 {
 				httpGzip = d.Args[0]
 			}
+		case "geo", "geoip_country", "geoip_org", "geoip_city":
+			reason := unsupportedDirectives["geo"][0]
+			if d.Directive != "geo" {
+				reason = "Legacy GeoIP .dat databases not supported; use a GeoLite2 .mmdb in the geoip block"
+			}
+			mc.report.entries = append(mc.report.entries, reportEntry{
+				vhost:     "(global)",
+				directive: d.Directive,
+				line:      d.Line,
+				reason:    reason,
+			})
+			mc.report.stubbed++
+		case "geoip2":
+			if reason := mc.convertGeoIP2(d); reason != "" {
+				mc.report.entries = append(mc.report.entries, reportEntry{
+					vhost:     "(global)",
+					directive: d.Directive,
+					line:      d.Line,
+					reason:    reason,
+				})
+				mc.report.stubbed++
+			} else {
+				mc.report.converted++
+			}
+		case "set_real_ip_from", "real_ip_header", "real_ip_recursive":
+			if reason := mc.convertRealIP(d); reason != "" {
+				mc.report.entries = append(mc.report.entries, reportEntry{
+					vhost:     "(global)",
+					directive: d.Directive,
+					line:      d.Line,
+					reason:    reason,
+				})
+				mc.report.stubbed++
+			} else {
+				mc.report.converted++
+			}
 		}
 	}
 
 	for _, d := range dirs {
 		if d.Directive == "server" {
-			vh := mc.convertServerBlock(d.Block, upstreams, rateZones, httpGzip)
+			vh := mc.convertServerBlock(d.Block, upstreams, rateZones, connZones, httpGzip)
 			if vh != nil {
 				mc.vhosts = append(mc.vhosts, vh)
 			}
 		}
 	}
+
+	// tinyproxy only believes PROXY headers from trusted proxies.
+	if mc.proxyProtocol && len(mc.trustedProxies) == 0 {
+		mc.proxyProtocol = false
+		mc.report.entries = append(mc.report.entries, reportEntry{
+			vhost:     "(global)",
+			directive: "proxy_protocol",
+			reason:    "proxy_protocol needs set_real_ip_from naming the load balancers",
+		})
+		mc.report.stubbed++
+	}
 }
 
 func (mc *migrateConf) convertServerBlock(
 	dirs crossplane.Directives,
 	upstreams map[string]crossplane.Directives,
 	rateZones map[string]rateLimitConf,
+	connZones map[string]string,
 	httpGzip string,
 ) *vhostConf {
 	vh := &vhostConf{compression: httpGzip}
@@ -227,6 +344,9 @@ func (mc *migrateConf) convertServerBlock(
 			if vh.port == 0 {
 				vh.port = port
 			}
+			if slices.Contains(d.Args, "proxy_protocol") {
+				mc.proxyProtocol = true
+			}
 			if ssl && vh.ssl == nil {
 				vh.ssl = &sslConf{}
 			}
@@ -236,11 +356,27 @@ func (mc *migrateConf) convertServerBlock(
 		vh.hostname = "default"
 	}
 
+	mc.convertDirectives(vh, dirs, upstreams, rateZones, connZones)
+	return vh
+}
+
+// convertDirectives converts the directives of a server block, or of a
+// location block inside one, into vh.
+func (mc *migrateConf) convertDirectives(
+	vh *vhostConf,
+	dirs crossplane.Directives,
+	upstreams map[string]crossplane.Directives,
+	rateZones map[string]rateLimitConf,
+	connZones map[string]string,
+) {
 	for _, d := range dirs {
 		switch d.Directive {
 		case "server_name", "listen":
 			mc.report.converted++
 
+		case "location":
+			mc.convertLocation(vh, d, upstreams, rateZones, connZones)
+
 		case "root":
 			if len(d.Args) > 0 {
 				vh.root = d.Args[0]
@@ -254,6 +390,10 @@ func (mc *migrateConf) convertServerBlock(
 					if uDirs, ok := upstreams[name]; ok {
 						uc, stubs := convertUpstreamBlock(uDirs)
 						vh.upstream = uc
+						vh.keepalive = append(vh.keepalive, uc.keepalive...)
+						if uc.idle != "" {
+							vh.timeouts = append(vh.timeouts, "idle "+uc.idle)
+						}
 						vh.stubs = append(vh.stubs, stubs...)
 						mc.report.converted++
 						break
@@ -293,6 +433,69 @@ func (mc *migrateConf) convertServerBlock(
 				mc.report.converted++
 			}
 
+		case "return":
+			if ret, ok := convertReturn(d.Args); ok {
+				vh.ret = ret
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Could not convert return arguments", "redirects")
+			}
+
+		case "rewrite":
+			if args, ok := convertRewrite(d.Args); ok {
+				vh.rewrites = append(vh.rewrites, args)
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Could not convert rewrite arguments", "rewrites")
+			}
+
+		case "proxy_set_header":
+			if line, ok := convertProxySetHeader(d.Args); ok {
+				vh.headers = append(vh.headers, line)
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Header value uses variables tinyproxy does not support", "proxy-set-header")
+			}
+
+		case "proxy_hide_header":
+			if len(d.Args) == 1 {
+				vh.headers = append(vh.headers, "response_remove "+d.Args[0])
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Could not convert proxy_hide_header arguments", "proxy-set-header")
+			}
+
+		case "error_page":
+			if convertErrorPage(d.Args) {
+				vh.errorPages = append(vh.errorPages, strings.Join(d.Args, " "))
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Only error_page with status codes and a file path is supported", "error-pages")
+			}
+
+		case "proxy_intercept_errors", "fastcgi_intercept_errors":
+			if len(d.Args) == 1 {
+				vh.intercept = d.Args[0]
+				mc.report.converted++
+			}
+
+		case "proxy_connect_timeout", "proxy_read_timeout", "proxy_send_timeout":
+			if dur, ok := convertNginxDuration(d.Args); ok {
+				name := strings.TrimSuffix(strings.TrimPrefix(d.Directive, "proxy_"), "_timeout")
+				vh.timeouts = append(vh.timeouts, name+" "+dur)
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Could not convert timeout value", "timeouts")
+			}
+
+		case "try_files":
+			if len(d.Args) >= 2 {
+				vh.tryFiles = d.Args
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "try_files needs at least one file and a fallback", "try-files")
+			}
+
 		case "add_header":
 			if mc.convertAddHeader(vh, d) {
 				mc.report.converted++
@@ -301,15 +504,54 @@ func (mc *migrateConf) convertServerBlock(
 			}
 
 		case "limit_req":
-			if rateZones != nil {
-				if rl, ok := resolveLimitReq(d.Args, rateZones); ok {
-					vh.security.rateReqs = rl.requests
-					vh.security.rateWin = rl.window
-					mc.report.converted++
-					break
+			zone, rl, ok := resolveLimitReq(d.Args, rateZones)
+			switch {
+			case !ok:
+				mc.addStub(vh, d, "Could not resolve rate limit zone", "rate-limiting")
+			case rl.key == "":
+				mc.addStub(vh, d, "Rate limit key "+rl.nginxKey+" not supported; use ip, header, cookie, jwt_sub or api_key", "rate-limiting")
+			default:
+				vh.rateZones = append(vh.rateZones, mc.rateZone(zone, rl))
+				vh.security.rateOff = true
+				mc.report.converted++
+			}
+
+		case "limit_conn":
+			if len(d.Args) == 2 {
+				n, err := strconv.Atoi(d.Args[1])
+				if err == nil && n > 0 {
+					switch connZones[d.Args[0]] {
+					case "per_ip":
+						if vh.limitConn.perIP == 0 || n < vh.limitConn.perIP {
+							vh.limitConn.perIP = n
+						}
+						mc.report.converted++
+						continue
+					case "per_vhost":
+						if vh.limitConn.perVHost == 0 || n < vh.limitConn.perVHost {
+							vh.limitConn.perVHost = n
+						}
+						mc.report.converted++
+						continue
+					}
 				}
 			}
-			mc.addStub(vh, d, "Could not resolve rate limit zone", "rate-limiting")
+			mc.addStub(vh, d, "Only zones keyed on the client address or server name are supported", "limit-conn")
+
+		case "set_real_ip_from", "real_ip_header", "real_ip_recursive":
+			if reason := mc.convertRealIP(d); reason != "" {
+				mc.addStub(vh, d, reason, "real-ip")
+			} else {
+				mc.report.converted++
+			}
+
+		case "limit_conn_status":
+			if len(d.Args) == 1 && (d.Args[0] == "429" || d.Args[0] == "503") {
+				vh.limitConn.status = d.Args[0]
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "limit_conn status must be 429 or 503", "limit-conn")
+			}
 
 		case "fastcgi_pass":
 			if len(d.Args) > 0 {
@@ -338,6 +580,59 @@ func (mc *migrateConf) convertServerBlock(
 				mc.report.converted++
 			}
 
+		case "auth_basic":
+			if len(d.Args) == 1 {
+				vh.authBasic.realm = d.Args[0]
+				vh.authBasic.dir = d
+				mc.report.converted++
+			}
+
+		case "auth_jwt":
+			if len(d.Args) == 1 {
+				vh.authJWT.realm = d.Args[0]
+				vh.authJWT.dir = d
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "JWT from a variable (token=) not supported; tokens are read from the Authorization header", "jwt")
+			}
+
+		case "auth_jwt_key_file":
+			if len(d.Args) == 1 {
+				vh.authJWT.file = d.Args[0]
+				mc.report.converted++
+			}
+
+		case "auth_request":
+			if len(d.Args) == 1 {
+				vh.authReq = d.Args[0]
+				vh.authReqDir = d
+				mc.report.converted++
+			}
+
+		case "internal":
+			vh.internal = true
+
+		case "allow", "deny":
+			if len(d.Args) == 1 && (d.Args[0] == "all" || validAccessAddr(d.Args[0])) {
+				vh.access = append(vh.access, d.Directive+" "+d.Args[0])
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Only addresses, CIDR ranges and all are supported", "access")
+			}
+
+		case "satisfy":
+			if len(d.Args) == 1 && d.Args[0] == "all" {
+				mc.report.converted++
+			} else {
+				mc.addStub(vh, d, "Access rules and authentication must both pass", "access")
+			}
+
+		case "auth_basic_user_file":
+			if len(d.Args) == 1 {
+				vh.authBasic.file = d.Args[0]
+				mc.report.converted++
+			}
+
 		default:
 			if !silentDirectives[d.Directive] {
 				if reason, ok := unsupportedDirectives[d.Directive]; ok {
@@ -346,11 +641,236 @@ func (mc *migrateConf) convertServerBlock(
 			}
 		}
 	}
-	return vh
+
+	if !vh.isLocation {
+		mc.resolveAuth(vh, func(c *vhostConf) *authConf { return &c.authBasic },
+			"auth_basic without auth_basic_user_file", "auth-basic")
+		mc.resolveAuth(vh, func(c *vhostConf) *authConf { return &c.authJWT },
+			"auth_jwt without auth_jwt_key_file", "jwt")
+		mc.resolveAuthRequest(vh)
+		resolveLimitConn(vh)
+	}
+}
+
+// resolveLimitConn applies nginx inheritance to the limit_conn settings of a
+// server's locations. nginx inherits the limits and the status separately,
+// while a tinyproxy limit_conn block in a location replaces the inherited one
+// as a whole.
+func resolveLimitConn(vh *vhostConf) {
+	sc := vh.limitConn
+	for _, lc := range vh.locations {
+		l := &lc.body.limitConn
+		hasLimits := l.perIP > 0 || l.perVHost > 0
+		if !hasLimits && l.status != "" && l.status != sc.status {
+			l.perIP, l.perVHost = sc.perIP, sc.perVHost
+		} else if hasLimits && l.status == "" {
+			l.status = sc.status
+		}
+	}
+}
+
+// resolveAuth turns an auth setting of a server and its locations into what
+// tinyproxy renders. nginx inherits the realm and the file separately and
+// only enables auth where a realm other than "off" is set, while tinyproxy
+// enables auth wherever a file is set. Auth enabled without a file anywhere
+// is stubbed with reason.
+func (mc *migrateConf) resolveAuth(vh *vhostConf, conf func(*vhostConf) *authConf, reason, anchor string) {
+	sc := conf(vh)
+	realm, file := sc.realm, sc.file
+	on := realm != "" && realm != "off" && file != ""
+	if realm != "" && realm != "off" && file == "" {
+		mc.report.converted--
+		mc.addStub(vh, sc.dir, reason, anchor)
+	}
+	if !on {
+		sc.realm, sc.file = "", ""
+	}
+
+	for _, lc := range vh.locations {
+		lcConf := conf(lc.body)
+		if lcConf.realm == "" && lcConf.file == "" {
+			continue
+		}
+		lRealm, lFile := lcConf.realm, lcConf.file
+		if lRealm == "" {
+			lRealm = realm
+		}
+		if lFile == "" {
+			lFile = file
+		}
+		lOn := lRealm != "" && lRealm != "off" && lFile != ""
+		switch {
+		case lcConf.dir != nil && lRealm != "off" && lFile == "":
+			mc.report.converted--
+			mc.addStub(lc.body, lcConf.dir, reason, anchor)
+			lcConf.realm, lcConf.file = "", ""
+		case lOn && (!on || lRealm != realm || lFile != file):
+			lcConf.realm, lcConf.file = lRealm, lFile
+		case !lOn && on:
+			lcConf.realm, lcConf.file = "off", ""
+		default:
+			lcConf.realm, lcConf.file = "", ""
+		}
+	}
+}
+
+// resolveAuthRequest replaces the auth_request URIs of a server and its
+// locations with the URL the matching location proxies to, since tinyproxy
+// calls the auth service directly. Internal locations used this way are
+// dropped; they only existed to serve the subrequest.
+func (mc *migrateConf) resolveAuthRequest(vh *vhostConf) {
+	used := make(map[*locationConf]bool)
+	scopes := []*vhostConf{vh}
+	for _, lc := range vh.locations {
+		scopes = append(scopes, lc.body)
+	}
+	for _, sc := range scopes {
+		if sc.authReq == "" || sc.authReq == "off" {
+			continue
+		}
+		target := ""
+		for _, lc := range vh.locations {
+			if lc.path == sc.authReq && (lc.modifier == "" || lc.modifier == "=") {
+				target = authRequestURL(lc.body.proxyPass, sc.authReq)
+				if target != "" {
+					used[lc] = true
+				}
+				break
+			}
+		}
+		if target == "" {
+			sc.authReq = ""
+			mc.report.converted--
+			mc.addStub(sc, sc.authReqDir, "auth_request must name a location that proxy_passes to the auth service", "auth-request")
+			continue
+		}
+		sc.authReq = target
+	}
+
+	kept := vh.locations[:0]
+	for _, lc := range vh.locations {
+		if !(used[lc] && lc.body.internal) {
+			kept = append(kept, lc)
+		}
+	}
+	vh.locations = kept
+}
+
+// authRequestURL returns the URL an auth_request to uri reaches through a
+// location with proxy_pass target: target itself when it has a path, or
+// target followed by uri.
+func authRequestURL(target, uri string) string {
+	_, rest, ok := strings.Cut(target, "://")
+	if !ok || rest == "" {
+		return ""
+	}
+	if strings.Contains(rest, "/") {
+		return target
+	}
+	return target + uri
+}
+
+// convertLocation converts an nginx location block into a tinyproxy location
+// on vh. Nested locations have no tinyproxy equivalent and are stubbed.
+func (mc *migrateConf) convertLocation(
+	vh *vhostConf,
+	d *crossplane.Directive,
+	upstreams map[string]crossplane.Directives,
+	rateZones map[string]rateLimitConf,
+	connZones map[string]string,
+) {
+	if vh.isLocation {
+		mc.addStub(vh, d, "Nested location blocks not supported", "url-routing")
+		return
+	}
+	lc := &locationConf{}
+	switch len(d.Args) {
+	case 1:
+		lc.path = d.Args[0]
+	case 2:
+		lc.modifier, lc.path = d.Args[0], d.Args[1]
+	}
+	if lc.path == "" || (lc.modifier != "" && strings.HasPrefix(lc.path, "@")) {
+		mc.addStub(vh, d, "Could not convert location arguments", "url-routing")
+		return
+	}
+	lc.body = &vhostConf{hostname: vh.hostname, isLocation: true}
+	mc.convertDirectives(lc.body, d.Block, upstreams, rateZones, connZones)
+	vh.locations = append(vh.locations, lc)
+	mc.report.converted++
 }
 
 // ── Helper functions ──────────────────────────────────────────────────────────
 
+// validAccessAddr reports whether an allow or deny argument is an address
+// or CIDR range tinyproxy accepts.
+func validAccessAddr(s string) bool {
+	_, err := realip.ParsePrefix(s)
+	return err == nil
+}
+
+// convertRealIP records a realip module directive. tinyproxy's
+// trusted_proxies is global, so addresses from every level are collected.
+// It returns the reason the directive can't be converted, or "".
+func (mc *migrateConf) convertRealIP(d *crossplane.Directive) string {
+	if len(d.Args) != 1 {
+		return "Could not convert " + d.Directive + " arguments"
+	}
+	switch d.Directive {
+	case "set_real_ip_from":
+		if _, err := realip.ParsePrefix(d.Args[0]); err != nil {
+			return "Only IP addresses and CIDR ranges can be trusted"
+		}
+		if !slices.Contains(mc.trustedProxies, d.Args[0]) {
+			mc.trustedProxies = append(mc.trustedProxies, d.Args[0])
+		}
+	case "real_ip_header":
+		switch strings.ToLower(d.Args[0]) {
+		case "x-forwarded-for":
+		case "proxy_protocol":
+			mc.proxyProtocol = true
+		default:
+			return "Only X-Forwarded-For and the PROXY protocol are supported as the client address source"
+		}
+	}
+	// real_ip_recursive: tinyproxy always skips every trusted proxy.
+	return ""
+}
+
+// convertGeoIP2 records the database of a geoip2 block (ngx_http_geoip2_module)
+// as the country or ASN database of the global geoip block, going by the
+// fields its variables read. The variables themselves have no equivalent;
+// tinyproxy forwards the country as X-Country-Code and blocks with
+// block_countries and block_asn. It returns the reason the block can't be
+// converted, or "".
+func (mc *migrateConf) convertGeoIP2(d *crossplane.Directive) string {
+	if len(d.Args) != 1 {
+		return "Could not convert geoip2 arguments"
+	}
+	var country, asn bool
+	for _, v := range d.Block {
+		for _, a := range v.Args {
+			switch a {
+			case "country", "registered_country":
+				country = true
+			case "autonomous_system_number":
+				asn = true
+			}
+		}
+	}
+	switch {
+	case !country && !asn:
+		return "Only the country and autonomous_system_number fields are supported"
+	case country && !asn && mc.geoip.CountryDB == "":
+		mc.geoip.CountryDB = d.Args[0]
+	case asn && !country && mc.geoip.ASNDB == "":
+		mc.geoip.ASNDB = d.Args[0]
+	default:
+		return "Only one country database and one ASN database are supported"
+	}
+	return ""
+}
+
 func parseListenArgs(args []string) (port int, ssl bool) {
 	if len(args) == 0 {
 		return 80, false
@@ -383,7 +903,8 @@ func upstreamName(proxyPass string) string {
 
 func convertBodySize(s string) string {
 	if s == "0" {
-		return ""
+		// No limit in both servers.
+		return "0"
 	}
 	upper := strings.ToUpper(strings.TrimSpace(s))
 	switch {
@@ -398,6 +919,121 @@ func convertBodySize(s string) string {
 	}
 }
 
+// convertProxySetHeader converts proxy_set_header to a headers block
+// request_set line. An empty value removes the header in both servers. Values
+// referencing nginx variables tinyproxy cannot expand are not converted.
+func convertProxySetHeader(args []string) (string, bool) {
+	if len(args) != 2 || len(variables.Unknown(args[1])) > 0 {
+		return "", false
+	}
+	val := args[1]
+	if val == "" || strings.ContainsAny(val, " \t") {
+		val = `"` + val + `"`
+	}
+	return "request_set " + args[0] + " " + val, true
+}
+
+// convertNginxDuration converts an nginx time value such as "60", "30s",
+// "5m" or "500ms" to a Go duration string. Multi-unit values ("1m30s") and
+// units Go lacks (d, w, M, y) are not converted.
+func convertNginxDuration(args []string) (string, bool) {
+	if len(args) != 1 {
+		return "", false
+	}
+	v := args[0]
+	if _, err := strconv.Atoi(v); err == nil {
+		v += "s"
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || strings.IndexAny(strings.TrimRight(v, "smh"), "smh") >= 0 {
+		return "", false
+	}
+	return v, true
+}
+
+// convertMaxFails converts the max_fails and fail_timeout parameters of an
+// upstream server, with nginx defaults of 1 and 10s for a missing one, to
+// upstream lines. nginx ejects a server for fail_timeout after max_fails
+// failures within it, without backoff.
+func convertMaxFails(maxFails, failTimeout string) ([]string, bool) {
+	if maxFails == "" {
+		maxFails = "1"
+	}
+	if failTimeout == "" {
+		failTimeout = "10s"
+	}
+	n, err := strconv.Atoi(maxFails)
+	if err != nil || n < 0 {
+		return nil, false
+	}
+	if n == 0 {
+		return []string{"max_fails off"}, true
+	}
+	timeout, ok := convertNginxDuration([]string{failTimeout})
+	if !ok {
+		return nil, false
+	}
+	lines := []string{"max_fails " + maxFails + " within " + timeout, "eject_time " + timeout}
+	if d, _ := time.ParseDuration(timeout); d > loadbalancer.DefaultLBConfig().Passive.MaxEjectTime {
+		lines = append(lines, "max_eject_time "+timeout)
+	}
+	return lines, true
+}
+
+// convertErrorPage reports whether error_page arguments can be used as-is:
+// status codes followed by a page path. Response code overrides (=200),
+// named locations and redirect URLs have no tinyproxy equivalent.
+func convertErrorPage(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	for _, a := range args[:len(args)-1] {
+		code, err := strconv.Atoi(a)
+		if err != nil || code < 300 || code > 599 {
+			return false
+		}
+	}
+	return strings.HasPrefix(args[len(args)-1], "/")
+}
+
+// convertRewrite converts nginx rewrite arguments, which tinyproxy accepts
+// unchanged. PCRE-only regex syntax (lookarounds, backreferences) fails to
+// compile and is stubbed, as are arguments containing whitespace or ending in
+// "{", which cannot be written on a single tinyproxy config line.
+func convertRewrite(args []string) (string, bool) {
+	if len(args) < 2 || len(args) > 3 {
+		return "", false
+	}
+	for _, a := range args {
+		if strings.ContainsAny(a, " \t") || strings.HasSuffix(a, "{") {
+			return "", false
+		}
+	}
+	if _, err := rewrite.NewRule(args[0], args[1], strings.Join(args[2:], "")); err != nil {
+		return "", false
+	}
+	return strings.Join(args, " "), true
+}
+
+// convertReturn converts nginx return arguments. Bare URLs and status codes
+// map across unchanged; text bodies containing spaces are quoted.
+func convertReturn(args []string) (string, bool) {
+	switch len(args) {
+	case 1:
+		return args[0], true
+	case 2:
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			return "", false
+		}
+		target := args[1]
+		if strings.ContainsAny(target, " \t") {
+			target = `"` + target + `"`
+		}
+		return args[0] + " " + target, true
+	}
+	return "", false
+}
+
 func directiveToRaw(d *crossplane.Directive) string {
 	if len(d.Block) == 0 {
 		return d.Directive + " " + strings.Join(d.Args, " ") + ";"
@@ -451,103 +1087,232 @@ const docsBase = "https://tinyproxy.io/docs/migration/nginx-gap-analysis"
 
 func renderVhostConf(mc *migrateConf) string {
 	var sb strings.Builder
+	if len(mc.trustedProxies) > 0 {
+		fmt.Fprintf(&sb, "trusted_proxies %s\n", strings.Join(mc.trustedProxies, " "))
+		if mc.proxyProtocol {
+			sb.WriteString("proxy_protocol on\n")
+		}
+		sb.WriteString("\n")
+	}
+	if mc.geoip != (geoip.Config{}) {
+		sb.WriteString("geoip {\n")
+		if mc.geoip.CountryDB != "" {
+			fmt.Fprintf(&sb, "    country_db %s\n", mc.geoip.CountryDB)
+		}
+		if mc.geoip.ASNDB != "" {
+			fmt.Fprintf(&sb, "    asn_db %s\n", mc.geoip.ASNDB)
+		}
+		sb.WriteString("}\n\n")
+	}
+	for _, z := range mc.rateZones {
+		fmt.Fprintf(&sb, "rate_limit_zone %s {\n", z.name)
+		fmt.Fprintf(&sb, "    requests %d\n", z.conf.requests)
+		fmt.Fprintf(&sb, "    window %s\n", z.conf.window)
+		fmt.Fprintf(&sb, "    burst %d\n", z.conf.burst)
+		if z.conf.delay >= 0 {
+			fmt.Fprintf(&sb, "    delay %d\n", z.conf.delay)
+		} else {
+			sb.WriteString("    nodelay\n")
+		}
+		fmt.Fprintf(&sb, "    key %s\n", z.conf.key)
+		sb.WriteString("}\n\n")
+	}
 	sb.WriteString("vhosts {\n")
 	for _, vh := range mc.vhosts {
 		sb.WriteString("    " + vh.hostname + " {\n")
+		renderVhostBody(&sb, vh, "        ")
+		sb.WriteString("    }\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
 
-		if vh.port != 0 {
-			fmt.Fprintf(&sb, "        port %d\n", vh.port)
+// renderVhostBody writes the directives of a vhost or location body, each
+// line prefixed with ind.
+func renderVhostBody(sb *strings.Builder, vh *vhostConf, ind string) {
+	if vh.port != 0 {
+		fmt.Fprintf(sb, ind+"port %d\n", vh.port)
+	}
+	if vh.root != "" {
+		fmt.Fprintf(sb, ind+"root %s\n", vh.root)
+	}
+	if vh.proxyPass != "" {
+		fmt.Fprintf(sb, ind+"proxy_pass %s\n", vh.proxyPass)
+	}
+	if vh.compression != "" {
+		fmt.Fprintf(sb, ind+"compression %s\n", vh.compression)
+	}
+	if vh.maxBodySize != "" {
+		fmt.Fprintf(sb, ind+"max_body_size %s\n", vh.maxBodySize)
+	}
+	if vh.ret != "" {
+		fmt.Fprintf(sb, ind+"return %s\n", vh.ret)
+	}
+	for _, ep := range vh.errorPages {
+		fmt.Fprintf(sb, ind+"error_page %s\n", ep)
+	}
+	if vh.intercept != "" {
+		fmt.Fprintf(sb, ind+"intercept_errors %s\n", vh.intercept)
+	}
+	if len(vh.rateZones) > 0 {
+		fmt.Fprintf(sb, ind+"rate_limit_zones %s\n", strings.Join(vh.rateZones, " "))
+	}
+	if len(vh.access) > 0 {
+		sb.WriteString(ind + "access {\n")
+		for _, l := range vh.access {
+			fmt.Fprintf(sb, ind+"    %s\n", l)
+		}
+		sb.WriteString(ind + "}\n")
+	}
+	if vh.authReq != "" {
+		fmt.Fprintf(sb, ind+"auth_request %s\n", vh.authReq)
+	}
+	if vh.authBasic.realm == "off" {
+		sb.WriteString(ind + "auth_basic off\n")
+	} else if vh.authBasic.file != "" {
+		sb.WriteString(ind + "auth_basic {\n")
+		fmt.Fprintf(sb, ind+"    realm \"%s\"\n", vh.authBasic.realm)
+		fmt.Fprintf(sb, ind+"    user_file %s\n", vh.authBasic.file)
+		sb.WriteString(ind + "}\n")
+	}
+	if vh.authJWT.realm == "off" {
+		sb.WriteString(ind + "jwt off\n")
+	} else if vh.authJWT.file != "" {
+		sb.WriteString(ind + "jwt {\n")
+		fmt.Fprintf(sb, ind+"    keys %s\n", vh.authJWT.file)
+		sb.WriteString(ind + "}\n")
+	}
+	for _, rw := range vh.rewrites {
+		fmt.Fprintf(sb, ind+"rewrite %s\n", rw)
+	}
+	if len(vh.tryFiles) > 0 {
+		fmt.Fprintf(sb, ind+"try_files %s\n", strings.Join(vh.tryFiles, " "))
+	}
+
+	if vh.ssl != nil && (vh.ssl.cert != "" || vh.ssl.key != "") {
+		sb.WriteString(ind + "ssl {\n")
+		if vh.ssl.cert != "" {
+			fmt.Fprintf(sb, ind+"    cert %s\n", vh.ssl.cert)
+		}
+		if vh.ssl.key != "" {
+			fmt.Fprintf(sb, ind+"    key %s\n", vh.ssl.key)
 		}
-		if vh.root != "" {
-			fmt.Fprintf(&sb, "        root %s\n", vh.root)
+		sb.WriteString(ind + "}\n")
+	}
+
+	if vh.security != (secConf{}) {
+		sb.WriteString(ind + "security {\n")
+		if vh.security.frameOptions != "" {
+			fmt.Fprintf(sb, ind+"    frame_options %s\n", vh.security.frameOptions)
+		}
+		if vh.security.contentType != "" {
+			fmt.Fprintf(sb, ind+"    content_type %s\n", vh.security.contentType)
 		}
-		if vh.proxyPass != "" {
-			fmt.Fprintf(&sb, "        proxy_pass %s\n", vh.proxyPass)
+		if vh.security.xssProtection != "" {
+			fmt.Fprintf(sb, ind+"    xss_protection %q\n", vh.security.xssProtection)
 		}
-		if vh.compression != "" {
-			fmt.Fprintf(&sb, "        compression %s\n", vh.compression)
+		if vh.security.csp != "" {
+			fmt.Fprintf(sb, ind+"    csp %q\n", vh.security.csp)
 		}
-		if vh.maxBodySize != "" {
-			fmt.Fprintf(&sb, "        max_body_size %s\n", vh.maxBodySize)
+		if vh.security.hsts != "" {
+			fmt.Fprintf(sb, ind+"    hsts %q\n", vh.security.hsts)
 		}
+		if vh.security.rateOff {
+			sb.WriteString(ind + "    rate_limit off\n")
+		}
+		sb.WriteString(ind + "}\n")
+	}
 
-		if vh.ssl != nil && (vh.ssl.cert != "" || vh.ssl.key != "") {
-			sb.WriteString("        ssl {\n")
-			if vh.ssl.cert != "" {
-				fmt.Fprintf(&sb, "            cert %s\n", vh.ssl.cert)
-			}
-			if vh.ssl.key != "" {
-				fmt.Fprintf(&sb, "            key %s\n", vh.ssl.key)
-			}
-			sb.WriteString("        }\n")
+	if vh.fastcgi != nil {
+		sb.WriteString(ind + "fastcgi {\n")
+		if vh.fastcgi.pass != "" {
+			fmt.Fprintf(sb, ind+"    pass %s\n", vh.fastcgi.pass)
+		}
+		if vh.fastcgi.index != "" {
+			fmt.Fprintf(sb, ind+"    index %s\n", vh.fastcgi.index)
 		}
+		for _, p := range vh.fastcgi.params {
+			fmt.Fprintf(sb, ind+"    param %s\n", p)
+		}
+		sb.WriteString(ind + "}\n")
+	}
 
-		if vh.security != (secConf{}) {
-			sb.WriteString("        security {\n")
-			if vh.security.frameOptions != "" {
-				fmt.Fprintf(&sb, "            frame_options %s\n", vh.security.frameOptions)
-			}
-			if vh.security.contentType != "" {
-				fmt.Fprintf(&sb, "            content_type %s\n", vh.security.contentType)
-			}
-			if vh.security.xssProtection != "" {
-				fmt.Fprintf(&sb, "            xss_protection %q\n", vh.security.xssProtection)
-			}
-			if vh.security.csp != "" {
-				fmt.Fprintf(&sb, "            csp %q\n", vh.security.csp)
-			}
-			if vh.security.hsts != "" {
-				fmt.Fprintf(&sb, "            hsts %q\n", vh.security.hsts)
-			}
-			if vh.security.rateReqs > 0 {
-				sb.WriteString("            rate_limit {\n")
-				fmt.Fprintf(&sb, "                requests %d\n", vh.security.rateReqs)
-				fmt.Fprintf(&sb, "                window %s\n", vh.security.rateWin)
-				sb.WriteString("            }\n")
-			}
-			sb.WriteString("        }\n")
+	if len(vh.headers) > 0 {
+		sb.WriteString(ind + "headers {\n")
+		for _, l := range vh.headers {
+			fmt.Fprintf(sb, ind+"    %s\n", l)
 		}
+		sb.WriteString(ind + "}\n")
+	}
 
-		if vh.fastcgi != nil {
-			sb.WriteString("        fastcgi {\n")
-			if vh.fastcgi.pass != "" {
-				fmt.Fprintf(&sb, "            pass %s\n", vh.fastcgi.pass)
-			}
-			if vh.fastcgi.index != "" {
-				fmt.Fprintf(&sb, "            index %s\n", vh.fastcgi.index)
-			}
-			for _, p := range vh.fastcgi.params {
-				fmt.Fprintf(&sb, "            param %s\n", p)
-			}
-			sb.WriteString("        }\n")
+	if len(vh.timeouts) > 0 {
+		sb.WriteString(ind + "timeouts {\n")
+		for _, l := range vh.timeouts {
+			fmt.Fprintf(sb, ind+"    %s\n", l)
 		}
+		sb.WriteString(ind + "}\n")
+	}
 
-		if vh.upstream != nil {
-			sb.WriteString("        upstream {\n")
-			fmt.Fprintf(&sb, "            strategy %s\n", vh.upstream.strategy)
-			for _, b := range vh.upstream.backends {
-				fmt.Fprintf(&sb, "            backend %s\n", b)
-			}
-			for _, s := range vh.upstream.stubs {
-				fmt.Fprintf(&sb, "            # UNSUPPORTED[%s]: %s\n", s.tag, s.raw)
-				fmt.Fprintf(&sb, "            # → %s\n", s.reason)
-				fmt.Fprintf(&sb, "            # → See: %s#%s\n", docsBase, s.anchor)
-				sb.WriteString("\n")
-			}
-			sb.WriteString("        }\n")
+	if len(vh.keepalive) > 0 {
+		sb.WriteString(ind + "keepalive {\n")
+		for _, l := range vh.keepalive {
+			fmt.Fprintf(sb, ind+"    %s\n", l)
 		}
+		sb.WriteString(ind + "}\n")
+	}
 
-		for _, s := range vh.stubs {
+	if lc := vh.limitConn; lc.perIP > 0 || lc.perVHost > 0 {
+		sb.WriteString(ind + "limit_conn {\n")
+		if lc.perIP > 0 {
+			fmt.Fprintf(sb, ind+"    per_ip %d\n", lc.perIP)
+		}
+		if lc.perVHost > 0 {
+			fmt.Fprintf(sb, ind+"    per_vhost %d\n", lc.perVHost)
+		}
+		if lc.status != "" {
+			fmt.Fprintf(sb, ind+"    status %s\n", lc.status)
+		}
+		sb.WriteString(ind + "}\n")
+	}
+
+	if vh.upstream != nil {
+		sb.WriteString(ind + "upstream {\n")
+		fmt.Fprintf(sb, ind+"    strategy %s\n", vh.upstream.strategy)
+		for _, b := range vh.upstream.backends {
+			fmt.Fprintf(sb, ind+"    backend %s\n", b)
+		}
+		for _, l := range vh.upstream.passive {
+			fmt.Fprintf(sb, ind+"    %s\n", l)
+		}
+		if vh.upstream.slowStart != "" {
+			fmt.Fprintf(sb, ind+"    slow_start %s\n", vh.upstream.slowStart)
+		}
+		for _, s := range vh.upstream.stubs {
+			fmt.Fprintf(sb, ind+"    # UNSUPPORTED[%s]: %s\n", s.tag, s.raw)
+			fmt.Fprintf(sb, ind+"    # → %s\n", s.reason)
+			fmt.Fprintf(sb, ind+"    # → See: %s#%s\n", docsBase, s.anchor)
 			sb.WriteString("\n")
-			fmt.Fprintf(&sb, "        # UNSUPPORTED[%s]: %s\n", s.tag, s.raw)
-			fmt.Fprintf(&sb, "        # → %s\n", s.reason)
-			fmt.Fprintf(&sb, "        # → See: %s#%s\n", docsBase, s.anchor)
 		}
+		sb.WriteString(ind + "}\n")
+	}
 
-		sb.WriteString("    }\n")
+	for _, lc := range vh.locations {
+		sb.WriteString("\n")
+		if lc.modifier != "" {
+			fmt.Fprintf(sb, ind+"location %s %s {\n", lc.modifier, lc.path)
+		} else {
+			fmt.Fprintf(sb, ind+"location %s {\n", lc.path)
+		}
+		renderVhostBody(sb, lc.body, ind+"    ")
+		sb.WriteString(ind + "}\n")
+	}
+
+	for _, s := range vh.stubs {
+		sb.WriteString("\n")
+		fmt.Fprintf(sb, ind+"# UNSUPPORTED[%s]: %s\n", s.tag, s.raw)
+		fmt.Fprintf(sb, ind+"# → %s\n", s.reason)
+		fmt.Fprintf(sb, ind+"# → See: %s#%s\n", docsBase, s.anchor)
 	}
-	sb.WriteString("}\n")
-	return sb.String()
 }
 
 func renderReport(mc *migrateConf) string {
@@ -584,6 +1349,10 @@ func renderReport(mc *migrateConf) string {
 
 func parseLimitReqZone(args []string) (zoneName string, rl rateLimitConf, ok bool) {
 	var rateOk bool
+	var key string
+	if len(args) > 0 && !strings.Contains(args[0], "=") {
+		key = args[0]
+	}
 	for _, a := range args {
 		if strings.HasPrefix(a, "zone=") {
 			val := strings.TrimPrefix(a, "zone=")
@@ -609,19 +1378,115 @@ func parseLimitReqZone(args []string) (zoneName string, rl rateLimitConf, ok boo
 		}
 	}
 	ok = zoneName != "" && rateOk
+	rl.nginxKey = key
+	rl.key = rateLimitKey(key)
 	return
 }
 
-func resolveLimitReq(args []string, zones map[string]rateLimitConf) (rateLimitConf, bool) {
-	for _, a := range args {
+// rateLimitKey translates the key of a limit_req_zone, or returns "" when
+// tinyproxy can't count requests by it.
+func rateLimitKey(key string) string {
+	switch {
+	case key == "$binary_remote_addr" || key == "$remote_addr":
+		return "ip"
+	case key == "$http_x_api_key" || key == "$arg_api_key":
+		return "api_key"
+	case key == "$jwt_claim_sub":
+		return "jwt_sub"
+	case strings.HasPrefix(key, "$http_"):
+		return "header " + nginxHeaderName(strings.TrimPrefix(key, "$http_"))
+	case strings.HasPrefix(key, "$cookie_"):
+		return "cookie " + strings.TrimPrefix(key, "$cookie_")
+	}
+	return ""
+}
+
+// nginxHeaderName turns the suffix of an nginx $http_ variable back into a
+// header name, e.g. "x_api_key" into "X-Api-Key".
+func nginxHeaderName(v string) string {
+	words := strings.Split(v, "_")
+	for i, w := range words {
+		if w != "" {
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+	return strings.Join(words, "-")
+}
+
+// rateZone returns the name of the rate_limit_zone for a limit_req of the
+// nginx zone, creating it on first use. nginx sets burst and delay on each
+// limit_req while tinyproxy sets them on the zone, so a use with other
+// settings gets a zone of its own.
+func (mc *migrateConf) rateZone(zone string, rl rateLimitConf) string {
+	n := 0
+	for _, z := range mc.rateZones {
+		if z.nginxZone != zone {
+			continue
+		}
+		if z.conf == rl {
+			return z.name
+		}
+		n++
+	}
+	name := zone
+	if n > 0 {
+		name = fmt.Sprintf("%s_%d", zone, n+1)
+	}
+	mc.rateZones = append(mc.rateZones, rateZoneConf{name: name, nginxZone: zone, conf: rl})
+	return name
+}
+
+// parseLimitConnZone reads "limit_conn_zone key zone=name:size" and reports
+// whether the key counts per client (per_ip) or per server (per_vhost).
+func parseLimitConnZone(args []string) (zoneName, kind string, ok bool) {
+	if len(args) < 2 {
+		return "", "", false
+	}
+	switch args[0] {
+	case "$binary_remote_addr", "$remote_addr":
+		kind = "per_ip"
+	case "$server_name", "$host":
+		kind = "per_vhost"
+	default:
+		return "", "", false
+	}
+	for _, a := range args[1:] {
 		if strings.HasPrefix(a, "zone=") {
-			name := strings.TrimPrefix(a, "zone=")
-			if rl, ok := zones[name]; ok {
-				return rl, true
+			zoneName, _, _ = strings.Cut(strings.TrimPrefix(a, "zone="), ":")
+		}
+	}
+	return zoneName, kind, zoneName != ""
+}
+
+// resolveLimitReq reads "limit_req zone=name [burst=n] [nodelay|delay=n]"
+// and returns the zone with the burst and delay applied.
+func resolveLimitReq(args []string, zones map[string]rateLimitConf) (zone string, rl rateLimitConf, ok bool) {
+	burst, delay := 0, 0
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, "zone="):
+			zone = strings.TrimPrefix(a, "zone=")
+			rl, ok = zones[zone]
+		case strings.HasPrefix(a, "burst="):
+			n, err := strconv.Atoi(strings.TrimPrefix(a, "burst="))
+			if err != nil || n < 0 {
+				return "", rateLimitConf{}, false
+			}
+			burst = n
+		case a == "nodelay":
+			delay = -1
+		case strings.HasPrefix(a, "delay="):
+			n, err := strconv.Atoi(strings.TrimPrefix(a, "delay="))
+			if err != nil || n < 0 {
+				return "", rateLimitConf{}, false
 			}
+			delay = n + 1
 		}
 	}
-	return rateLimitConf{}, false
+	// nginx serves one request at the rate plus burst more.
+	rl.burst = burst + 1
+	rl.delay = min(delay, rl.burst)
+	return zone, rl, ok
 }
 
 func convertUpstreamBlock(dirs crossplane.Directives) (*upstreamConf, []inlineStub) {
@@ -654,16 +1519,67 @@ func convertUpstreamBlock(dirs crossplane.Directives) (*upstreamConf, []inlineSt
 				addr = "http://" + addr
 			}
 			backend := addr
+			maxFails, failTimeout, slowStart := "", "", ""
 			for i := 1; i < len(d.Args); i++ {
-				if strings.HasPrefix(d.Args[i], "weight=") {
+				switch {
+				case strings.HasPrefix(d.Args[i], "weight="):
 					w := strings.TrimPrefix(d.Args[i], "weight=")
 					if _, err := strconv.Atoi(w); err == nil {
 						backend += " weight " + w
 					}
+				case strings.HasPrefix(d.Args[i], "max_fails="):
+					maxFails = strings.TrimPrefix(d.Args[i], "max_fails=")
+				case strings.HasPrefix(d.Args[i], "fail_timeout="):
+					failTimeout = strings.TrimPrefix(d.Args[i], "fail_timeout=")
+				case strings.HasPrefix(d.Args[i], "slow_start="):
+					slowStart = strings.TrimPrefix(d.Args[i], "slow_start=")
+				case d.Args[i] == "down":
+					backend += " down"
 				}
-				// skip "down", "fail_timeout=", "max_fails="
 			}
 			uc.backends = append(uc.backends, backend)
+			if slowStart != "" {
+				ramp, ok := convertNginxDuration([]string{slowStart})
+				switch {
+				case !ok:
+					stubs = append(stubs, inlineStub{
+						tag:    "server(slow_start)",
+						raw:    directiveToRaw(d),
+						reason: "Could not convert slow_start",
+						anchor: "upstream-slow-start",
+					})
+				case uc.slowStart != "" && uc.slowStart != ramp:
+					stubs = append(stubs, inlineStub{
+						tag:    "server(slow_start)",
+						raw:    directiveToRaw(d),
+						reason: "slow_start applies to the whole upstream; the first server's is used",
+						anchor: "upstream-slow-start",
+					})
+				default:
+					uc.slowStart = ramp
+				}
+			}
+			if maxFails != "" || failTimeout != "" {
+				passive, ok := convertMaxFails(maxFails, failTimeout)
+				switch {
+				case !ok:
+					stubs = append(stubs, inlineStub{
+						tag:    "server(max_fails)",
+						raw:    directiveToRaw(d),
+						reason: "Could not convert max_fails or fail_timeout",
+						anchor: "upstream-max-fails",
+					})
+				case uc.passive != nil && !slices.Equal(uc.passive, passive):
+					stubs = append(stubs, inlineStub{
+						tag:    "server(max_fails)",
+						raw:    directiveToRaw(d),
+						reason: "max_fails and fail_timeout apply to the whole upstream; the first server's are used",
+						anchor: "upstream-max-fails",
+					})
+				default:
+					uc.passive = passive
+				}
+			}
 
 		case "ip_hash":
 			uc.strategy = "ip_hash"
@@ -672,7 +1588,33 @@ func convertUpstreamBlock(dirs crossplane.Directives) (*upstreamConf, []inlineSt
 		case "random":
 			uc.strategy = "round_robin"
 
-		case "keepalive", "keepalive_requests", "keepalive_time":
+		case "keepalive":
+			if len(d.Args) == 1 {
+				if _, err := strconv.Atoi(d.Args[0]); err == nil {
+					uc.keepalive = append(uc.keepalive, "max_idle_per_host "+d.Args[0])
+					continue
+				}
+			}
+			stubs = append(stubs, inlineStub{
+				tag:    d.Directive,
+				raw:    directiveToRaw(d),
+				reason: "Could not convert keepalive value",
+				anchor: "upstream-keepalive",
+			})
+
+		case "keepalive_timeout":
+			if dur, ok := convertNginxDuration(d.Args); ok {
+				uc.idle = dur
+				continue
+			}
+			stubs = append(stubs, inlineStub{
+				tag:    d.Directive,
+				raw:    directiveToRaw(d),
+				reason: "Could not convert keepalive_timeout value",
+				anchor: "upstream-keepalive",
+			})
+
+		case "keepalive_requests", "keepalive_time":
 			stubs = append(stubs, inlineStub{
 				tag:    d.Directive,
 				raw:    directiveToRaw(d),
@@ -2,11 +2,16 @@ package main
 
 import (
 	"os"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
 	crossplane "github.com/nginxinc/nginx-go-crossplane"
+	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/config"
+	"tinyproxy/internal/server/security"
 )
 
 func writeTemp(t *testing.T, content string) string {
@@ -28,7 +33,7 @@ func TestConvertServerBlock_Basic(t *testing.T) {
 		{Directive: "root", Args: []string{"/var/www/html"}},
 	}
 	mc := &migrateConf{report: reportConf{}}
-	vh := mc.convertServerBlock(dirs, nil, nil, "")
+	vh := mc.convertServerBlock(dirs, nil, nil, nil, "")
 	if vh.hostname != "example.com" {
 		t.Errorf("hostname = %q, want %q", vh.hostname, "example.com")
 	}
@@ -48,7 +53,7 @@ func TestConvertServerBlock_SSL(t *testing.T) {
 		{Directive: "ssl_certificate_key", Args: []string{"/etc/ssl/key.pem"}},
 	}
 	mc := &migrateConf{report: reportConf{}}
-	vh := mc.convertServerBlock(dirs, nil, nil, "")
+	vh := mc.convertServerBlock(dirs, nil, nil, nil, "")
 	if vh.port != 443 {
 		t.Errorf("port = %d, want 443", vh.port)
 	}
@@ -109,7 +114,7 @@ func TestConvertBodySize(t *testing.T) {
 		{"20m", "20MB"},
 		{"1g", "1GB"},
 		{"512k", "512KB"},
-		{"0", ""},
+		{"0", "0"},
 		{"1024", "1024B"},
 	}
 	for _, c := range cases {
@@ -132,7 +137,7 @@ func TestConvertAddHeader_SecurityHeaders(t *testing.T) {
 		{Directive: "add_header", Args: []string{"Strict-Transport-Security", "max-age=31536000; includeSubDomains"}},
 	}
 	mc := &migrateConf{report: reportConf{}}
-	vh := mc.convertServerBlock(dirs, nil, nil, "")
+	vh := mc.convertServerBlock(dirs, nil, nil, nil, "")
 	if vh.security.frameOptions != "DENY" {
 		t.Errorf("frameOptions = %q, want DENY", vh.security.frameOptions)
 	}
@@ -151,7 +156,7 @@ func TestConvertAddHeader_NonSecurity_Stubbed(t *testing.T) {
 		{Directive: "add_header", Args: []string{"X-Custom-Header", "value"}},
 	}
 	mc := &migrateConf{report: reportConf{}}
-	vh := mc.convertServerBlock(dirs, nil, nil, "")
+	vh := mc.convertServerBlock(dirs, nil, nil, nil, "")
 	if len(vh.stubs) == 0 {
 		t.Error("expected stub for non-security add_header")
 	}
@@ -190,14 +195,24 @@ func TestConvertServerBlock_RateLimit(t *testing.T) {
 		{Directive: "listen", Args: []string{"80"}},
 		{Directive: "limit_req", Args: []string{"zone=api", "burst=20"}},
 	}
-	zones := map[string]rateLimitConf{"api": {requests: 100, window: "1m"}}
+	zones := map[string]rateLimitConf{"api": {requests: 100, window: "1m", key: "ip", nginxKey: "$binary_remote_addr"}}
 	mc := &migrateConf{report: reportConf{}}
-	vh := mc.convertServerBlock(dirs, nil, zones, "")
-	if vh.security.rateReqs != 100 {
-		t.Errorf("rateReqs = %d, want 100", vh.security.rateReqs)
+	vh := mc.convertServerBlock(dirs, nil, zones, nil, "")
+	if len(vh.rateZones) != 1 || vh.rateZones[0] != "api" {
+		t.Fatalf("rateZones = %v, want [api]", vh.rateZones)
 	}
-	if vh.security.rateWin != "1m" {
-		t.Errorf("rateWin = %q, want 1m", vh.security.rateWin)
+	if len(mc.rateZones) != 1 {
+		t.Fatalf("got %d zones, want 1", len(mc.rateZones))
+	}
+	rl := mc.rateZones[0].conf
+	if rl.requests != 100 {
+		t.Errorf("requests = %d, want 100", rl.requests)
+	}
+	if rl.window != "1m" {
+		t.Errorf("window = %q, want 1m", rl.window)
+	}
+	if rl.burst != 21 || rl.delay != 0 {
+		t.Errorf("burst, delay = %d, %d, want 21, 0", rl.burst, rl.delay)
 	}
 }
 
@@ -211,7 +226,7 @@ func TestConvertServerBlock_FastCGI(t *testing.T) {
 		{Directive: "fastcgi_param", Args: []string{"SCRIPT_FILENAME", "/var/www/html/$fastcgi_script_name"}},
 	}
 	mc := &migrateConf{report: reportConf{}}
-	vh := mc.convertServerBlock(dirs, nil, nil, "")
+	vh := mc.convertServerBlock(dirs, nil, nil, nil, "")
 	if vh.fastcgi == nil {
 		t.Fatal("fastcgi is nil")
 	}
@@ -229,13 +244,14 @@ func TestConvertUpstreamBlock_RoundRobin(t *testing.T) {
 	dirs := crossplane.Directives{
 		{Directive: "server", Args: []string{"10.0.0.1:8080", "weight=3"}},
 		{Directive: "server", Args: []string{"10.0.0.2:8080"}},
+		{Directive: "server", Args: []string{"10.0.0.3:8080", "down"}},
 	}
 	uc, stubs := convertUpstreamBlock(dirs)
 	if uc.strategy != "round_robin" {
 		t.Errorf("strategy = %q, want round_robin", uc.strategy)
 	}
-	if len(uc.backends) != 2 {
-		t.Fatalf("got %d backends, want 2", len(uc.backends))
+	if len(uc.backends) != 3 {
+		t.Fatalf("got %d backends, want 3", len(uc.backends))
 	}
 	if uc.backends[0] != "http://10.0.0.1:8080 weight 3" {
 		t.Errorf("backend[0] = %q", uc.backends[0])
@@ -243,11 +259,32 @@ func TestConvertUpstreamBlock_RoundRobin(t *testing.T) {
 	if uc.backends[1] != "http://10.0.0.2:8080" {
 		t.Errorf("backend[1] = %q", uc.backends[1])
 	}
+	if uc.backends[2] != "http://10.0.0.3:8080 down" {
+		t.Errorf("backend[2] = %q", uc.backends[2])
+	}
 	if len(stubs) != 0 {
 		t.Errorf("unexpected stubs: %v", stubs)
 	}
 }
 
+func TestConvertUpstreamBlock_SlowStart(t *testing.T) {
+	dirs := crossplane.Directives{
+		{Directive: "server", Args: []string{"10.0.0.1:8080", "slow_start=30"}},
+		{Directive: "server", Args: []string{"10.0.0.2:8080", "slow_start=30s"}},
+		{Directive: "server", Args: []string{"10.0.0.3:8080", "slow_start=1m"}},
+	}
+	uc, stubs := convertUpstreamBlock(dirs)
+	if uc.slowStart != "30s" {
+		t.Errorf("slowStart = %q, want 30s", uc.slowStart)
+	}
+	if len(uc.backends) != 3 || uc.backends[0] != "http://10.0.0.1:8080" {
+		t.Errorf("backends = %q", uc.backends)
+	}
+	if len(stubs) != 1 || stubs[0].tag != "server(slow_start)" || !strings.Contains(stubs[0].raw, "10.0.0.3") {
+		t.Errorf("stubs = %+v, want the conflicting slow_start stubbed", stubs)
+	}
+}
+
 func TestConvertUpstreamBlock_IpHash(t *testing.T) {
 	dirs := crossplane.Directives{
 		{Directive: "ip_hash"},
@@ -259,17 +296,25 @@ func TestConvertUpstreamBlock_IpHash(t *testing.T) {
 	}
 }
 
-func TestConvertUpstreamBlock_KeepaliveStubbed(t *testing.T) {
+func TestConvertUpstreamBlock_Keepalive(t *testing.T) {
 	dirs := crossplane.Directives{
 		{Directive: "server", Args: []string{"10.0.0.1:8080"}},
 		{Directive: "keepalive", Args: []string{"32"}},
+		{Directive: "keepalive_timeout", Args: []string{"75s"}},
+		{Directive: "keepalive_requests", Args: []string{"1000"}},
+	}
+	uc, stubs := convertUpstreamBlock(dirs)
+	if len(uc.keepalive) != 1 || uc.keepalive[0] != "max_idle_per_host 32" {
+		t.Errorf("keepalive = %v", uc.keepalive)
+	}
+	if uc.idle != "75s" {
+		t.Errorf("idle = %q, want 75s", uc.idle)
 	}
-	_, stubs := convertUpstreamBlock(dirs)
 	if len(stubs) != 1 {
 		t.Fatalf("got %d stubs, want 1", len(stubs))
 	}
-	if stubs[0].tag != "keepalive" {
-		t.Errorf("stub tag = %q, want keepalive", stubs[0].tag)
+	if stubs[0].tag != "keepalive_requests" {
+		t.Errorf("stub tag = %q, want keepalive_requests", stubs[0].tag)
 	}
 }
 
@@ -398,3 +443,778 @@ func TestRenderReport_Counts(t *testing.T) {
 		t.Errorf("missing directive in report:\n%s", rpt)
 	}
 }
+
+func TestConvertServerBlock_Locations(t *testing.T) {
+	dirs := crossplane.Directives{
+		{Directive: "server_name", Args: []string{"example.com"}},
+		{Directive: "listen", Args: []string{"80"}},
+		{Directive: "root", Args: []string{"/var/www/html"}},
+		{Directive: "location", Args: []string{"/api/"}, Block: crossplane.Directives{
+			{Directive: "proxy_pass", Args: []string{"http://127.0.0.1:3000"}},
+		}},
+		{Directive: "location", Args: []string{"~", `\.php$`}, Block: crossplane.Directives{
+			{Directive: "fastcgi_pass", Args: []string{"127.0.0.1:9000"}},
+		}},
+		{Directive: "location", Args: []string{"@fallback"}, Block: crossplane.Directives{
+			{Directive: "proxy_pass", Args: []string{"http://127.0.0.1:4000"}},
+		}},
+		{Directive: "location", Args: []string{"/"}, Block: crossplane.Directives{
+			{Directive: "try_files", Args: []string{"$uri", "$uri/", "@fallback"}},
+		}},
+	}
+	mc := &migrateConf{report: reportConf{}}
+	vh := mc.convertServerBlock(dirs, nil, nil, nil, "")
+	if len(vh.locations) != 4 {
+		t.Fatalf("got %d locations, want 4", len(vh.locations))
+	}
+	if vh.locations[0].path != "/api/" || vh.locations[0].body.proxyPass != "http://127.0.0.1:3000" {
+		t.Errorf("locations[0] = %+v", vh.locations[0])
+	}
+	if vh.locations[1].modifier != "~" || vh.locations[1].body.fastcgi == nil {
+		t.Errorf("locations[1] = %+v", vh.locations[1])
+	}
+	if vh.locations[2].path != "@fallback" || vh.locations[2].body.proxyPass != "http://127.0.0.1:4000" {
+		t.Errorf("locations[2] = %+v", vh.locations[2])
+	}
+	if got := strings.Join(vh.locations[3].body.tryFiles, " "); got != "$uri $uri/ @fallback" {
+		t.Errorf("try_files = %q", got)
+	}
+	if len(vh.stubs) != 0 {
+		t.Errorf("unexpected stubs: %+v", vh.stubs)
+	}
+}
+
+func TestRenderVhostConf_LocationsParse(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name example.com;
+        listen 80;
+        root /var/www/html;
+        location /api/ {
+            proxy_pass http://127.0.0.1:3000;
+        }
+        location = /healthz {
+            proxy_pass http://127.0.0.1:8081;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	out := renderVhostConf(mc)
+	if !strings.Contains(out, "        location /api/ {\n            proxy_pass http://127.0.0.1:3000\n        }") {
+		t.Errorf("missing location block:\n%s", out)
+	}
+	cfg, err := config.NewParser(strings.NewReader(out)).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v\n%s", err, out)
+	}
+	if got := len(cfg.VHosts["example.com"].Locations); got != 2 {
+		t.Errorf("parsed %d locations, want 2", got)
+	}
+}
+
+func TestConvertReturn(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+		ok   bool
+	}{
+		{[]string{"301", "https://example.com$request_uri"}, "301 https://example.com$request_uri", true},
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"403"}, "403", true},
+		{[]string{"200", "hello world"}, `200 "hello world"`, true},
+		{[]string{"abc", "def"}, "", false},
+	}
+	for _, c := range cases {
+		got, ok := convertReturn(c.args)
+		if got != c.want || ok != c.ok {
+			t.Errorf("convertReturn(%v) = (%q,%v), want (%q,%v)", c.args, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestConvertNginxFile_ReturnRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name www.example.com;
+        listen 80;
+        return 301 https://example.com$request_uri;
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 0 {
+		t.Errorf("stubbed = %d, want 0", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	rc := cfg.VHosts["www.example.com"].Return
+	if rc.Code != 301 || rc.Target != "https://example.com$request_uri" {
+		t.Errorf("Return = %+v", rc)
+	}
+}
+
+func TestConvertRewrite(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+		ok   bool
+	}{
+		{[]string{"^/blog/(.*)$", "/posts/$1", "last"}, "^/blog/(.*)$ /posts/$1 last", true},
+		{[]string{"^/old$", "/new?"}, "^/old$ /new?", true},
+		{[]string{"^/(?!api)(.*)$", "/app/$1"}, "", false},
+		{[]string{"^/a b$", "/c"}, "", false},
+		{[]string{"^/a$"}, "", false},
+	}
+	for _, c := range cases {
+		got, ok := convertRewrite(c.args)
+		if got != c.want || ok != c.ok {
+			t.Errorf("convertRewrite(%q) = %q, %v; want %q, %v", c.args, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestConvertNginxFile_RewriteRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name example.com;
+        listen 80;
+        root /var/www/html;
+        rewrite ^/blog/(\d+)/(.*)$ /posts/$2?year=$1 last;
+        location /posts/ {
+            rewrite ^/posts/(.*)$ /index.php?slug=$1 break;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 0 {
+		t.Errorf("stubbed = %d, want 0", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	if len(vh.Rewrites) != 1 || vh.Rewrites[0].Flag != "last" {
+		t.Errorf("vhost rewrites = %v", vh.Rewrites)
+	}
+	if len(vh.Locations) != 1 || len(vh.Locations[0].VHost.Rewrites) != 1 {
+		t.Errorf("location rewrites not converted")
+	}
+}
+
+func TestConvertProxySetHeader(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+		ok   bool
+	}{
+		{[]string{"Host", "$host"}, "request_set Host $host", true},
+		{[]string{"X-Forwarded-For", "$proxy_add_x_forwarded_for"}, "request_set X-Forwarded-For $proxy_add_x_forwarded_for", true},
+		{[]string{"Connection", ""}, `request_set Connection ""`, true},
+		{[]string{"X-Via", "edge proxy"}, `request_set X-Via "edge proxy"`, true},
+		{[]string{"X-Upstream", "$upstream_addr"}, "", false},
+	}
+	for _, c := range cases {
+		got, ok := convertProxySetHeader(c.args)
+		if got != c.want || ok != c.ok {
+			t.Errorf("convertProxySetHeader(%q) = %q, %v; want %q, %v", c.args, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestConvertNginxFile_HeadersRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name example.com;
+        listen 80;
+        proxy_pass http://127.0.0.1:3000;
+        proxy_set_header Host $host;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_hide_header X-Powered-By;
+        location /ws {
+            proxy_set_header Upgrade $http_upgrade;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 0 {
+		t.Errorf("stubbed = %d, want 0", mc.report.stubbed)
+	}
+	out := renderVhostConf(mc)
+	cfg, err := config.NewParser(strings.NewReader(out)).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v\n%s", err, out)
+	}
+	vh := cfg.VHosts["example.com"]
+	if len(vh.Headers.RequestSet) != 2 || vh.Headers.ResponseRemove[0] != "X-Powered-By" {
+		t.Errorf("vhost headers = %+v", vh.Headers)
+	}
+	ws := vh.Locations[0].VHost.Headers
+	if len(ws.RequestSet) != 1 || ws.RequestSet[0].Name != "Upgrade" {
+		t.Errorf("location headers = %+v", ws)
+	}
+}
+
+func TestConvertErrorPage(t *testing.T) {
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"500", "502", "503", "504", "/50x.html"}, true},
+		{[]string{"404", "/404.html"}, true},
+		{[]string{"404", "=200", "/empty.gif"}, false},
+		{[]string{"404", "@fallback"}, false},
+		{[]string{"403", "https://example.com/forbidden"}, false},
+		{[]string{"/50x.html"}, false},
+	}
+	for _, c := range cases {
+		if got := convertErrorPage(c.args); got != c.ok {
+			t.Errorf("convertErrorPage(%q) = %v, want %v", c.args, got, c.ok)
+		}
+	}
+}
+
+func TestConvertNginxFile_ErrorPageRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name example.com;
+        listen 80;
+        root /var/www/html;
+        proxy_pass http://127.0.0.1:3000;
+        proxy_intercept_errors on;
+        error_page 500 502 503 504 /50x.html;
+        error_page 404 =200 /empty.gif;
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 1 {
+		t.Errorf("stubbed = %d, want 1", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	ep := cfg.VHosts["example.com"].ErrorPages
+	if len(ep.Pages) != 4 || ep.Pages[502] != "/50x.html" || !ep.InterceptErrors {
+		t.Errorf("ErrorPages = %+v", ep)
+	}
+}
+
+func TestConvertNginxDuration(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"60", "60s", true},
+		{"30s", "30s", true},
+		{"5m", "5m", true},
+		{"500ms", "500ms", true},
+		{"1h", "1h", true},
+		{"1m30s", "", false},
+		{"1d", "", false},
+		{"0", "", false},
+	}
+	for _, c := range cases {
+		got, ok := convertNginxDuration([]string{c.in})
+		if got != c.want || ok != c.ok {
+			t.Errorf("convertNginxDuration(%q) = %q, %v; want %q, %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestConvertNginxFile_TimeoutsRoundTrip(t *testing.T) {
+	conf := `
+http {
+    upstream app {
+        server 10.0.0.1:8080;
+        server 10.0.0.2:8080;
+        keepalive 32;
+    }
+    server {
+        server_name example.com;
+        listen 80;
+        proxy_connect_timeout 5;
+        proxy_read_timeout 5m;
+        proxy_send_timeout 1d;
+        location / {
+            proxy_pass http://app;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 1 {
+		t.Errorf("stubbed = %d, want 1", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	if vh.Timeouts.Connect != 5*time.Second || vh.Timeouts.Read != 5*time.Minute || vh.Timeouts.Send != 0 {
+		t.Errorf("Timeouts = %+v", vh.Timeouts)
+	}
+	if len(vh.Locations) != 1 {
+		t.Fatalf("got %d locations, want 1", len(vh.Locations))
+	}
+	if ka := vh.Locations[0].VHost.Keepalive; ka.MaxIdlePerHost != 32 {
+		t.Errorf("location Keepalive = %+v", ka)
+	}
+}
+
+func TestConvertNginxFile_MaxFailsRoundTrip(t *testing.T) {
+	conf := `
+http {
+    upstream app {
+        server 10.0.0.1:8080 max_fails=3 fail_timeout=20s;
+        server 10.0.0.2:8080 weight=2 max_fails=3 fail_timeout=20s;
+        server 10.0.0.3:8080 max_fails=5;
+    }
+    server {
+        server_name example.com;
+        listen 80;
+        location / {
+            proxy_pass http://app;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	out := renderVhostConf(mc)
+	if !strings.Contains(out, "# UNSUPPORTED[server(max_fails)]: server 10.0.0.3:8080 max_fails=5") {
+		t.Errorf("conflicting max_fails not stubbed:\n%s", out)
+	}
+	cfg, err := config.NewParser(strings.NewReader(out)).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v\n%s", err, out)
+	}
+	vh := cfg.VHosts["example.com"].Locations[0].VHost
+	want := loadbalancer.PassiveCheckConfig{MaxFails: 3, FailWindow: 20 * time.Second, EjectTime: 20 * time.Second, MaxEjectTime: 5 * time.Minute}
+	if got := vh.Upstream.Passive; got != want {
+		t.Errorf("Passive = %+v, want %+v", got, want)
+	}
+}
+
+func TestConvertMaxFails(t *testing.T) {
+	cases := []struct {
+		maxFails, failTimeout string
+		want                  []string
+	}{
+		{"2", "", []string{"max_fails 2 within 10s", "eject_time 10s"}},
+		{"", "30", []string{"max_fails 1 within 30s", "eject_time 30s"}},
+		{"1", "1h", []string{"max_fails 1 within 1h", "eject_time 1h", "max_eject_time 1h"}},
+		{"0", "", []string{"max_fails off"}},
+		{"x", "", nil},
+		{"1", "1d", nil},
+	}
+	for _, c := range cases {
+		got, ok := convertMaxFails(c.maxFails, c.failTimeout)
+		if !slices.Equal(got, c.want) || ok != (c.want != nil) {
+			t.Errorf("convertMaxFails(%q, %q) = %q, %v; want %q", c.maxFails, c.failTimeout, got, ok, c.want)
+		}
+	}
+}
+
+func TestConvertNginxFile_AuthBasicRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name staging.example.com;
+        listen 80;
+        proxy_pass http://127.0.0.1:3000;
+        auth_basic_user_file /etc/nginx/.htpasswd;
+        location / {
+            auth_basic "Staging";
+        }
+        location /health {
+            auth_basic off;
+        }
+    }
+    server {
+        server_name admin.example.com;
+        listen 80;
+        proxy_pass http://127.0.0.1:4000;
+        auth_basic "Admin";
+        auth_basic_user_file /etc/nginx/admin.htpasswd;
+        location /public {
+            auth_basic off;
+        }
+    }
+    server {
+        server_name broken.example.com;
+        listen 80;
+        proxy_pass http://127.0.0.1:5000;
+        auth_basic "No users";
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 1 {
+		t.Errorf("stubbed = %d, want 1", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+
+	staging := cfg.VHosts["staging.example.com"]
+	if staging.AuthBasic.UserFile != "" {
+		t.Errorf("staging AuthBasic = %+v, want off outside locations", staging.AuthBasic)
+	}
+	if ab := staging.Locations[0].VHost.AuthBasic; ab.Realm != "Staging" || ab.UserFile != "/etc/nginx/.htpasswd" {
+		t.Errorf("staging / AuthBasic = %+v", ab)
+	}
+	if ab := staging.Locations[1].VHost.AuthBasic; ab.UserFile != "" {
+		t.Errorf("staging /health AuthBasic = %+v, want off", ab)
+	}
+
+	admin := cfg.VHosts["admin.example.com"]
+	if admin.AuthBasic.Realm != "Admin" || admin.AuthBasic.UserFile != "/etc/nginx/admin.htpasswd" {
+		t.Errorf("admin AuthBasic = %+v", admin.AuthBasic)
+	}
+	if ab := admin.Locations[0].VHost.AuthBasic; ab.UserFile != "" {
+		t.Errorf("admin /public AuthBasic = %+v, want off", ab)
+	}
+
+	if ab := cfg.VHosts["broken.example.com"].AuthBasic; ab.UserFile != "" {
+		t.Errorf("broken AuthBasic = %+v, want stubbed", ab)
+	}
+}
+
+func TestConvertNginxFile_AuthRequestRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name app.example.com;
+        listen 80;
+        proxy_pass http://127.0.0.1:3000;
+        auth_request /auth;
+        location = /auth {
+            internal;
+            proxy_pass http://127.0.0.1:9000/verify;
+        }
+        location /public {
+            auth_request off;
+        }
+        location /sso {
+            auth_request /sso-check;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 1 {
+		t.Errorf("stubbed = %d, want 1", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	vh := cfg.VHosts["app.example.com"]
+	if vh.AuthRequest.URL != "http://127.0.0.1:9000/verify" {
+		t.Errorf("AuthRequest = %+v", vh.AuthRequest)
+	}
+	if len(vh.Locations) != 2 {
+		t.Fatalf("got %d locations, want 2 (internal /auth dropped)", len(vh.Locations))
+	}
+	if ar := vh.Locations[0].VHost.AuthRequest; vh.Locations[0].Path != "/public" || ar.URL != "" {
+		t.Errorf("location %s AuthRequest = %+v, want off", vh.Locations[0].Path, ar)
+	}
+}
+
+func TestAuthRequestURL(t *testing.T) {
+	cases := []struct{ target, uri, want string }{
+		{"http://127.0.0.1:9000/verify", "/auth", "http://127.0.0.1:9000/verify"},
+		{"http://127.0.0.1:9000", "/auth", "http://127.0.0.1:9000/auth"},
+		{"", "/auth", ""},
+	}
+	for _, c := range cases {
+		if got := authRequestURL(c.target, c.uri); got != c.want {
+			t.Errorf("authRequestURL(%q, %q) = %q, want %q", c.target, c.uri, got, c.want)
+		}
+	}
+}
+
+func TestConvertNginxFile_JWTRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name api.example.com;
+        listen 80;
+        proxy_pass http://127.0.0.1:3000;
+        auth_jwt "API";
+        auth_jwt_key_file /etc/nginx/jwks.json;
+        location /health {
+            auth_jwt off;
+        }
+        location /web {
+            auth_jwt "Web" token=$cookie_auth;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 1 {
+		t.Errorf("stubbed = %d, want 1", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	vh := cfg.VHosts["api.example.com"]
+	if vh.JWT.Keys != "/etc/nginx/jwks.json" {
+		t.Errorf("JWT = %+v", vh.JWT)
+	}
+	if k := vh.Locations[0].VHost.JWT.Keys; k != "" {
+		t.Errorf("/health JWT keys = %q, want off", k)
+	}
+}
+
+func TestConvertNginxFile_LimitConnRoundTrip(t *testing.T) {
+	conf := `
+http {
+    limit_conn_zone $binary_remote_addr zone=addr:10m;
+    limit_conn_zone $server_name zone=perserver:10m;
+    limit_conn_zone $http_x_api_key zone=apikey:10m;
+    server {
+        server_name example.com;
+        listen 80;
+        proxy_pass http://localhost:3000;
+        limit_conn addr 20;
+        limit_conn perserver 2000;
+        limit_conn_status 429;
+        location /upload {
+            limit_conn addr 2;
+        }
+        location /api {
+            limit_conn apikey 5;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 1 {
+		t.Errorf("stubbed = %d, want 1 (the limit_conn on an API key zone)", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	if lc := vh.LimitConn; lc.PerIP != 20 || lc.PerVHost != 2000 || lc.Status != 429 {
+		t.Errorf("LimitConn = %+v", lc)
+	}
+	if len(vh.Locations) != 2 {
+		t.Fatalf("got %d locations, want 2", len(vh.Locations))
+	}
+	if lc := vh.Locations[0].VHost.LimitConn; lc.PerIP != 2 || lc.PerVHost != 0 || lc.Status != 429 {
+		t.Errorf("/upload LimitConn = %+v, want per_ip 2 with the inherited status", lc)
+	}
+	if lc := vh.Locations[1].VHost.LimitConn; lc.PerIP != 20 || lc.PerVHost != 2000 {
+		t.Errorf("/api LimitConn = %+v, want the server limits", lc)
+	}
+}
+
+func TestConvertNginxFile_RealIPRoundTrip(t *testing.T) {
+	conf := `
+http {
+    set_real_ip_from 10.0.0.0/8;
+    real_ip_header X-Forwarded-For;
+    real_ip_recursive on;
+    server {
+        server_name example.com;
+        listen 443 ssl proxy_protocol;
+        set_real_ip_from 192.168.1.1;
+        set_real_ip_from unix:;
+        proxy_pass http://localhost:3000;
+    }
+    server {
+        server_name cdn.example.com;
+        listen 80;
+        real_ip_header CF-Connecting-IP;
+        proxy_pass http://localhost:3001;
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 2 {
+		t.Errorf("stubbed = %d, want 2 (unix: and CF-Connecting-IP)", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	var got []string
+	for _, p := range cfg.TrustedProxies {
+		got = append(got, p.String())
+	}
+	if strings.Join(got, " ") != "10.0.0.0/8 192.168.1.1/32" {
+		t.Errorf("TrustedProxies = %v", got)
+	}
+	if !cfg.ProxyProtocol {
+		t.Error("ProxyProtocol = false, want true")
+	}
+}
+
+func TestConvertNginxFile_AccessRoundTrip(t *testing.T) {
+	conf := `
+http {
+    server {
+        server_name example.com;
+        listen 80;
+        proxy_pass http://localhost:3000;
+        deny 192.0.2.1;
+        location /admin {
+            allow 10.0.0.0/8;
+            allow 2001:db8::/32;
+            allow unix:;
+            deny all;
+            satisfy any;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 2 {
+		t.Errorf("stubbed = %d, want 2 (unix: and satisfy any)", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	if r := vh.Access.Rules; len(r) != 1 || r[0].Allow || r[0].Prefix.String() != "192.0.2.1/32" {
+		t.Errorf("Access = %+v", vh.Access)
+	}
+	r := vh.Locations[0].VHost.Access.Rules
+	if len(r) != 3 || !r[0].Allow || r[1].Prefix.String() != "2001:db8::/32" || r[2].Allow || !r[2].All {
+		t.Errorf("/admin Access = %+v", r)
+	}
+}
+
+func TestConvertNginxFile_GeoIPRoundTrip(t *testing.T) {
+	conf := `
+http {
+    geoip2 /var/lib/GeoIP/GeoLite2-Country.mmdb {
+        auto_reload 60m;
+        $geoip2_country_code default=XX country iso_code;
+    }
+    geoip2 /var/lib/GeoIP/GeoLite2-ASN.mmdb {
+        $geoip2_asn autonomous_system_number;
+    }
+    geoip2 /var/lib/GeoIP/GeoLite2-City.mmdb {
+        $geoip2_city city names en;
+    }
+    geoip_country /usr/share/GeoIP/GeoIP.dat;
+    geo $office {
+        default 0;
+        10.0.0.0/8 1;
+    }
+    server {
+        server_name example.com;
+        listen 80;
+        proxy_pass http://localhost:3000;
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 3 {
+		t.Errorf("stubbed = %d, want 3 (city geoip2, geoip_country and geo)", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+	if cfg.GeoIP.CountryDB != "/var/lib/GeoIP/GeoLite2-Country.mmdb" || cfg.GeoIP.ASNDB != "/var/lib/GeoIP/GeoLite2-ASN.mmdb" {
+		t.Errorf("GeoIP = %+v", cfg.GeoIP)
+	}
+}
+
+func TestConvertNginxFile_RateLimitRoundTrip(t *testing.T) {
+	conf := `
+http {
+    limit_req_zone $binary_remote_addr zone=per_ip:10m rate=10r/s;
+    limit_req_zone $http_x_tenant_id zone=tenant:10m rate=600r/m;
+    limit_req_zone $server_name zone=per_server:10m rate=100r/s;
+    server {
+        server_name example.com;
+        listen 80;
+        proxy_pass http://localhost:3000;
+        limit_req zone=per_ip burst=20 nodelay;
+        location /api {
+            limit_req zone=per_ip burst=5 delay=2;
+            limit_req zone=tenant burst=60;
+        }
+        location /all {
+            limit_req zone=per_server;
+        }
+    }
+}`
+	mc, err := convertNginxFile(writeTemp(t, conf))
+	if err != nil {
+		t.Fatalf("convertNginxFile: %v", err)
+	}
+	if mc.report.stubbed != 1 {
+		t.Errorf("stubbed = %d, want 1 ($server_name key)", mc.report.stubbed)
+	}
+	cfg, err := config.NewParser(strings.NewReader(renderVhostConf(mc))).Parse()
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v", err)
+	}
+
+	want := map[string]security.RateLimitConfig{
+		"per_ip":   {Requests: 10, Window: time.Second, Burst: 21, Key: "ip"},
+		"per_ip_2": {Requests: 10, Window: time.Second, Burst: 6, Queue: true, Delay: 3, Key: "ip"},
+		"tenant":   {Requests: 600, Window: time.Minute, Burst: 61, Queue: true, Key: "header", KeyName: "X-Tenant-Id"},
+	}
+	if !reflect.DeepEqual(cfg.RateLimitZones, want) {
+		t.Errorf("RateLimitZones = %+v, want %+v", cfg.RateLimitZones, want)
+	}
+	vh := cfg.VHosts["example.com"]
+	if !slices.Equal(vh.RateLimitZones, []string{"per_ip"}) || vh.Security.RateLimit.Requests != 0 {
+		t.Errorf("vhost zones = %v, built-in limit = %+v", vh.RateLimitZones, vh.Security.RateLimit)
+	}
+	if api := vh.Locations[0].VHost; !slices.Equal(api.RateLimitZones, []string{"per_ip_2", "tenant"}) {
+		t.Errorf("/api zones = %v", api.RateLimitZones)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/proxy"
+)
+
+// maxHeldResponse bounds the response of a try that may be retried, which
+// is held back until it is known whether another backend will be tried. A
+// longer response is sent on as it is.
+const maxHeldResponse = 64 << 10
+
+type retriesKey struct{}
+
+// withRetryCount returns r with room for the number of times it is retried,
+// for the dashboard.
+func withRetryCount(r *http.Request) (*http.Request, *int) {
+	n := new(int)
+	return r.WithContext(context.WithValue(r.Context(), retriesKey{}, n)), n
+}
+
+// serveUpstream proxies r to a backend of up. A try that can't connect or
+// gets a status of the retry block is retried on a backend not tried yet,
+// as long as the method is retried, the body fits the replay buffer and the
+// retry budget allows.
+func serveUpstream(w http.ResponseWriter, r *http.Request, up *upstream) {
+	lb := up.lb
+	rc := up.retry
+	retries := 0
+	var body []byte
+	if rc.Attempts > 0 && slices.Contains(rc.Methods, r.Method) {
+		var ok bool
+		if body, ok = bufferBody(r, rc.BodyLimit); ok {
+			retries = rc.Attempts
+		}
+	}
+
+	var tried []*loadbalancer.Backend
+	var held *retryWriter
+	for {
+		// The budget is checked before a backend is picked, which may
+		// take one of the probes of a half-open circuit breaker.
+		if held != nil && len(tried) < len(lb.Backends()) && !lb.AllowRetry() {
+			log.Printf("not retrying %s %s%s: retry budget exhausted", r.Method, r.Host, r.URL.Path)
+			held.commit()
+			return
+		}
+		backend, err := lb.Next(r, tried...)
+		if err != nil {
+			if held != nil {
+				held.commit()
+				return
+			}
+			log.Printf("load balancer error: %v", err)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if held != nil {
+			log.Printf("retrying %s %s%s on %s after %s", r.Method, r.Host, r.URL.Path, backend.URL, held.reason())
+			if n, ok := r.Context().Value(retriesKey{}).(*int); ok {
+				*n++
+			}
+		}
+		tried = append(tried, backend)
+
+		var out http.ResponseWriter = w
+		held = nil
+		if len(tried) <= retries {
+			held = &retryWriter{w: w, header: make(http.Header), statuses: rc.Statuses}
+			out = held
+		}
+		failure := serveBackend(out, r, body, lb, up.backends, backend)
+		if held == nil {
+			return
+		}
+		held.failure = failure
+		if !held.retryable(rc) {
+			held.commit()
+			return
+		}
+	}
+}
+
+// serveBackend proxies r to backend and returns the error of a try that
+// failed without a response from it.
+func serveBackend(w http.ResponseWriter, r *http.Request, body []byte, lb *loadbalancer.LoadBalancer, backends *proxy.Upstream, backend *loadbalancer.Backend) error {
+	lb.MarkActive(backend)
+	defer lb.MarkDone(backend)
+
+	// Set sticky-session cookie if strategy requires it
+	lb.SetAffinityCookie(w, backend)
+
+	backendProxy, err := backends.Backend(backend.URL)
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return nil
+	}
+	r, outcome := proxy.TrackOutcome(r)
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	backendProxy.ServeHTTP(w, r)
+	lb.Report(backend, outcome.Err, outcome.Status, outcome.Latency)
+	return outcome.Err
+}
+
+// bufferBody reads r's body, if it has one of at most limit bytes, so it can
+// be sent again. It reports false, with the body left to be read as it
+// was, when it is larger or can't be read.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength > limit {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		// Whatever stopped the read, such as max_body_size, stops the
+		// proxy's read the same way.
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return buf, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// retryWriter holds back the response of a try that may be retried. A
+// response with a status that isn't retried is passed through at once; one
+// that is, or a 502 that may stand for a failed connection, is kept until
+// commit or dropped for a retry.
+type retryWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	statuses []int
+	failure  error // set once the try is over
+
+	status    int
+	held      bool
+	committed bool
+	buf       bytes.Buffer
+}
+
+func (rw *retryWriter) Header() http.Header {
+	if rw.committed {
+		return rw.w.Header()
+	}
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(status int) {
+	// Informational responses such as 103 Early Hints are dropped, since
+	// the try they come from may be abandoned.
+	if rw.status != 0 || status < 200 && status != http.StatusSwitchingProtocols {
+		return
+	}
+	rw.status = status
+	if status == http.StatusBadGateway || slices.Contains(rw.statuses, status) {
+		rw.held = true
+		return
+	}
+	rw.commit()
+}
+
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.held && rw.buf.Len()+len(b) <= maxHeldResponse {
+		return rw.buf.Write(b)
+	}
+	rw.commit()
+	return rw.w.Write(b)
+}
+
+// Flush sends what was written so far unless the response is held back.
+func (rw *retryWriter) Flush() {
+	if rw.held && !rw.committed {
+		return
+	}
+	http.NewResponseController(rw.w).Flush()
+}
+
+func (rw *retryWriter) Unwrap() http.ResponseWriter { return rw.w }
+
+// commit sends the response as written so far and passes the rest
+// through.
+func (rw *retryWriter) commit() {
+	if rw.committed {
+		return
+	}
+	rw.committed = true
+	rw.held = false
+	dst := rw.w.Header()
+	for k, v := range rw.header {
+		dst[k] = v
+	}
+	if rw.status != 0 {
+		rw.w.WriteHeader(rw.status)
+	}
+	if rw.buf.Len() > 0 {
+		rw.w.Write(rw.buf.Bytes())
+		rw.buf.Reset()
+	}
+}
+
+// retryable reports whether the finished try may be retried: its response
+// is still held back and it failed to connect or got a retried status.
+func (rw *retryWriter) retryable(rc loadbalancer.RetryConfig) bool {
+	if !rw.held || rw.committed {
+		return false
+	}
+	if rw.failure != nil {
+		return rc.ConnectError && proxy.IsConnectError(rw.failure)
+	}
+	return slices.Contains(rc.Statuses, rw.status)
+}
+
+// reason describes why the try is retried, for the log.
+func (rw *retryWriter) reason() string {
+	if rw.failure != nil {
+		return rw.failure.Error()
+	}
+	return "status " + strconv.Itoa(rw.status)
+}
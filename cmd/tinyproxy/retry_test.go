@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tinyproxy/internal/loadbalancer"
+)
+
+func TestRetryWriter(t *testing.T) {
+	rc := loadbalancer.RetryConfig{Statuses: []int{503}}
+
+	// A retried status is held back, then sent whole if there is no retry.
+	rec := httptest.NewRecorder()
+	rw := &retryWriter{w: rec, header: make(http.Header), statuses: rc.Statuses}
+	rw.Header().Set("Retry-After", "5")
+	rw.WriteHeader(503)
+	rw.Write([]byte("busy"))
+	if rec.Code != 200 || rec.Body.Len() != 0 || rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("held response was written: %d %q", rec.Code, rec.Body.String())
+	}
+	if !rw.retryable(rc) {
+		t.Error("held 503 not retryable")
+	}
+	rw.commit()
+	if rec.Code != 503 || rec.Body.String() != "busy" || rec.Header().Get("Retry-After") != "5" {
+		t.Errorf("committed response = %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	// Other statuses pass straight through.
+	rec = httptest.NewRecorder()
+	rw = &retryWriter{w: rec, header: make(http.Header), statuses: rc.Statuses}
+	rw.WriteHeader(404)
+	rw.Write([]byte("missing"))
+	if rec.Code != 404 || rec.Body.String() != "missing" || rw.retryable(rc) {
+		t.Errorf("404 = %d %q, retryable %v; want it passed through", rec.Code, rec.Body.String(), rw.retryable(rc))
+	}
+
+	// A response too long to hold is sent on and can't be retried.
+	rec = httptest.NewRecorder()
+	rw = &retryWriter{w: rec, header: make(http.Header), statuses: rc.Statuses}
+	rw.WriteHeader(503)
+	long := strings.Repeat("x", maxHeldResponse+1)
+	rw.Write([]byte(long))
+	if rec.Code != 503 || rec.Body.Len() != len(long) || rw.retryable(rc) {
+		t.Errorf("long 503 = %d with %d bytes, retryable %v", rec.Code, rec.Body.Len(), rw.retryable(rc))
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/", strings.NewReader("hello"))
+	if body, ok := bufferBody(r, 5); !ok || string(body) != "hello" {
+		t.Errorf("bufferBody = %q, %v; want the body", body, ok)
+	}
+
+	// Without a length the body is read up to the limit and put back.
+	r = httptest.NewRequest("PUT", "/", strings.NewReader("hello world"))
+	r.ContentLength = -1
+	if _, ok := bufferBody(r, 5); ok {
+		t.Error("body over the limit was buffered")
+	}
+	if b, err := io.ReadAll(r.Body); err != nil || string(b) != "hello world" {
+		t.Errorf("body after bufferBody = %q, %v", b, err)
+	}
+}
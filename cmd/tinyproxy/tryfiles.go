@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"tinyproxy/internal/server/config"
+	"tinyproxy/internal/server/redirect"
+	"tinyproxy/internal/server/rewrite"
+	"tinyproxy/internal/server/variables"
+)
+
+// maxInternalRedirects bounds try_files fallbacks that redirect into another
+// try_files, matching nginx's limit of 10.
+const maxInternalRedirects = 10
+
+type internalRedirectsKey struct{}
+
+// tryFiles serves the first try_files candidate that exists under the vhost
+// root. When none exist the final entry decides: "=<code>" responds with that
+// status, "@name" hands the request to a named location, and anything else is
+// an internal redirect to that URI, resolved against cfg and subs, the
+// config and subsystems the request started with.
+func (vh *VHostHandler) tryFiles(w http.ResponseWriter, r *http.Request, cfg *config.ServerConfig, subs *subsystems, vhost *config.VirtualHost) {
+	candidates := vhost.TryFiles[:len(vhost.TryFiles)-1]
+	fallback := vhost.TryFiles[len(vhost.TryFiles)-1]
+
+	root := http.Dir(vhost.Root)
+	for _, c := range candidates {
+		if serveTryFile(w, r, root, variables.Expand(c, r)) {
+			return
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(fallback, "="):
+		code, _ := strconv.Atoi(fallback[1:])
+		http.Error(w, http.StatusText(code), code)
+	case strings.HasPrefix(fallback, "@"):
+		vh.internalRedirect(w, r, cfg, subs, fallback)
+	default:
+		target, err := url.Parse(variables.Expand(fallback, r))
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = target.Path
+		r2.URL.RawPath = ""
+		if target.RawQuery != "" || strings.Contains(fallback, "?") {
+			r2.URL.RawQuery = target.RawQuery
+		}
+		vh.internalRedirect(w, r2, cfg, subs, "")
+	}
+}
+
+// serveTryFile serves name from root if it is a regular file, or if it ends in
+// "/" and is a directory containing index.html. It reports whether it served.
+func serveTryFile(w http.ResponseWriter, r *http.Request, root http.FileSystem, name string) bool {
+	if name == "" {
+		return false
+	}
+	dir := strings.HasSuffix(name, "/")
+	name = path.Clean("/" + name)
+	if dir {
+		name = path.Join(name, "index.html")
+	}
+
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return true
+}
+
+// internalRedirect re-dispatches r within its vhost, as nginx does for a
+// try_files fallback. named selects a named location; when empty the location
+// is matched again against the request path. cfg and subs are the ones the
+// request started with, so a reload meanwhile doesn't change them under it.
+// Compression and caching from the original scope already wrap w, so only
+// the backend handler runs here.
+func (vh *VHostHandler) internalRedirect(w http.ResponseWriter, r *http.Request, cfg *config.ServerConfig, subs *subsystems, named string) {
+	n, _ := r.Context().Value(internalRedirectsKey{}).(int)
+	if n >= maxInternalRedirects {
+		log.Printf("try_files: internal redirect cycle for %s%s", r.Host, r.URL.Path)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), internalRedirectsKey{}, n+1))
+
+	parent := cfg.VHosts[r.Host]
+	if parent == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var vhost *config.VirtualHost
+	var scope string
+	if named != "" {
+		loc := parent.NamedLocation(named)
+		if loc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		vhost, scope = loc.VHost, scopeKey(r.Host, loc)
+	} else {
+		var redir *rewrite.Result
+		vhost, scope, _, redir = resolveVHost(cfg, r)
+		if redir != nil {
+			writeRewriteRedirect(w, r, redir)
+			return
+		}
+	}
+
+	if vhost.Return.Code != 0 {
+		redirect.Return(w, r, vhost.Return.Code, vhost.Return.Target)
+		return
+	}
+	subs.protect(scope, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vh.handleVHost(w, r, cfg, subs, vhost, subs.upstreams[scope])
+	})).ServeHTTP(w, r)
+}
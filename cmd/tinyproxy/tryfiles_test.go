@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTryFilesHandler(t *testing.T, body string) *VHostHandler {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "about.html"), "about page")
+	writeFile(t, filepath.Join(root, "docs", "index.html"), "docs index")
+	writeFile(t, filepath.Join(root, "index.html"), "spa shell")
+
+	vh, _ := newTestHandler(t, "vhosts {\n    example.com {\n        root "+root+"\n"+body+"\n    }\n}")
+	return vh
+}
+
+func TestTryFiles_Fallbacks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend "+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	vh := newTryFilesHandler(t, `
+        try_files $uri $uri/ /index.html
+        location /static {
+            try_files $uri =404
+        }
+        location /api {
+            try_files $uri @app
+        }
+        location @app {
+            proxy_pass `+backend.URL+`
+        }
+        location /loop {
+            try_files $uri /loop/again
+        }`)
+
+	cases := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"/about.html", 200, "about page"},
+		{"/docs/", 200, "docs index"},
+		{"/some/client/route", 200, "spa shell"},
+		{"/static/missing.css", 404, "Not Found\n"},
+		{"/api/users?id=1", 200, "backend /api/users?id=1"},
+		{"/loop/x", 500, "Internal Server Error\n"},
+	}
+	for _, c := range cases {
+		rec := get(vh, "", c.path)
+		if code, body := rec.Code, rec.Body.String(); code != c.wantCode || body != c.wantBody {
+			t.Errorf("GET %s = %d %q, want %d %q", c.path, code, body, c.wantCode, c.wantBody)
+		}
+	}
+}
+
+func TestTryFiles_URIFallbackRematchesLocations(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "php "+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	vh := newTryFilesHandler(t, `
+        try_files $uri $uri/ /index.php?$args
+        location ~ \.php$ {
+            proxy_pass `+backend.URL+`
+        }`)
+
+	rec := get(vh, "", "/2024/hello-world/?p=7")
+	if code, body := rec.Code, rec.Body.String(); code != 200 || body != "php /index.php?p=7" {
+		t.Errorf("got %d %q, want the .php location with args preserved", code, body)
+	}
+}
+
+func TestInternalRedirect_MissingVHost(t *testing.T) {
+	vh := newTryFilesHandler(t, `
+        try_files $uri @app
+        location @app {
+            return 204
+        }`)
+
+	// The request's own config is used, so a vhost it doesn't have is
+	// not found rather than a nil dereference.
+	req := httptest.NewRequest("GET", "http://other.example.com/", nil)
+	for _, named := range []string{"@app", ""} {
+		rec := httptest.NewRecorder()
+		vh.internalRedirect(rec, req, vh.config, vh.subs, named)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("named %q: status %d, want 404", named, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	vh.internalRedirect(rec, httptest.NewRequest("GET", "http://example.com/", nil), vh.config, vh.subs, "@app")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("example.com: status %d, want 204", rec.Code)
+	}
+}
@@ -2,6 +2,7 @@ package dashconfig
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -62,14 +63,8 @@ func HandlePut(configPath string, sighupFn func()) http.HandlerFunc {
 			json.NewEncoder(w).Encode(map[string]string{"error": parseErr.Error()})
 			return
 		}
-		tmpPath := configPath + ".tmp"
-		if err := os.WriteFile(tmpPath, body, 0644); err != nil {
-			http.Error(w, "failed to write temp config: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if err := os.Rename(tmpPath, configPath); err != nil {
-			os.Remove(tmpPath)
-			http.Error(w, "failed to replace config: "+err.Error(), http.StatusInternalServerError)
+		if err := WriteFile(configPath, body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		if sighupFn != nil {
@@ -78,3 +73,17 @@ func HandlePut(configPath string, sighupFn func()) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// WriteFile atomically replaces the config file with body, which should
+// already have been validated.
+func WriteFile(configPath string, body []byte) error {
+	tmpPath := configPath + ".tmp"
+	if err := os.WriteFile(tmpPath, body, 0644); err != nil {
+		return fmt.Errorf("failed to write temp config: %w", err)
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace config: %w", err)
+	}
+	return nil
+}
@@ -4,104 +4,50 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	dashconfig "tinyproxy/internal/dashboard/config"
 	"tinyproxy/internal/dashboard/logring"
 	"tinyproxy/internal/dashboard/stats"
+	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/auth"
 	"tinyproxy/internal/server/middleware"
+	"tinyproxy/internal/server/security"
 )
 
 
 
 // AuthMiddleware enforces HTTP Basic Auth with bcrypt password comparison.
 type AuthMiddleware struct {
-	username string
-	hash     []byte
-	limiter  *AuthLimiter
+	basic *auth.Basic
 }
 
 // NewAuthMiddleware creates an AuthMiddleware for the given username and bcrypt hash.
 func NewAuthMiddleware(username string, hash []byte) *AuthMiddleware {
 	return &AuthMiddleware{
-		username: username,
-		hash:     hash,
-		limiter:  NewAuthLimiter(5),
+		basic: auth.NewBasic("tinyproxy dashboard", auth.Users{username: string(hash)}),
 	}
 }
 
 // Wrap returns next wrapped with Basic Auth enforcement.
 func (a *AuthMiddleware) Wrap(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := remoteIP(r)
-		if a.limiter.IsBlocked(ip) {
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-			return
-		}
-		user, pass, ok := r.BasicAuth()
-		if !ok || user != a.username || bcrypt.CompareHashAndPassword(a.hash, []byte(pass)) != nil {
-			a.limiter.RecordFailure(ip)
-			w.Header().Set("WWW-Authenticate", `Basic realm="tinyproxy dashboard"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-func remoteIP(r *http.Request) string {
-	addr := r.RemoteAddr
-	if i := strings.LastIndex(addr, ":"); i > 0 {
-		return addr[:i]
-	}
-	return addr
+	return a.basic.Wrap(next)
 }
 
 // AuthLimiter tracks failed auth attempts per IP.
-type AuthLimiter struct {
-	mu     sync.Mutex
-	hits   map[string][]time.Time
-	max    int
-	window time.Duration
-}
+type AuthLimiter = auth.Limiter
 
 // NewAuthLimiter creates a limiter allowing max failed attempts per minute per IP.
 func NewAuthLimiter(max int) *AuthLimiter {
-	return &AuthLimiter{
-		hits:   make(map[string][]time.Time),
-		max:    max,
-		window: time.Minute,
-	}
-}
-
-// IsBlocked returns true if ip has exceeded the failure limit.
-func (l *AuthLimiter) IsBlocked(ip string) bool {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	now := time.Now()
-	cutoff := now.Add(-l.window)
-	hits := l.hits[ip]
-	i := 0
-	for ; i < len(hits) && hits[i].Before(cutoff); i++ {
-	}
-	hits = hits[i:]
-	l.hits[ip] = hits
-	return len(hits) >= l.max
-}
-
-// RecordFailure records a failed auth attempt for ip.
-func (l *AuthLimiter) RecordFailure(ip string) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	l.hits[ip] = append(l.hits[ip], time.Now())
+	return auth.NewLimiter(max)
 }
 
 // NewStatsHandler returns an http.Handler for GET /api/stats.
@@ -126,6 +72,137 @@ func NewStatsHandler(db *stats.DB) http.Handler {
 	})
 }
 
+// NewConnectionsHandler returns an http.Handler for GET /api/connections,
+// the in-flight request counts of each vhost with limit_conn.
+func NewConnectionsHandler(connStats func() []security.ConnStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := []security.ConnStats{}
+		if connStats != nil {
+			if st := connStats(); st != nil {
+				result = st
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// NewUpstreamsHandler returns an http.Handler for GET /api/upstreams, the
+// state of the load-balanced backends. upstreamStats may be nil.
+func NewUpstreamsHandler(upstreamStats func() []loadbalancer.UpstreamStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := []loadbalancer.UpstreamStats{}
+		if upstreamStats != nil {
+			if st := upstreamStats(); st != nil {
+				result = st
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// BackendChange is the body of a request to /api/upstreams/backends.
+type BackendChange struct {
+	Scope   string `json:"scope"`
+	URL     string `json:"url"`
+	Weight  int    `json:"weight,omitempty"`
+	State   string `json:"state,omitempty"`
+	Persist bool   `json:"persist,omitempty"` // also write the backends to the config file
+}
+
+// NewBackendsHandler returns an http.Handler for /api/upstreams/backends,
+// which changes the backends of a load balancer at runtime: POST adds one,
+// PATCH sets the state or weight of one and DELETE removes one. It answers
+// with the scope's backends as they are afterwards. remove takes a backend
+// out of a scope; when nil it is removed from the load balancer alone.
+// balancer, remove and save may be nil.
+func NewBackendsHandler(balancer func(scope string) *loadbalancer.LoadBalancer, remove func(scope, url string) error, save func(scope string) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPatch, http.MethodDelete:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// A JSON body can't be sent cross-site without a CORS preflight,
+		// so another site can't make a logged-in browser change backends.
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var c BackendChange
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var lb *loadbalancer.LoadBalancer
+		if balancer != nil {
+			lb = balancer(c.Scope)
+		}
+		if lb == nil {
+			http.Error(w, fmt.Sprintf("no load balancer for %q", c.Scope), http.StatusNotFound)
+			return
+		}
+
+		var err error
+		switch r.Method {
+		case http.MethodPost:
+			if u, perr := url.Parse(c.URL); perr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				http.Error(w, fmt.Sprintf("invalid backend URL %q", c.URL), http.StatusBadRequest)
+				return
+			}
+			if c.State != "" && c.State != loadbalancer.StateEnabled && c.State != loadbalancer.StateDisabled {
+				http.Error(w, "a new backend must be enabled or disabled", http.StatusBadRequest)
+				return
+			}
+			_, err = lb.AddBackend(loadbalancer.BackendConfig{URL: c.URL, Weight: c.Weight, Down: c.State == loadbalancer.StateDisabled})
+		case http.MethodPatch:
+			if c.State == "" && c.Weight == 0 {
+				http.Error(w, "nothing to change: set state or weight", http.StatusBadRequest)
+				return
+			}
+			if c.State != "" {
+				err = lb.SetState(c.URL, c.State)
+			}
+			if err == nil && c.Weight != 0 {
+				err = lb.SetWeight(c.URL, c.Weight)
+			}
+		case http.MethodDelete:
+			if remove != nil {
+				err = remove(c.Scope, c.URL)
+			} else {
+				err = lb.RemoveBackend(c.URL)
+			}
+		}
+		switch {
+		case errors.Is(err, loadbalancer.ErrBackendNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, loadbalancer.ErrBackendExists), errors.Is(err, loadbalancer.ErrLastBackend):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if c.Persist {
+			if save == nil {
+				err = errors.New("saving to the config file is unavailable")
+			} else {
+				err = save(c.Scope)
+			}
+			if err != nil {
+				http.Error(w, "changed at runtime but not saved: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lb.Stats(c.Scope))
+	})
+}
+
 // NewLogsHandler returns an http.Handler for GET /api/logs.
 func NewLogsHandler(db *stats.DB) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -190,6 +267,20 @@ type Config struct {
 	TLSCert    string
 	TLSKey     string
 	ConfigPath string
+	// ConnStats reports current limit_conn counts; nil when unavailable.
+	ConnStats func() []security.ConnStats
+	// UpstreamStats reports the state of load-balanced backends; nil when
+	// unavailable.
+	UpstreamStats func() []loadbalancer.UpstreamStats
+	// Balancer returns the load balancer of a scope listed by UpstreamStats,
+	// or nil, for changing its backends at runtime; nil when unavailable.
+	Balancer func(scope string) *loadbalancer.LoadBalancer
+	// RemoveBackend takes a backend out of a scope listed by UpstreamStats;
+	// nil when unavailable.
+	RemoveBackend func(scope, url string) error
+	// SaveBackends writes the backends of a scope's load balancer to the
+	// config file; nil when unavailable.
+	SaveBackends func(scope string) error
 }
 
 // Server is a self-contained admin dashboard HTTP server.
@@ -218,6 +309,9 @@ func New(cfg Config, db *stats.DB, logbuf *logring.Buffer, reloadCh chan<- struc
     mux.Handle("/api/stats", NewStatsHandler(db))
     mux.Handle("/api/logs", NewLogsHandler(db))
     mux.Handle("/api/logs/stream", NewLogsStreamHandler(logbuf))
+    mux.Handle("/api/connections", NewConnectionsHandler(cfg.ConnStats))
+    mux.Handle("/api/upstreams", NewUpstreamsHandler(cfg.UpstreamStats))
+    mux.Handle("/api/upstreams/backends", NewBackendsHandler(cfg.Balancer, cfg.RemoveBackend, cfg.SaveBackends))
     mux.Handle("/api/config", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         switch r.Method {
         case http.MethodGet:
@@ -238,7 +332,7 @@ func New(cfg Config, db *stats.DB, logbuf *logring.Buffer, reloadCh chan<- struc
     }))
 
     // Pass the trigger function here as well
-    RegisterUIHandlers(mux, cfg.ConfigPath, db, triggerReload)
+    RegisterUIHandlers(mux, cfg.ConfigPath, db, triggerReload, cfg.ConnStats, cfg.UpstreamStats)
 
 	var handler http.Handler = middleware.Recovery(mux)
 
@@ -5,12 +5,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"tinyproxy/internal/dashboard"
 	"tinyproxy/internal/dashboard/stats"
+	"tinyproxy/internal/loadbalancer"
+	"tinyproxy/internal/server/security"
 )
 
 func mustHash(password string) []byte {
@@ -115,3 +118,143 @@ func TestLogsHandlerReturnsJSON(t *testing.T) {
 		t.Fatalf("want 200, got %d", rec.Code)
 	}
 }
+
+func TestConnectionsHandler(t *testing.T) {
+	conns := func() []security.ConnStats {
+		return []security.ConnStats{{Scope: "example.com", Active: 3, Conns: 4, PerVHost: 100, PerIP: 2, ConnsPerIP: 5,
+			TopIPs: []security.IPConns{{IP: "10.0.0.1", Active: 2, Conns: 3}, {IP: "10.0.0.2", Active: 1, Conns: 1}}}}
+	}
+	rec := httptest.NewRecorder()
+	dashboard.NewConnectionsHandler(conns).ServeHTTP(rec, httptest.NewRequest("GET", "/api/connections", nil))
+	var result []security.ConnStats
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(result) != 1 || result[0].Active != 3 || result[0].TopIPs[0].IP != "10.0.0.1" {
+		t.Errorf("result = %+v", result)
+	}
+
+	rec = httptest.NewRecorder()
+	dashboard.NewConnectionsHandler(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/api/connections", nil))
+	if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+		t.Errorf("without limits: body %q, want []", body)
+	}
+
+	mux := http.NewServeMux()
+	dashboard.RegisterUIHandlers(mux, "", testDB(t), func() {}, conns, nil)
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/overview", nil)
+	req.Header.Set("HX-Request", "true")
+	mux.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "10.0.0.1 (2/2, 3/5 open)") {
+		t.Errorf("overview does not show connection counts:\n%s", rec.Body.String())
+	}
+}
+
+func TestUpstreamsHandler(t *testing.T) {
+	ups := func() []loadbalancer.UpstreamStats {
+		return []loadbalancer.UpstreamStats{{Scope: "example.com", Backends: []loadbalancer.HealthStats{
+			{URL: "http://10.0.0.1:8080", Alive: true, ActiveConns: 4, Breaker: loadbalancer.BreakerClosed},
+			{URL: "http://10.0.0.2:8080", Alive: true, Breaker: loadbalancer.BreakerOpen},
+		}}}
+	}
+	rec := httptest.NewRecorder()
+	dashboard.NewUpstreamsHandler(ups).ServeHTTP(rec, httptest.NewRequest("GET", "/api/upstreams", nil))
+	var result []struct {
+		Scope    string
+		Backends []struct {
+			URL     string
+			Breaker string
+		}
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(result) != 1 || len(result[0].Backends) != 2 || result[0].Backends[1].Breaker != "open" {
+		t.Errorf("result = %+v", result)
+	}
+
+	rec = httptest.NewRecorder()
+	dashboard.NewUpstreamsHandler(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/api/upstreams", nil))
+	if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+		t.Errorf("without upstreams: body %q, want []", body)
+	}
+
+	mux := http.NewServeMux()
+	dashboard.RegisterUIHandlers(mux, "", testDB(t), func() {}, nil, ups)
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/overview", nil)
+	req.Header.Set("HX-Request", "true")
+	mux.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if !strings.Contains(body, "http://10.0.0.2:8080") || !strings.Contains(body, ">open<") {
+		t.Errorf("overview does not show upstream backends:\n%s", body)
+	}
+}
+
+func TestBackendsHandler(t *testing.T) {
+	lb, err := loadbalancer.New(loadbalancer.LBConfig{Backends: []loadbalancer.BackendConfig{{URL: "http://10.0.0.1:8080"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer := func(scope string) *loadbalancer.LoadBalancer {
+		if scope == "example.com" {
+			return lb
+		}
+		return nil
+	}
+	var saved []string
+	save := func(scope string) error {
+		saved = append(saved, scope)
+		return nil
+	}
+	h := dashboard.NewBackendsHandler(balancer, nil, save)
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/upstreams/backends", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, c := range []struct {
+		method, body string
+		code         int
+	}{
+		{"POST", `{"scope":"example.com","url":"http://10.0.0.2:8080","weight":2}`, http.StatusOK},
+		{"POST", `{"scope":"example.com","url":"http://10.0.0.2:8080"}`, http.StatusConflict},
+		{"POST", `{"scope":"example.com","url":"10.0.0.3:8080"}`, http.StatusBadRequest},
+		{"POST", `{"scope":"other.example.com","url":"http://10.0.0.3:8080"}`, http.StatusNotFound},
+		{"PATCH", `{"scope":"example.com","url":"http://10.0.0.1:8080","state":"draining"}`, http.StatusOK},
+		{"PATCH", `{"scope":"example.com","url":"http://10.0.0.1:8080","state":"paused"}`, http.StatusBadRequest},
+		{"PATCH", `{"scope":"example.com","url":"http://10.0.0.9:8080","weight":5}`, http.StatusNotFound},
+		{"PATCH", `{"scope":"example.com","url":"http://10.0.0.1:8080"}`, http.StatusBadRequest},
+		{"DELETE", `{"scope":"example.com","url":"http://10.0.0.1:8080","persist":true}`, http.StatusOK},
+		{"DELETE", `{"scope":"example.com","url":"http://10.0.0.2:8080"}`, http.StatusConflict},
+		{"GET", ``, http.StatusMethodNotAllowed},
+	} {
+		if rec := do(c.method, c.body); rec.Code != c.code {
+			t.Errorf("%s %s: status %d, want %d: %s", c.method, c.body, rec.Code, c.code, rec.Body.String())
+		}
+	}
+
+	rec := do("PATCH", `{"scope":"example.com","url":"http://10.0.0.2:8080","state":"disabled","persist":true}`)
+	var result loadbalancer.UpstreamStats
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(result.Backends) != 1 || result.Backends[0].State != "disabled" || result.Backends[0].Weight != 2 {
+		t.Errorf("result = %+v", result)
+	}
+	if len(saved) != 2 {
+		t.Errorf("saved %d times, want 2 for the persisted changes", len(saved))
+	}
+
+	req := httptest.NewRequest("POST", "/api/upstreams/backends", strings.NewReader(`{"scope":"example.com","url":"http://10.0.0.3:8080"}`))
+	req.Header.Set("Content-Type", "text/plain")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain body: status %d, want 415", rec.Code)
+	}
+}
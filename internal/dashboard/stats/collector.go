@@ -4,7 +4,7 @@ import "log"
 
 // RequestRecord holds per-request data recorded by the proxy.
 type RequestRecord struct {
-	TS      int64  // unix milliseconds
+	TS      int64 // unix milliseconds
 	VHost   string
 	Method  string
 	Path    string
@@ -12,6 +12,13 @@ type RequestRecord struct {
 	Latency int64 // microseconds
 	Bytes   int64
 	Remote  string
+	Country string // ISO country code from geoip; empty when unknown
+	ASN     uint
+	// WAF is "block" or "detect" when WAF rules matched the request, with
+	// the matching rule IDs in WAFRules.
+	WAF      string
+	WAFRules []int
+	Retries  int // times the request was retried on another backend
 }
 
 // Collector receives RequestRecords from the proxy handler via a buffered
@@ -3,6 +3,7 @@ package stats
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"log"
 	"time"
 
@@ -19,7 +20,12 @@ CREATE TABLE IF NOT EXISTS requests (
 	status  INTEGER NOT NULL,
 	latency INTEGER NOT NULL,
 	bytes   INTEGER NOT NULL,
-	remote  TEXT NOT NULL
+	remote  TEXT NOT NULL,
+	country TEXT NOT NULL DEFAULT '',
+	asn     INTEGER NOT NULL DEFAULT 0,
+	waf     TEXT NOT NULL DEFAULT '',
+	waf_rules TEXT NOT NULL DEFAULT '',
+	retries INTEGER NOT NULL DEFAULT 0
 );
 CREATE INDEX IF NOT EXISTS idx_requests_ts    ON requests(ts);
 CREATE INDEX IF NOT EXISTS idx_requests_vhost ON requests(vhost, ts);
@@ -33,6 +39,17 @@ CREATE TABLE IF NOT EXISTS log_lines (
 CREATE INDEX IF NOT EXISTS idx_log_lines_ts ON log_lines(ts);
 `
 
+// addedColumns are request columns added after the first release. Open adds
+// them to databases created before, since CREATE TABLE IF NOT EXISTS leaves
+// an existing table as it is.
+var addedColumns = []struct{ name, def string }{
+	{"country", "TEXT NOT NULL DEFAULT ''"},
+	{"asn", "INTEGER NOT NULL DEFAULT 0"},
+	{"waf", "TEXT NOT NULL DEFAULT ''"},
+	{"waf_rules", "TEXT NOT NULL DEFAULT ''"},
+	{"retries", "INTEGER NOT NULL DEFAULT 0"},
+}
+
 // DB wraps a SQLite database for stats and log persistence.
 type DB struct {
 	db *sql.DB
@@ -49,11 +66,38 @@ func Open(path string) (*DB, error) {
 		db.Close()
 		return nil, err
 	}
+	if err := addColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	d := &DB{db: db}
 	d.prune()
 	return d, nil
 }
 
+func addColumns(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('requests')`)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		have[name] = true
+	}
+	rows.Close()
+	for _, c := range addedColumns {
+		if have[c.name] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE requests ADD COLUMN ` + c.name + ` ` + c.def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Close closes the underlying database.
 func (d *DB) Close() error { return d.db.Close() }
 
@@ -105,14 +149,14 @@ func (d *DB) writeBatch(records []RequestRecord) error {
 	if err != nil {
 		return err
 	}
-	stmt, err := tx.Prepare(`INSERT INTO requests (ts,vhost,method,path,status,latency,bytes,remote) VALUES (?,?,?,?,?,?,?,?)`)
+	stmt, err := tx.Prepare(`INSERT INTO requests (ts,vhost,method,path,status,latency,bytes,remote,country,asn,waf,waf_rules,retries) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 	defer stmt.Close()
 	for _, r := range records {
-		if _, err := stmt.Exec(r.TS, r.VHost, r.Method, r.Path, r.Status, r.Latency, r.Bytes, r.Remote); err != nil {
+		if _, err := stmt.Exec(r.TS, r.VHost, r.Method, r.Path, r.Status, r.Latency, r.Bytes, r.Remote, r.Country, r.ASN, r.WAF, wafRules(r.WAFRules), r.Retries); err != nil {
 			tx.Rollback()
 			return err
 		}
@@ -138,6 +182,12 @@ type StatsResult struct {
 	TopPaths      []CountEntry     `json:"top_paths"`
 	StatusCodes   map[string]int64 `json:"status_codes"`
 	TopIPs        []CountEntry     `json:"top_ips"`
+	TopCountries  []CountEntry     `json:"top_countries"`
+	WAFBlocked    int64            `json:"waf_blocked"`
+	WAFDetected   int64            `json:"waf_detected"`
+	TopWAFRules   []CountEntry     `json:"top_waf_rules"`
+	Retries       int64            `json:"retries"`
+	Retried       int64            `json:"retried"` // requests retried at least once
 }
 
 // RPSPoint is one data point in the requests-per-second time series.
@@ -162,11 +212,21 @@ type LogLine struct {
 // WriteRequestDirect is a test helper that bypasses the batch writer.
 func (d *DB) WriteRequestDirect(r RequestRecord) error {
 	_, err := d.db.Exec(
-		`INSERT INTO requests (ts,vhost,method,path,status,latency,bytes,remote) VALUES (?,?,?,?,?,?,?,?)`,
-		r.TS, r.VHost, r.Method, r.Path, r.Status, r.Latency, r.Bytes, r.Remote)
+		`INSERT INTO requests (ts,vhost,method,path,status,latency,bytes,remote,country,asn,waf,waf_rules,retries) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		r.TS, r.VHost, r.Method, r.Path, r.Status, r.Latency, r.Bytes, r.Remote, r.Country, r.ASN, r.WAF, wafRules(r.WAFRules), r.Retries)
 	return err
 }
 
+// wafRules encodes rule IDs as a JSON array for the waf_rules column, which
+// QueryStats expands with json_each. No rules is the empty string.
+func wafRules(ids []int) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(ids)
+	return string(b)
+}
+
 // QueryStats returns aggregated traffic statistics for the given window.
 func (d *DB) QueryStats(window time.Duration) (*StatsResult, error) {
 	since := time.Now().Add(-window).UnixMilli()
@@ -226,6 +286,31 @@ func (d *DB) QueryStats(window time.Duration) (*StatsResult, error) {
 	if err != nil {
 		return nil, err
 	}
+	result.TopCountries, err = d.queryTopN(`SELECT country, COUNT(*) FROM requests WHERE ts >= ? AND country != '' GROUP BY country ORDER BY COUNT(*) DESC LIMIT 10`, since)
+	if err != nil {
+		return nil, err
+	}
+	row = d.db.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN waf = 'block' THEN 1 ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN waf = 'detect' THEN 1 ELSE 0 END), 0)
+		FROM requests WHERE ts >= ?`, since)
+	if err := row.Scan(&result.WAFBlocked, &result.WAFDetected); err != nil {
+		return nil, err
+	}
+	result.TopWAFRules, err = d.queryTopN(`
+		SELECT CAST(r.value AS TEXT), COUNT(*)
+		FROM requests, json_each(requests.waf_rules) AS r
+		WHERE ts >= ? AND waf_rules != ''
+		GROUP BY r.value ORDER BY COUNT(*) DESC, r.value LIMIT 10`, since)
+	if err != nil {
+		return nil, err
+	}
+	row = d.db.QueryRow(`
+		SELECT COALESCE(SUM(retries), 0), COALESCE(SUM(CASE WHEN retries > 0 THEN 1 ELSE 0 END), 0)
+		FROM requests WHERE ts >= ?`, since)
+	if err := row.Scan(&result.Retries, &result.Retried); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
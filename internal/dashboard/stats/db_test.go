@@ -2,7 +2,11 @@ package stats_test
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 	"tinyproxy/internal/dashboard/stats"
@@ -112,3 +116,92 @@ func TestQueryLogsFilters(t *testing.T) {
 		t.Fatalf("expected 1 error line, got %v", errors)
 	}
 }
+
+func TestQueryStatsTopCountries(t *testing.T) {
+	db := tempDB(t)
+	now := time.Now().UnixMilli()
+	for i, country := range []string{"DE", "DE", "US", ""} {
+		db.WriteRequestDirect(stats.RequestRecord{
+			TS: now, VHost: "a.com", Method: "GET", Path: "/", Status: 200,
+			Remote: fmt.Sprintf("10.0.0.%d", i), Country: country, ASN: 64500,
+		})
+	}
+	result, err := db.QueryStats(time.Hour)
+	if err != nil {
+		t.Fatalf("QueryStats: %v", err)
+	}
+	want := []stats.CountEntry{{Key: "DE", Count: 2}, {Key: "US", Count: 1}}
+	if !reflect.DeepEqual(result.TopCountries, want) {
+		t.Errorf("TopCountries = %+v, want %+v", result.TopCountries, want)
+	}
+}
+
+func TestDBOpenAddsColumnsToOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`CREATE TABLE requests (
+		id INTEGER PRIMARY KEY, ts INTEGER NOT NULL, vhost TEXT NOT NULL, method TEXT NOT NULL,
+		path TEXT NOT NULL, status INTEGER NOT NULL, latency INTEGER NOT NULL,
+		bytes INTEGER NOT NULL, remote TEXT NOT NULL)`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := stats.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if err := db.WriteRequestDirect(stats.RequestRecord{TS: time.Now().UnixMilli(), VHost: "a.com", Country: "FR"}); err != nil {
+		t.Fatalf("write after upgrade: %v", err)
+	}
+}
+
+func TestQueryStatsWAF(t *testing.T) {
+	db := tempDB(t)
+	now := time.Now().UnixMilli()
+	for _, r := range []stats.RequestRecord{
+		{WAF: "block", WAFRules: []int{942100, 942110}},
+		{WAF: "block", WAFRules: []int{942100}},
+		{WAF: "detect", WAFRules: []int{941100}},
+		{},
+	} {
+		r.TS, r.VHost, r.Method, r.Path, r.Status = now, "a.com", "GET", "/", 200
+		if err := db.WriteRequestDirect(r); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	result, err := db.QueryStats(time.Hour)
+	if err != nil {
+		t.Fatalf("QueryStats: %v", err)
+	}
+	if result.WAFBlocked != 2 || result.WAFDetected != 1 {
+		t.Errorf("WAFBlocked = %d, WAFDetected = %d, want 2 and 1", result.WAFBlocked, result.WAFDetected)
+	}
+	want := []stats.CountEntry{{Key: "942100", Count: 2}, {Key: "941100", Count: 1}, {Key: "942110", Count: 1}}
+	if !reflect.DeepEqual(result.TopWAFRules, want) {
+		t.Errorf("TopWAFRules = %+v, want %+v", result.TopWAFRules, want)
+	}
+}
+
+func TestQueryStatsRetries(t *testing.T) {
+	db := tempDB(t)
+	now := time.Now().UnixMilli()
+	for _, retries := range []int{0, 1, 2, 0} {
+		r := stats.RequestRecord{TS: now, VHost: "a.com", Method: "GET", Path: "/", Status: 200, Retries: retries}
+		if err := db.WriteRequestDirect(r); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	result, err := db.QueryStats(time.Hour)
+	if err != nil {
+		t.Fatalf("QueryStats: %v", err)
+	}
+	if result.Retries != 3 || result.Retried != 2 {
+		t.Errorf("Retries = %d, Retried = %d, want 3 and 2", result.Retries, result.Retried)
+	}
+}
@@ -12,7 +12,9 @@ import (
 	"time"
 
 	"tinyproxy/internal/dashboard/stats"
+	"tinyproxy/internal/loadbalancer"
 	"tinyproxy/internal/server/config"
+	"tinyproxy/internal/server/security"
 )
 
 //go:embed templates/*.html
@@ -34,6 +36,8 @@ type UIOverviewData struct {
 	BandwidthMB   float64
 	SVGPath       template.HTMLAttr
 	SVGArea       template.HTMLAttr
+	Connections   []security.ConnStats
+	Upstreams     []loadbalancer.UpstreamStats
 }
 
 type UITrafficData struct {
@@ -143,7 +147,7 @@ func buildOverviewData(db *stats.DB) (UIOverviewData, error) {
 	}, nil
 }
 
-func RegisterUIHandlers(mux *http.ServeMux, cfgPath string, db *stats.DB, sighupFn func()) {
+func RegisterUIHandlers(mux *http.ServeMux, cfgPath string, db *stats.DB, sighupFn func(), connStats func() []security.ConnStats, upstreamStats func() []loadbalancer.UpstreamStats) {
 	// Redirect root to overview
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
@@ -159,6 +163,12 @@ func RegisterUIHandlers(mux *http.ServeMux, cfgPath string, db *stats.DB, sighup
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		if connStats != nil {
+			data.Connections = connStats()
+		}
+		if upstreamStats != nil {
+			data.Upstreams = upstreamStats()
+		}
 		render(w, r, overviewTpl, "overview", data)
 	})
 
@@ -1,12 +1,16 @@
 package fastcgi
  
 import (
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strconv"
  
 	fcgi "github.com/tomasen/fcgi_client"
+
+	"tinyproxy/internal/server/errorpage"
 )
  
 // Handler connects to a FastCGI backend and proxies the request.
@@ -24,6 +28,12 @@ func Handler(w http.ResponseWriter, r *http.Request, pass string, root string, i
 		scriptName = "/" + index
 	}
  
+	// RemoteAddr holds the client address resolved through trusted proxies.
+	remoteAddr, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
 	env := map[string]string{
 		"SCRIPT_FILENAME": filepath.Join(root, scriptName),
 		"SCRIPT_NAME":     scriptName,
@@ -34,7 +44,8 @@ func Handler(w http.ResponseWriter, r *http.Request, pass string, root string, i
 		"SERVER_PROTOCOL": r.Proto,
 		"CONTENT_TYPE":    r.Header.Get("Content-Type"),
 		"CONTENT_LENGTH":  strconv.FormatInt(r.ContentLength, 10),
-		"REMOTE_ADDR":     r.RemoteAddr,
+		"REMOTE_ADDR":     remoteAddr,
+		"REMOTE_PORT":     remotePort,
 		"SERVER_NAME":     r.Host,
 		"HTTP_HOST":       r.Host,
 	}
@@ -46,6 +57,11 @@ func Handler(w http.ResponseWriter, r *http.Request, pass string, root string, i
 	default:
 		resp, err = fcgiClient.Get(env)
 	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		slog.Error("fastcgi request failed", "address", pass, "error", err)
 		http.Error(w, "FastCGI processing error", http.StatusBadGateway)
@@ -59,6 +75,7 @@ func Handler(w http.ResponseWriter, r *http.Request, pass string, root string, i
 			w.Header().Add(key, val)
 		}
 	}
+	errorpage.FromUpstream(r)
 	if resp.StatusCode != 0 && resp.StatusCode != http.StatusOK {
 		w.WriteHeader(resp.StatusCode)
 	}
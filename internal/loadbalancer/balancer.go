@@ -1,14 +1,20 @@
 package loadbalancer
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
@@ -19,11 +25,19 @@ var (
 // Backend represents a single upstream server.
 type Backend struct {
 	URL               string
-	Weight            int
+	weight            atomic.Int64
+	admin             atomic.Int32 // adminEnabled, adminDraining or adminDisabled
 	alive             atomic.Bool
 	activeConns       atomic.Int64
 	consecutiveFails  atomic.Int32
 	consecutivePasses atomic.Int32
+	ejectedUntil      atomic.Int64 // unix nanoseconds; 0 when never ejected
+	recoveredAt       atomic.Int64 // unix nanoseconds it was last given requests again
+	breaker           *breaker     // nil without a circuit breaker
+
+	mu        sync.Mutex  // guards the passive check state below
+	failTimes []time.Time // failed requests within the fail window
+	ejections int         // consecutive ejections, for the backoff
 }
 
 // IsAlive reports whether the backend is considered healthy.
@@ -32,6 +46,31 @@ func (b *Backend) IsAlive() bool { return b.alive.Load() }
 // SetAlive marks the backend as alive or dead.
 func (b *Backend) SetAlive(v bool) { b.alive.Store(v) }
 
+// Ejected reports whether the backend is ejected for failing requests.
+func (b *Backend) Ejected() bool { return time.Now().UnixNano() < b.ejectedUntil.Load() }
+
+// BreakerState returns the state of the backend's circuit breaker, or ""
+// without one.
+func (b *Backend) BreakerState() string {
+	if b.breaker == nil {
+		return ""
+	}
+	return b.breaker.State()
+}
+
+// Weight returns the backend's weight for the weighted strategy.
+func (b *Backend) Weight() int { return int(b.weight.Load()) }
+
+// markRecovered records that the backend is given requests again, which
+// starts its slow start.
+func (b *Backend) markRecovered() { b.recoveredAt.Store(time.Now().UnixNano()) }
+
+// available reports whether the backend may be given requests.
+func (b *Backend) available() bool {
+	return b.IsAlive() && !b.Ejected() && b.admin.Load() == adminEnabled &&
+		(b.breaker == nil || b.breaker.ready(time.Now()))
+}
+
 // ActiveConns returns the number of in-flight requests.
 func (b *Backend) ActiveConns() int64 { return b.activeConns.Load() }
 
@@ -43,6 +82,10 @@ type LoadBalancer struct {
 	cookieName  string
 	roundRobinIdx uint64
 	healthChecker *HealthChecker
+	passive       PassiveCheckConfig
+	breaker       BreakerConfig // for backends added at runtime
+	slowStart     time.Duration
+	budget        retryBudget
 }
 
 // New creates a LoadBalancer from the given config and starts health checking.
@@ -53,13 +96,8 @@ func New(cfg LBConfig) (*LoadBalancer, error) {
 
 	backends := make([]*Backend, len(cfg.Backends))
 	for i, bc := range cfg.Backends {
-		w := bc.Weight
-		if w <= 0 {
-			w = 1
-		}
-		b := &Backend{URL: bc.URL, Weight: w}
-		b.SetAlive(true)
-		backends[i] = b
+		backends[i] = newBackend(bc, cfg.Breaker)
+		backends[i].SetAlive(true)
 	}
 
 	cookieName := cfg.CookieName
@@ -71,6 +109,10 @@ func New(cfg LBConfig) (*LoadBalancer, error) {
 		backends:   backends,
 		strategy:   cfg.Strategy,
 		cookieName: cookieName,
+		passive:    cfg.Passive,
+		breaker:    cfg.Breaker,
+		slowStart:  cfg.SlowStart,
+		budget:     retryBudget{percent: cfg.Retry.Budget},
 	}
 
 	if cfg.HealthCheck.Enabled {
@@ -81,41 +123,74 @@ func New(cfg LBConfig) (*LoadBalancer, error) {
 	return lb, nil
 }
 
+func newBackend(bc BackendConfig, breaker BreakerConfig) *Backend {
+	b := &Backend{URL: bc.URL}
+	b.weight.Store(int64(max(bc.Weight, 1)))
+	if bc.Down {
+		b.admin.Store(adminDisabled)
+	}
+	if breaker.Enabled {
+		b.breaker = newBreaker(bc.URL, breaker)
+	}
+	return b
+}
+
 // Next selects the next backend based on the configured strategy.
 // For cookie-based affinity, it checks the request for an existing affinity cookie.
-func (lb *LoadBalancer) Next(r *http.Request) (*Backend, error) {
+// Backends in exclude, such as those a retried request already failed on,
+// are passed over. A call without exclude counts a request toward the
+// retry budget.
+func (lb *LoadBalancer) Next(r *http.Request, exclude ...*Backend) (*Backend, error) {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
+	if len(exclude) == 0 {
+		lb.budget.request()
+	}
 	alive := lb.aliveBackends()
-	if len(alive) == 0 {
-		return nil, ErrNoHealthyBackends
+	if len(exclude) > 0 {
+		alive = slices.DeleteFunc(alive, func(b *Backend) bool { return slices.Contains(exclude, b) })
+	}
+	for len(alive) > 0 {
+		b := lb.pick(r, alive)
+		// Another request may have taken the last probe since alive was
+		// built; pick again without b.
+		if b.breaker != nil && !b.breaker.admit(time.Now()) {
+			alive = slices.DeleteFunc(alive, func(o *Backend) bool { return o == b })
+			continue
+		}
+		return b, nil
 	}
+	return nil, ErrNoHealthyBackends
+}
 
+// pick chooses one of alive by the strategy.
+func (lb *LoadBalancer) pick(r *http.Request, alive []*Backend) *Backend {
 	// Cookie-based sticky sessions: check for existing affinity cookie
 	if lb.strategy == "cookie" || lb.strategy == "ip_hash" {
 		if cookie, err := r.Cookie(lb.cookieName); err == nil {
 			for _, b := range alive {
 				if hashBackend(b.URL) == cookie.Value {
-					return b, nil
+					return b
 				}
 			}
 			// Cookie pointed to a dead backend; fall through to re-assign
 		}
 	}
 
+	now := time.Now()
 	switch lb.strategy {
 	case "least_conn":
-		return lb.leastConn(alive), nil
+		return lb.leastConn(alive, now)
 	case "ip_hash":
-		return lb.ipHash(alive, clientIP(r)), nil
+		return lb.ipHash(alive, clientIP(r), now)
 	case "weighted":
-		return lb.weightedRoundRobin(alive), nil
+		return lb.weightedRoundRobin(alive, now)
 	case "cookie":
 		// First request (no cookie) → use round-robin to assign
-		return lb.roundRobin(alive), nil
+		return lb.roundRobin(alive, now)
 	default: // round_robin
-		return lb.roundRobin(alive), nil
+		return lb.roundRobin(alive, now)
 	}
 }
 
@@ -146,6 +221,137 @@ func (lb *LoadBalancer) MarkActive(b *Backend) {
 	b.activeConns.Add(1)
 }
 
+// Report records the outcome of a request to b: err when it got no
+// response, otherwise the response status and how long it took to arrive.
+// It feeds the passive health checks and the circuit breaker, which counts
+// 5xx responses as failures too. An outcome that is unknown, with neither
+// an error nor a status, or the client's own cancellation, says nothing
+// about the backend and is not recorded; a half-open probe left without one
+// is let through again once OpenTime has passed.
+func (lb *LoadBalancer) Report(b *Backend, err error, status int, latency time.Duration) {
+	if err == nil && status == 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		lb.ReportFailure(b)
+	}
+	if b.breaker != nil {
+		b.breaker.record(time.Now(), err != nil || status >= 500, latency)
+	}
+}
+
+// ReportFailure records a request to b that failed, such as one the backend
+// refused or dropped. A backend failing MaxFails requests within the fail
+// window is ejected for EjectTime, doubled each time it is ejected again
+// within MaxEjectTime of rejoining. With active health checks it rejoins
+// once they pass after the ejection; without, when the ejection ends. The
+// last available backend is never ejected, as failing requests are better
+// than none.
+func (lb *LoadBalancer) ReportFailure(b *Backend) {
+	pc := lb.passive
+	if pc.MaxFails <= 0 {
+		return
+	}
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Ejected() {
+		return
+	}
+	recent := b.failTimes[:0]
+	for _, t := range b.failTimes {
+		if now.Sub(t) < pc.FailWindow {
+			recent = append(recent, t)
+		}
+	}
+	b.failTimes = append(recent, now)
+	if len(b.failTimes) < pc.MaxFails || !lb.othersAvailable(b) {
+		return
+	}
+
+	if until := time.Unix(0, b.ejectedUntil.Load()); now.Sub(until) > pc.MaxEjectTime {
+		b.ejections = 0
+	}
+	d := pc.EjectTime
+	for i := 0; i < b.ejections && d < pc.MaxEjectTime; i++ {
+		d *= 2
+	}
+	d = min(d, pc.MaxEjectTime)
+	b.ejections++
+	b.failTimes = b.failTimes[:0]
+	b.ejectedUntil.Store(now.Add(d).UnixNano())
+	if lb.healthChecker != nil {
+		// Rejoin only once the active checks pass again.
+		b.consecutivePasses.Store(0)
+		b.SetAlive(false)
+	}
+	slog.Warn("backend ejected",
+		"url", b.URL,
+		"fails", pc.MaxFails,
+		"window", pc.FailWindow,
+		"duration", d,
+	)
+}
+
+// othersAvailable reports whether a backend other than b may be given
+// requests.
+func (lb *LoadBalancer) othersAvailable(b *Backend) bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, o := range lb.backends {
+		if o != b && o.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowRetry reports whether the retry budget has room for one more retry,
+// and if so takes it.
+func (lb *LoadBalancer) AllowRetry() bool {
+	return lb.budget.retry()
+}
+
+// retryBudgetWindow is the period retries are weighed against requests in.
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudget keeps retries within a percentage of requests, so a failing
+// upstream isn't sent several times its usual load. The first retry of a
+// window is always allowed, which matters only at low traffic.
+type retryBudget struct {
+	percent int
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	retries  int
+}
+
+func (rb *retryBudget) roll() {
+	if now := time.Now(); now.Sub(rb.start) >= retryBudgetWindow {
+		rb.start, rb.requests, rb.retries = now, 0, 0
+	}
+}
+
+func (rb *retryBudget) request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll()
+	rb.requests++
+}
+
+func (rb *retryBudget) retry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll()
+	if rb.retries*100 >= rb.requests*rb.percent {
+		return false
+	}
+	rb.retries++
+	return true
+}
+
 // Stop shuts down the health checker.
 func (lb *LoadBalancer) Stop() {
 	if lb.healthChecker != nil {
@@ -162,15 +368,47 @@ func (lb *LoadBalancer) Backends() []*Backend {
 	return out
 }
 
+// UpstreamStats is the state of the backends of one upstream, for the
+// dashboard.
+type UpstreamStats struct {
+	Scope    string        `json:"scope"`
+	Backends []HealthStats `json:"backends"`
+}
+
+// Stats returns the state of the backends, listed under scope.
+func (lb *LoadBalancer) Stats(scope string) UpstreamStats {
+	return UpstreamStats{Scope: scope, Backends: backendStats(lb.Backends())}
+}
+
 // --- Strategy implementations ---
 
-func (lb *LoadBalancer) roundRobin(alive []*Backend) *Backend {
+func (lb *LoadBalancer) roundRobin(alive []*Backend, now time.Time) *Backend {
+	// A rotation can't give a backend in slow start a growing share, so
+	// while one is ramping picks are random, weighted by the ramps.
+	if lb.ramping(alive, now) {
+		if b := weightedRandom(alive, func(b *Backend) float64 { return lb.ramp(b, now) }); b != nil {
+			return b
+		}
+	}
 	idx := atomic.AddUint64(&lb.roundRobinIdx, 1)
 	return alive[idx%uint64(len(alive))]
 }
 
-func (lb *LoadBalancer) leastConn(alive []*Backend) *Backend {
-	min := alive[0]
+func (lb *LoadBalancer) leastConn(alive []*Backend, now time.Time) *Backend {
+	// The in-flight requests of a backend in slow start count for more the
+	// earlier in its ramp it is.
+	var min *Backend
+	minLoad := math.Inf(1)
+	for _, b := range alive {
+		if load := float64(b.ActiveConns()+1) / lb.ramp(b, now); load < minLoad {
+			min, minLoad = b, load
+		}
+	}
+	if min != nil {
+		return min
+	}
+	// Every backend is at the very start of its ramp.
+	min = alive[0]
 	for _, b := range alive[1:] {
 		if b.ActiveConns() < min.ActiveConns() {
 			min = b
@@ -179,23 +417,42 @@ func (lb *LoadBalancer) leastConn(alive []*Backend) *Backend {
 	return min
 }
 
-func (lb *LoadBalancer) ipHash(alive []*Backend, ip string) *Backend {
+func (lb *LoadBalancer) ipHash(alive []*Backend, ip string, now time.Time) *Backend {
 	h := sha256.Sum256([]byte(ip))
 	idx := binary.BigEndian.Uint64(h[:8]) % uint64(len(alive))
-	return alive[idx]
+	b := alive[idx]
+	// A backend in slow start keeps the share of its clients its ramp
+	// allows, the same clients as the share grows; the others are hashed
+	// over the remaining backends.
+	if f := lb.ramp(b, now); f < 1 && len(alive) > 1 && math.Ldexp(float64(binary.BigEndian.Uint64(h[8:16])), -64) >= f {
+		return lb.ipHash(slices.Delete(slices.Clone(alive), int(idx), int(idx)+1), ip, now)
+	}
+	return b
 }
 
-func (lb *LoadBalancer) weightedRoundRobin(alive []*Backend) *Backend {
-	totalWeight := 0
-	for _, b := range alive {
-		totalWeight += b.Weight
-	}
-	if totalWeight == 0 {
+func (lb *LoadBalancer) weightedRoundRobin(alive []*Backend, now time.Time) *Backend {
+	b := weightedRandom(alive, func(b *Backend) float64 { return float64(b.Weight()) * lb.ramp(b, now) })
+	if b == nil {
 		return alive[0]
 	}
-	r := rand.Intn(totalWeight)
-	for _, b := range alive {
-		r -= b.Weight
+	return b
+}
+
+// weightedRandom picks one of alive with a chance in proportion to its
+// weight, or returns nil when the weights add up to 0.
+func weightedRandom(alive []*Backend, weight func(*Backend) float64) *Backend {
+	weights := make([]float64, len(alive))
+	total := 0.0
+	for i, b := range alive {
+		weights[i] = weight(b)
+		total += weights[i]
+	}
+	if total <= 0 {
+		return nil
+	}
+	r := rand.Float64() * total
+	for i, b := range alive {
+		r -= weights[i]
 		if r < 0 {
 			return b
 		}
@@ -203,10 +460,29 @@ func (lb *LoadBalancer) weightedRoundRobin(alive []*Backend) *Backend {
 	return alive[len(alive)-1]
 }
 
+// ramp returns how far into its slow start b is, from 0 when it was just
+// given requests again to 1 once slow start is over. A backend's slow start
+// begins when it recovers or is added, or when its ejection ends.
+func (lb *LoadBalancer) ramp(b *Backend, now time.Time) float64 {
+	if lb.slowStart <= 0 {
+		return 1
+	}
+	since := now.Sub(time.Unix(0, max(b.recoveredAt.Load(), b.ejectedUntil.Load())))
+	if since >= lb.slowStart {
+		return 1
+	}
+	return max(float64(since)/float64(lb.slowStart), 0)
+}
+
+// ramping reports whether any of alive is in slow start.
+func (lb *LoadBalancer) ramping(alive []*Backend, now time.Time) bool {
+	return lb.slowStart > 0 && slices.ContainsFunc(alive, func(b *Backend) bool { return lb.ramp(b, now) < 1 })
+}
+
 func (lb *LoadBalancer) aliveBackends() []*Backend {
 	alive := make([]*Backend, 0, len(lb.backends))
 	for _, b := range lb.backends {
-		if b.IsAlive() {
+		if b.available() {
 			alive = append(alive, b)
 		}
 	}
@@ -219,12 +495,12 @@ func hashBackend(url string) string {
 	return fmt.Sprintf("%x", h[:8])
 }
 
+// clientIP returns the client address of r without the port. RemoteAddr has
+// already been resolved through trusted proxies, so forwarding headers,
+// which any client can set, are not consulted.
 func clientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return xff
-	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
 	}
 	return r.RemoteAddr
 }
@@ -1,9 +1,14 @@
 package loadbalancer
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func newTestConfig(strategy string, urls ...string) LBConfig {
@@ -94,6 +99,37 @@ func TestIPHash(t *testing.T) {
 	}
 }
 
+func TestIPHash_ClientIPOnly(t *testing.T) {
+	cfg := newTestConfig("ip_hash", "http://a:1", "http://b:2", "http://c:3")
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.100:12345"
+	first, err := lb.Next(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new connection from the same client, or one claiming to forward
+	// someone else, must not move the client to another backend.
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.168.1.100:%d", 20000+i)
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		req.Header.Set("X-Real-IP", fmt.Sprintf("198.51.100.%d", i))
+		b, err := lb.Next(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.URL != first.URL {
+			t.Fatalf("request %d went to %s, want %s", i, b.URL, first.URL)
+		}
+	}
+}
+
 func TestCookieAffinity(t *testing.T) {
 	cfg := newTestConfig("cookie", "http://a:1", "http://b:2")
 	lb, err := New(cfg)
@@ -263,3 +299,574 @@ func TestCookieProperties(t *testing.T) {
 		t.Errorf("MaxAge = %d, want 86400", c.MaxAge)
 	}
 }
+
+func newPassiveTestLB(t *testing.T, urls ...string) *LoadBalancer {
+	t.Helper()
+	cfg := newTestConfig("round_robin", urls...)
+	cfg.Passive = PassiveCheckConfig{
+		MaxFails:     2,
+		FailWindow:   time.Second,
+		EjectTime:    50 * time.Millisecond,
+		MaxEjectTime: 150 * time.Millisecond,
+	}
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func servedBy(lb *LoadBalancer, n int) map[string]int {
+	seen := map[string]int{}
+	for i := 0; i < n; i++ {
+		b, err := lb.Next(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			continue
+		}
+		seen[b.URL]++
+	}
+	return seen
+}
+
+func TestPassiveEjection(t *testing.T) {
+	lb := newPassiveTestLB(t, "http://a:1", "http://b:2")
+	a := lb.Backends()[0]
+
+	lb.ReportFailure(a)
+	if a.Ejected() {
+		t.Fatal("ejected after one failure, want two")
+	}
+	lb.ReportFailure(a)
+	if !a.Ejected() {
+		t.Fatal("not ejected after two failures")
+	}
+	if seen := servedBy(lb, 4); seen["http://a:1"] != 0 {
+		t.Errorf("ejected backend got %d requests", seen["http://a:1"])
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if a.Ejected() {
+		t.Fatal("still ejected after the ejection time")
+	}
+	if seen := servedBy(lb, 4); seen["http://a:1"] != 2 {
+		t.Errorf("rejoined backend got %d of 4 requests, want 2", seen["http://a:1"])
+	}
+}
+
+func TestPassiveEjection_Backoff(t *testing.T) {
+	lb := newPassiveTestLB(t, "http://a:1", "http://b:2")
+	a := lb.Backends()[0]
+
+	// Each repeat ejection doubles, up to the maximum.
+	for _, want := range []time.Duration{50, 100, 150, 150} {
+		lb.ReportFailure(a)
+		lb.ReportFailure(a)
+		got := time.Until(time.Unix(0, a.ejectedUntil.Load()))
+		if want *= time.Millisecond; got > want || got < want-20*time.Millisecond {
+			t.Fatalf("ejected for %v, want %v", got, want)
+		}
+		a.ejectedUntil.Store(time.Now().UnixNano()) // end the ejection early
+	}
+}
+
+func TestPassiveEjection_Window(t *testing.T) {
+	lb := newPassiveTestLB(t, "http://a:1", "http://b:2")
+	lb.passive.FailWindow = 20 * time.Millisecond
+	a := lb.Backends()[0]
+
+	lb.ReportFailure(a)
+	time.Sleep(30 * time.Millisecond)
+	lb.ReportFailure(a)
+	if a.Ejected() {
+		t.Error("ejected for failures further apart than the window")
+	}
+}
+
+func TestPassiveEjection_LastBackend(t *testing.T) {
+	lb := newPassiveTestLB(t, "http://a:1", "http://b:2")
+	a, b := lb.Backends()[0], lb.Backends()[1]
+
+	lb.ReportFailure(a)
+	lb.ReportFailure(a)
+	lb.ReportFailure(b)
+	lb.ReportFailure(b)
+	if b.Ejected() {
+		t.Error("last available backend was ejected")
+	}
+	if _, err := lb.Next(httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Errorf("Next: %v", err)
+	}
+}
+
+func TestPassiveEjection_RejoinThroughHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := newTestConfig("round_robin", srv.URL, "http://b:2")
+	cfg.HealthCheck = HealthCheckConfig{
+		Enabled:       true,
+		Path:          "/",
+		Interval:      10 * time.Millisecond,
+		Timeout:       5 * time.Millisecond,
+		FailThreshold: 100,
+		PassThreshold: 1,
+	}
+	cfg.Passive = PassiveCheckConfig{MaxFails: 1, FailWindow: time.Second, EjectTime: 30 * time.Millisecond, MaxEjectTime: time.Second}
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Stop()
+	a := lb.Backends()[0]
+
+	lb.ReportFailure(a)
+	// The ejection ends, but the backend stays out while its probes fail.
+	time.Sleep(60 * time.Millisecond)
+	if a.IsAlive() {
+		t.Fatal("rejoined while failing health checks")
+	}
+	healthy.Store(true)
+	deadline := time.Now().Add(time.Second)
+	for !a.IsAlive() {
+		if time.Now().After(deadline) {
+			t.Fatal("did not rejoin once health checks passed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNextExclude(t *testing.T) {
+	lb, err := New(newTestConfig("round_robin", "http://a:1", "http://b:2", "http://c:3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := lb.Backends()
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 6; i++ {
+		b, err := lb.Next(req, backends[0], backends[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != backends[1] {
+			t.Fatalf("Next excluding a and c = %s", b.URL)
+		}
+	}
+	if _, err := lb.Next(req, backends...); err != ErrNoHealthyBackends {
+		t.Errorf("Next excluding all: err = %v, want ErrNoHealthyBackends", err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	cfg := newTestConfig("round_robin", "http://a:1", "http://b:2")
+	cfg.Retry.Budget = 20
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	// The first retry is allowed even for a single request.
+	lb.Next(req)
+	if !lb.AllowRetry() {
+		t.Fatal("first retry refused")
+	}
+	if lb.AllowRetry() {
+		t.Fatal("second retry for one request allowed")
+	}
+	// Retries between requests don't count as requests.
+	for i := 0; i < 9; i++ {
+		lb.Next(req)
+		lb.Next(req, lb.Backends()[0])
+	}
+	if !lb.AllowRetry() {
+		t.Error("retry refused at 1 in 10 requests")
+	}
+	if lb.AllowRetry() {
+		t.Error("retry allowed beyond 20% of requests")
+	}
+}
+
+func newBreakerTestLB(t *testing.T, bc BreakerConfig, urls ...string) *LoadBalancer {
+	t.Helper()
+	cfg := newTestConfig("round_robin", urls...)
+	cfg.Breaker = bc
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func testBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Enabled:          true,
+		Window:           time.Second,
+		MinRequests:      4,
+		ErrorRate:        50,
+		SlowRate:         50,
+		OpenTime:         50 * time.Millisecond,
+		HalfOpenRequests: 2,
+	}
+}
+
+func TestCircuitBreaker_ErrorRate(t *testing.T) {
+	lb := newBreakerTestLB(t, testBreakerConfig(), "http://a:1", "http://b:2")
+	a := lb.Backends()[0]
+
+	lb.Report(a, nil, 503, time.Millisecond)
+	lb.Report(a, fmt.Errorf("connection refused"), 0, time.Millisecond)
+	lb.Report(a, nil, 200, time.Millisecond)
+	if got := a.BreakerState(); got != BreakerClosed {
+		t.Fatalf("state after 3 requests = %s, want closed below min_requests", got)
+	}
+	lb.Report(a, nil, 200, time.Millisecond)
+	if got := a.BreakerState(); got != BreakerOpen {
+		t.Fatalf("state after 2 of 4 failed = %s, want open", got)
+	}
+	if seen := servedBy(lb, 4); seen["http://a:1"] != 0 {
+		t.Errorf("open backend got %d requests", seen["http://a:1"])
+	}
+}
+
+func TestCircuitBreaker_Latency(t *testing.T) {
+	bc := testBreakerConfig()
+	bc.ErrorRate = 0
+	bc.Latency = 100 * time.Millisecond
+	lb := newBreakerTestLB(t, bc, "http://a:1", "http://b:2")
+	a := lb.Backends()[0]
+
+	for i := 0; i < 4; i++ {
+		lb.Report(a, nil, 500, time.Millisecond) // error_rate is off
+	}
+	if got := a.BreakerState(); got != BreakerClosed {
+		t.Fatalf("state after fast failures = %s, want closed", got)
+	}
+	lb.Report(a, nil, 200, 200*time.Millisecond)
+	lb.Report(a, nil, 200, 150*time.Millisecond)
+	lb.Report(a, nil, 200, 100*time.Millisecond)
+	if got := a.BreakerState(); got != BreakerClosed {
+		t.Fatalf("state after 3 of 7 slow = %s, want closed", got)
+	}
+	lb.Report(a, nil, 200, time.Second)
+	if got := a.BreakerState(); got != BreakerOpen {
+		t.Errorf("state after 4 of 8 slow = %s, want open", got)
+	}
+}
+
+func TestCircuitBreaker_HalfOpen(t *testing.T) {
+	lb := newBreakerTestLB(t, testBreakerConfig(), "http://a:1", "http://b:2")
+	a := lb.Backends()[0]
+	for i := 0; i < 4; i++ {
+		lb.Report(a, nil, 502, time.Millisecond)
+	}
+	if got := a.BreakerState(); got != BreakerOpen {
+		t.Fatalf("state = %s, want open", got)
+	}
+
+	// After the open time, only HalfOpenRequests probes get through.
+	time.Sleep(60 * time.Millisecond)
+	if seen := servedBy(lb, 10); seen["http://a:1"] != 2 {
+		t.Errorf("half-open backend got %d requests, want 2 probes", seen["http://a:1"])
+	}
+	if got := a.BreakerState(); got != BreakerHalfOpen {
+		t.Fatalf("state = %s, want half-open", got)
+	}
+	lb.Report(a, nil, 200, time.Millisecond)
+	if got := a.BreakerState(); got != BreakerHalfOpen {
+		t.Fatalf("state after one probe passed = %s, want half-open", got)
+	}
+	lb.Report(a, nil, 200, time.Millisecond)
+	if got := a.BreakerState(); got != BreakerClosed {
+		t.Fatalf("state after both probes passed = %s, want closed", got)
+	}
+	// Closing starts the window over.
+	lb.Report(a, nil, 500, time.Millisecond)
+	if got := a.BreakerState(); got != BreakerClosed {
+		t.Errorf("state after one failure once closed = %s, want closed", got)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenConcurrent(t *testing.T) {
+	lb := newBreakerTestLB(t, testBreakerConfig(), "http://a:1")
+	a := lb.Backends()[0]
+	for i := 0; i < 4; i++ {
+		lb.Report(a, nil, 502, time.Millisecond)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// Requests racing for the probes get no more than HalfOpenRequests.
+	req := httptest.NewRequest("GET", "/", nil)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var probes atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := lb.Next(req); err == nil {
+				probes.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := probes.Load(); n != 2 {
+		t.Errorf("%d probes sent, want 2", n)
+	}
+}
+
+func TestCircuitBreaker_UnknownOutcome(t *testing.T) {
+	lb := newBreakerTestLB(t, testBreakerConfig(), "http://a:1", "http://b:2")
+	a := lb.Backends()[0]
+	for i := 0; i < 4; i++ {
+		lb.Report(a, nil, 502, time.Millisecond)
+	}
+	time.Sleep(60 * time.Millisecond)
+	servedBy(lb, 4)
+
+	// Probes the client gave up on neither close nor reopen the breaker.
+	lb.Report(a, nil, 0, time.Millisecond)
+	lb.Report(a, context.Canceled, 0, time.Millisecond)
+	if got := a.BreakerState(); got != BreakerHalfOpen {
+		t.Fatalf("state after unknown outcomes = %s, want half-open", got)
+	}
+	if seen := servedBy(lb, 4); seen["http://a:1"] != 0 {
+		t.Errorf("half-open backend got %d requests with its probes out", seen["http://a:1"])
+	}
+	// Once the open time has passed again, new probes go out.
+	time.Sleep(60 * time.Millisecond)
+	if seen := servedBy(lb, 10); seen["http://a:1"] != 2 {
+		t.Errorf("re-armed backend got %d requests, want 2 probes", seen["http://a:1"])
+	}
+}
+
+func TestCircuitBreaker_Reopen(t *testing.T) {
+	lb := newBreakerTestLB(t, testBreakerConfig(), "http://a:1", "http://b:2")
+	a := lb.Backends()[0]
+	for i := 0; i < 4; i++ {
+		lb.Report(a, nil, 502, time.Millisecond)
+	}
+	time.Sleep(60 * time.Millisecond)
+	servedBy(lb, 4)
+	lb.Report(a, fmt.Errorf("connection refused"), 0, time.Millisecond)
+	if got := a.BreakerState(); got != BreakerOpen {
+		t.Fatalf("state after a failed probe = %s, want open", got)
+	}
+	if seen := servedBy(lb, 4); seen["http://a:1"] != 0 {
+		t.Errorf("reopened backend got %d requests", seen["http://a:1"])
+	}
+	stats := lb.Stats("example.com")
+	if stats.Scope != "example.com" || stats.Backends[0].Breaker != BreakerOpen || stats.Backends[1].Breaker != BreakerClosed {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
+
+func TestBackendStates(t *testing.T) {
+	lb, err := New(newTestConfig("round_robin", "http://a:1", "http://b:2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := lb.Backends()[0]
+	lb.MarkActive(a)
+
+	for _, state := range []string{StateDraining, StateDisabled} {
+		if err := lb.SetState("http://a:1", state); err != nil {
+			t.Fatal(err)
+		}
+		if got := a.State(); got != state {
+			t.Errorf("State = %s, want %s", got, state)
+		}
+		if seen := servedBy(lb, 4); seen["http://a:1"] != 0 {
+			t.Errorf("%s backend got %d requests", state, seen["http://a:1"])
+		}
+	}
+	if a.ActiveConns() != 1 {
+		t.Errorf("in-flight request lost: ActiveConns = %d", a.ActiveConns())
+	}
+	if err := lb.SetState("http://a:1", StateEnabled); err != nil {
+		t.Fatal(err)
+	}
+	if seen := servedBy(lb, 4); seen["http://a:1"] != 2 {
+		t.Errorf("enabled backend got %d of 4 requests, want 2", seen["http://a:1"])
+	}
+
+	if err := lb.SetState("http://a:1", "paused"); err != ErrInvalidState {
+		t.Errorf("SetState(paused) = %v, want ErrInvalidState", err)
+	}
+	if err := lb.SetState("http://c:3", StateDraining); err != ErrBackendNotFound {
+		t.Errorf("SetState of unknown backend = %v, want ErrBackendNotFound", err)
+	}
+}
+
+func TestAddRemoveBackend(t *testing.T) {
+	lb, err := New(newTestConfig("weighted", "http://a:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.AddBackend(BackendConfig{URL: "http://a:1"}); err != ErrBackendExists {
+		t.Errorf("adding a duplicate = %v, want ErrBackendExists", err)
+	}
+	if _, err := lb.AddBackend(BackendConfig{URL: "http://b:2", Weight: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if seen := servedBy(lb, 400); seen["http://b:2"] < 250 {
+		t.Errorf("added backend of weight 3 got %d of 400 requests", seen["http://b:2"])
+	}
+	if err := lb.SetWeight("http://b:2", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.AddBackend(BackendConfig{URL: "http://c:3", Down: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := []BackendConfig{{URL: "http://a:1", Weight: 1}, {URL: "http://b:2", Weight: 1}, {URL: "http://c:3", Weight: 1, Down: true}}
+	if got := lb.BackendConfigs(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("BackendConfigs = %+v, want %+v", got, want)
+	}
+
+	before := lb.Backends()
+	if err := lb.RemoveBackend("http://a:1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 3 || before[0].URL != "http://a:1" {
+		t.Error("RemoveBackend changed an earlier snapshot")
+	}
+	if seen := servedBy(lb, 10); seen["http://a:1"] != 0 || seen["http://b:2"] != 10 {
+		t.Errorf("after removing a: served %v", seen)
+	}
+	if err := lb.RemoveBackend("http://a:1"); err != ErrBackendNotFound {
+		t.Errorf("removing twice = %v, want ErrBackendNotFound", err)
+	}
+	lb.RemoveBackend("http://c:3")
+	if err := lb.RemoveBackend("http://b:2"); err != ErrLastBackend {
+		t.Errorf("removing the last backend = %v, want ErrLastBackend", err)
+	}
+}
+
+func TestAddBackend_HealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := newTestConfig("round_robin", "http://a:1")
+	cfg.HealthCheck = HealthCheckConfig{
+		Enabled:       true,
+		Path:          "/",
+		Interval:      20 * time.Millisecond,
+		Timeout:       time.Second,
+		FailThreshold: 1,
+		PassThreshold: 1,
+	}
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Stop()
+
+	// A backend added with health checks gets requests once they pass.
+	b, err := lb.AddBackend(BackendConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if b.IsAlive() {
+		t.Fatal("added backend alive before passing a health check")
+	}
+	healthy.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if !b.IsAlive() {
+		t.Error("added backend not alive after passing its health checks")
+	}
+}
+
+func TestSlowStart_Ramp(t *testing.T) {
+	cfg := newTestConfig("round_robin", "http://a:1")
+	cfg.SlowStart = 10 * time.Second
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := lb.Backends()[0]
+	now := time.Now()
+	if got := lb.ramp(a, now); got != 1 {
+		t.Errorf("ramp of a backend in service from the start = %v, want 1", got)
+	}
+
+	hc := NewHealthChecker(lb.Backends(), HealthCheckConfig{PassThreshold: 1})
+	a.SetAlive(false)
+	hc.recordPass(a)
+	now = time.Unix(0, a.recoveredAt.Load())
+	for _, c := range []struct {
+		after time.Duration
+		want  float64
+	}{
+		{0, 0},
+		{2500 * time.Millisecond, 0.25},
+		{5 * time.Second, 0.5},
+		{10 * time.Second, 1},
+		{time.Minute, 1},
+	} {
+		if got := lb.ramp(a, now.Add(c.after)); got != c.want {
+			t.Errorf("ramp %v after recovering = %v, want %v", c.after, got, c.want)
+		}
+	}
+
+	// The end of an ejection starts it too.
+	a.ejectedUntil.Store(now.Add(time.Minute).UnixNano())
+	if got := lb.ramp(a, now.Add(time.Minute+time.Second)); got != 0.1 {
+		t.Errorf("ramp 1s after the ejection ended = %v, want 0.1", got)
+	}
+}
+
+func TestSlowStart_Strategies(t *testing.T) {
+	// b is a quarter of the way into its ramp, so it gets a quarter of its
+	// full share: with a of weight 1 and b of weight 1, a fifth of the
+	// requests, except with ip_hash, which hashes a quarter of b's half of
+	// the clients to it.
+	for _, c := range []struct {
+		strategy string
+		want     float64
+	}{
+		{"round_robin", 0.2},
+		{"cookie", 0.2},
+		{"weighted", 0.2},
+		{"least_conn", 0.2},
+		{"ip_hash", 0.125},
+	} {
+		cfg := newTestConfig(c.strategy, "http://a:1", "http://b:2")
+		cfg.SlowStart = time.Hour
+		lb, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := lb.Backends()[1]
+		b.recoveredAt.Store(time.Now().Add(-15 * time.Minute).UnixNano())
+
+		const n = 4000
+		got := 0
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = fmt.Sprintf("10.%d.%d.1:1234", i/256, i%256)
+			picked, err := lb.Next(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb.MarkActive(picked) // requests pile up, for least_conn
+			if picked == b {
+				got++
+			}
+		}
+		if share := float64(got) / n; share < c.want-0.03 || share > c.want+0.03 {
+			t.Errorf("%s: backend in slow start got %.3f of requests, want %.3f", c.strategy, share, c.want)
+		}
+	}
+}
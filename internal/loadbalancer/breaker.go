@@ -0,0 +1,172 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"    // requests flow; outcomes are counted
+	BreakerOpen     = "open"      // no requests until OpenTime has passed
+	BreakerHalfOpen = "half-open" // a few probe requests decide
+)
+
+// breakerBuckets is how many parts the rolling window is counted in.
+const breakerBuckets = 10
+
+// breaker is the circuit breaker of one backend. Closed, it counts failed
+// and slow requests over a rolling window and opens when either share
+// reaches its limit. Open, it lets no requests through until OpenTime has
+// passed, then half-opens: HalfOpenRequests probes are let through, and it
+// closes if all of them succeed or opens again if one fails.
+type breaker struct {
+	url string
+	cfg BreakerConfig
+
+	mu          sync.Mutex
+	state       string
+	buckets     [breakerBuckets]breakerBucket
+	cur         int
+	bucketStart time.Time // start of buckets[cur]
+	since       time.Time // when the state was entered
+	probes      int       // probes let through while half-open
+	passed      int       // probes that succeeded
+}
+
+type breakerBucket struct {
+	requests, failures, slow int
+}
+
+func newBreaker(url string, cfg BreakerConfig) *breaker {
+	return &breaker{url: url, cfg: cfg, state: BreakerClosed}
+}
+
+// State returns the breaker's state.
+func (cb *breaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// ready reports whether a request may be sent now, without taking a probe.
+func (cb *breaker) ready(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		return now.Sub(cb.since) >= cb.cfg.OpenTime
+	case BreakerHalfOpen:
+		// Probes whose outcome never came don't hold it half-open forever.
+		return cb.probes < cb.cfg.HalfOpenRequests || now.Sub(cb.since) >= cb.cfg.OpenTime
+	}
+	return true
+}
+
+// admit decides whether a request may be sent now and, if so, takes it:
+// once the open period is over it half-opens, and half-open it counts a
+// probe. Deciding and taking under one lock keeps concurrent requests from
+// sending more than HalfOpenRequests probes.
+func (cb *breaker) admit(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		if now.Sub(cb.since) < cb.cfg.OpenTime {
+			return false
+		}
+		cb.setState(BreakerHalfOpen, now)
+	case BreakerHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenRequests {
+			if now.Sub(cb.since) < cb.cfg.OpenTime {
+				return false
+			}
+			cb.setState(BreakerHalfOpen, now)
+		}
+	default:
+		return true
+	}
+	cb.probes++
+	return true
+}
+
+// record counts the outcome of a request.
+func (cb *breaker) record(now time.Time, failed bool, latency time.Duration) {
+	slow := cb.cfg.Latency > 0 && latency >= cb.cfg.Latency
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerHalfOpen:
+		if failed || slow {
+			cb.setState(BreakerOpen, now)
+			return
+		}
+		if cb.passed++; cb.passed >= cb.cfg.HalfOpenRequests {
+			cb.setState(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		cb.rotate(now)
+		b := &cb.buckets[cb.cur]
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+		var total breakerBucket
+		for _, b := range cb.buckets {
+			total.requests += b.requests
+			total.failures += b.failures
+			total.slow += b.slow
+		}
+		if total.requests < cb.cfg.MinRequests {
+			return
+		}
+		if cb.cfg.ErrorRate > 0 && total.failures*100 >= cb.cfg.ErrorRate*total.requests ||
+			cb.cfg.Latency > 0 && total.slow*100 >= cb.cfg.SlowRate*total.requests {
+			cb.setState(BreakerOpen, now)
+			slog.Warn("circuit breaker opened",
+				"url", cb.url,
+				"requests", total.requests,
+				"failures", total.failures,
+				"slow", total.slow,
+				"window", cb.cfg.Window,
+			)
+		}
+	}
+	// Requests finishing while it is open have no say.
+}
+
+func (cb *breaker) setState(state string, now time.Time) {
+	switch {
+	case state == BreakerOpen && cb.state == BreakerHalfOpen:
+		slog.Warn("circuit breaker reopened", "url", cb.url)
+	case state == BreakerClosed:
+		slog.Info("circuit breaker closed", "url", cb.url)
+		cb.buckets = [breakerBuckets]breakerBucket{}
+	}
+	cb.state = state
+	cb.since = now
+	cb.probes, cb.passed = 0, 0
+}
+
+// rotate moves to the bucket now falls in, clearing those passed over.
+func (cb *breaker) rotate(now time.Time) {
+	width := cb.cfg.Window / breakerBuckets
+	if width <= 0 || cb.bucketStart.IsZero() {
+		cb.bucketStart = now
+		return
+	}
+	for i := 0; now.Sub(cb.bucketStart) >= width; i++ {
+		if i == breakerBuckets {
+			cb.buckets = [breakerBuckets]breakerBucket{}
+			cb.bucketStart = now
+			return
+		}
+		cb.cur = (cb.cur + 1) % breakerBuckets
+		cb.buckets[cb.cur] = breakerBucket{}
+		cb.bucketStart = cb.bucketStart.Add(width)
+	}
+}
@@ -8,12 +8,17 @@ type LBConfig struct {
 	Strategy    string // "round_robin", "least_conn", "ip_hash", "weighted", "cookie"
 	CookieName  string // session-affinity cookie name (default "_tp_backend")
 	HealthCheck HealthCheckConfig
+	Passive     PassiveCheckConfig
+	Retry       RetryConfig
+	Breaker     BreakerConfig
+	SlowStart   time.Duration // ramp of a backend given requests again; 0 disables
 }
 
 // BackendConfig describes a single upstream backend server.
 type BackendConfig struct {
 	URL    string
-	Weight int // relative weight for weighted round-robin (default 1)
+	Weight int  // relative weight for weighted round-robin (default 1)
+	Down   bool // disabled: given no requests until enabled at runtime
 }
 
 // HealthCheckConfig controls active health probing of backends.
@@ -26,6 +31,62 @@ type HealthCheckConfig struct {
 	PassThreshold int           // consecutive passes before marking up (default 2)
 }
 
+// PassiveCheckConfig controls ejection of backends that fail real requests.
+type PassiveCheckConfig struct {
+	MaxFails     int           // failed requests within FailWindow that eject a backend; 0 disables
+	FailWindow   time.Duration // window failures are counted in (default 30s)
+	EjectTime    time.Duration // first ejection period, doubled on each repeat (default 10s)
+	MaxEjectTime time.Duration // longest ejection period (default 5m)
+}
+
+// RetryConfig controls retrying failed requests on other backends.
+type RetryConfig struct {
+	Attempts     int      // retries after the first try; 0 disables
+	ConnectError bool     // retry when the backend can't be connected to
+	Statuses     []int    // backend response statuses that are retried
+	Methods      []string // request methods that are retried
+	Budget       int      // retries as a percentage of requests
+	BodyLimit    int64    // largest request body buffered for replay
+}
+
+// DefaultRetryConfig returns the settings of a retry block before its
+// directives apply.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		Attempts:     1,
+		ConnectError: true,
+		Methods:      []string{"GET", "HEAD"},
+		Budget:       20,
+		BodyLimit:    64 << 10,
+	}
+}
+
+// BreakerConfig controls the circuit breakers of an upstream's backends.
+type BreakerConfig struct {
+	Enabled          bool
+	Window           time.Duration // rolling window outcomes are counted over
+	MinRequests      int           // requests in the window before it can open
+	ErrorRate        int           // percentage of failed requests that opens it; 0 disables
+	Latency          time.Duration // requests slower than this are slow; 0 disables
+	SlowRate         int           // percentage of slow requests that opens it
+	OpenTime         time.Duration // how long it stays open before probing
+	HalfOpenRequests int           // probe requests let through half-open
+}
+
+// DefaultBreakerConfig returns the settings of a circuit_breaker block
+// before its directives apply.
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Enabled:          true,
+		Window:           10 * time.Second,
+		MinRequests:      20,
+		ErrorRate:        50,
+		SlowRate:         50,
+		OpenTime:         30 * time.Second,
+		HalfOpenRequests: 3,
+	}
+}
+
 // DefaultLBConfig returns an LBConfig with sensible defaults.
 func DefaultLBConfig() LBConfig {
 	return LBConfig{
@@ -39,5 +100,11 @@ func DefaultLBConfig() LBConfig {
 			FailThreshold: 3,
 			PassThreshold: 2,
 		},
+		Passive: PassiveCheckConfig{
+			MaxFails:     3,
+			FailWindow:   30 * time.Second,
+			EjectTime:    10 * time.Second,
+			MaxEjectTime: 5 * time.Minute,
+		},
 	}
 }
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 )
 
 // HealthChecker periodically probes backends and updates their alive status.
 type HealthChecker struct {
+	mu        sync.Mutex // guards backends, which change at runtime
 	backends  []*Backend
 	cfg       HealthCheckConfig
 	client    *http.Client
@@ -64,11 +66,25 @@ func (hc *HealthChecker) loop() {
 }
 
 func (hc *HealthChecker) checkAll() {
-	for _, b := range hc.backends {
+	for _, b := range hc.snapshot() {
 		go hc.check(b)
 	}
 }
 
+func (hc *HealthChecker) snapshot() []*Backend {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.backends
+}
+
+// setBackends replaces the backends to probe. The slice must not be
+// modified afterwards.
+func (hc *HealthChecker) setBackends(backends []*Backend) {
+	hc.mu.Lock()
+	hc.backends = backends
+	hc.mu.Unlock()
+}
+
 func (hc *HealthChecker) check(b *Backend) {
 	url := fmt.Sprintf("%s%s", b.URL, hc.cfg.Path)
 	resp, err := hc.client.Get(url)
@@ -89,7 +105,9 @@ func (hc *HealthChecker) recordPass(b *Backend) {
 	b.consecutiveFails.Store(0)
 	passes := b.consecutivePasses.Add(1)
 
-	if !b.IsAlive() && int(passes) >= hc.cfg.PassThreshold {
+	// Ejected backends rejoin once their ejection is over.
+	if !b.IsAlive() && int(passes) >= hc.cfg.PassThreshold && !b.Ejected() {
+		b.markRecovered()
 		b.SetAlive(true)
 		slog.Info("backend recovered", "url", b.URL, "passes", passes)
 	}
@@ -111,20 +129,32 @@ func (hc *HealthChecker) recordFail(b *Backend, err error) {
 
 // Stats returns a snapshot of backend health for observability.
 type HealthStats struct {
-	URL              string
-	Alive            bool
-	ActiveConns      int64
-	ConsecutiveFails int32
+	URL              string `json:"url"`
+	Alive            bool   `json:"alive"`
+	ActiveConns      int64  `json:"active_conns"`
+	ConsecutiveFails int32  `json:"consecutive_fails"`
+	Ejected          bool   `json:"ejected"`
+	Breaker          string `json:"breaker,omitempty"` // circuit breaker state; empty without one
+	Weight           int    `json:"weight"`
+	State            string `json:"state"` // enabled, draining or disabled
 }
 
 func (hc *HealthChecker) Stats() []HealthStats {
-	stats := make([]HealthStats, len(hc.backends))
-	for i, b := range hc.backends {
+	return backendStats(hc.snapshot())
+}
+
+func backendStats(backends []*Backend) []HealthStats {
+	stats := make([]HealthStats, len(backends))
+	for i, b := range backends {
 		stats[i] = HealthStats{
 			URL:              b.URL,
 			Alive:            b.IsAlive(),
 			ActiveConns:      b.ActiveConns(),
 			ConsecutiveFails: b.consecutiveFails.Load(),
+			Ejected:          b.Ejected(),
+			Breaker:          b.BreakerState(),
+			Weight:           b.Weight(),
+			State:            b.State(),
 		}
 	}
 	return stats
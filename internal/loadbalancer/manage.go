@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+)
+
+// Backend states set at runtime.
+const (
+	StateEnabled  = "enabled"  // given requests
+	StateDraining = "draining" // given no new requests while in-flight ones finish
+	StateDisabled = "disabled" // given no requests
+)
+
+const (
+	adminEnabled int32 = iota
+	adminDraining
+	adminDisabled
+)
+
+var adminStates = [...]string{adminEnabled: StateEnabled, adminDraining: StateDraining, adminDisabled: StateDisabled}
+
+var (
+	ErrBackendExists   = errors.New("backend already exists")
+	ErrBackendNotFound = errors.New("no such backend")
+	ErrLastBackend     = errors.New("cannot remove the last backend")
+	ErrInvalidState    = errors.New("invalid backend state: must be enabled, draining or disabled")
+)
+
+// State returns the backend's runtime state: StateEnabled, StateDraining
+// or StateDisabled.
+func (b *Backend) State() string { return adminStates[b.admin.Load()] }
+
+// Backend returns the backend with url, or nil.
+func (lb *LoadBalancer) Backend(url string) *Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.find(url)
+}
+
+func (lb *LoadBalancer) find(url string) *Backend {
+	for _, b := range lb.backends {
+		if b.URL == url {
+			return b
+		}
+	}
+	return nil
+}
+
+// SetState sets the runtime state of the backend with url. Draining and
+// disabled backends get no new requests; requests already sent to them
+// are not affected.
+func (lb *LoadBalancer) SetState(url, state string) error {
+	i := slices.Index(adminStates[:], state)
+	if i < 0 {
+		return ErrInvalidState
+	}
+	b := lb.Backend(url)
+	if b == nil {
+		return ErrBackendNotFound
+	}
+	if old := b.admin.Swap(int32(i)); old != int32(i) {
+		if state == StateEnabled {
+			b.markRecovered()
+		}
+		slog.Info("backend state changed", "url", url, "from", adminStates[old], "to", state)
+	}
+	return nil
+}
+
+// SetWeight sets the weight of the backend with url. Weights below 1 are
+// taken as 1.
+func (lb *LoadBalancer) SetWeight(url string, weight int) error {
+	b := lb.Backend(url)
+	if b == nil {
+		return ErrBackendNotFound
+	}
+	b.weight.Store(int64(max(weight, 1)))
+	return nil
+}
+
+// AddBackend adds a backend. With active health checks it starts out down
+// and is given requests once its checks pass; otherwise it is given
+// requests at once. Either way its slow start begins then.
+func (lb *LoadBalancer) AddBackend(bc BackendConfig) (*Backend, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.find(bc.URL) != nil {
+		return nil, ErrBackendExists
+	}
+	b := newBackend(bc, lb.breaker)
+	// The slice is copied, not appended to, since Backends and the health
+	// checker hand out the old one.
+	lb.backends = append(slices.Clip(lb.backends), b)
+	if lb.healthChecker != nil {
+		lb.healthChecker.setBackends(lb.backends)
+		go lb.healthChecker.check(b)
+	} else {
+		b.markRecovered()
+		b.SetAlive(true)
+	}
+	slog.Info("backend added", "url", bc.URL, "weight", b.Weight())
+	return b, nil
+}
+
+// RemoveBackend removes the backend with url. Requests already sent to it
+// are not affected; drain it first to let them finish before it goes.
+func (lb *LoadBalancer) RemoveBackend(url string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	i := slices.IndexFunc(lb.backends, func(b *Backend) bool { return b.URL == url })
+	if i < 0 {
+		return ErrBackendNotFound
+	}
+	if len(lb.backends) == 1 {
+		return ErrLastBackend
+	}
+	lb.backends = slices.Delete(slices.Clone(lb.backends), i, i+1)
+	if lb.healthChecker != nil {
+		lb.healthChecker.setBackends(lb.backends)
+	}
+	slog.Info("backend removed", "url", url)
+	return nil
+}
+
+// BackendConfigs returns the backends as they are now, for writing back to
+// the config file. Disabled backends are marked down; draining ones are
+// not, since draining is meant to end with their removal.
+func (lb *LoadBalancer) BackendConfigs() []BackendConfig {
+	backends := lb.Backends()
+	out := make([]BackendConfig, len(backends))
+	for i, b := range backends {
+		out[i] = BackendConfig{URL: b.URL, Weight: b.Weight(), Down: b.admin.Load() == adminDisabled}
+	}
+	return out
+}
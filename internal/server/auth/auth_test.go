@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUsers_Check(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// $2y$ is what htpasswd -B writes.
+	y := "$2y$" + strings.TrimPrefix(string(bc), "$2a$")
+	file := "# staging\n" +
+		"bcrypt:" + string(bc) + "\n" +
+		"bcrypty:" + y + "\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"apr1:$apr1$rOueB1Xy$n0re4rY22jg3qhPwiKGWw0\n" +
+		"\n" +
+		"empty:$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ.\n"
+	users, err := ParseHtpasswd(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"bcrypt", "secret", true},
+		{"bcrypt", "wrong", false},
+		{"bcrypty", "secret", true},
+		{"sha", "secret", true},
+		{"sha", "Secret", false},
+		{"apr1", "secret", true},
+		{"apr1", "secret2", false},
+		{"empty", "", true},
+		{"nobody", "secret", false},
+	}
+	for _, c := range cases {
+		if got := users.Check(c.user, c.pass); got != c.want {
+			t.Errorf("Check(%q, %q) = %v, want %v", c.user, c.pass, got, c.want)
+		}
+	}
+}
+
+func TestParseHtpasswd_Rejects(t *testing.T) {
+	for _, line := range []string{
+		"des:rl0uE2W4nFyHc", // crypt(3)
+		"plain:secret",
+		"nohash",
+		":$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ.",
+	} {
+		if _, err := ParseHtpasswd(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseHtpasswd(%q): expected error", line)
+		}
+	}
+}
+
+func TestBasic_Wrap(t *testing.T) {
+	users := Users{"alice": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}
+	h := NewBasic("Staging", users).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	do := func(user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no credentials: status %d, want 401", rec.Code)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="Staging", charset="UTF-8"` {
+		t.Errorf("WWW-Authenticate = %q", got)
+	}
+	if rec := do("alice", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("valid credentials: status %d, want 200", rec.Code)
+	}
+
+	for i := 0; i < maxFailures; i++ {
+		if rec := do("alice", "guess"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, rec.Code)
+		}
+	}
+	if rec := do("alice", "secret"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("after %d failures: status %d, want 429", maxFailures, rec.Code)
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	l := NewLimiter(2)
+	defer l.Stop()
+	l.RecordFailure("192.0.2.1")
+	l.RecordFailure("192.0.2.2")
+
+	l.prune(time.Now())
+	if len(l.hits) != 2 {
+		t.Fatalf("pruned recent failures: %v", l.hits)
+	}
+	l.prune(time.Now().Add(2 * time.Minute))
+	if len(l.hits) != 0 {
+		t.Errorf("expired failures kept: %v", l.hits)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	for addr, want := range map[string]string{
+		"192.0.2.1:5000":     "192.0.2.1",
+		"[2001:db8::1]:5000": "2001:db8::1",
+		"192.0.2.1":          "192.0.2.1",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		if got := RemoteIP(req); got != want {
+			t.Errorf("RemoteIP(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
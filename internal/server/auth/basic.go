@@ -0,0 +1,70 @@
+// Package auth controls access to vhosts with HTTP Basic authentication, like
+// nginx auth_basic, subrequests to an external auth service, like nginx
+// auth_request, and JWT bearer tokens checked against local keys. Repeated
+// Basic auth failures are limited per client IP.
+package auth
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// maxFailures is how many failed attempts per minute an IP may make before it
+// is answered with 429.
+const maxFailures = 5
+
+// BasicConfig is the auth_basic block of a vhost or location. Auth is off
+// when UserFile is empty.
+type BasicConfig struct {
+	Realm    string
+	UserFile string
+}
+
+// Basic enforces HTTP Basic auth against a set of users.
+type Basic struct {
+	realm   string
+	users   Users
+	limiter *Limiter
+}
+
+// NewBasic creates a Basic for users with its own failure limiter.
+func NewBasic(realm string, users Users) *Basic {
+	return &Basic{realm: realm, users: users, limiter: NewLimiter(maxFailures)}
+}
+
+// LoadBasic reads cfg.UserFile and creates a Basic for it.
+func LoadBasic(cfg BasicConfig) (*Basic, error) {
+	users, err := LoadHtpasswd(cfg.UserFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewBasic(cfg.Realm, users), nil
+}
+
+// Stop stops the failure limiter's pruning.
+func (b *Basic) Stop() {
+	b.limiter.Stop()
+}
+
+// Wrap returns next wrapped with Basic Auth enforcement.
+func (b *Basic) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := RemoteIP(r)
+		if b.limiter.IsBlocked(ip) {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || !b.users.Check(user, pass) {
+			if ok {
+				b.limiter.RecordFailure(ip)
+				log.Printf("auth_basic: failed login for %q from %s on %s", user, ip, r.Host)
+			}
+			w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(b.realm)+`, charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
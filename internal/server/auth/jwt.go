@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JWTConfig is the jwt block of a vhost or location. Validation is off when
+// Keys is empty.
+type JWTConfig struct {
+	// Keys is a JWKS file or a file of PEM public keys or certificates.
+	Keys     string
+	Issuer   string // required iss claim, if set
+	Audience string // required aud claim entry, if set
+	// ClaimsToHeaders copies claims of a valid token to upstream headers.
+	ClaimsToHeaders []ClaimHeader
+}
+
+// ClaimHeader names a token claim and the header it is sent upstream in.
+type ClaimHeader struct {
+	Claim  string
+	Header string
+}
+
+// verificationKey is a key from the key file: *rsa.PublicKey,
+// *ecdsa.PublicKey or an HMAC secret.
+type verificationKey struct {
+	kid string
+	key any
+}
+
+// JWT validates bearer tokens signed with RS256, ES256 or HS256.
+type JWT struct {
+	keys     []verificationKey
+	issuer   string
+	audience string
+	claims   []ClaimHeader
+	now      func() time.Time
+}
+
+// LoadJWT reads cfg.Keys and creates a JWT for it.
+func LoadJWT(cfg JWTConfig) (*JWT, error) {
+	b, err := os.ReadFile(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	var keys []verificationKey
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		keys, err = parseJWKS(trimmed)
+	} else {
+		keys, err = parsePEMKeys(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.Keys, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys found", cfg.Keys)
+	}
+	j := NewJWT(cfg)
+	j.keys = keys
+	return j, nil
+}
+
+// NewJWT creates a JWT for cfg without reading cfg.Keys. Having no keys, it
+// rejects every token.
+func NewJWT(cfg JWTConfig) *JWT {
+	return &JWT{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		claims:   cfg.ClaimsToHeaders,
+		now:      time.Now,
+	}
+}
+
+func parseJWKS(b []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	var keys []verificationKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key any
+		switch k.Kty {
+		case "RSA":
+			n, errN := b64(k.N)
+			e, errE := b64(k.E)
+			if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %d: invalid RSA key", i)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, fmt.Errorf("key %d: unsupported curve %q", i, k.Crv)
+			}
+			x, errX := b64(k.X)
+			y, errY := b64(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("key %d: invalid EC key", i)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if _, err := pub.ECDH(); err != nil {
+				return nil, fmt.Errorf("key %d: invalid EC key: %w", i, err)
+			}
+			key = pub
+		case "oct":
+			secret, err := b64(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("key %d: invalid oct key", i)
+			}
+			key = secret
+		default:
+			return nil, fmt.Errorf("key %d: unsupported key type %q", i, k.Kty)
+		}
+		keys = append(keys, verificationKey{kid: k.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func parsePEMKeys(b []byte) ([]verificationKey, error) {
+	var keys []verificationKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return keys, nil
+		}
+		var key any
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+		keys = append(keys, verificationKey{key: key})
+	}
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Wrap returns next wrapped with bearer token validation. Requests without a
+// valid token get 401.
+func (j *JWT) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A client must not be able to supply the claim headers itself.
+		for _, c := range j.claims {
+			r.Header.Del(c.Header)
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := j.validate(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description=`+strconv.Quote(err.Error()))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		for _, c := range j.claims {
+			if v, ok := claimString(claims[c.Claim]); ok {
+				r.Header.Set(c.Header, v)
+			}
+		}
+		if sub, ok := claimString(claims["sub"]); ok {
+			r = r.WithContext(context.WithValue(r.Context(), subjectKey{}, sub))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type subjectKey struct{}
+
+// Subject returns the sub claim of the token a JWT validated for the request
+// ctx belongs to, or "" when there is none.
+func Subject(ctx context.Context) string {
+	sub, _ := ctx.Value(subjectKey{}).(string)
+	return sub
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// validate checks token's signature and its exp, nbf, iss and aud claims,
+// and returns its claims.
+func (j *JWT) validate(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hb, err := b64(parts[0])
+	if err != nil || json.Unmarshal(hb, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, err := b64(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	if !j.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], sig) {
+		return nil, errors.New("invalid signature")
+	}
+
+	cb, err := b64(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims map[string]any
+	dec := json.NewDecoder(bytes.NewReader(cb))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	now := j.now()
+	if exp, ok := claims["exp"]; ok {
+		t, ok := numericDate(exp)
+		if !ok || !now.Before(t) {
+			return nil, errors.New("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := numericDate(nbf)
+		if !ok || now.Before(t) {
+			return nil, errors.New("token not yet valid")
+		}
+	}
+	if j.issuer != "" && claims["iss"] != j.issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if j.audience != "" && !hasAudience(claims["aud"], j.audience) {
+		return nil, errors.New("wrong audience")
+	}
+	return claims, nil
+}
+
+// verify checks sig against every key that suits alg and, when the token
+// names one, has kid.
+func (j *JWT) verify(alg, kid, signed string, sig []byte) bool {
+	sum := sha256.Sum256([]byte(signed))
+	for _, k := range j.keys {
+		if kid != "" && k.kid != "" && k.kid != kid {
+			continue
+		}
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if alg == "ES256" && key.Curve == elliptic.P256() && len(sig) == 64 {
+				r := new(big.Int).SetBytes(sig[:32])
+				s := new(big.Int).SetBytes(sig[32:])
+				if ecdsa.Verify(key, sum[:], r, s) {
+					return true
+				}
+			}
+		case []byte:
+			if alg == "HS256" {
+				mac := hmac.New(sha256.New, key)
+				mac.Write([]byte(signed))
+				if hmac.Equal(mac.Sum(nil), sig) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func hasAudience(aud any, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []any:
+		for _, v := range a {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString renders a claim as a header value: strings and numbers as they
+// are, anything else as JSON.
+func claimString(v any) (string, bool) {
+	switch c := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return c, true
+	case json.Number:
+		return c.String(), true
+	case bool:
+		return strconv.FormatBool(c), true
+	default:
+		b, err := json.Marshal(c)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+}
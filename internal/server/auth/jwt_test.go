@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signToken(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	h, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	c, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestJWT_Validate(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	enc := base64.RawURLEncoding
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": enc.EncodeToString(ecKey.X.Bytes()), "y": enc.EncodeToString(ecKey.Y.Bytes())},
+		{"kty": "oct", "kid": "hs1", "k": enc.EncodeToString(secret)},
+		{"kty": "RSA", "kid": "rsa1", "n": enc.EncodeToString(rsaKey.N.Bytes()), "e": "AQAB"},
+	}})
+	dir := t.TempDir()
+	jwksPath := filepath.Join(dir, "jwks.json")
+	os.WriteFile(jwksPath, jwks, 0o644)
+
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	pemPath := filepath.Join(dir, "key.pem")
+	os.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644)
+
+	now := time.Unix(1_800_000_000, 0)
+	valid := func() map[string]any {
+		return map[string]any{
+			"sub": "user-42", "iss": "https://auth.example.com", "aud": []string{"api", "web"},
+			"exp": now.Add(time.Hour).Unix(), "nbf": now.Add(-time.Minute).Unix(),
+			"admin": true, "org": map[string]string{"id": "acme"},
+		}
+	}
+	with := func(k string, v any) map[string]any {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	rsaPub := x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)
+
+	cfg := JWTConfig{
+		Issuer:   "https://auth.example.com",
+		Audience: "api",
+		ClaimsToHeaders: []ClaimHeader{
+			{Claim: "sub", Header: "X-User-Id"},
+			{Claim: "admin", Header: "X-Admin"},
+			{Claim: "org", Header: "X-Org"},
+		},
+	}
+	cases := []struct {
+		name  string
+		keys  string
+		token string
+		ok    bool
+	}{
+		{"RS256 PEM", pemPath, signToken(t, "RS256", "", rsaKey, valid()), true},
+		{"RS256 JWKS", jwksPath, signToken(t, "RS256", "rsa1", rsaKey, valid()), true},
+		{"ES256 JWKS", jwksPath, signToken(t, "ES256", "ec1", ecKey, valid()), true},
+		{"HS256 JWKS", jwksPath, signToken(t, "HS256", "hs1", secret, valid()), true},
+		{"no exp or nbf", jwksPath, signToken(t, "HS256", "", secret, with("nbf", nil)), true},
+		{"expired", jwksPath, signToken(t, "HS256", "hs1", secret, with("exp", now.Add(-time.Second).Unix())), false},
+		{"not yet valid", jwksPath, signToken(t, "HS256", "hs1", secret, with("nbf", now.Add(time.Minute).Unix())), false},
+		{"wrong issuer", jwksPath, signToken(t, "HS256", "hs1", secret, with("iss", "https://evil.example.com")), false},
+		{"wrong audience", jwksPath, signToken(t, "HS256", "hs1", secret, with("aud", "web")), false},
+		{"other key", pemPath, signToken(t, "RS256", "", otherRSA, valid()), false},
+		{"kid of another key", jwksPath, signToken(t, "RS256", "ec1", rsaKey, valid()), false},
+		{"alg none", jwksPath, signToken(t, "none", "", nil, valid()), false},
+		{"HS256 with RSA public key", pemPath, signToken(t, "HS256", "", rsaPub, valid()), false},
+		{"malformed", jwksPath, "not.a.token", false},
+	}
+	for _, c := range cases {
+		cfg.Keys = c.keys
+		j, err := LoadJWT(cfg)
+		if err != nil {
+			t.Fatalf("%s: LoadJWT: %v", c.name, err)
+		}
+		j.now = func() time.Time { return now }
+
+		var got http.Header
+		var sub string
+		h := j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, sub = r.Header, Subject(r.Context())
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("X-User-Id", "spoofed")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if c.ok {
+			if rec.Code != http.StatusOK {
+				t.Errorf("%s: status %d, want 200 (%s)", c.name, rec.Code, rec.Header().Get("WWW-Authenticate"))
+				continue
+			}
+			if got.Get("X-User-Id") != "user-42" || got.Get("X-Admin") != "true" || got.Get("X-Org") != `{"id":"acme"}` {
+				t.Errorf("%s: claim headers = %v", c.name, got)
+			}
+			if sub != "user-42" {
+				t.Errorf("%s: Subject = %q, want user-42", c.name, sub)
+			}
+		} else if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", c.name, rec.Code)
+		}
+	}
+}
+
+func TestJWT_MissingToken(t *testing.T) {
+	j := NewJWT(JWTConfig{})
+	called := false
+	h := j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusUnauthorized || called || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("status %d, called %v, WWW-Authenticate %q", rec.Code, called, rec.Header().Get("WWW-Authenticate"))
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiter tracks failed auth attempts per IP. IPs whose failures have all
+// expired are pruned periodically until Stop is called.
+type Limiter struct {
+	mu       sync.Mutex
+	hits     map[string][]time.Time
+	max      int
+	window   time.Duration
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewLimiter creates a limiter allowing max failed attempts per minute per IP.
+func NewLimiter(max int) *Limiter {
+	l := &Limiter{
+		hits:   make(map[string][]time.Time),
+		max:    max,
+		window: time.Minute,
+		done:   make(chan struct{}),
+	}
+	go l.cleanup(l.window)
+	return l
+}
+
+func (l *Limiter) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		l.prune(time.Now())
+	}
+}
+
+// prune drops the IPs whose last failure is older than the window.
+func (l *Limiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := now.Add(-l.window)
+	for ip, hits := range l.hits {
+		if hits[len(hits)-1].Before(cutoff) {
+			delete(l.hits, ip)
+		}
+	}
+}
+
+// Stop ends the periodic pruning.
+func (l *Limiter) Stop() {
+	l.stopOnce.Do(func() { close(l.done) })
+}
+
+// IsBlocked returns true if ip has exceeded the failure limit.
+func (l *Limiter) IsBlocked(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+	hits := l.hits[ip]
+	i := 0
+	for ; i < len(hits) && hits[i].Before(cutoff); i++ {
+	}
+	hits = hits[i:]
+	if len(hits) == 0 {
+		delete(l.hits, ip)
+		return false
+	}
+	l.hits[ip] = hits
+	return len(hits) >= l.max
+}
+
+// RecordFailure records a failed auth attempt for ip.
+func (l *Limiter) RecordFailure(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hits[ip] = append(l.hits[ip], time.Now())
+}
+
+// RemoteIP returns the address r came from, without the port.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// subrequestTimeout bounds a call to the auth service.
+const subrequestTimeout = 10 * time.Second
+
+// RequestConfig is the auth_request setting of a vhost or location. Auth is
+// off when URL is empty.
+type RequestConfig struct {
+	URL string
+	// Headers are copied from a successful auth response to the request
+	// sent upstream, e.g. X-User.
+	Headers []string
+}
+
+// Request authorizes each request with a subrequest to an auth service, like
+// nginx auth_request.
+type Request struct {
+	url     string
+	headers []string
+	client  *http.Client
+}
+
+// NewRequest creates a Request for cfg. Its connections to the auth service
+// are kept alive across requests.
+func NewRequest(cfg RequestConfig) *Request {
+	return &Request{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client: &http.Client{
+			Timeout: subrequestTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Wrap returns next wrapped with the auth subrequest. The subrequest is a GET
+// with the client's headers plus X-Original-URI, X-Original-Method and
+// X-Original-Host. A 2xx response lets the request through, 401 and 403 are
+// returned to the client, and anything else is a 500.
+func (a *Request) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A client must not be able to supply the headers the auth service sets.
+		for _, name := range a.headers {
+			r.Header.Del(name)
+		}
+
+		sub, err := http.NewRequestWithContext(r.Context(), http.MethodGet, a.url, nil)
+		if err != nil {
+			log.Printf("auth_request: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		sub.Header = r.Header.Clone()
+		for _, h := range []string{"Connection", "Content-Length", "Content-Type", "Transfer-Encoding", "Expect", "Te", "Trailer", "Upgrade"} {
+			sub.Header.Del(h)
+		}
+		sub.Header.Set("X-Original-URI", r.URL.RequestURI())
+		sub.Header.Set("X-Original-Method", r.Method)
+		sub.Header.Set("X-Original-Host", r.Host)
+
+		resp, err := a.client.Do(sub)
+		if err != nil {
+			log.Printf("auth_request: %s: %v", a.url, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// Drain the body so the connection can be reused.
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			for _, name := range a.headers {
+				if v := resp.Header.Values(name); len(v) > 0 {
+					r.Header[http.CanonicalHeaderKey(name)] = v
+				}
+			}
+			next.ServeHTTP(w, r)
+		case resp.StatusCode == http.StatusUnauthorized:
+			for _, v := range resp.Header.Values("WWW-Authenticate") {
+				w.Header().Add("WWW-Authenticate", v)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		case resp.StatusCode == http.StatusForbidden:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			log.Printf("auth_request: %s returned unexpected status %d", a.url, resp.StatusCode)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	})
+}
+
+// Close closes idle connections to the auth service.
+func (a *Request) Close() {
+	a.client.CloseIdleConnections()
+}
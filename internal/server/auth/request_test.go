@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequest_Wrap(t *testing.T) {
+	sso := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Original-URI") != "/reports?id=7" || r.Header.Get("X-Original-Method") != "POST" {
+			t.Errorf("subrequest headers = %v", r.Header)
+		}
+		switch r.Header.Get("Cookie") {
+		case "session=alice":
+			w.Header().Set("X-User", "alice")
+			w.Header().Set("X-Internal", "not copied")
+		case "session=bob":
+			w.WriteHeader(http.StatusForbidden)
+		case "session=broken":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sso"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer sso.Close()
+
+	a := NewRequest(RequestConfig{URL: sso.URL + "/verify", Headers: []string{"X-User"}})
+	defer a.Close()
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("user=" + r.Header.Get("X-User") + " internal=" + r.Header.Get("X-Internal")))
+	}))
+
+	cases := []struct {
+		cookie   string
+		wantCode int
+		wantBody string
+	}{
+		{"session=alice", 200, "user=alice internal="},
+		{"session=bob", 403, ""},
+		{"session=broken", 500, ""},
+		{"", 401, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "http://app.example.com/reports?id=7", nil)
+		req.Header.Set("X-User", "mallory")
+		if c.cookie != "" {
+			req.Header.Set("Cookie", c.cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.wantCode {
+			t.Errorf("%q: status %d, want %d", c.cookie, rec.Code, c.wantCode)
+		}
+		if c.wantBody != "" && rec.Body.String() != c.wantBody {
+			t.Errorf("%q: body %q, want %q", c.cookie, rec.Body.String(), c.wantBody)
+		}
+		if c.wantCode == 401 && rec.Header().Get("WWW-Authenticate") != `Bearer realm="sso"` {
+			t.Errorf("WWW-Authenticate = %q", rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestRequest_Unreachable(t *testing.T) {
+	a := NewRequest(RequestConfig{URL: "http://127.0.0.1:1/verify"})
+	called := false
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError || called {
+		t.Errorf("status %d, called %v; want 500 without calling next", rec.Code, called)
+	}
+}
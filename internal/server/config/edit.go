@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tinyproxy/internal/loadbalancer"
+)
+
+// SetUpstreamBackends returns src, the text of a config file, with the
+// backend lines of an upstream block replaced by backends. The block is the
+// one of vhost host, or of its location when location, as given by
+// Location.String, isn't empty. The new lines take the place of the first
+// old one; everything else, comments included, is left as it was.
+func SetUpstreamBackends(src, host, location string, backends []loadbalancer.BackendConfig) (string, error) {
+	target := []string{"vhosts", host}
+	if location != "" {
+		target = append(target, location)
+	}
+	target = append(target, "upstream")
+
+	lines := strings.Split(src, "\n")
+	var stack []string
+	found := false
+	at, indent := -1, ""
+	var out []string
+	for _, raw := range lines {
+		line := strings.TrimSpace(raw)
+		inTarget := slices.Equal(stack, target)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "}":
+			if inTarget && at < 0 {
+				// No backend lines yet: add them at the end of the block.
+				at, indent = len(out), leadingSpace(raw)+"    "
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case strings.HasSuffix(line, "{"):
+			header := strings.Join(strings.Fields(strings.TrimSuffix(line, "{")), " ")
+			stack = append(stack, header)
+			if slices.Equal(stack, target) {
+				if found {
+					return "", fmt.Errorf("more than one upstream block for %s", scopeName(host, location))
+				}
+				found = true
+			}
+		case inTarget && strings.Fields(line)[0] == "backend":
+			if at < 0 {
+				at, indent = len(out), leadingSpace(raw)
+			}
+			continue
+		}
+		out = append(out, raw)
+	}
+	if !found {
+		return "", fmt.Errorf("no upstream block for %s", scopeName(host, location))
+	}
+
+	add := make([]string, len(backends))
+	for i, bc := range backends {
+		line := indent + "backend " + bc.URL
+		if bc.Weight > 1 {
+			line += " weight " + strconv.Itoa(bc.Weight)
+		}
+		if bc.Down {
+			line += " down"
+		}
+		add[i] = line
+	}
+	return strings.Join(slices.Insert(out, at, add...), "\n"), nil
+}
+
+func leadingSpace(s string) string {
+	return s[:len(s)-len(strings.TrimLeft(s, " \t"))]
+}
+
+func scopeName(host, location string) string {
+	if location == "" {
+		return "vhost " + host
+	}
+	return "vhost " + host + " " + location
+}
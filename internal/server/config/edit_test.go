@@ -0,0 +1,87 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"tinyproxy/internal/loadbalancer"
+)
+
+const editInput = `vhosts {
+    example.com {
+        upstream {
+            strategy weighted
+            # the app servers
+            backend http://10.0.0.1:8080 weight 3
+            backend http://10.0.0.2:8080
+            health_check {
+                path /healthz
+            }
+        }
+        location /api {
+            upstream {
+                backend http://10.0.1.1:8080
+            }
+        }
+    }
+    other.example.com {
+        upstream {
+            backend http://10.0.2.1:8080
+        }
+    }
+}
+`
+
+func TestSetUpstreamBackends(t *testing.T) {
+	got, err := SetUpstreamBackends(editInput, "example.com", "", []loadbalancer.BackendConfig{
+		{URL: "http://10.0.0.2:8080", Weight: 1},
+		{URL: "http://10.0.0.3:8080", Weight: 2, Down: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(editInput, `            backend http://10.0.0.1:8080 weight 3
+            backend http://10.0.0.2:8080
+`, `            backend http://10.0.0.2:8080
+            backend http://10.0.0.3:8080 weight 2 down
+`, 1)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	cfg, err := NewParser(strings.NewReader(got)).Parse()
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	backends := cfg.VHosts["example.com"].Upstream.Backends
+	if len(backends) != 2 || !backends[1].Down || backends[1].Weight != 2 {
+		t.Errorf("parsed backends = %+v", backends)
+	}
+	if api := cfg.VHosts["example.com"].Locations[0].VHost.Upstream.Backends; len(api) != 1 || api[0].URL != "http://10.0.1.1:8080" {
+		t.Errorf("location backends = %+v, want unchanged", api)
+	}
+}
+
+func TestSetUpstreamBackends_Location(t *testing.T) {
+	got, err := SetUpstreamBackends(editInput, "example.com", "location /api", []loadbalancer.BackendConfig{
+		{URL: "http://10.0.1.2:8080", Weight: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(editInput, "http://10.0.1.1:8080", "http://10.0.1.2:8080", 1)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSetUpstreamBackends_Errors(t *testing.T) {
+	for _, c := range []struct{ host, location string }{
+		{"missing.example.com", ""},
+		{"example.com", "location /static"},
+	} {
+		if _, err := SetUpstreamBackends(editInput, c.host, c.location, nil); err == nil {
+			t.Errorf("%s %s: expected an error", c.host, c.location)
+		}
+	}
+}
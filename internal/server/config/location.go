@@ -0,0 +1,306 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Location match modifiers, mirroring nginx semantics.
+const (
+	MatchPrefix        = ""   // location /api { }
+	MatchExact         = "="  // location = /healthz { }
+	MatchPreferPrefix  = "^~" // location ^~ /static { } — prefix that skips regex checks
+	MatchRegex         = "~"  // location ~ \.php$ { }
+	MatchRegexCaseless = "~*" // location ~* \.(png|jpg)$ { }
+)
+
+// Location is a path-scoped block inside a vhost. VHost holds the effective
+// settings for requests that match: the parent vhost's settings with the
+// location's own directives applied on top.
+type Location struct {
+	Modifier string
+	Path     string
+	VHost    *VirtualHost
+	// OwnBackend is set when the location declares a backend of its own
+	// instead of inheriting the vhost's.
+	OwnBackend bool
+	regex      *regexp.Regexp
+}
+
+// String renders the location header as written in the config, e.g. "location ~* \.php$".
+func (l *Location) String() string {
+	if l.Modifier == MatchPrefix {
+		return "location " + l.Path
+	}
+	return "location " + l.Modifier + " " + l.Path
+}
+
+// IsNamed reports whether l is a named location (location @name), which is
+// never matched against request paths and is only reachable from try_files.
+func (l *Location) IsNamed() bool {
+	return strings.HasPrefix(l.Path, "@")
+}
+
+// Matches reports whether path is selected by this location on its own,
+// ignoring the precedence rules applied by MatchLocation.
+func (l *Location) Matches(path string) bool {
+	switch l.Modifier {
+	case MatchExact:
+		return path == l.Path
+	case MatchRegex, MatchRegexCaseless:
+		return l.regex.MatchString(path)
+	default:
+		return strings.HasPrefix(path, l.Path)
+	}
+}
+
+// MatchLocation picks the location that handles path using nginx precedence:
+// an exact match wins outright; otherwise the longest matching prefix is
+// remembered, and if it is not marked ^~ the regex locations are tried in
+// config order, the first match winning. Falls back to the longest prefix.
+// Returns nil when no location matches and the vhost-level settings apply.
+func (vh *VirtualHost) MatchLocation(path string) *Location {
+	var longest *Location
+	for _, l := range vh.Locations {
+		if l.IsNamed() {
+			continue
+		}
+		switch l.Modifier {
+		case MatchExact:
+			if path == l.Path {
+				return l
+			}
+		case MatchPrefix, MatchPreferPrefix:
+			if l.Matches(path) && (longest == nil || len(l.Path) > len(longest.Path)) {
+				longest = l
+			}
+		}
+	}
+	if longest != nil && longest.Modifier == MatchPreferPrefix {
+		return longest
+	}
+	for _, l := range vh.Locations {
+		if (l.Modifier == MatchRegex || l.Modifier == MatchRegexCaseless) && l.Matches(path) {
+			return l
+		}
+	}
+	return longest
+}
+
+// NamedLocation returns the location declared as "location @name", or nil.
+func (vh *VirtualHost) NamedLocation(name string) *Location {
+	for _, l := range vh.Locations {
+		if l.IsNamed() && l.Path == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of vh that can be modified without affecting the
+// original. Locations are not copied — a location never contains locations.
+func (vh *VirtualHost) clone() *VirtualHost {
+	c := *vh
+	c.Locations = nil
+	c.BotProtection.BlockedAgents = slices.Clone(vh.BotProtection.BlockedAgents)
+	c.BotProtection.AllowedAgents = slices.Clone(vh.BotProtection.AllowedAgents)
+	c.BotProtection.BlockedPaths = slices.Clone(vh.BotProtection.BlockedPaths)
+	c.Cache.Methods = slices.Clone(vh.Cache.Methods)
+	c.Upstream.Backends = slices.Clone(vh.Upstream.Backends)
+	c.TryFiles = slices.Clone(vh.TryFiles)
+	c.GeoIP.BlockCountries = slices.Clone(vh.GeoIP.BlockCountries)
+	c.GeoIP.BlockASN = slices.Clone(vh.GeoIP.BlockASN)
+	c.RateLimitZones = slices.Clone(vh.RateLimitZones)
+	c.WAF.Rules = slices.Clone(vh.WAF.Rules)
+	c.WAF.ExcludeRules = slices.Clone(vh.WAF.ExcludeRules)
+	if vh.ErrorPages.Pages != nil {
+		c.ErrorPages.Pages = make(map[int]string, len(vh.ErrorPages.Pages))
+		for k, v := range vh.ErrorPages.Pages {
+			c.ErrorPages.Pages[k] = v
+		}
+	}
+	if vh.FastCGI.Params != nil {
+		c.FastCGI.Params = make(map[string]string, len(vh.FastCGI.Params))
+		for k, v := range vh.FastCGI.Params {
+			c.FastCGI.Params[k] = v
+		}
+	}
+	return &c
+}
+
+// pendingLocation is a location block whose body has been read but not yet
+// applied. Bodies are applied once the enclosing vhost block closes so that
+// a location inherits every vhost directive regardless of where it appears.
+type pendingLocation struct {
+	loc  *Location
+	line int // config line of the "location ... {" header
+	body []string
+}
+
+// parseLocationHeader parses "location [modifier] path {" into a Location.
+func parseLocationHeader(parts []string) (*Location, error) {
+	if len(parts) < 3 || parts[len(parts)-1] != "{" {
+		return nil, fmt.Errorf("location block must be written as %q", "location [=|~|~*|^~] /path {")
+	}
+	args := parts[1 : len(parts)-1]
+	loc := &Location{Modifier: MatchPrefix}
+	switch len(args) {
+	case 1:
+		loc.Path = args[0]
+	case 2:
+		switch args[0] {
+		case MatchExact, MatchPreferPrefix, MatchRegex, MatchRegexCaseless:
+			loc.Modifier = args[0]
+		default:
+			return nil, fmt.Errorf("unknown location modifier %q: must be =, ~, ~* or ^~", args[0])
+		}
+		loc.Path = args[1]
+	default:
+		return nil, fmt.Errorf("location takes a single path (got %d arguments)", len(args))
+	}
+
+	switch loc.Modifier {
+	case MatchRegex, MatchRegexCaseless:
+		expr := loc.Path
+		if loc.Modifier == MatchRegexCaseless {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid location regex %q: %w", loc.Path, err)
+		}
+		loc.regex = re
+	default:
+		if strings.HasPrefix(loc.Path, "@") {
+			if loc.Modifier != MatchPrefix || len(loc.Path) == 1 {
+				return nil, fmt.Errorf("invalid named location %q", strings.Join(args, " "))
+			}
+			break
+		}
+		if !strings.HasPrefix(loc.Path, "/") {
+			return nil, fmt.Errorf("location path %q must start with / (or @ for a named location)", loc.Path)
+		}
+	}
+	return loc, nil
+}
+
+// readLocationBody collects the raw lines of a location block up to its
+// matching closing brace.
+func (p *Parser) readLocationBody() ([]string, error) {
+	var body []string
+	depth := 0
+	for p.scanner.Scan() {
+		p.line++
+		line := strings.TrimSpace(p.scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			body = append(body, "")
+			continue
+		}
+		if line == "}" {
+			if depth == 0 {
+				return body, nil
+			}
+			depth--
+		} else if strings.HasSuffix(line, "{") {
+			if strings.HasPrefix(line, "location ") {
+				return nil, fmt.Errorf("nested location blocks are not supported")
+			}
+			depth++
+		}
+		body = append(body, line)
+	}
+	return nil, fmt.Errorf("unexpected end of file: missing closing } for location block")
+}
+
+// applyLocations resolves the pending locations of the current vhost. Each
+// location starts from a copy of the fully-parsed vhost and then applies its
+// own directives. Setting a backend (proxy_pass, upstream, root or fastcgi)
+// inside a location replaces the inherited one rather than conflicting with it.
+func (p *Parser) applyLocations(pending []pendingLocation) error {
+	parent := p.currentVHost
+	defer func() { p.currentVHost = parent }()
+
+	for _, pl := range pending {
+		eff := parent.clone()
+		pl.loc.OwnBackend = resetInheritedBackend(eff, pl.body)
+		// As in nginx, a vhost-level try_files only applies to requests that
+		// match no location, and vhost-level rewrites run before matching.
+		eff.TryFiles = nil
+		eff.Rewrites = nil
+
+		sub := &Parser{
+			scanner:      bufio.NewScanner(strings.NewReader(strings.Join(pl.body, "\n"))),
+			line:         pl.line,
+			config:       p.config,
+			currentVHost: eff,
+			inLocation:   true,
+		}
+		for sub.scanner.Scan() {
+			sub.line++
+			line := strings.TrimSpace(sub.scanner.Text())
+			if line == "" {
+				continue
+			}
+			if err := sub.parseLine(line); err != nil {
+				return fmt.Errorf("%s (line %d): %v", pl.loc, sub.line, err)
+			}
+		}
+
+		pl.loc.VHost = eff
+		parent.Locations = append(parent.Locations, pl.loc)
+	}
+
+	if err := checkTryFiles(parent, parent); err != nil {
+		return err
+	}
+	for _, l := range parent.Locations {
+		if err := checkTryFiles(parent, l.VHost); err != nil {
+			return fmt.Errorf("%s: %v", l, err)
+		}
+	}
+	return nil
+}
+
+// checkTryFiles verifies that a try_files directive in vh, which is parent
+// or the effective settings of one of its locations, has a root to look in
+// and that a named-location fallback exists.
+func checkTryFiles(parent, vh *VirtualHost) error {
+	if len(vh.TryFiles) == 0 {
+		return nil
+	}
+	if vh.Root == "" {
+		return fmt.Errorf("try_files requires root")
+	}
+	fallback := vh.TryFiles[len(vh.TryFiles)-1]
+	if strings.HasPrefix(fallback, "@") && parent.NamedLocation(fallback) == nil {
+		return fmt.Errorf("try_files fallback %s: no such named location", fallback)
+	}
+	return nil
+}
+
+// resetInheritedBackend clears the backend a location inherited from its vhost
+// when the location body declares its own, and reports whether it does.
+func resetInheritedBackend(vh *VirtualHost, body []string) bool {
+	own := false
+	for _, line := range body {
+		directive, _, _ := strings.Cut(line, " ")
+		switch directive {
+		case "proxy_pass", "upstream", "root":
+			vh.ProxyPass = ""
+			vh.Root = ""
+			vh.FastCGI.Pass = ""
+			vh.FastCGI.Enabled = false
+			vh.Upstream.Backends = nil
+			own = true
+		case "fastcgi":
+			vh.ProxyPass = ""
+			vh.Upstream.Backends = nil
+			own = true
+		}
+	}
+	return own
+}
@@ -4,11 +4,21 @@ import (
     "bufio"
     "fmt"
     "io"
+    "net"
+    "net/url"
     "strconv"
     "strings"
     "time"
 
     "tinyproxy/internal/loadbalancer"
+    "tinyproxy/internal/server/auth"
+    "tinyproxy/internal/server/geoip"
+    "tinyproxy/internal/server/proxy"
+    "tinyproxy/internal/server/realip"
+    "tinyproxy/internal/server/redirect"
+    "tinyproxy/internal/server/rewrite"
+    "tinyproxy/internal/server/security"
+    "tinyproxy/internal/server/waf"
 )
 
 type Parser struct {
@@ -16,6 +26,9 @@ type Parser struct {
     line    int
     config  *ServerConfig
     currentVHost *VirtualHost
+    pendingLocations []pendingLocation
+    inLocation       bool // parsing the body of a location block
+    locationErrorPages bool // the location has replaced its inherited error pages
 }
 
 func NewParser(reader io.Reader) *Parser {
@@ -41,13 +54,214 @@ func (p *Parser) Parse() (*ServerConfig, error) {
             }
             continue
         }
-        
-        return nil, fmt.Errorf("line %d: expected vhosts block", p.line)
+
+        parts := strings.Fields(line)
+        switch parts[0] {
+        case "trusted_proxies":
+            if len(parts) < 2 {
+                return nil, fmt.Errorf("line %d: trusted_proxies requires at least one address or CIDR range", p.line)
+            }
+            for _, a := range parts[1:] {
+                prefix, err := realip.ParsePrefix(a)
+                if err != nil {
+                    return nil, fmt.Errorf("line %d: trusted_proxies: %v", p.line, err)
+                }
+                p.config.TrustedProxies = append(p.config.TrustedProxies, prefix)
+            }
+            continue
+        case "proxy_protocol":
+            if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+                return nil, fmt.Errorf("line %d: proxy_protocol must be on or off", p.line)
+            }
+            p.config.ProxyProtocol = parts[1] == "on"
+            continue
+        case "geoip":
+            if len(parts) != 2 || parts[1] != "{" {
+                return nil, fmt.Errorf("line %d: geoip block must be opened with %q", p.line, "geoip {")
+            }
+            if err := p.parseGeoIP(); err != nil {
+                return nil, fmt.Errorf("line %d: %v", p.line, err)
+            }
+            continue
+        case "rate_limit_zone":
+            if len(parts) != 3 || parts[2] != "{" {
+                return nil, fmt.Errorf("line %d: rate_limit_zone must be opened with %q", p.line, "rate_limit_zone <name> {")
+            }
+            if _, dup := p.config.RateLimitZones[parts[1]]; dup {
+                return nil, fmt.Errorf("line %d: duplicate rate_limit_zone %q", p.line, parts[1])
+            }
+            var zone security.RateLimitConfig
+            if err := p.parseRateLimitBlock(&zone); err != nil {
+                return nil, fmt.Errorf("line %d: %v", p.line, err)
+            }
+            if zone.Requests == 0 {
+                return nil, fmt.Errorf("line %d: rate_limit_zone %q requires requests", p.line, parts[1])
+            }
+            if p.config.RateLimitZones == nil {
+                p.config.RateLimitZones = make(map[string]security.RateLimitConfig)
+            }
+            p.config.RateLimitZones[parts[1]] = zone
+            continue
+        case "rate_limit_redis":
+            if len(parts) != 2 || parts[1] != "{" {
+                return nil, fmt.Errorf("line %d: rate_limit_redis block must be opened with %q", p.line, "rate_limit_redis {")
+            }
+            if err := p.parseRateLimitRedis(); err != nil {
+                return nil, fmt.Errorf("line %d: %v", p.line, err)
+            }
+            continue
+        }
+
+        return nil, fmt.Errorf("line %d: expected vhosts block, trusted_proxies, proxy_protocol, geoip, rate_limit_zone or rate_limit_redis", p.line)
+    }
+
+    // Addresses in PROXY headers are only believed from trusted proxies.
+    if p.config.ProxyProtocol && len(p.config.TrustedProxies) == 0 {
+        return nil, fmt.Errorf("proxy_protocol on requires trusted_proxies")
+    }
+    if err := p.checkGeoIPRules(); err != nil {
+        return nil, err
+    }
+    if err := p.checkRateLimitZones(); err != nil {
+        return nil, err
     }
-    
     return p.config, nil
 }
 
+// parseGeoIP parses the global geoip block naming the MaxMind databases.
+func (p *Parser) parseGeoIP() error {
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if p.config.GeoIP == (geoip.Config{}) {
+                return fmt.Errorf("geoip requires country_db or asn_db")
+            }
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) != 2 {
+            return fmt.Errorf("geoip %s requires a file path", parts[0])
+        }
+        switch parts[0] {
+        case "country_db":
+            p.config.GeoIP.CountryDB = parts[1]
+        case "asn_db":
+            p.config.GeoIP.ASNDB = parts[1]
+        default:
+            return fmt.Errorf("unknown geoip directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for geoip block")
+}
+
+// parseRateLimitRedis parses the global rate_limit_redis block.
+func (p *Parser) parseRateLimitRedis() error {
+    rc := &p.config.RateLimitRedis
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if rc.Address == "" {
+                return fmt.Errorf("rate_limit_redis requires address")
+            }
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) != 2 {
+            return fmt.Errorf("rate_limit_redis %s requires a value", parts[0])
+        }
+        switch parts[0] {
+        case "address":
+            if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+                return fmt.Errorf("invalid rate_limit_redis address %q: must be host:port", parts[1])
+            }
+            rc.Address = parts[1]
+        case "password":
+            rc.Password = parts[1]
+        case "db":
+            db, err := strconv.Atoi(parts[1])
+            if err != nil || db < 0 {
+                return fmt.Errorf("invalid rate_limit_redis db %q: must be an integer >= 0", parts[1])
+            }
+            rc.DB = db
+        case "timeout":
+            timeout, err := time.ParseDuration(parts[1])
+            if err != nil || timeout <= 0 {
+                return fmt.Errorf("invalid rate_limit_redis timeout %q: must be a positive duration", parts[1])
+            }
+            rc.Timeout = timeout
+        case "on_error":
+            if parts[1] != "allow" && parts[1] != "deny" {
+                return fmt.Errorf("rate_limit_redis on_error must be allow or deny")
+            }
+            rc.FailClosed = parts[1] == "deny"
+        default:
+            return fmt.Errorf("unknown rate_limit_redis directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for rate_limit_redis block")
+}
+
+// checkRateLimitZones verifies that every zone named by rate_limit_zones is
+// defined, and that rate_limit_redis is configured if any limit uses store
+// redis. Zones may be defined after the vhosts that use them.
+func (p *Parser) checkRateLimitZones() error {
+    redis := p.config.RateLimitRedis.Address != ""
+    for name, zone := range p.config.RateLimitZones {
+        if zone.Store == security.RateLimitStoreRedis && !redis {
+            return fmt.Errorf("rate_limit_zone %q: store redis requires rate_limit_redis", name)
+        }
+    }
+    for name, vh := range p.config.VHosts {
+        scopes := []*VirtualHost{vh}
+        for _, l := range vh.Locations {
+            scopes = append(scopes, l.VHost)
+        }
+        for _, sc := range scopes {
+            for _, z := range sc.RateLimitZones {
+                if _, ok := p.config.RateLimitZones[z]; !ok {
+                    return fmt.Errorf("vhost %q: unknown rate_limit_zone %q", name, z)
+                }
+            }
+            if sc.Security.RateLimit.Store == security.RateLimitStoreRedis && !redis {
+                return fmt.Errorf("vhost %q: rate_limit store redis requires rate_limit_redis", name)
+            }
+        }
+    }
+    return nil
+}
+
+// checkGeoIPRules verifies that the databases the block_countries and
+// block_asn rules of every vhost and location depend on are configured.
+func (p *Parser) checkGeoIPRules() error {
+    for name, vh := range p.config.VHosts {
+        scopes := []*VirtualHost{vh}
+        for _, l := range vh.Locations {
+            scopes = append(scopes, l.VHost)
+        }
+        for _, sc := range scopes {
+            if len(sc.GeoIP.BlockCountries) > 0 && p.config.GeoIP.CountryDB == "" {
+                return fmt.Errorf("vhost %q: block_countries requires geoip country_db", name)
+            }
+            if len(sc.GeoIP.BlockASN) > 0 && p.config.GeoIP.ASNDB == "" {
+                return fmt.Errorf("vhost %q: block_asn requires geoip asn_db", name)
+            }
+        }
+    }
+    return nil
+}
+
 func (p *Parser) parseVhosts() error {
     for p.scanner.Scan() {
         p.line++
@@ -68,6 +282,7 @@ func (p *Parser) parseVhosts() error {
             }
             p.currentVHost = NewVirtualHost()
             p.currentVHost.Hostname = domain
+            p.pendingLocations = nil
 
             if err := p.parseVHostBlock(); err != nil {
                 return err
@@ -92,7 +307,7 @@ func (p *Parser) parseVHostBlock() error {
         }
 
         if line == "}" {
-            return nil
+            return p.applyLocations(p.pendingLocations)
         }
 
         if err := p.parseLine(line); err != nil {
@@ -158,7 +373,186 @@ func (p *Parser) parseLine(line string) error {
             return fmt.Errorf("max_body_size: %w", err)
         }
         p.currentVHost.MaxBodySize = size
-    case "ssl", "security", "socks5", "fastcgi", "bot_protection", "cache", "upstream":
+    case "return":
+        rc, err := parseReturn(parts[1:])
+        if err != nil {
+            return err
+        }
+        p.currentVHost.Return = rc
+    case "redirect":
+        rc, err := parseRedirect(parts[1:])
+        if err != nil {
+            return err
+        }
+        p.currentVHost.Return = rc
+    case "rewrite":
+        if len(parts) < 3 || len(parts) > 4 {
+            return fmt.Errorf("rewrite must be written as %q", "rewrite <regex> <replacement> [last|break|redirect|permanent]")
+        }
+        flag := ""
+        if len(parts) == 4 {
+            flag = parts[3]
+        }
+        rule, err := rewrite.NewRule(unquote(parts[1]), unquote(parts[2]), flag)
+        if err != nil {
+            return err
+        }
+        p.currentVHost.Rewrites = append(p.currentVHost.Rewrites, rule)
+    case "error_page":
+        if len(parts) < 3 {
+            return fmt.Errorf("error_page requires at least one status code and a page")
+        }
+        // As in nginx, error_page directives in a location replace the
+        // inherited ones instead of adding to them.
+        if p.currentVHost.ErrorPages.Pages == nil || (p.inLocation && !p.locationErrorPages) {
+            p.currentVHost.ErrorPages.Pages = make(map[int]string)
+            p.locationErrorPages = p.inLocation
+        }
+        page := parts[len(parts)-1]
+        for _, arg := range parts[1 : len(parts)-1] {
+            code, err := strconv.Atoi(arg)
+            if err != nil || code < 300 || code > 599 {
+                return fmt.Errorf("invalid error_page status code %q: must be 300-599", arg)
+            }
+            p.currentVHost.ErrorPages.Pages[code] = page
+        }
+    case "intercept_errors":
+        if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+            return fmt.Errorf("intercept_errors must be on or off")
+        }
+        p.currentVHost.ErrorPages.InterceptErrors = parts[1] == "on"
+    case "try_files":
+        if len(parts) < 3 {
+            return fmt.Errorf("try_files requires at least one candidate and a fallback")
+        }
+        fallback := parts[len(parts)-1]
+        if strings.HasPrefix(fallback, "=") {
+            code, err := strconv.Atoi(fallback[1:])
+            if err != nil || code < 100 || code > 599 {
+                return fmt.Errorf("invalid try_files status fallback %q", fallback)
+            }
+        }
+        p.currentVHost.TryFiles = parts[1:]
+    case "location":
+        if p.inLocation {
+            return fmt.Errorf("nested location blocks are not supported")
+        }
+        loc, err := parseLocationHeader(parts)
+        if err != nil {
+            return err
+        }
+        start := p.line
+        body, err := p.readLocationBody()
+        if err != nil {
+            return err
+        }
+        p.pendingLocations = append(p.pendingLocations, pendingLocation{loc: loc, line: start, body: body})
+    case "auth_request":
+        if len(parts) != 2 {
+            return fmt.Errorf("auth_request requires a URL or off")
+        }
+        if parts[1] == "off" {
+            p.currentVHost.AuthRequest = auth.RequestConfig{}
+            return nil
+        }
+        u, err := url.Parse(parts[1])
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("invalid auth_request URL %q: must be an http:// or https:// URL", parts[1])
+        }
+        p.currentVHost.AuthRequest.URL = parts[1]
+    case "auth_request_headers":
+        if len(parts) < 2 {
+            return fmt.Errorf("auth_request_headers requires at least one header name")
+        }
+        p.currentVHost.AuthRequest.Headers = parts[1:]
+    case "limit_conn":
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.LimitConn = security.ConnLimitConfig{}
+            return nil
+        }
+        if len(parts) != 2 || parts[1] != "{" {
+            return fmt.Errorf("limit_conn must be opened with %q or turned off with %q", "limit_conn {", "limit_conn off")
+        }
+        return p.parseLimitConn()
+    case "waf":
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.WAF = waf.Config{}
+            return nil
+        }
+        if len(parts) != 2 || parts[1] != "{" {
+            return fmt.Errorf("waf must be opened with %q or turned off with %q", "waf {", "waf off")
+        }
+        return p.parseWAF()
+    case "rate_limit_zones":
+        if len(parts) < 2 {
+            return fmt.Errorf("rate_limit_zones requires at least one zone name or off")
+        }
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.RateLimitZones = nil
+            return nil
+        }
+        p.currentVHost.RateLimitZones = parts[1:]
+    case "block_countries":
+        if len(parts) < 2 {
+            return fmt.Errorf("block_countries requires at least one country code or off")
+        }
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.GeoIP.BlockCountries = nil
+            return nil
+        }
+        var codes []string
+        for _, c := range parts[1:] {
+            if len(c) != 2 || strings.ContainsFunc(c, func(r rune) bool { return r < 'A' || r > 'Z' }) {
+                return fmt.Errorf("invalid country code %q: must be two upper-case letters (ISO 3166-1)", c)
+            }
+            codes = append(codes, c)
+        }
+        p.currentVHost.GeoIP.BlockCountries = codes
+    case "block_asn":
+        if len(parts) < 2 {
+            return fmt.Errorf("block_asn requires at least one AS number or off")
+        }
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.GeoIP.BlockASN = nil
+            return nil
+        }
+        var asns []uint
+        for _, a := range parts[1:] {
+            n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(a), "AS"), 10, 32)
+            if err != nil || n == 0 {
+                return fmt.Errorf("invalid AS number %q", a)
+            }
+            asns = append(asns, uint(n))
+        }
+        p.currentVHost.GeoIP.BlockASN = asns
+    case "access":
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.Access = security.AccessConfig{}
+            return nil
+        }
+        if len(parts) != 2 || parts[1] != "{" {
+            return fmt.Errorf("access must be opened with %q or turned off with %q", "access {", "access off")
+        }
+        return p.parseAccess()
+    case "jwt":
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.JWT = auth.JWTConfig{}
+            return nil
+        }
+        if len(parts) != 2 || parts[1] != "{" {
+            return fmt.Errorf("jwt must be opened with %q or turned off with %q", "jwt {", "jwt off")
+        }
+        return p.parseJWT()
+    case "auth_basic":
+        if len(parts) == 2 && parts[1] == "off" {
+            p.currentVHost.AuthBasic = auth.BasicConfig{}
+            return nil
+        }
+        if len(parts) != 2 || parts[1] != "{" {
+            return fmt.Errorf("auth_basic must be opened with %q or turned off with %q", "auth_basic {", "auth_basic off")
+        }
+        return p.parseAuthBasic()
+    case "ssl", "security", "socks5", "fastcgi", "bot_protection", "cache", "upstream", "headers", "timeouts", "keepalive":
         if len(parts) != 2 || parts[1] != "{" {
             return fmt.Errorf("%q block must be opened with %q", parts[0], parts[0]+" {")
         }
@@ -177,6 +571,12 @@ func (p *Parser) parseLine(line string) error {
             return p.parseCache()
         case "upstream":
             return p.parseUpstream()
+        case "headers":
+            return p.parseHeaders()
+        case "timeouts":
+            return p.parseTimeouts()
+        case "keepalive":
+            return p.parseKeepalive()
         }
     default:
         return fmt.Errorf("unknown directive %q", parts[0])
@@ -255,11 +655,15 @@ func (p *Parser) parseSecurity() error {
         }
         
         if line == "rate_limit {" {
-            if err := p.parseRateLimit(); err != nil {
+            if err := p.parseRateLimitBlock(&p.currentVHost.Security.RateLimit); err != nil {
                 return err
             }
             continue
         }
+        if line == "rate_limit off" {
+            p.currentVHost.Security.RateLimit = security.RateLimitConfig{}
+            continue
+        }
         
         parts := strings.Fields(line)
         if len(parts) < 2 {
@@ -292,7 +696,9 @@ func (p *Parser) parseSecurity() error {
     return fmt.Errorf("unexpected end of file: missing closing } for security block")
 }
 
-func (p *Parser) parseRateLimit() error {
+// parseRateLimitBlock parses the body of a rate_limit or rate_limit_zone
+// block into rl. Settings the block leaves out keep their current values.
+func (p *Parser) parseRateLimitBlock(rl *security.RateLimitConfig) error {
     for p.scanner.Scan() {
         p.line++
         line := strings.TrimSpace(p.scanner.Text())
@@ -300,14 +706,16 @@ func (p *Parser) parseRateLimit() error {
         if line == "}" {
             return nil
         }
-        
-        parts := strings.Fields(line)
-        if len(parts) < 2 {
+        if line == "" || strings.HasPrefix(line, "#") {
             continue
         }
         
+        parts := strings.Fields(line)
         switch parts[0] {
         case "requests":
+            if len(parts) != 2 {
+                return fmt.Errorf("rate_limit requests requires a number")
+            }
             requests, err := strconv.Atoi(parts[1])
             if err != nil {
                 return fmt.Errorf("invalid rate_limit requests %q: must be an integer", parts[1])
@@ -315,13 +723,53 @@ func (p *Parser) parseRateLimit() error {
             if requests < 0 {
                 return fmt.Errorf("rate_limit requests must be >= 0")
             }
-            p.currentVHost.Security.RateLimit.Requests = requests
+            rl.Requests = requests
         case "window":
+            if len(parts) != 2 {
+                return fmt.Errorf("rate_limit window requires a duration")
+            }
             window, err := time.ParseDuration(parts[1])
             if err != nil {
                 return fmt.Errorf("invalid rate_limit window %q: %w", parts[1], err)
             }
-            p.currentVHost.Security.RateLimit.Window = window
+            rl.Window = window
+        case "burst":
+            if len(parts) != 2 {
+                return fmt.Errorf("rate_limit burst requires a number")
+            }
+            burst, err := strconv.Atoi(parts[1])
+            if err != nil || burst < 1 {
+                return fmt.Errorf("invalid rate_limit burst %q: must be a positive integer", parts[1])
+            }
+            rl.Burst = burst
+        case "nodelay":
+            if len(parts) != 1 {
+                return fmt.Errorf("rate_limit nodelay takes no value")
+            }
+            rl.Queue, rl.Delay = false, 0
+        case "delay":
+            if len(parts) != 2 {
+                return fmt.Errorf("rate_limit delay requires a number")
+            }
+            delay, err := strconv.Atoi(parts[1])
+            if err != nil || delay < 0 {
+                return fmt.Errorf("invalid rate_limit delay %q: must be an integer >= 0", parts[1])
+            }
+            rl.Queue, rl.Delay = true, delay
+        case "key":
+            key, name, err := security.ParseRateLimitKey(parts[1:])
+            if err != nil {
+                return err
+            }
+            rl.Key, rl.KeyName = key, name
+        case "store":
+            if len(parts) != 2 || (parts[1] != security.RateLimitStoreMemory && parts[1] != security.RateLimitStoreRedis) {
+                return fmt.Errorf("rate_limit store must be memory or redis")
+            }
+            rl.Store = parts[1]
+            if rl.Store == security.RateLimitStoreMemory {
+                rl.Store = ""
+            }
         default:
             return fmt.Errorf("unknown rate_limit directive %q", parts[0])
         }
@@ -468,6 +916,9 @@ func (p *Parser) parseUpstream() error {
             continue
         }
         if line == "}" {
+            if pc := p.currentVHost.Upstream.Passive; pc.MaxFails > 0 && pc.EjectTime > pc.MaxEjectTime {
+                return fmt.Errorf("upstream eject_time %s is longer than max_eject_time %s", pc.EjectTime, pc.MaxEjectTime)
+            }
             return nil
         }
 
@@ -477,6 +928,18 @@ func (p *Parser) parseUpstream() error {
             }
             continue
         }
+        if line == "retry {" {
+            if err := p.parseRetry(); err != nil {
+                return err
+            }
+            continue
+        }
+        if line == "circuit_breaker {" {
+            if err := p.parseCircuitBreaker(); err != nil {
+                return err
+            }
+            continue
+        }
 
         parts := strings.Fields(line)
         if len(parts) < 2 {
@@ -505,7 +968,54 @@ func (p *Parser) parseUpstream() error {
                     bc.Weight = w
                 }
             }
+            for _, arg := range parts[2:] {
+                if arg == "down" {
+                    bc.Down = true
+                }
+            }
             p.currentVHost.Upstream.Backends = append(p.currentVHost.Upstream.Backends, bc)
+        case "max_fails":
+            // max_fails <n> [within <duration>] | off
+            passive := &p.currentVHost.Upstream.Passive
+            if parts[1] == "off" {
+                passive.MaxFails = 0
+                continue
+            }
+            n, err := strconv.Atoi(parts[1])
+            if err != nil || n < 0 {
+                return fmt.Errorf("invalid upstream max_fails %q: must be a number or off", parts[1])
+            }
+            passive.MaxFails = n
+            switch {
+            case len(parts) == 4 && parts[2] == "within":
+                d, err := time.ParseDuration(parts[3])
+                if err != nil || d <= 0 {
+                    return fmt.Errorf("invalid upstream max_fails window %q: must be a positive duration", parts[3])
+                }
+                passive.FailWindow = d
+            case len(parts) != 2:
+                return fmt.Errorf("invalid upstream max_fails %q: want max_fails <n> [within <duration>]", strings.Join(parts[1:], " "))
+            }
+        case "slow_start":
+            if parts[1] == "off" {
+                p.currentVHost.Upstream.SlowStart = 0
+                continue
+            }
+            d, err := time.ParseDuration(parts[1])
+            if err != nil || d <= 0 {
+                return fmt.Errorf("invalid upstream slow_start %q: must be a positive duration or off", parts[1])
+            }
+            p.currentVHost.Upstream.SlowStart = d
+        case "eject_time", "max_eject_time":
+            d, err := time.ParseDuration(parts[1])
+            if err != nil || d <= 0 {
+                return fmt.Errorf("invalid upstream %s %q: must be a positive duration", parts[0], parts[1])
+            }
+            if parts[0] == "eject_time" {
+                p.currentVHost.Upstream.Passive.EjectTime = d
+            } else {
+                p.currentVHost.Upstream.Passive.MaxEjectTime = d
+            }
         default:
             return fmt.Errorf("unknown upstream directive %q", parts[0])
         }
@@ -513,6 +1023,152 @@ func (p *Parser) parseUpstream() error {
     return fmt.Errorf("unexpected end of file: missing closing } for upstream block")
 }
 
+// parseRetry parses a retry block in an upstream. Directives it leaves out
+// keep the defaults of loadbalancer.DefaultRetryConfig.
+func (p *Parser) parseRetry() error {
+    rc := loadbalancer.DefaultRetryConfig()
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            p.currentVHost.Upstream.Retry = rc
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) < 2 {
+            return fmt.Errorf("retry %s: missing value", parts[0])
+        }
+
+        switch parts[0] {
+        case "attempts":
+            n, err := strconv.Atoi(parts[1])
+            if err != nil || n < 1 {
+                return fmt.Errorf("invalid retry attempts %q: must be a positive number", parts[1])
+            }
+            rc.Attempts = n
+        case "on":
+            rc.ConnectError = false
+            rc.Statuses = nil
+            for _, cond := range parts[1:] {
+                if cond == "connect_error" {
+                    rc.ConnectError = true
+                    continue
+                }
+                code, err := strconv.Atoi(cond)
+                if err != nil || code < 500 || code > 599 {
+                    return fmt.Errorf("invalid retry condition %q: must be connect_error or a 5xx status", cond)
+                }
+                rc.Statuses = append(rc.Statuses, code)
+            }
+        case "methods":
+            rc.Methods = nil
+            for _, m := range parts[1:] {
+                if m != strings.ToUpper(m) {
+                    return fmt.Errorf("invalid retry method %q: must be upper case", m)
+                }
+                rc.Methods = append(rc.Methods, m)
+            }
+        case "budget":
+            n, err := strconv.Atoi(strings.TrimSuffix(parts[1], "%"))
+            if err != nil || n < 1 {
+                return fmt.Errorf("invalid retry budget %q: must be a positive percentage", parts[1])
+            }
+            rc.Budget = n
+        case "body_limit":
+            size, err := parseByteSize(parts[1])
+            if err != nil || size < 0 {
+                return fmt.Errorf("invalid retry body_limit %q", parts[1])
+            }
+            rc.BodyLimit = size
+        default:
+            return fmt.Errorf("unknown retry directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for retry block")
+}
+
+// parseCircuitBreaker parses a circuit_breaker block in an upstream.
+// Directives it leaves out keep the defaults of
+// loadbalancer.DefaultBreakerConfig.
+func (p *Parser) parseCircuitBreaker() error {
+    bc := loadbalancer.DefaultBreakerConfig()
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if bc.ErrorRate == 0 && bc.Latency == 0 {
+                return fmt.Errorf("circuit_breaker: error_rate and latency are both off")
+            }
+            p.currentVHost.Upstream.Breaker = bc
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) != 2 {
+            return fmt.Errorf("circuit_breaker %s: want one value", parts[0])
+        }
+
+        switch parts[0] {
+        case "window", "open_time":
+            d, err := time.ParseDuration(parts[1])
+            if err != nil || d <= 0 {
+                return fmt.Errorf("invalid circuit_breaker %s %q: must be a positive duration", parts[0], parts[1])
+            }
+            if parts[0] == "window" {
+                bc.Window = d
+            } else {
+                bc.OpenTime = d
+            }
+        case "latency":
+            if parts[1] == "off" {
+                bc.Latency = 0
+                continue
+            }
+            d, err := time.ParseDuration(parts[1])
+            if err != nil || d <= 0 {
+                return fmt.Errorf("invalid circuit_breaker latency %q: must be a positive duration or off", parts[1])
+            }
+            bc.Latency = d
+        case "min_requests", "half_open_requests":
+            n, err := strconv.Atoi(parts[1])
+            if err != nil || n < 1 {
+                return fmt.Errorf("invalid circuit_breaker %s %q: must be a positive number", parts[0], parts[1])
+            }
+            if parts[0] == "min_requests" {
+                bc.MinRequests = n
+            } else {
+                bc.HalfOpenRequests = n
+            }
+        case "error_rate", "slow_rate":
+            n := 0
+            if parts[0] != "error_rate" || parts[1] != "off" {
+                var err error
+                n, err = strconv.Atoi(strings.TrimSuffix(parts[1], "%"))
+                if err != nil || n < 1 || n > 100 {
+                    return fmt.Errorf("invalid circuit_breaker %s %q: must be a percentage from 1%% to 100%%", parts[0], parts[1])
+                }
+            }
+            if parts[0] == "error_rate" {
+                bc.ErrorRate = n
+            } else {
+                bc.SlowRate = n
+            }
+        default:
+            return fmt.Errorf("unknown circuit_breaker directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for circuit_breaker block")
+}
+
 func (p *Parser) parseHealthCheck() error {
     // Enable health checking when the block is present
     p.currentVHost.Upstream.HealthCheck.Enabled = true
@@ -566,6 +1222,407 @@ func (p *Parser) parseHealthCheck() error {
     return fmt.Errorf("unexpected end of file: missing closing } for health_check block")
 }
 
+// parseHeaders parses a headers block. As with nginx proxy_set_header, a
+// headers block in a location replaces the one inherited from the vhost.
+func (p *Parser) parseHeaders() error {
+    var h proxy.HeaderRules
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            p.currentVHost.Headers = h
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        switch parts[0] {
+        case "request_set", "response_set":
+            if len(parts) < 3 {
+                return fmt.Errorf("%s requires a header name and value", parts[0])
+            }
+            hv := proxy.Header{Name: parts[1], Value: unquote(strings.Join(parts[2:], " "))}
+            if parts[0] == "request_set" {
+                h.RequestSet = append(h.RequestSet, hv)
+            } else {
+                h.ResponseSet = append(h.ResponseSet, hv)
+            }
+        case "request_remove", "response_remove":
+            if len(parts) != 2 {
+                return fmt.Errorf("%s requires a single header name", parts[0])
+            }
+            if parts[0] == "request_remove" {
+                h.RequestRemove = append(h.RequestRemove, parts[1])
+            } else {
+                h.ResponseRemove = append(h.ResponseRemove, parts[1])
+            }
+        default:
+            return fmt.Errorf("unknown headers directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for headers block")
+}
+
+// parseTimeouts parses a timeouts block. They apply to proxy_pass and
+// upstream backends.
+func (p *Parser) parseTimeouts() error {
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) != 2 {
+            return fmt.Errorf("timeouts %s requires a single duration", parts[0])
+        }
+        d, err := time.ParseDuration(parts[1])
+        if err != nil || d <= 0 {
+            return fmt.Errorf("invalid timeouts %s %q: must be a positive duration such as 30s", parts[0], parts[1])
+        }
+        switch parts[0] {
+        case "connect":
+            p.currentVHost.Timeouts.Connect = d
+        case "read":
+            p.currentVHost.Timeouts.Read = d
+        case "send":
+            p.currentVHost.Timeouts.Send = d
+        case "idle":
+            p.currentVHost.Timeouts.Idle = d
+        default:
+            return fmt.Errorf("unknown timeouts directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for timeouts block")
+}
+
+// parseAuthBasic parses an auth_basic block protecting the vhost with the
+// users of an htpasswd file.
+func (p *Parser) parseAuthBasic() error {
+    cfg := p.currentVHost.AuthBasic
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if cfg.UserFile == "" {
+                return fmt.Errorf("auth_basic requires user_file")
+            }
+            if cfg.Realm == "" {
+                cfg.Realm = "Restricted"
+            }
+            p.currentVHost.AuthBasic = cfg
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) < 2 {
+            return fmt.Errorf("auth_basic %s requires a value", parts[0])
+        }
+        switch parts[0] {
+        case "realm":
+            cfg.Realm = unquote(strings.Join(parts[1:], " "))
+        case "user_file":
+            cfg.UserFile = unquote(parts[1])
+        default:
+            return fmt.Errorf("unknown auth_basic directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for auth_basic block")
+}
+
+// parseAccess parses an access block of allow and deny rules. The block
+// replaces the rules a location inherits rather than adding to them.
+func (p *Parser) parseAccess() error {
+    cfg := security.AccessConfig{}
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if len(cfg.Rules) == 0 {
+                return fmt.Errorf("access requires at least one allow, deny or include rule")
+            }
+            p.currentVHost.Access = cfg
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) != 2 {
+            return fmt.Errorf("access %s requires a single argument", parts[0])
+        }
+        if parts[0] == "include" {
+            cfg.Rules = append(cfg.Rules, security.AccessRule{File: parts[1]})
+            continue
+        }
+        rule, err := security.ParseAccessRule(parts[0], parts[1])
+        if err != nil {
+            return err
+        }
+        cfg.Rules = append(cfg.Rules, rule)
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for access block")
+}
+
+// parseLimitConn parses a limit_conn block capping in-flight requests and
+// open connections.
+func (p *Parser) parseLimitConn() error {
+    cfg := security.ConnLimitConfig{}
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if cfg.PerIP == 0 && cfg.PerVHost == 0 && cfg.ConnsPerIP == 0 {
+                return fmt.Errorf("limit_conn requires per_ip, per_vhost or connections_per_ip")
+            }
+            p.currentVHost.LimitConn = cfg
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) != 2 {
+            return fmt.Errorf("limit_conn %s requires a single number", parts[0])
+        }
+        n, err := strconv.Atoi(parts[1])
+        if err != nil || n <= 0 {
+            return fmt.Errorf("invalid limit_conn %s %q: must be a positive number", parts[0], parts[1])
+        }
+        switch parts[0] {
+        case "per_ip":
+            cfg.PerIP = n
+        case "per_vhost":
+            cfg.PerVHost = n
+        case "connections_per_ip":
+            cfg.ConnsPerIP = n
+        case "status":
+            if n != 429 && n != 503 {
+                return fmt.Errorf("invalid limit_conn status %d: must be 429 or 503", n)
+            }
+            cfg.Status = n
+        default:
+            return fmt.Errorf("unknown limit_conn directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for limit_conn block")
+}
+
+// parseWAF parses a waf block. A location's block starts from the vhost's
+// settings, so rules and exclude_rules add to them.
+func (p *Parser) parseWAF() error {
+    cfg := &p.currentVHost.WAF
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if cfg.Mode == "" {
+                return fmt.Errorf("waf requires mode detect or block")
+            }
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) < 2 {
+            return fmt.Errorf("waf %s requires a value", parts[0])
+        }
+        switch parts[0] {
+        case "mode":
+            if len(parts) != 2 || (parts[1] != waf.ModeDetect && parts[1] != waf.ModeBlock) {
+                return fmt.Errorf("waf mode must be detect or block")
+            }
+            cfg.Mode = parts[1]
+        case "rules":
+            cfg.Rules = append(cfg.Rules, parts[1:]...)
+        case "base_rules":
+            if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+                return fmt.Errorf("waf base_rules must be on or off")
+            }
+            cfg.NoBaseRules = parts[1] == "off"
+        case "threshold":
+            n, err := strconv.Atoi(parts[1])
+            if len(parts) != 2 || err != nil || n <= 0 {
+                return fmt.Errorf("invalid waf threshold %q: must be a positive integer", parts[1])
+            }
+            cfg.Threshold = n
+        case "body_limit":
+            size, err := parseByteSize(parts[1])
+            if len(parts) != 2 || err != nil || size <= 0 {
+                return fmt.Errorf("invalid waf body_limit %q: must be a positive size", parts[1])
+            }
+            cfg.BodyLimit = size
+        case "exclude_rules":
+            for _, a := range parts[1:] {
+                id, err := strconv.Atoi(a)
+                if err != nil || id <= 0 {
+                    return fmt.Errorf("invalid waf rule id %q", a)
+                }
+                cfg.ExcludeRules = append(cfg.ExcludeRules, id)
+            }
+        default:
+            return fmt.Errorf("unknown waf directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for waf block")
+}
+
+// parseJWT parses a jwt block validating bearer tokens against local keys.
+func (p *Parser) parseJWT() error {
+    cfg := p.currentVHost.JWT
+    claimsSet := false
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if cfg.Keys == "" {
+                return fmt.Errorf("jwt requires keys")
+            }
+            p.currentVHost.JWT = cfg
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) < 2 {
+            return fmt.Errorf("jwt %s requires a value", parts[0])
+        }
+        switch parts[0] {
+        case "keys":
+            cfg.Keys = unquote(parts[1])
+        case "issuer":
+            cfg.Issuer = unquote(parts[1])
+        case "audience":
+            cfg.Audience = unquote(parts[1])
+        case "claims_to_headers":
+            // A block that sets claims replaces the inherited ones.
+            if !claimsSet {
+                cfg.ClaimsToHeaders = nil
+                claimsSet = true
+            }
+            for _, pair := range parts[1:] {
+                claim, header, ok := strings.Cut(pair, ":")
+                if !ok || claim == "" || header == "" {
+                    return fmt.Errorf("invalid claims_to_headers entry %q: must be claim:Header", pair)
+                }
+                cfg.ClaimsToHeaders = append(cfg.ClaimsToHeaders, auth.ClaimHeader{Claim: claim, Header: header})
+            }
+        default:
+            return fmt.Errorf("unknown jwt directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for jwt block")
+}
+
+// parseKeepalive parses a keepalive block sizing the idle connection pool
+// to proxy_pass and upstream backends.
+func (p *Parser) parseKeepalive() error {
+    for p.scanner.Scan() {
+        p.line++
+        line := strings.TrimSpace(p.scanner.Text())
+
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            return nil
+        }
+
+        parts := strings.Fields(line)
+        if len(parts) != 2 {
+            return fmt.Errorf("keepalive %s requires a single number", parts[0])
+        }
+        n, err := strconv.Atoi(parts[1])
+        if err != nil || n <= 0 {
+            return fmt.Errorf("invalid keepalive %s %q: must be a positive number", parts[0], parts[1])
+        }
+        switch parts[0] {
+        case "max_idle":
+            p.currentVHost.Keepalive.MaxIdle = n
+        case "max_idle_per_host":
+            p.currentVHost.Keepalive.MaxIdlePerHost = n
+        default:
+            return fmt.Errorf("unknown keepalive directive %q", parts[0])
+        }
+    }
+    return fmt.Errorf("unexpected end of file: missing closing } for keepalive block")
+}
+
+// parseReturn parses the arguments of "return <code> [url|text]" or the
+// nginx shorthand "return <url>", which is a 302.
+func parseReturn(args []string) (ReturnConfig, error) {
+    if len(args) == 0 {
+        return ReturnConfig{}, fmt.Errorf("return requires a status code or URL")
+    }
+    if isAbsoluteURL(args[0]) && len(args) == 1 {
+        return ReturnConfig{Code: 302, Target: args[0]}, nil
+    }
+    code, err := strconv.Atoi(args[0])
+    if err != nil || code < 100 || code > 599 {
+        return ReturnConfig{}, fmt.Errorf("invalid return status code %q: must be 100-599", args[0])
+    }
+    rc := ReturnConfig{Code: code, Target: unquote(strings.Join(args[1:], " "))}
+    if redirect.IsRedirect(code) && rc.Target == "" {
+        return ReturnConfig{}, fmt.Errorf("return %d requires a URL", code)
+    }
+    return rc, nil
+}
+
+// parseRedirect parses "redirect <url> [301|302|307|308]". The default is 301.
+func parseRedirect(args []string) (ReturnConfig, error) {
+    if len(args) == 0 {
+        return ReturnConfig{}, fmt.Errorf("redirect requires a URL")
+    }
+    rc := ReturnConfig{Code: 301, Target: args[0]}
+    if len(args) > 1 {
+        code, err := strconv.Atoi(args[1])
+        if err != nil {
+            return ReturnConfig{}, fmt.Errorf("invalid redirect status code %q", args[1])
+        }
+        switch code {
+        case 301, 302, 307, 308:
+        default:
+            return ReturnConfig{}, fmt.Errorf("invalid redirect status code %d: must be 301, 302, 307, or 308", code)
+        }
+        rc.Code = code
+    }
+    return rc, nil
+}
+
+func isAbsoluteURL(s string) bool {
+    return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "$scheme://")
+}
+
+// unquote strips one pair of surrounding double quotes, if present.
+func unquote(s string) string {
+    if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+        return s[1 : len(s)-1]
+    }
+    return s
+}
+
 // parseByteSize parses human-readable byte sizes like "256MB", "1GB", "512KB".
 func parseByteSize(s string) (int64, error) {
     s = strings.TrimSpace(s)
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_Access(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        access {
+            deny 192.0.2.1
+            allow all
+        }
+        location /admin {
+            access {
+                allow 10.0.0.0/8
+                allow 2001:db8::/32
+                include /etc/tinyproxy/office.list
+                deny all
+            }
+        }
+        location /health {
+            access off
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	if r := vh.Access.Rules; len(r) != 2 || r[0].Allow || r[0].Prefix.String() != "192.0.2.1/32" || !r[1].Allow || !r[1].All {
+		t.Errorf("Access = %+v", vh.Access)
+	}
+	r := vh.Locations[0].VHost.Access.Rules
+	if len(r) != 4 {
+		t.Fatalf("/admin rules = %+v, want 4 replacing the inherited ones", r)
+	}
+	if r[1].Prefix.String() != "2001:db8::/32" || r[2].File != "/etc/tinyproxy/office.list" || r[3].Allow || !r[3].All {
+		t.Errorf("/admin rules = %+v", r)
+	}
+	if r := vh.Locations[1].VHost.Access.Rules; len(r) != 0 {
+		t.Errorf("/health rules = %+v, want off", r)
+	}
+
+	for _, block := range []string{
+		"access {\n }",
+		"access {\n allow\n }",
+		"access {\n allow 10.0.0.0/8 192.0.2.0/24\n }",
+		"access {\n permit 10.0.0.0/8\n }",
+		"access {\n deny 300.0.0.1\n }",
+	} {
+		input := "vhosts {\n example.com {\n  " + block + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", block)
+		}
+	}
+}
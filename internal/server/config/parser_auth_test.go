@@ -0,0 +1,141 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_AuthBasic(t *testing.T) {
+	input := `
+vhosts {
+    staging.example.com {
+        proxy_pass http://localhost:3000
+        auth_basic {
+            realm "Staging Area"
+            user_file /etc/tinyproxy/staging.htpasswd
+        }
+        location /health {
+            auth_basic off
+        }
+        location /admin {
+            auth_basic {
+                realm Admins
+            }
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["staging.example.com"]
+	if vh.AuthBasic.Realm != "Staging Area" || vh.AuthBasic.UserFile != "/etc/tinyproxy/staging.htpasswd" {
+		t.Errorf("AuthBasic = %+v", vh.AuthBasic)
+	}
+	if ab := vh.Locations[0].VHost.AuthBasic; ab.UserFile != "" {
+		t.Errorf("/health AuthBasic = %+v, want off", ab)
+	}
+	if ab := vh.Locations[1].VHost.AuthBasic; ab.Realm != "Admins" || ab.UserFile != vh.AuthBasic.UserFile {
+		t.Errorf("/admin AuthBasic = %+v, want realm overridden and user_file inherited", ab)
+	}
+}
+
+func TestParser_AuthBasicErrors(t *testing.T) {
+	for _, block := range []string{
+		"auth_basic {\n realm Staging\n }",
+		"auth_basic {\n user_file\n }",
+		"auth_basic {\n password secret\n }",
+		"auth_basic on",
+	} {
+		input := "vhosts {\n example.com {\n  " + block + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", block)
+		}
+	}
+}
+
+func TestParser_AuthRequest(t *testing.T) {
+	input := `
+vhosts {
+    app.example.com {
+        proxy_pass http://localhost:3000
+        auth_request http://127.0.0.1:9000/verify
+        auth_request_headers X-User X-Email
+        location /public {
+            auth_request off
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["app.example.com"]
+	ar := vh.AuthRequest
+	if ar.URL != "http://127.0.0.1:9000/verify" || len(ar.Headers) != 2 || ar.Headers[1] != "X-Email" {
+		t.Errorf("AuthRequest = %+v", ar)
+	}
+	if ar := vh.Locations[0].VHost.AuthRequest; ar.URL != "" {
+		t.Errorf("/public AuthRequest = %+v, want off", ar)
+	}
+
+	for _, line := range []string{"auth_request /auth", "auth_request", "auth_request_headers"} {
+		input := "vhosts {\n example.com {\n  " + line + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
+
+func TestParser_JWT(t *testing.T) {
+	input := `
+vhosts {
+    api.example.com {
+        proxy_pass http://localhost:3000
+        jwt {
+            keys /etc/tinyproxy/jwks.json
+            issuer https://auth.example.com
+            audience api
+            claims_to_headers sub:X-User-Id email:X-Email
+        }
+        location /admin {
+            jwt {
+                claims_to_headers role:X-Role
+            }
+        }
+        location /health {
+            jwt off
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["api.example.com"]
+	j := vh.JWT
+	if j.Keys != "/etc/tinyproxy/jwks.json" || j.Issuer != "https://auth.example.com" || j.Audience != "api" {
+		t.Errorf("JWT = %+v", j)
+	}
+	if len(j.ClaimsToHeaders) != 2 || j.ClaimsToHeaders[1].Claim != "email" || j.ClaimsToHeaders[1].Header != "X-Email" {
+		t.Errorf("ClaimsToHeaders = %+v", j.ClaimsToHeaders)
+	}
+	admin := vh.Locations[0].VHost.JWT
+	if admin.Keys != j.Keys || len(admin.ClaimsToHeaders) != 1 || admin.ClaimsToHeaders[0].Claim != "role" {
+		t.Errorf("/admin JWT = %+v, want keys inherited and claims replaced", admin)
+	}
+	if vh.Locations[1].VHost.JWT.Keys != "" {
+		t.Errorf("/health JWT = %+v, want off", vh.Locations[1].VHost.JWT)
+	}
+
+	for _, block := range []string{
+		"jwt {\n issuer x\n }",
+		"jwt {\n keys k.json\n claims_to_headers sub\n }",
+		"jwt {\n keys k.json\n leeway 5s\n }",
+	} {
+		input := "vhosts {\n example.com {\n  " + block + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", block)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_ErrorPage(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        error_page 502 503 504 /etc/tinyproxy/errors/5xx.html.tmpl
+        error_page 404 /etc/tinyproxy/errors/404.html
+        intercept_errors on
+        location /api {
+            error_page 502 /etc/tinyproxy/errors/api.json
+        }
+        location /static {
+            root /var/www
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+
+	ep := vh.ErrorPages
+	if len(ep.Pages) != 4 || ep.Pages[503] != "/etc/tinyproxy/errors/5xx.html.tmpl" || ep.Pages[404] != "/etc/tinyproxy/errors/404.html" {
+		t.Errorf("Pages = %v", ep.Pages)
+	}
+	if !ep.InterceptErrors {
+		t.Error("InterceptErrors = false, want true")
+	}
+
+	api := vh.Locations[0].VHost.ErrorPages
+	if len(api.Pages) != 1 || api.Pages[502] != "/etc/tinyproxy/errors/api.json" {
+		t.Errorf("location error_page should replace the vhost's, got %v", api.Pages)
+	}
+	if !api.InterceptErrors {
+		t.Error("location should inherit intercept_errors")
+	}
+	if static := vh.Locations[1].VHost.ErrorPages; len(static.Pages) != 4 {
+		t.Errorf("location without error_page should inherit, got %v", static.Pages)
+	}
+}
+
+func TestParser_ErrorPageErrors(t *testing.T) {
+	for _, line := range []string{
+		"error_page /50x.html",
+		"error_page 200 /ok.html",
+		"error_page abc /x.html",
+		"intercept_errors yes",
+	} {
+		input := "vhosts {\n example.com {\n  " + line + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
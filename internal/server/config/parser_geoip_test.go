@@ -0,0 +1,59 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParser_GeoIP(t *testing.T) {
+	input := `
+geoip {
+    country_db /var/lib/GeoIP/GeoLite2-Country.mmdb
+    asn_db /var/lib/GeoIP/GeoLite2-ASN.mmdb
+}
+
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        block_countries RU CN
+        block_asn 14061 AS16509
+        location /status {
+            block_countries off
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if cfg.GeoIP.CountryDB != "/var/lib/GeoIP/GeoLite2-Country.mmdb" || cfg.GeoIP.ASNDB != "/var/lib/GeoIP/GeoLite2-ASN.mmdb" {
+		t.Errorf("GeoIP = %+v", cfg.GeoIP)
+	}
+	vh := cfg.VHosts["example.com"]
+	if !slices.Equal(vh.GeoIP.BlockCountries, []string{"RU", "CN"}) || !slices.Equal(vh.GeoIP.BlockASN, []uint{14061, 16509}) {
+		t.Errorf("vhost GeoIP = %+v", vh.GeoIP)
+	}
+	loc := vh.Locations[0].VHost.GeoIP
+	if len(loc.BlockCountries) != 0 || !slices.Equal(loc.BlockASN, []uint{14061, 16509}) {
+		t.Errorf("/status GeoIP = %+v, want countries off and ASNs inherited", loc)
+	}
+
+	for _, input := range []string{
+		"geoip {\n}",
+		"geoip {\n country_db\n}",
+		"geoip {\n city_db /x.mmdb\n}",
+		"geoip {\n country_db /x.mmdb\n",
+		"geoip {\n asn_db /x.mmdb\n}\nvhosts {\n example.com {\n  block_countries RU\n }\n}",
+		"geoip {\n country_db /x.mmdb\n}\nvhosts {\n example.com {\n  location /api {\n   block_asn 14061\n  }\n }\n}",
+		"geoip {\n country_db /x.mmdb\n}\nvhosts {\n example.com {\n  block_countries\n }\n}",
+		"geoip {\n country_db /x.mmdb\n}\nvhosts {\n example.com {\n  block_countries ru\n }\n}",
+		"geoip {\n country_db /x.mmdb\n}\nvhosts {\n example.com {\n  block_countries RUS\n }\n}",
+		"geoip {\n asn_db /x.mmdb\n}\nvhosts {\n example.com {\n  block_asn 0\n }\n}",
+		"geoip {\n asn_db /x.mmdb\n}\nvhosts {\n example.com {\n  block_asn hetzner\n }\n}",
+	} {
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
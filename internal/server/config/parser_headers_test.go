@@ -0,0 +1,68 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_Headers(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        headers {
+            request_set X-Forwarded-For $remote_addr
+            request_set X-Client "tinyproxy edge"
+            request_remove Cookie
+            response_set X-Frame-Options DENY
+            response_remove X-Powered-By
+        }
+        location /api {
+            headers {
+                request_set X-Api 1
+            }
+        }
+        location /static {
+            root /var/www
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	h := vh.Headers
+
+	if len(h.RequestSet) != 2 || h.RequestSet[1].Name != "X-Client" || h.RequestSet[1].Value != "tinyproxy edge" {
+		t.Errorf("RequestSet = %+v", h.RequestSet)
+	}
+	if len(h.RequestRemove) != 1 || h.RequestRemove[0] != "Cookie" {
+		t.Errorf("RequestRemove = %v", h.RequestRemove)
+	}
+	if len(h.ResponseSet) != 1 || len(h.ResponseRemove) != 1 {
+		t.Errorf("response rules = %+v", h)
+	}
+
+	api := vh.Locations[0].VHost.Headers
+	if len(api.RequestSet) != 1 || api.RequestSet[0].Name != "X-Api" || len(api.ResponseRemove) != 0 {
+		t.Errorf("location headers block should replace the vhost's, got %+v", api)
+	}
+	if static := vh.Locations[1].VHost.Headers; len(static.RequestSet) != 2 {
+		t.Errorf("location without headers block should inherit, got %+v", static)
+	}
+}
+
+func TestParser_HeadersErrors(t *testing.T) {
+	for _, body := range []string{
+		"request_set X-Only",
+		"request_remove",
+		"response_remove A B",
+		"add X-Foo bar",
+	} {
+		input := "vhosts {\n example.com {\n  headers {\n   " + body + "\n  }\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", body)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_LimitConn(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        limit_conn {
+            per_ip 20
+            per_vhost 2000
+            connections_per_ip 50
+        }
+        location /upload {
+            limit_conn {
+                per_ip 2
+                status 429
+            }
+        }
+        location /internal {
+            limit_conn off
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	if lc := vh.LimitConn; lc.PerIP != 20 || lc.PerVHost != 2000 || lc.ConnsPerIP != 50 || lc.Status != 0 {
+		t.Errorf("LimitConn = %+v", lc)
+	}
+	if lc := vh.Locations[0].VHost.LimitConn; lc.PerIP != 2 || lc.PerVHost != 0 || lc.ConnsPerIP != 0 || lc.Status != 429 {
+		t.Errorf("/upload LimitConn = %+v, want its own limits only", lc)
+	}
+	if lc := vh.Locations[1].VHost.LimitConn; lc.PerIP != 0 || lc.PerVHost != 0 {
+		t.Errorf("/internal LimitConn = %+v, want off", lc)
+	}
+
+	for _, block := range []string{
+		"limit_conn {\n }",
+		"limit_conn {\n per_ip 0\n }",
+		"limit_conn {\n connections_per_ip 0\n }",
+		"limit_conn {\n per_ip 5\n status 500\n }",
+		"limit_conn {\n per_server 5\n }",
+	} {
+		input := "vhosts {\n example.com {\n  " + block + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", block)
+		}
+	}
+}
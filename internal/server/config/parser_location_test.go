@@ -0,0 +1,147 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_Locations(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        port 80
+        root /var/www
+
+        location /api {
+            proxy_pass http://api:3000
+        }
+
+        location = /healthz {
+            proxy_pass http://health:8080
+        }
+
+        location ~* \.php$ {
+            fastcgi {
+                pass 127.0.0.1:9000
+                index index.php
+            }
+        }
+
+        bot_protection {
+            enabled true
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	if len(vh.Locations) != 3 {
+		t.Fatalf("got %d locations, want 3", len(vh.Locations))
+	}
+
+	api := vh.Locations[0]
+	if api.Modifier != MatchPrefix || api.Path != "/api" {
+		t.Errorf("locations[0] = %s", api)
+	}
+	if api.VHost.ProxyPass != "http://api:3000" {
+		t.Errorf("api ProxyPass = %q", api.VHost.ProxyPass)
+	}
+	if api.VHost.Root != "" {
+		t.Errorf("api should not inherit root when it sets proxy_pass, got %q", api.VHost.Root)
+	}
+	// Directives declared after the location block are still inherited.
+	if !api.VHost.BotProtection.Enabled {
+		t.Error("api should inherit bot_protection from the vhost")
+	}
+
+	php := vh.Locations[2]
+	if php.VHost.FastCGI.Pass != "127.0.0.1:9000" {
+		t.Errorf("php FastCGI.Pass = %q", php.VHost.FastCGI.Pass)
+	}
+	if php.VHost.Root != "/var/www" {
+		t.Errorf("php should keep the inherited root for fastcgi, got %q", php.VHost.Root)
+	}
+
+	// The vhost itself is unchanged by its locations.
+	if vh.ProxyPass != "" || vh.Root != "/var/www" {
+		t.Errorf("vhost backend changed: proxy_pass=%q root=%q", vh.ProxyPass, vh.Root)
+	}
+}
+
+func TestMatchLocation_Precedence(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        root /var/www
+        location / {
+            root /srv/default
+        }
+        location /static {
+            root /srv/static
+        }
+        location ^~ /assets {
+            root /srv/assets
+        }
+        location = /exact {
+            root /srv/exact
+        }
+        location ~ \.png$ {
+            root /srv/png
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+
+	cases := []struct{ path, wantRoot string }{
+		{"/exact", "/srv/exact"},
+		{"/exact/more", "/srv/default"},
+		{"/static/app.js", "/srv/static"},
+		{"/static/logo.png", "/srv/png"},    // regex beats plain prefix
+		{"/assets/logo.png", "/srv/assets"}, // ^~ prefix skips regex
+		{"/other", "/srv/default"},
+	}
+	for _, c := range cases {
+		loc := vh.MatchLocation(c.path)
+		if loc == nil {
+			t.Errorf("MatchLocation(%q) = nil, want root %q", c.path, c.wantRoot)
+			continue
+		}
+		if loc.VHost.Root != c.wantRoot {
+			t.Errorf("MatchLocation(%q) = %s (root %q), want root %q", c.path, loc, loc.VHost.Root, c.wantRoot)
+		}
+	}
+}
+
+func TestParser_LocationErrors(t *testing.T) {
+	cases := map[string]string{
+		"bad modifier": `location ~~ /x {
+            root /a
+        }`,
+		"relative path": `location api {
+            root /a
+        }`,
+		"bad regex": `location ~ ([ {
+            root /a
+        }`,
+		"nested": `location /a {
+            location /b {
+                root /a
+            }
+        }`,
+		"unknown directive": `location /a {
+            bogus on
+        }`,
+	}
+	for name, loc := range cases {
+		input := "vhosts {\n    example.com {\n        " + loc + "\n    }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%s: expected parse error", name)
+		}
+	}
+}
@@ -12,6 +12,12 @@ vhosts {
         port 80
         root /var/www
         max_body_size 20MB
+        location /upload {
+            max_body_size 1GB
+        }
+        location /stream {
+            max_body_size 0
+        }
     }
 }`
 	p := NewParser(strings.NewReader(input))
@@ -27,4 +33,10 @@ vhosts {
 	if vh.MaxBodySize != want {
 		t.Errorf("MaxBodySize = %d, want %d", vh.MaxBodySize, want)
 	}
+	if got := vh.Locations[0].VHost.MaxBodySize; got != 1<<30 {
+		t.Errorf("/upload MaxBodySize = %d, want %d", got, 1<<30)
+	}
+	if got := vh.Locations[1].VHost.MaxBodySize; got != 0 {
+		t.Errorf("/stream MaxBodySize = %d, want 0", got)
+	}
 }
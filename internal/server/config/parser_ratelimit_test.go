@@ -0,0 +1,170 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"tinyproxy/internal/server/security"
+)
+
+func TestParser_RateLimit(t *testing.T) {
+	input := `
+rate_limit_zone api {
+    requests 10
+    window 1s
+    burst 20
+    nodelay
+    key header X-Api-Key
+}
+
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        security {
+            rate_limit {
+                requests 300
+                window 1m
+                burst 50
+                delay 10
+                key cookie session
+            }
+        }
+        rate_limit_zones api login
+        location /login {
+            rate_limit_zones login
+            security {
+                rate_limit off
+            }
+        }
+        location /health {
+            rate_limit_zones off
+        }
+    }
+}
+
+rate_limit_zone login {
+    requests 5
+    window 1m
+    key jwt_sub
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if got, want := cfg.RateLimitZones["api"], (security.RateLimitConfig{
+		Requests: 10, Window: time.Second, Burst: 20, Key: "header", KeyName: "X-Api-Key",
+	}); got != want {
+		t.Errorf("zone api = %+v, want %+v", got, want)
+	}
+	if got := cfg.RateLimitZones["login"]; got.Requests != 5 || got.Key != "jwt_sub" {
+		t.Errorf("zone login = %+v", got)
+	}
+
+	vh := cfg.VHosts["example.com"]
+	if got, want := vh.Security.RateLimit, (security.RateLimitConfig{
+		Requests: 300, Window: time.Minute, Burst: 50, Queue: true, Delay: 10, Key: "cookie", KeyName: "session",
+	}); got != want {
+		t.Errorf("rate_limit = %+v, want %+v", got, want)
+	}
+	if !slices.Equal(vh.RateLimitZones, []string{"api", "login"}) {
+		t.Errorf("RateLimitZones = %v", vh.RateLimitZones)
+	}
+	login := vh.Locations[0].VHost
+	if !slices.Equal(login.RateLimitZones, []string{"login"}) || login.Security.RateLimit.Requests != 0 {
+		t.Errorf("/login zones = %v, rate_limit = %+v", login.RateLimitZones, login.Security.RateLimit)
+	}
+	if health := vh.Locations[1].VHost; len(health.RateLimitZones) != 0 || health.Security.RateLimit.Requests != 300 {
+		t.Errorf("/health zones = %v, rate_limit = %+v", health.RateLimitZones, health.Security.RateLimit)
+	}
+
+	for _, input := range []string{
+		"rate_limit_zone api {\n window 1s\n}",
+		"rate_limit_zone api\n",
+		"rate_limit_zone api {\n requests 1\n}\nrate_limit_zone api {\n requests 2\n}",
+		"rate_limit_zone api {\n requests 1\n burst 0\n}",
+		"rate_limit_zone api {\n requests 1\n delay -1\n}",
+		"rate_limit_zone api {\n requests 1\n nodelay 5\n}",
+		"rate_limit_zone api {\n requests 1\n key header\n}",
+		"rate_limit_zone api {\n requests 1\n key user\n}",
+		"rate_limit_zone api {\n requests 1\n",
+		"vhosts {\n example.com {\n  rate_limit_zones missing\n }\n}",
+		"vhosts {\n example.com {\n  rate_limit_zones\n }\n}",
+	} {
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestParser_RateLimitRedis(t *testing.T) {
+	input := `
+rate_limit_redis {
+    address redis.internal:6379
+    password secret
+    db 3
+    timeout 50ms
+    on_error deny
+}
+
+rate_limit_zone api {
+    requests 10
+    store redis
+}
+
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        security {
+            rate_limit {
+                requests 300
+                store redis
+            }
+        }
+        location /local {
+            security {
+                rate_limit {
+                    requests 10
+                    store memory
+                }
+            }
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if got, want := cfg.RateLimitRedis, (security.RedisConfig{
+		Address: "redis.internal:6379", Password: "secret", DB: 3, Timeout: 50 * time.Millisecond, FailClosed: true,
+	}); got != want {
+		t.Errorf("RateLimitRedis = %+v, want %+v", got, want)
+	}
+	if got := cfg.RateLimitZones["api"].Store; got != security.RateLimitStoreRedis {
+		t.Errorf("zone api store = %q, want redis", got)
+	}
+	vh := cfg.VHosts["example.com"]
+	if got := vh.Security.RateLimit.Store; got != security.RateLimitStoreRedis {
+		t.Errorf("rate_limit store = %q, want redis", got)
+	}
+	if got := vh.Locations[0].VHost.Security.RateLimit.Store; got != "" {
+		t.Errorf("/local store = %q, want memory", got)
+	}
+
+	for _, input := range []string{
+		"rate_limit_redis {\n db 1\n}",
+		"rate_limit_redis {\n address redis.internal\n}",
+		"rate_limit_redis {\n address redis.internal:6379\n on_error ignore\n}",
+		"rate_limit_redis {\n address redis.internal:6379\n timeout 0s\n}",
+		"rate_limit_redis {\n address redis.internal:6379\n db -1\n}",
+		"rate_limit_redis {\n address redis.internal:6379\n",
+		"rate_limit_zone api {\n requests 1\n store disk\n}",
+		"rate_limit_zone api {\n requests 1\n store redis\n}",
+		"vhosts {\n example.com {\n  security {\n   rate_limit {\n    requests 1\n    store redis\n   }\n  }\n }\n}",
+	} {
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
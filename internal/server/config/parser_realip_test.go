@@ -0,0 +1,45 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_TrustedProxies(t *testing.T) {
+	input := `
+trusted_proxies 10.0.0.0/8 192.168.1.1
+trusted_proxies 2001:db8::/32
+proxy_protocol on
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	var got []string
+	for _, p := range cfg.TrustedProxies {
+		got = append(got, p.String())
+	}
+	if strings.Join(got, " ") != "10.0.0.0/8 192.168.1.1/32 2001:db8::/32" {
+		t.Errorf("TrustedProxies = %v", got)
+	}
+	if !cfg.ProxyProtocol {
+		t.Error("ProxyProtocol = false, want true")
+	}
+
+	for _, bad := range []string{
+		"trusted_proxies\n",
+		"trusted_proxies 10.0.0.0/33\n",
+		"trusted_proxies proxy.internal\n",
+		"proxy_protocol yes\n",
+		"proxy_protocol on\n",
+	} {
+		input := bad + "vhosts {\n example.com {\n  proxy_pass http://localhost:3000\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
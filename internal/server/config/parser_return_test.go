@@ -0,0 +1,67 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_ReturnAndRedirect(t *testing.T) {
+	input := `
+vhosts {
+    www.example.com {
+        return 301 https://example.com$request_uri
+    }
+    old.example.com {
+        redirect https://new.example.com$request_uri 308
+    }
+    example.com {
+        root /var/www
+        location /gone {
+            return 410 "This page has been removed"
+        }
+        location /legacy {
+            return https://example.com/
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		got      ReturnConfig
+		wantCode int
+		want     string
+	}{
+		{"return", cfg.VHosts["www.example.com"].Return, 301, "https://example.com$request_uri"},
+		{"redirect", cfg.VHosts["old.example.com"].Return, 308, "https://new.example.com$request_uri"},
+		{"return text", cfg.VHosts["example.com"].Locations[0].VHost.Return, 410, "This page has been removed"},
+		{"return url", cfg.VHosts["example.com"].Locations[1].VHost.Return, 302, "https://example.com/"},
+	}
+	for _, c := range cases {
+		if c.got.Code != c.wantCode || c.got.Target != c.want {
+			t.Errorf("%s: got %d %q, want %d %q", c.name, c.got.Code, c.got.Target, c.wantCode, c.want)
+		}
+	}
+	if cfg.VHosts["example.com"].Return.Code != 0 {
+		t.Error("location return leaked into the vhost")
+	}
+}
+
+func TestParser_ReturnErrors(t *testing.T) {
+	for _, line := range []string{
+		"return",
+		"return abc",
+		"return 999",
+		"return 301",
+		"redirect",
+		"redirect https://example.com 200",
+	} {
+		input := "vhosts {\n    example.com {\n        " + line + "\n    }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected parse error", line)
+		}
+	}
+}
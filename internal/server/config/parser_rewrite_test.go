@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParser_Rewrite(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        root /var/www
+        rewrite ^/blog/(\d+)/(.*)$ /posts/$2?year=$1 last
+        rewrite ^/old-docs/(.*)$ /docs/$1 permanent
+        location /posts {
+            rewrite ^/posts/(.*)$ /index.php?slug=$1 break
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+
+	if len(vh.Rewrites) != 2 {
+		t.Fatalf("got %d vhost rewrites, want 2", len(vh.Rewrites))
+	}
+	if got := vh.Rewrites[0].String(); got != `rewrite ^/blog/(\d+)/(.*)$ /posts/$2?year=$1 last` {
+		t.Errorf("Rewrites[0] = %s", got)
+	}
+	if vh.Rewrites[1].Flag != "permanent" {
+		t.Errorf("Rewrites[1].Flag = %q, want permanent", vh.Rewrites[1].Flag)
+	}
+
+	loc := vh.Locations[0].VHost
+	if len(loc.Rewrites) != 1 || loc.Rewrites[0].Replacement != "/index.php?slug=$1" {
+		t.Errorf("location rewrites = %v, want only its own rule", loc.Rewrites)
+	}
+}
+
+func TestParser_RewriteErrors(t *testing.T) {
+	for _, line := range []string{
+		"rewrite",
+		"rewrite ^/a$",
+		"rewrite ^/(a$ /b",
+		"rewrite ^/a$ /b sometimes",
+		"rewrite ^/a$ /b last extra",
+	} {
+		input := "vhosts {\n example.com {\n  " + line + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
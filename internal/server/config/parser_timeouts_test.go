@@ -0,0 +1,64 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParser_TimeoutsAndKeepalive(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        timeouts {
+            connect 5s
+            read 30s
+            send 10s
+            idle 2m
+        }
+        keepalive {
+            max_idle 200
+            max_idle_per_host 50
+        }
+        location /reports {
+            timeouts {
+                read 10m
+            }
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+
+	to := vh.Timeouts
+	if to.Connect != 5*time.Second || to.Read != 30*time.Second || to.Send != 10*time.Second || to.Idle != 2*time.Minute {
+		t.Errorf("Timeouts = %+v", to)
+	}
+	if vh.Keepalive.MaxIdle != 200 || vh.Keepalive.MaxIdlePerHost != 50 {
+		t.Errorf("Keepalive = %+v", vh.Keepalive)
+	}
+
+	loc := vh.Locations[0].VHost.Timeouts
+	if loc.Read != 10*time.Minute || loc.Connect != 5*time.Second {
+		t.Errorf("location Timeouts = %+v, want read overridden and the rest inherited", loc)
+	}
+}
+
+func TestParser_TimeoutsErrors(t *testing.T) {
+	for _, block := range []string{
+		"timeouts {\n read forever\n }",
+		"timeouts {\n read -1s\n }",
+		"timeouts {\n write 5s\n }",
+		"keepalive {\n max_idle many\n }",
+		"keepalive {\n max_conns 5\n }",
+	} {
+		input := "vhosts {\n example.com {\n  " + block + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", block)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParser_TryFiles(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        root /var/www
+        try_files $uri $uri/ /index.php?$args
+        location ~ \.php$ {
+            fastcgi {
+                pass 127.0.0.1:9000
+            }
+        }
+        location /assets {
+            try_files $uri =404
+        }
+        location /app {
+            try_files $uri @backend
+        }
+        location @backend {
+            proxy_pass http://127.0.0.1:3000
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+
+	if want := []string{"$uri", "$uri/", "/index.php?$args"}; !slices.Equal(vh.TryFiles, want) {
+		t.Errorf("vhost try_files = %v, want %v", vh.TryFiles, want)
+	}
+	if len(vh.Locations[0].VHost.TryFiles) != 0 {
+		t.Errorf("vhost try_files leaked into %s", vh.Locations[0])
+	}
+	if want := []string{"$uri", "=404"}; !slices.Equal(vh.Locations[1].VHost.TryFiles, want) {
+		t.Errorf("/assets try_files = %v, want %v", vh.Locations[1].VHost.TryFiles, want)
+	}
+
+	named := vh.NamedLocation("@backend")
+	if named == nil || named.VHost.ProxyPass != "http://127.0.0.1:3000" {
+		t.Fatalf("named location not parsed: %+v", named)
+	}
+	if got := vh.MatchLocation("/@backend"); got != nil {
+		t.Errorf("named location matched a request path: %s", got)
+	}
+}
+
+func TestParser_TryFilesErrors(t *testing.T) {
+	cases := map[string]string{
+		"too few args":   "root /var/www\n try_files $uri",
+		"bad code":       "root /var/www\n try_files $uri =999",
+		"missing root":   "try_files $uri =404",
+		"missing named":  "root /var/www\n try_files $uri @nope",
+		"named modifier": "root /var/www\n location = @x {\n }",
+	}
+	for name, body := range cases {
+		input := "vhosts {\n example.com {\n " + body + "\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
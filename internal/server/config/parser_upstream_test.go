@@ -0,0 +1,238 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tinyproxy/internal/loadbalancer"
+)
+
+func TestParser_UpstreamPassiveChecks(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+            backend http://10.0.0.2:8080
+            max_fails 5 within 1m
+            eject_time 30s
+            max_eject_time 10m
+        }
+    }
+    defaults.example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+        }
+    }
+    off.example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+            max_fails off
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	want := loadbalancer.PassiveCheckConfig{MaxFails: 5, FailWindow: time.Minute, EjectTime: 30 * time.Second, MaxEjectTime: 10 * time.Minute}
+	if got := cfg.VHosts["example.com"].Upstream.Passive; got != want {
+		t.Errorf("Passive = %+v, want %+v", got, want)
+	}
+	if got, want := cfg.VHosts["defaults.example.com"].Upstream.Passive, loadbalancer.DefaultLBConfig().Passive; got != want {
+		t.Errorf("default Passive = %+v, want %+v", got, want)
+	}
+	if got := cfg.VHosts["off.example.com"].Upstream.Passive.MaxFails; got != 0 {
+		t.Errorf("max_fails off: MaxFails = %d, want 0", got)
+	}
+}
+
+func TestParser_UpstreamPassiveErrors(t *testing.T) {
+	for _, line := range []string{
+		"max_fails many",
+		"max_fails -1",
+		"max_fails 3 within",
+		"max_fails 3 within soon",
+		"max_fails 3 during 30s",
+		"eject_time 0s",
+		"max_eject_time forever",
+		"eject_time 10m",
+	} {
+		input := "vhosts {\n example.com {\n  upstream {\n   backend http://10.0.0.1:8080\n   " + line + "\n  }\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestParser_UpstreamRetry(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+            backend http://10.0.0.2:8080
+            retry {
+                attempts 2
+                on connect_error 502 503
+                methods GET HEAD PUT
+                budget 25%
+                body_limit 1MB
+            }
+        }
+    }
+    defaults.example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+            retry {
+            }
+        }
+    }
+    off.example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	want := loadbalancer.RetryConfig{
+		Attempts:     2,
+		ConnectError: true,
+		Statuses:     []int{502, 503},
+		Methods:      []string{"GET", "HEAD", "PUT"},
+		Budget:       25,
+		BodyLimit:    1 << 20,
+	}
+	if got := cfg.VHosts["example.com"].Upstream.Retry; !reflect.DeepEqual(got, want) {
+		t.Errorf("Retry = %+v, want %+v", got, want)
+	}
+	if got, want := cfg.VHosts["defaults.example.com"].Upstream.Retry, loadbalancer.DefaultRetryConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("default Retry = %+v, want %+v", got, want)
+	}
+	if got := cfg.VHosts["off.example.com"].Upstream.Retry.Attempts; got != 0 {
+		t.Errorf("without a retry block: Attempts = %d, want 0", got)
+	}
+}
+
+func TestParser_UpstreamRetryErrors(t *testing.T) {
+	for _, line := range []string{
+		"attempts 0",
+		"attempts many",
+		"on timeout",
+		"on 404",
+		"methods get",
+		"budget 0%",
+		"budget -5%",
+		"body_limit lots",
+		"backoff 1s",
+	} {
+		input := "vhosts {\n example.com {\n  upstream {\n   backend http://10.0.0.1:8080\n   retry {\n    " + line + "\n   }\n  }\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestParser_UpstreamCircuitBreaker(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+            backend http://10.0.0.2:8080
+            circuit_breaker {
+                window 30s
+                min_requests 50
+                error_rate 25%
+                latency 500ms
+                slow_rate 80%
+                open_time 1m
+                half_open_requests 5
+            }
+        }
+    }
+    defaults.example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+            circuit_breaker {
+            }
+        }
+    }
+    off.example.com {
+        upstream {
+            backend http://10.0.0.1:8080
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	want := loadbalancer.BreakerConfig{
+		Enabled:          true,
+		Window:           30 * time.Second,
+		MinRequests:      50,
+		ErrorRate:        25,
+		Latency:          500 * time.Millisecond,
+		SlowRate:         80,
+		OpenTime:         time.Minute,
+		HalfOpenRequests: 5,
+	}
+	if got := cfg.VHosts["example.com"].Upstream.Breaker; got != want {
+		t.Errorf("Breaker = %+v, want %+v", got, want)
+	}
+	if got, want := cfg.VHosts["defaults.example.com"].Upstream.Breaker, loadbalancer.DefaultBreakerConfig(); got != want {
+		t.Errorf("default Breaker = %+v, want %+v", got, want)
+	}
+	if cfg.VHosts["off.example.com"].Upstream.Breaker.Enabled {
+		t.Error("without a circuit_breaker block: breaker enabled")
+	}
+}
+
+func TestParser_UpstreamCircuitBreakerErrors(t *testing.T) {
+	for _, line := range []string{
+		"window 0s",
+		"min_requests 0",
+		"error_rate 0%",
+		"error_rate 150%",
+		"slow_rate off",
+		"latency fast",
+		"half_open_requests",
+		"error_rate off",
+		"trip_after 5",
+	} {
+		input := "vhosts {\n example.com {\n  upstream {\n   backend http://10.0.0.1:8080\n   circuit_breaker {\n    " + line + "\n   }\n  }\n }\n}"
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestParser_UpstreamSlowStart(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want time.Duration
+		ok   bool
+	}{
+		{"slow_start 30s", 30 * time.Second, true},
+		{"slow_start off", 0, true},
+		{"", 0, true},
+		{"slow_start 0s", 0, false},
+		{"slow_start gradually", 0, false},
+	} {
+		input := "vhosts {\n example.com {\n  upstream {\n   backend http://10.0.0.1:8080\n   " + c.line + "\n  }\n }\n}"
+		cfg, err := NewParser(strings.NewReader(input)).Parse()
+		if (err == nil) != c.ok {
+			t.Errorf("%q: err = %v, want ok %v", c.line, err, c.ok)
+			continue
+		}
+		if err == nil && cfg.VHosts["example.com"].Upstream.SlowStart != c.want {
+			t.Errorf("%q: SlowStart = %v, want %v", c.line, cfg.VHosts["example.com"].Upstream.SlowStart, c.want)
+		}
+	}
+}
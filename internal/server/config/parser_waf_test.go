@@ -0,0 +1,88 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"tinyproxy/internal/server/waf"
+)
+
+func TestParser_WAF(t *testing.T) {
+	input := `
+vhosts {
+    example.com {
+        proxy_pass http://localhost:3000
+        waf {
+            mode block
+            rules /etc/go-tinyproxy/waf/*.conf
+            threshold 10
+            body_limit 64KB
+            exclude_rules 920270
+        }
+        location /api {
+            waf {
+                exclude_rules 942100 942110
+                rules /etc/go-tinyproxy/waf/api.conf
+            }
+        }
+        location /preview {
+            waf {
+                mode detect
+                base_rules off
+            }
+        }
+        location /health {
+            waf off
+        }
+    }
+}`
+	cfg, err := NewParser(strings.NewReader(input)).Parse()
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	vh := cfg.VHosts["example.com"]
+	want := waf.Config{
+		Mode:         waf.ModeBlock,
+		Rules:        []string{"/etc/go-tinyproxy/waf/*.conf"},
+		Threshold:    10,
+		BodyLimit:    64 << 10,
+		ExcludeRules: []int{920270},
+	}
+	if !reflect.DeepEqual(vh.WAF, want) {
+		t.Errorf("WAF = %+v, want %+v", vh.WAF, want)
+	}
+
+	// A location's block adds to the vhost's settings.
+	api := vh.Locations[0].VHost.WAF
+	if api.Mode != waf.ModeBlock || api.Threshold != 10 ||
+		!reflect.DeepEqual(api.Rules, []string{"/etc/go-tinyproxy/waf/*.conf", "/etc/go-tinyproxy/waf/api.conf"}) ||
+		!reflect.DeepEqual(api.ExcludeRules, []int{920270, 942100, 942110}) {
+		t.Errorf("/api WAF = %+v", api)
+	}
+	if !reflect.DeepEqual(vh.WAF, want) {
+		t.Errorf("vhost WAF changed by location: %+v", vh.WAF)
+	}
+	if preview := vh.Locations[1].VHost.WAF; preview.Mode != waf.ModeDetect || !preview.NoBaseRules {
+		t.Errorf("/preview WAF = %+v", preview)
+	}
+	if health := vh.Locations[2].VHost.WAF; health.Mode != "" {
+		t.Errorf("/health WAF = %+v, want off", health)
+	}
+
+	for _, input := range []string{
+		"vhosts {\n example.com {\n  waf {\n   rules /x.conf\n  }\n }\n}",
+		"vhosts {\n example.com {\n  waf {\n   mode prevent\n  }\n }\n}",
+		"vhosts {\n example.com {\n  waf {\n   mode block\n   threshold 0\n  }\n }\n}",
+		"vhosts {\n example.com {\n  waf {\n   mode block\n   body_limit lots\n  }\n }\n}",
+		"vhosts {\n example.com {\n  waf {\n   mode block\n   exclude_rules abc\n  }\n }\n}",
+		"vhosts {\n example.com {\n  waf {\n   mode block\n   base_rules maybe\n  }\n }\n}",
+		"vhosts {\n example.com {\n  waf {\n   mode block\n   paranoia 2\n  }\n }\n}",
+		"vhosts {\n example.com {\n  waf on\n }\n}",
+		"vhosts {\n example.com {\n  waf {\n   mode block\n",
+	} {
+		if _, err := NewParser(strings.NewReader(input)).Parse(); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
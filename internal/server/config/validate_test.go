@@ -3,6 +3,8 @@ package config
 import (
 	"testing"
 	"time"
+
+	"tinyproxy/internal/server/security"
 )
 
 func makeMinimalVHost() *VirtualHost {
@@ -12,11 +14,7 @@ func makeMinimalVHost() *VirtualHost {
 		Root:        "/var/www",
 		MaxBodySize: 1024,
 		Security: SecurityConfig{
-			RateLimit: struct {
-				Enabled  bool
-				Requests int
-				Window   time.Duration
-			}{Requests: 10, Window: time.Minute},
+			RateLimit: security.RateLimitConfig{Requests: 10, Window: time.Minute},
 		},
 	}
 }
@@ -1,10 +1,18 @@
 package config
 
 import (
+    "net/netip"
     "time"
 
     "tinyproxy/internal/cache"
     "tinyproxy/internal/loadbalancer"
+    "tinyproxy/internal/server/auth"
+    "tinyproxy/internal/server/errorpage"
+    "tinyproxy/internal/server/geoip"
+    "tinyproxy/internal/server/proxy"
+    "tinyproxy/internal/server/rewrite"
+    "tinyproxy/internal/server/security"
+    "tinyproxy/internal/server/waf"
 )
 
 type SecurityConfig struct {
@@ -15,11 +23,7 @@ type SecurityConfig struct {
         CSP           string 
         HSTS          string 
     }
-    RateLimit struct {
-        Enabled  bool
-        Requests int           
-        Window   time.Duration 
-    }
+    RateLimit   security.RateLimitConfig
     MaxBodySize int64 
 }
 
@@ -33,6 +37,13 @@ type BotProtectionConfig struct {
     BlockedPaths  []string // operator-defined paths to block in addition to built-ins
 }
 
+// ReturnConfig answers requests directly with a status code instead of
+// dispatching them to a backend. Code 0 means no return is configured.
+type ReturnConfig struct {
+    Code   int
+    Target string // redirect URL for 3xx codes, response body otherwise; may contain $variables
+}
+
 type VirtualHost struct {
     Hostname    string
     Port        int
@@ -60,6 +71,28 @@ type VirtualHost struct {
     BotProtection BotProtectionConfig
     Cache         cache.CacheConfig
     Upstream      loadbalancer.LBConfig
+    Locations     []*Location // path-scoped overrides, in config order
+    Return        ReturnConfig
+    // TryFiles lists candidate paths checked under Root in order; the last
+    // entry is the fallback: a URI, "=<status>", or "@<named location>".
+    TryFiles      []string
+    // Rewrites run in order before the request is dispatched. Vhost-level
+    // rules run before location matching, location rules after it.
+    Rewrites      []rewrite.Rule
+    Headers       proxy.HeaderRules
+    Timeouts      proxy.Timeouts
+    Keepalive     proxy.Keepalive
+    ErrorPages    errorpage.Config
+    AuthBasic     auth.BasicConfig
+    AuthRequest   auth.RequestConfig
+    JWT           auth.JWTConfig
+    LimitConn     security.ConnLimitConfig
+    Access        security.AccessConfig
+    GeoIP         geoip.Rules
+    WAF           waf.Config
+    // RateLimitZones names the shared rate_limit_zone limits that apply in
+    // addition to Security.RateLimit, in order.
+    RateLimitZones []string
 }
 
 func NewVirtualHost() *VirtualHost {
@@ -79,12 +112,7 @@ func NewVirtualHost() *VirtualHost {
                 CSP:           "",
                 HSTS:          "max-age=31536000; includeSubDomains",
             },
-            RateLimit: struct {
-                Enabled  bool
-                Requests int           
-                Window   time.Duration
-            }{
-                Enabled:  true,
+            RateLimit: security.RateLimitConfig{
                 Requests: 100,
                 Window:   time.Minute,
             },
@@ -98,6 +126,17 @@ func NewVirtualHost() *VirtualHost {
 
 type ServerConfig struct {
     VHosts map[string]*VirtualHost
+    // TrustedProxies are the proxies whose X-Forwarded-For entries and
+    // PROXY protocol headers are believed when resolving the client address.
+    TrustedProxies []netip.Prefix
+    ProxyProtocol  bool // connections start with a PROXY protocol header
+    GeoIP          geoip.Config
+    // RateLimitZones are the named rate limits vhosts and locations attach
+    // with rate_limit_zones. Every scope using a zone shares its counters.
+    RateLimitZones map[string]security.RateLimitConfig
+    // RateLimitRedis is the server rate limits with store redis share their
+    // counts through.
+    RateLimitRedis security.RedisConfig
 }
 
 func NewServerConfig() *ServerConfig {
@@ -125,12 +164,7 @@ func NewServerConfig() *ServerConfig {
                 CSP:           "default-src 'self'",
                 HSTS:          "max-age=31536000; includeSubDomains",
             },
-            RateLimit: struct {
-                Enabled  bool
-                Requests int           
-                Window   time.Duration 
-            }{
-                Enabled:  true,
+            RateLimit: security.RateLimitConfig{
                 Requests: 100,
                 Window:   time.Minute,
             },
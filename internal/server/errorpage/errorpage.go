@@ -0,0 +1,213 @@
+// Package errorpage replaces error responses with custom pages, like nginx
+// error_page. A page is a static file or, when its name ends in .tmpl, an
+// html/template rendered with the status, request ID and vhost.
+package errorpage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tinyproxy/internal/server/middleware"
+)
+
+// Config is the error_page and intercept_errors settings of a vhost.
+type Config struct {
+	// Pages maps a status code to the page served for it. Paths are resolved
+	// against the vhost root when it has one.
+	Pages map[int]string
+	// InterceptErrors also replaces error responses from proxied and FastCGI
+	// backends, like nginx proxy_intercept_errors. Without it only errors
+	// produced by tinyproxy itself are replaced.
+	InterceptErrors bool
+}
+
+// Data is passed to .tmpl error pages.
+type Data struct {
+	Status     int
+	StatusText string
+	RequestID  string
+	VHost      string
+	Path       string
+}
+
+type page struct {
+	contentType string
+	body        []byte             // static page
+	tmpl        *template.Template // .tmpl page
+}
+
+// Pages holds the loaded error pages of one vhost or location.
+type Pages struct {
+	byCode    map[int]*page
+	intercept bool
+}
+
+// Load reads the pages named in cfg, resolving relative to root when root is
+// set. A file shared by several codes is read once.
+func Load(cfg Config, root string) (*Pages, error) {
+	ps := &Pages{byCode: make(map[int]*page, len(cfg.Pages)), intercept: cfg.InterceptErrors}
+	loaded := make(map[string]*page)
+	for code, name := range cfg.Pages {
+		path := name
+		if root != "" {
+			path = filepath.Join(root, filepath.FromSlash(name))
+		}
+		if p, ok := loaded[path]; ok {
+			ps.byCode[code] = p
+			continue
+		}
+		p, err := loadPage(path)
+		if err != nil {
+			return nil, fmt.Errorf("error_page %d: %w", code, err)
+		}
+		loaded[path] = p
+		ps.byCode[code] = p
+	}
+	return ps, nil
+}
+
+func loadPage(path string) (*page, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(path, ".tmpl")
+	p := &page{contentType: mime.TypeByExtension(filepath.Ext(name))}
+	if p.contentType == "" {
+		p.contentType = "text/html; charset=utf-8"
+	}
+	if name == path {
+		p.body = b
+		return p, nil
+	}
+	p.tmpl, err = template.New(filepath.Base(path)).Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type stateKey struct{}
+
+// state is shared between the writer installed by Wrap and FromUpstream.
+type state struct {
+	upstream bool
+}
+
+// FromUpstream marks the response about to be written for r as coming from a
+// backend, so Wrap only replaces it when intercept_errors is on. r may be the
+// outgoing request of a reverse proxy; it shares the original's context.
+func FromUpstream(r *http.Request) {
+	if st, ok := r.Context().Value(stateKey{}).(*state); ok {
+		st.upstream = true
+	}
+}
+
+// Wrap returns a writer that serves ps's page in place of any response whose
+// status has one, and the request to serve with it. ps may be nil.
+func Wrap(w http.ResponseWriter, r *http.Request, ps *Pages) (http.ResponseWriter, *http.Request) {
+	if ps == nil || len(ps.byCode) == 0 {
+		return w, r
+	}
+	st := &state{}
+	r = r.WithContext(context.WithValue(r.Context(), stateKey{}, st))
+	return &interceptWriter{ResponseWriter: w, r: r, pages: ps, st: st}, r
+}
+
+type interceptWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	pages       *Pages
+	st          *state
+	wroteHeader bool
+	replaced    bool // the page was written; discard the handler's body
+}
+
+func (w *interceptWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if code < 200 {
+		// Informational responses such as 100 Continue precede the real one.
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+	p := w.pages.byCode[code]
+	if p == nil || (w.st.upstream && !w.pages.intercept) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.replaced = true
+	w.serve(p, code)
+}
+
+func (w *interceptWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *interceptWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements http.Flusher for streaming responses that are not replaced.
+func (w *interceptWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serve writes page p with status code, dropping headers that described the
+// body being replaced.
+func (w *interceptWriter) serve(p *page, code int) {
+	body := p.body
+	if p.tmpl != nil {
+		var buf bytes.Buffer
+		id, _ := w.r.Context().Value(middleware.RequestIDKey).(string)
+		err := p.tmpl.Execute(&buf, Data{
+			Status:     code,
+			StatusText: http.StatusText(code),
+			RequestID:  id,
+			VHost:      w.r.Host,
+			Path:       w.r.URL.Path,
+		})
+		if err != nil {
+			log.Printf("error_page: rendering %d page for %s: %v", code, w.r.Host, err)
+			w.replaced = false
+			w.ResponseWriter.WriteHeader(code)
+			return
+		}
+		body = buf.Bytes()
+	}
+
+	h := w.Header()
+	for _, k := range []string{"Content-Encoding", "Content-Length", "Content-Range", "ETag", "Last-Modified", "Vary"} {
+		h.Del(k)
+	}
+	h.Set("Content-Type", p.contentType)
+	w.ResponseWriter.WriteHeader(code)
+	if w.r.Method != http.MethodHead {
+		w.ResponseWriter.Write(body)
+	}
+}
@@ -0,0 +1,104 @@
+package errorpage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tinyproxy/internal/server/middleware"
+)
+
+func loadTestPages(t *testing.T, intercept bool) *Pages {
+	t.Helper()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "errors"), 0o755)
+	os.WriteFile(filepath.Join(root, "errors", "404.html"), []byte("<h1>Not here</h1>"), 0o644)
+	os.WriteFile(filepath.Join(root, "errors", "5xx.html.tmpl"),
+		[]byte(`{{.Status}} {{.StatusText}} on {{.VHost}}{{.Path}} id={{.RequestID}}`), 0o644)
+
+	ps, err := Load(Config{
+		Pages: map[int]string{
+			404: "/errors/404.html",
+			502: "/errors/5xx.html.tmpl",
+			503: "/errors/5xx.html.tmpl",
+		},
+		InterceptErrors: intercept,
+	}, root)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return ps
+}
+
+func serve(ps *Pages, h http.HandlerFunc, method string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.com/deploy", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.RequestIDKey, "abc123"))
+	rec := httptest.NewRecorder()
+	w, r := Wrap(rec, req, ps)
+	h(w, r)
+	return rec
+}
+
+func TestWrap_ReplacesErrors(t *testing.T) {
+	ps := loadTestPages(t, false)
+
+	rec := serve(ps, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}, "GET")
+	if rec.Code != 502 || rec.Body.String() != "502 Bad Gateway on example.com/deploy id=abc123" {
+		t.Errorf("502 = %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	rec = serve(ps, http.NotFound, "GET")
+	if rec.Code != 404 || rec.Body.String() != "<h1>Not here</h1>" {
+		t.Errorf("404 = %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(ps, http.NotFound, "HEAD")
+	if rec.Code != 404 || rec.Body.Len() != 0 {
+		t.Errorf("HEAD 404 = %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(ps, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}, "GET")
+	if rec.Body.String() != "Forbidden\n" {
+		t.Errorf("403 without a page was replaced: %q", rec.Body.String())
+	}
+}
+
+func TestWrap_UpstreamErrors(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		FromUpstream(r)
+		w.Header().Set("Content-Length", "12")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("backend down"))
+	}
+
+	rec := serve(loadTestPages(t, false), upstream, "GET")
+	if rec.Body.String() != "backend down" {
+		t.Errorf("upstream error replaced without intercept_errors: %q", rec.Body.String())
+	}
+
+	rec = serve(loadTestPages(t, true), upstream, "GET")
+	if !strings.HasPrefix(rec.Body.String(), "503 Service Unavailable") {
+		t.Errorf("upstream error not intercepted: %q", rec.Body.String())
+	}
+	if rec.Header().Get("Content-Length") != "" {
+		t.Error("upstream Content-Length kept on replaced page")
+	}
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	_, err := Load(Config{Pages: map[int]string{500: "/nope.html"}}, t.TempDir())
+	if err == nil {
+		t.Error("expected error for missing page")
+	}
+}
@@ -0,0 +1,136 @@
+// Package geoip looks up the country and autonomous system of client
+// addresses in local MaxMind DB files (GeoLite2 or GeoIP2) and blocks
+// requests by country or ASN.
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Config names the databases to load. Either may be empty.
+type Config struct {
+	CountryDB string // GeoLite2-Country, GeoIP2-Country or a City database
+	ASNDB     string // GeoLite2-ASN or GeoIP2-ISP
+}
+
+// Info is what is known about a client address. Fields are empty when the
+// database doesn't cover the address or isn't loaded.
+type Info struct {
+	Country string // ISO 3166-1 alpha-2 code, e.g. "DE"
+	ASN     uint
+}
+
+// DB holds the loaded databases. A nil *DB finds nothing.
+type DB struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// Open loads the databases in cfg. The files are read into memory, so they
+// can be replaced on disk and a DB stays valid until it is garbage collected.
+func Open(cfg Config) (*DB, error) {
+	db := &DB{}
+	var err error
+	if cfg.CountryDB != "" {
+		if db.country, err = load(cfg.CountryDB); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ASNDB != "" {
+		if db.asn, err = load(cfg.ASNDB); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func load(path string) (*maxminddb.Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Lookup returns what the databases know about ip.
+func (db *DB) Lookup(ip netip.Addr) Info {
+	var info Info
+	if db == nil || !ip.IsValid() {
+		return info
+	}
+	addr := ip.Unmap().AsSlice()
+	if db.country != nil {
+		var rec struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if db.country.Lookup(addr, &rec) == nil {
+			info.Country = rec.Country.ISOCode
+		}
+	}
+	if db.asn != nil {
+		var rec struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}
+		if db.asn.Lookup(addr, &rec) == nil {
+			info.ASN = rec.ASN
+		}
+	}
+	return info
+}
+
+type infoKey struct{}
+
+// WithInfo returns a copy of ctx carrying info.
+func WithInfo(ctx context.Context, info Info) context.Context {
+	return context.WithValue(ctx, infoKey{}, info)
+}
+
+// FromContext returns the Info stored by WithInfo and whether a lookup was
+// made at all, which is false when GeoIP is not configured.
+func FromContext(ctx context.Context) (Info, bool) {
+	info, ok := ctx.Value(infoKey{}).(Info)
+	return info, ok
+}
+
+// Rules blocks clients by country or ASN. Addresses the databases don't
+// cover are never blocked.
+type Rules struct {
+	BlockCountries []string
+	BlockASN       []uint
+}
+
+// Empty reports whether r blocks nothing.
+func (r Rules) Empty() bool {
+	return len(r.BlockCountries) == 0 && len(r.BlockASN) == 0
+}
+
+// Blocked reports whether r blocks a client described by info.
+func (r Rules) Blocked(info Info) bool {
+	return (info.Country != "" && slices.Contains(r.BlockCountries, info.Country)) ||
+		(info.ASN != 0 && slices.Contains(r.BlockASN, info.ASN))
+}
+
+// Wrap returns next guarded by r, using the Info that WithInfo stored in
+// the request context. Blocked clients get 403.
+func (r Rules) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if info, _ := FromContext(req.Context()); r.Blocked(info) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
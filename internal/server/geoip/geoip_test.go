@@ -0,0 +1,106 @@
+package geoip_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tinyproxy/internal/server/geoip"
+	"tinyproxy/internal/server/geoip/geoiptest"
+)
+
+func TestLookup(t *testing.T) {
+	db, err := geoip.Open(geoip.Config{
+		CountryDB: geoiptest.CountryDB(t),
+		ASNDB:     geoiptest.ASNDB(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want geoip.Info
+	}{
+		{"203.0.113.7", geoip.Info{Country: "DE", ASN: 14061}},
+		{"203.0.113.200", geoip.Info{Country: "DE"}},
+		{"::ffff:203.0.113.7", geoip.Info{Country: "DE", ASN: 14061}},
+		{"2001:db8::1", geoip.Info{Country: "FR"}},
+		{"100.64.0.1", geoip.Info{}},
+	}
+	for _, tt := range tests {
+		if got := db.Lookup(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestLookupNilDB(t *testing.T) {
+	var db *geoip.DB
+	if got := db.Lookup(netip.MustParseAddr("203.0.113.7")); got != (geoip.Info{}) {
+		t.Errorf("nil DB Lookup = %+v, want empty", got)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	if _, err := geoip.Open(geoip.Config{CountryDB: filepath.Join(t.TempDir(), "missing.mmdb")}); err == nil {
+		t.Error("expected error for missing database")
+	}
+	bad := filepath.Join(t.TempDir(), "bad.mmdb")
+	if err := os.WriteFile(bad, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geoip.Open(geoip.Config{ASNDB: bad}); err == nil {
+		t.Error("expected error for corrupt database")
+	}
+}
+
+func TestRulesBlocked(t *testing.T) {
+	r := geoip.Rules{BlockCountries: []string{"RU", "CN"}, BlockASN: []uint{14061}}
+	tests := []struct {
+		info geoip.Info
+		want bool
+	}{
+		{geoip.Info{Country: "RU"}, true},
+		{geoip.Info{Country: "DE", ASN: 14061}, true},
+		{geoip.Info{Country: "DE", ASN: 64500}, false},
+		{geoip.Info{}, false},
+	}
+	for _, tt := range tests {
+		if got := r.Blocked(tt.info); got != tt.want {
+			t.Errorf("Blocked(%+v) = %v, want %v", tt.info, got, tt.want)
+		}
+	}
+}
+
+func TestRulesWrap(t *testing.T) {
+	h := geoip.Rules{BlockCountries: []string{"RU"}}.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tt := range []struct {
+		country string
+		want    int
+	}{
+		{"RU", http.StatusForbidden},
+		{"DE", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(geoip.WithInfo(req.Context(), geoip.Info{Country: tt.country}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("country %s: status = %d, want %d", tt.country, rec.Code, tt.want)
+		}
+	}
+
+	// Without a lookup in the context nothing is blocked.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("no lookup: status = %d, want 200", rec.Code)
+	}
+}
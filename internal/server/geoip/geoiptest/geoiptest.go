@@ -0,0 +1,43 @@
+// Package geoiptest provides small MaxMind DB files for tests.
+//
+// The country database maps 192.0.2.0/24 to RU, 198.51.100.0/24 and
+// 203.0.113.0/24 to DE, and 2001:db8::/32 to FR. The ASN database maps
+// 203.0.113.0/25 to AS14061. Other addresses are in neither. The files in
+// testdata were written with github.com/maxmind/mmdbwriter.
+package geoiptest
+
+import (
+	_ "embed"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	//go:embed testdata/GeoLite2-Country-Test.mmdb
+	countryDB []byte
+	//go:embed testdata/GeoLite2-ASN-Test.mmdb
+	asnDB []byte
+)
+
+// CountryDB writes the country database to a temporary file and returns its
+// path.
+func CountryDB(t testing.TB) string {
+	t.Helper()
+	return write(t, "GeoLite2-Country.mmdb", countryDB)
+}
+
+// ASNDB writes the ASN database to a temporary file and returns its path.
+func ASNDB(t testing.TB) string {
+	t.Helper()
+	return write(t, "GeoLite2-ASN.mmdb", asnDB)
+}
+
+func write(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+
+	"tinyproxy/internal/server/variables"
+)
+
+// Header is a header name and a value that may contain $variables.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// HeaderRules are the edits of a vhost's headers block. Request edits are
+// applied to the upstream request after the built-in X-Forwarded-* and
+// X-Real-IP headers, so they can override them; response edits are applied
+// to the upstream response. Removals run before sets.
+type HeaderRules struct {
+	RequestSet     []Header
+	RequestRemove  []string
+	ResponseSet    []Header
+	ResponseRemove []string
+}
+
+// applyRequest edits out, the upstream request, expanding variables against
+// in, the request received from the client. Setting Host changes the Host
+// sent upstream; an empty value removes the header, as in nginx.
+func (h HeaderRules) applyRequest(out, in *http.Request) {
+	for _, name := range h.RequestRemove {
+		out.Header.Del(name)
+	}
+	for _, hv := range h.RequestSet {
+		v := variables.Expand(hv.Value, in)
+		if http.CanonicalHeaderKey(hv.Name) == "Host" {
+			out.Host = v
+			continue
+		}
+		if v == "" {
+			out.Header.Del(hv.Name)
+			continue
+		}
+		out.Header.Set(hv.Name, v)
+	}
+}
+
+// modifyResponse applies the response edits to an upstream response.
+func (h HeaderRules) modifyResponse(resp *http.Response) error {
+	for _, name := range h.ResponseRemove {
+		resp.Header.Del(name)
+	}
+	for _, hv := range h.ResponseSet {
+		resp.Header.Set(hv.Name, variables.Expand(hv.Value, resp.Request))
+	}
+	return nil
+}
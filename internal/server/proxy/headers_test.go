@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"tinyproxy/internal/server/realip"
+)
+
+func TestHeaderRules(t *testing.T) {
+	var got http.Header
+	var gotHost string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		gotHost = r.Host
+		w.Header().Set("Server", "legacy/1.0")
+		w.Header().Set("X-Powered-By", "PHP")
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	rules := HeaderRules{
+		RequestSet: []Header{
+			{Name: "X-Request-Path", Value: "$uri$is_args$args"},
+			{Name: "X-Real-IP", Value: "$http_cf_connecting_ip"},
+			{Name: "Host", Value: "internal.example"},
+		},
+		RequestRemove:  []string{"Cookie"},
+		ResponseSet:    []Header{{Name: "X-Served-By", Value: "tinyproxy $host"}},
+		ResponseRemove: []string{"X-Powered-By"},
+	}
+	p, err := NewSingleBackendProxy(backend.URL, rules, Timeouts{}, Keepalive{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/a?b=1", nil)
+	req.RemoteAddr = "203.0.113.9:5000"
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("CF-Connecting-IP", "198.51.100.7")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if v := got.Get("X-Request-Path"); v != "/a?b=1" {
+		t.Errorf("X-Request-Path = %q", v)
+	}
+	if v := got.Get("X-Real-IP"); v != "198.51.100.7" {
+		t.Errorf("X-Real-IP = %q, want override", v)
+	}
+	if got.Get("Cookie") != "" {
+		t.Error("Cookie was not removed")
+	}
+	if gotHost != "internal.example" {
+		t.Errorf("Host = %q", gotHost)
+	}
+	if v := got.Get("X-Forwarded-For"); v != "192.0.2.1, 203.0.113.9" {
+		t.Errorf("X-Forwarded-For = %q, want client appended", v)
+	}
+	if v := got.Get("X-Forwarded-Host"); v != "example.com" {
+		t.Errorf("X-Forwarded-Host = %q", v)
+	}
+
+	if rec.Header().Get("X-Powered-By") != "" {
+		t.Error("X-Powered-By was not removed")
+	}
+	if v := rec.Header().Get("X-Served-By"); v != "tinyproxy internal.example" {
+		t.Errorf("X-Served-By = %q", v)
+	}
+	if v := rec.Header().Get("Server"); v != "legacy/1.0" {
+		t.Errorf("Server = %q, want untouched", v)
+	}
+}
+
+func TestHeaderRules_ForwardedForOverride(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name  string
+		rules HeaderRules
+		want  []string
+	}{
+		{"replace", HeaderRules{RequestSet: []Header{{Name: "X-Forwarded-For", Value: "$remote_addr"}}}, []string{"203.0.113.9"}},
+		{"explicit append", HeaderRules{RequestSet: []Header{{Name: "X-Forwarded-For", Value: "$proxy_add_x_forwarded_for"}}}, []string{"192.0.2.1, 203.0.113.9"}},
+		{"remove", HeaderRules{RequestRemove: []string{"X-Forwarded-For"}}, nil},
+	}
+	for _, c := range cases {
+		p, err := NewSingleBackendProxy(backend.URL, c.rules, Timeouts{}, Keepalive{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "203.0.113.9:5000"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		p.ServeHTTP(httptest.NewRecorder(), req)
+
+		if v := got.Values("X-Forwarded-For"); len(v) != len(c.want) || (len(v) > 0 && v[0] != c.want[0]) {
+			t.Errorf("%s: X-Forwarded-For = %q, want %q", c.name, v, c.want)
+		}
+	}
+}
+
+func TestProxy_ResolvedClientIP(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+	p, err := NewSingleBackendProxy(backend.URL, HeaderRules{}, Timeouts{}, Keepalive{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lb, _ := realip.ParsePrefix("10.0.0.0/8")
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.5:5000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	req = realip.New([]netip.Prefix{lb}).Resolve(req)
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	if v := got.Get("X-Real-IP"); v != "198.51.100.7" {
+		t.Errorf("X-Real-IP = %q, want the resolved client", v)
+	}
+	if v := got.Get("X-Forwarded-For"); v != "198.51.100.7, 10.0.0.5" {
+		t.Errorf("X-Forwarded-For = %q, want the load balancer appended", v)
+	}
+}
@@ -2,13 +2,18 @@ package proxy
  
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"time"
+	"tinyproxy/internal/server/errorpage"
 	"tinyproxy/internal/server/fingerprint"
+	"tinyproxy/internal/server/geoip"
+	"tinyproxy/internal/server/realip"
 
 	"golang.org/x/net/proxy"
 )
@@ -19,6 +24,9 @@ type VHost struct {
 	Socks5Addr    string
 	Socks5User    string
 	Socks5Pass    string
+	Headers       HeaderRules
+	Timeouts      Timeouts
+	Keepalive     Keepalive
 }
  
 type ReverseProxy struct {
@@ -41,50 +49,15 @@ func NewReverseProxy(vhosts []VHost) (*ReverseProxy, error) {
 			return nil, err
 		}
  
-		p := httputil.NewSingleHostReverseProxy(target)
-		p.Transport = transport
-		p.ErrorHandler = proxyErrorHandler
- 
-		// Rewrite request headers like nginx proxy_set_header
-		originalDirector := p.Director
-		p.Director = func(req *http.Request) {
-			originalDirector(req)
-			// Preserve original host for backends that need it
-			req.Header.Set("X-Forwarded-Host", req.Host)
-			req.Header.Set("X-Forwarded-Proto", schemeFromRequest(req))
-			if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-				req.Header.Set("X-Real-IP", ip)
-			}
-			if fp := fingerprint.FromContext(req.Context()); fp.JA3 != "" {
-				req.Header.Set("X-JA3-Fingerprint", fp.JA3)
-				req.Header.Set("X-JA4-Fingerprint", fp.JA4)
-			}
-		}
- 
-		proxyMap[vh.Domain] = p
+		proxyMap[vh.Domain] = newHTTPProxy(target, transport, vh.Headers)
 	}
  
 	return &ReverseProxy{vhosts: proxyMap}, nil
 }
  
 func buildTransport(vh VHost) (http.RoundTripper, error) {
-	// Connection pool and timeout settings mirroring nginx/traefik defaults
-	dialer := &net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}
- 
-	transport := &http.Transport{
-		DialContext:           dialer.DialContext,
-		MaxIdleConns:          100,
-		MaxIdleConnsPerHost:   20,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:  10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		ResponseHeaderTimeout: 30 * time.Second,
-		ForceAttemptHTTP2:     true,
-	}
- 
+	var dial dialFunc
+
 	// Wire SOCKS5 transport if configured
 	if vh.Socks5Addr != "" {
 		var auth *proxy.Auth
@@ -94,23 +67,76 @@ func buildTransport(vh VHost) (http.RoundTripper, error) {
 				Password: vh.Socks5Pass,
 			}
 		}
-		socksDialer, err := proxy.SOCKS5("tcp", vh.Socks5Addr, auth, proxy.Direct)
+		socksDialer, err := proxy.SOCKS5("tcp", vh.Socks5Addr, auth, vh.Timeouts.dialer())
 		if err != nil {
 			return nil, err
 		}
 		if ctxDialer, ok := socksDialer.(proxy.ContextDialer); ok {
-			transport.DialContext = ctxDialer.DialContext
+			dial = ctxDialer.DialContext
 		} else {
-			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
 				return socksDialer.Dial(network, addr)
 			}
 		}
 	}
  
-	return transport, nil
+	return newTransport(vh.Timeouts, vh.Keepalive, dial), nil
 }
  
+// newHTTPProxy builds a reverse proxy to target. The client's Host header is
+// passed through, the address of the connection's peer is appended to
+// X-Forwarded-For (nginx's $proxy_add_x_forwarded_for), X-Real-IP is set to
+// the resolved client address and X-Forwarded-Host and X-Forwarded-Proto
+// are set, like nginx proxy_set_header. headers is applied last.
+func newHTTPProxy(target *url.URL, transport http.RoundTripper, headers HeaderRules) *httputil.ReverseProxy {
+	p := &httputil.ReverseProxy{
+		Transport:    transport,
+		ErrorHandler: proxyErrorHandler,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-For", realip.ForwardedFor(pr.In))
+			if ip, _, err := net.SplitHostPort(pr.In.RemoteAddr); err == nil {
+				pr.Out.Header.Set("X-Real-IP", ip)
+			}
+			if geo, ok := geoip.FromContext(pr.In.Context()); ok {
+				pr.Out.Header.Del("X-Country-Code")
+				if geo.Country != "" {
+					pr.Out.Header.Set("X-Country-Code", geo.Country)
+				}
+			}
+			if fp := fingerprint.FromContext(pr.In.Context()); fp.JA3 != "" {
+				pr.Out.Header.Set("X-JA3-Fingerprint", fp.JA3)
+				pr.Out.Header.Set("X-JA4-Fingerprint", fp.JA4)
+			}
+			headers.applyRequest(pr.Out, pr.In)
+		},
+	}
+	p.ModifyResponse = func(resp *http.Response) error {
+		if o, ok := resp.Request.Context().Value(outcomeKey{}).(*Outcome); ok {
+			o.Status = resp.StatusCode
+			o.Latency = time.Since(o.start)
+		}
+		errorpage.FromUpstream(resp.Request)
+		return headers.modifyResponse(resp)
+	}
+	return p
+}
+
 func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	// A body cut off by max_body_size is the client's fault, not the
+	// backend's.
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// A client that went away hasn't shown anything about the backend.
+	if o, ok := r.Context().Value(outcomeKey{}).(*Outcome); ok && r.Context().Err() == nil {
+		o.Err = err
+		o.Latency = time.Since(o.start)
+	}
 	slog.Error("proxy error",
 		"host", r.Host,
 		"path", r.URL.Path,
@@ -118,14 +144,48 @@ func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
 	)
 	http.Error(w, "Bad Gateway", http.StatusBadGateway)
 }
+
+type outcomeKey struct{}
+
+// Outcome is what became of a request to a backend, as recorded by the
+// proxy that serves a request from TrackOutcome.
+type Outcome struct {
+	// Err is set when the backend couldn't be reached or broke off its
+	// response, and stays nil when it answered, whatever the status.
+	Err error
+	// Status is the status of the backend's response.
+	Status int
+	// Latency is how long the response headers, or the error, took.
+	Latency time.Duration
+
+	start time.Time
+}
+
+// TrackOutcome returns r with room for the outcome of the proxy that
+// serves it, so the caller can tell a backend that couldn't be reached or
+// broke off its response from one that answered, and how fast it did.
+func TrackOutcome(r *http.Request) (*http.Request, *Outcome) {
+	o := &Outcome{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), outcomeKey{}, o)), o
+}
+
+// IsConnectError reports whether err, as recorded by TrackOutcome, is a
+// failure to connect to the backend, which therefore never saw the request.
+func IsConnectError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
  
-func schemeFromRequest(r *http.Request) string {
-	if r.TLS != nil {
-		return "https"
+// Close closes the idle backend connections of every vhost. In-flight
+// requests are not affected.
+func (rp *ReverseProxy) Close() {
+	for _, p := range rp.vhosts {
+		if t, ok := p.Transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
 	}
-	return "http"
 }
- 
+
 // ServeHTTP implements the http.Handler interface.
 func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	host := r.Host
@@ -141,43 +201,66 @@ func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // NewSingleBackendProxy creates a reverse proxy targeting a single backend URL.
 // This is used by the load balancer path where the target is chosen at request time.
-func NewSingleBackendProxy(targetURL string) (http.Handler, error) {
+func NewSingleBackendProxy(targetURL string, headers HeaderRules, timeouts Timeouts, keepalive Keepalive) (http.Handler, error) {
 	target, err := url.Parse(targetURL)
 	if err != nil {
 		return nil, err
 	}
+	return newHTTPProxy(target, newTransport(timeouts, keepalive, nil), headers), nil
+}
+
+// Upstream proxies to the backends of a load-balanced vhost. The backends
+// share one transport, so its keepalive pool outlives individual requests and
+// max_idle applies across all of them.
+type Upstream struct {
+	transport *http.Transport
+	headers   HeaderRules
+
+	mu       sync.RWMutex
+	backends map[string]http.Handler
+}
+
+// NewUpstream creates an Upstream with no backends yet.
+func NewUpstream(headers HeaderRules, timeouts Timeouts, keepalive Keepalive) *Upstream {
+	return &Upstream{
+		transport: newTransport(timeouts, keepalive, nil),
+		headers:   headers,
+		backends:  make(map[string]http.Handler),
+	}
+}
 
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		MaxIdleConnsPerHost:   20,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		ResponseHeaderTimeout: 30 * time.Second,
-		ForceAttemptHTTP2:     true,
+// Backend returns the proxy to targetURL, building it on first use.
+func (u *Upstream) Backend(targetURL string) (http.Handler, error) {
+	u.mu.RLock()
+	h, ok := u.backends[targetURL]
+	u.mu.RUnlock()
+	if ok {
+		return h, nil
 	}
 
-	p := httputil.NewSingleHostReverseProxy(target)
-	p.Transport = transport
-	p.ErrorHandler = proxyErrorHandler
-
-	originalDirector := p.Director
-	p.Director = func(req *http.Request) {
-		originalDirector(req)
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Forwarded-Proto", schemeFromRequest(req))
-		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-			req.Header.Set("X-Real-IP", ip)
-		}
-		if fp := fingerprint.FromContext(req.Context()); fp.JA3 != "" {
-			req.Header.Set("X-JA3-Fingerprint", fp.JA3)
-			req.Header.Set("X-JA4-Fingerprint", fp.JA4)
-		}
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if h, ok := u.backends[targetURL]; ok {
+		return h, nil
 	}
+	h = newHTTPProxy(target, u.transport, u.headers)
+	u.backends[targetURL] = h
+	return h, nil
+}
 
-	return p, nil
-}
\ No newline at end of file
+// Remove drops the proxy to targetURL, for a backend taken out of service.
+// Requests already using it are not affected.
+func (u *Upstream) Remove(targetURL string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.backends, targetURL)
+}
+
+// Close closes the idle connections to all backends.
+func (u *Upstream) Close() {
+	u.transport.CloseIdleConnections()
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestUpstream_ReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	remotes := make(map[string]bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes[r.RemoteAddr] = true
+		mu.Unlock()
+	}))
+	defer backend.Close()
+
+	u := NewUpstream(HeaderRules{}, Timeouts{}, Keepalive{})
+	defer u.Close()
+	for i := 0; i < 5; i++ {
+		h, err := u.Backend(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	if len(remotes) != 1 {
+		t.Errorf("backend saw %d connections, want 1", len(remotes))
+	}
+
+	h1, _ := u.Backend(backend.URL)
+	h2, _ := u.Backend(backend.URL)
+	if h1 != h2 {
+		t.Error("Backend built a second proxy for the same URL")
+	}
+}
+
+func TestUpstream_Remove(t *testing.T) {
+	u := NewUpstream(HeaderRules{}, Timeouts{}, Keepalive{})
+	first, err := u.Backend("http://10.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Backend("http://10.0.0.2:8080")
+	u.Remove("http://10.0.0.1:8080")
+	if len(u.backends) != 1 {
+		t.Errorf("%d proxies kept, want 1", len(u.backends))
+	}
+	// Added again, the backend gets a new proxy.
+	if again, _ := u.Backend("http://10.0.0.1:8080"); again == first {
+		t.Error("removed proxy reused")
+	}
+}
+
+func TestTrackOutcome(t *testing.T) {
+	answers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer answers.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	u := NewUpstream(HeaderRules{}, Timeouts{}, Keepalive{})
+	defer u.Close()
+	for _, c := range []struct {
+		url    string
+		failed bool
+		status int
+	}{
+		{answers.URL, false, http.StatusInternalServerError}, // an error status is still an answer
+		{down.URL, true, 0},
+	} {
+		h, _ := u.Backend(c.url)
+		r, o := TrackOutcome(httptest.NewRequest("GET", "http://example.com/", nil))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if (o.Err != nil) != c.failed {
+			t.Errorf("%s: Err = %v, want failed %v", c.url, o.Err, c.failed)
+		}
+		if IsConnectError(o.Err) != c.failed {
+			t.Errorf("%s: IsConnectError(%v) = %v, want %v", c.url, o.Err, !c.failed, c.failed)
+		}
+		if o.Status != c.status {
+			t.Errorf("%s: Status = %d, want %d", c.url, o.Status, c.status)
+		}
+		if o.Latency <= 0 {
+			t.Errorf("%s: Latency = %v, want > 0", c.url, o.Latency)
+		}
+	}
+}
+
+// BenchmarkProxy compares a proxy built once with one built per request, as
+// handleVHost used to do. The rebuilt proxy dials a new connection every time.
+func BenchmarkProxy(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	serve := func(b *testing.B, h http.Handler) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d", rec.Code)
+		}
+	}
+
+	b.Run("reused", func(b *testing.B) {
+		u := NewUpstream(HeaderRules{}, Timeouts{}, Keepalive{})
+		defer u.Close()
+		h, _ := u.Backend(backend.URL)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			serve(b, h)
+		}
+	})
+
+	b.Run("per-request", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			u := NewUpstream(HeaderRules{}, Timeouts{}, Keepalive{})
+			h, _ := u.Backend(backend.URL)
+			serve(b, h)
+			// Without this the idle connections pile up until IdleConnTimeout.
+			u.Close()
+		}
+	})
+}
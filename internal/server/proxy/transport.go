@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults used for any Timeouts or Keepalive field left at zero.
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultReadTimeout    = 30 * time.Second
+	DefaultIdleTimeout    = 90 * time.Second
+	DefaultMaxIdle        = 100
+	DefaultMaxIdlePerHost = 20
+)
+
+// Timeouts bound the stages of a request to a backend, like nginx
+// proxy_connect_timeout, proxy_read_timeout and proxy_send_timeout.
+type Timeouts struct {
+	Connect time.Duration // establishing the connection
+	Read    time.Duration // waiting for the response headers once the request is sent
+	Send    time.Duration // between two writes of the request; zero means no limit
+	Idle    time.Duration // how long an unused connection stays in the pool
+}
+
+// Keepalive sizes the pool of idle backend connections.
+type Keepalive struct {
+	MaxIdle        int // across all backends of the vhost
+	MaxIdlePerHost int // per backend
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (t Timeouts) dialer() *net.Dialer {
+	connect := t.Connect
+	if connect == 0 {
+		connect = DefaultConnectTimeout
+	}
+	return &net.Dialer{Timeout: connect, KeepAlive: 30 * time.Second}
+}
+
+// newTransport builds the backend transport. dial opens connections, for
+// example through SOCKS5; when nil, a plain dialer with the connect timeout
+// is used.
+func newTransport(t Timeouts, k Keepalive, dial dialFunc) *http.Transport {
+	if dial == nil {
+		dial = t.dialer().DialContext
+	}
+	if t.Send > 0 {
+		dial = withSendTimeout(dial, t.Send)
+	}
+	read := t.Read
+	if read == 0 {
+		read = DefaultReadTimeout
+	}
+	idle := t.Idle
+	if idle == 0 {
+		idle = DefaultIdleTimeout
+	}
+	maxIdle := k.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = DefaultMaxIdle
+	}
+	perHost := k.MaxIdlePerHost
+	if perHost == 0 {
+		perHost = DefaultMaxIdlePerHost
+	}
+
+	return &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   perHost,
+		IdleConnTimeout:       idle,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: read,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// withSendTimeout wraps dial so that every write to the connection must
+// complete within d.
+func withSendTimeout(dial dialFunc, d time.Duration) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &sendTimeoutConn{Conn: c, timeout: d}, nil
+	}
+}
+
+type sendTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *sendTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
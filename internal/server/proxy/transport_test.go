@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewTransport_Defaults(t *testing.T) {
+	tr := newTransport(Timeouts{}, Keepalive{}, nil)
+	if tr.ResponseHeaderTimeout != DefaultReadTimeout || tr.IdleConnTimeout != DefaultIdleTimeout {
+		t.Errorf("timeouts = %s/%s", tr.ResponseHeaderTimeout, tr.IdleConnTimeout)
+	}
+	if tr.MaxIdleConns != DefaultMaxIdle || tr.MaxIdleConnsPerHost != DefaultMaxIdlePerHost {
+		t.Errorf("pool = %d/%d", tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+
+	tr = newTransport(Timeouts{Read: 5 * time.Minute, Idle: time.Minute}, Keepalive{MaxIdle: 500, MaxIdlePerHost: 64}, nil)
+	if tr.ResponseHeaderTimeout != 5*time.Minute || tr.IdleConnTimeout != time.Minute {
+		t.Errorf("timeouts = %s/%s", tr.ResponseHeaderTimeout, tr.IdleConnTimeout)
+	}
+	if tr.MaxIdleConns != 500 || tr.MaxIdleConnsPerHost != 64 {
+		t.Errorf("pool = %d/%d", tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("report"))
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		read time.Duration
+		want int
+	}{
+		{50 * time.Millisecond, http.StatusBadGateway},
+		{2 * time.Second, http.StatusOK},
+	}
+	for _, c := range cases {
+		p, err := NewSingleBackendProxy(backend.URL, HeaderRules{}, Timeouts{Read: c.read}, Keepalive{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/report", nil))
+		if rec.Code != c.want {
+			t.Errorf("read %s: status %d, want %d", c.read, rec.Code, c.want)
+		}
+	}
+}
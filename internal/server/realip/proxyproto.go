@@ -0,0 +1,201 @@
+package realip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts every PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Header is the longest v1 header the specification allows.
+const maxV1Header = 107
+
+// Listener reads the PROXY protocol header (v1 or v2) a load balancer sends
+// at the start of every connection. When the connection comes from an
+// address Trusted accepts, the client address in the header becomes the
+// connection's RemoteAddr; otherwise the header is read and ignored.
+// Connections without a valid header are closed.
+//
+// The header is read on the connection's first Read or RemoteAddr, in the
+// goroutine serving it, so a client that sends nothing holds up only its
+// own connection.
+type Listener struct {
+	net.Listener
+	Trusted func(netip.Addr) bool
+}
+
+// headerTimeout bounds the wait for a connection's PROXY header.
+const headerTimeout = 2 * time.Second
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxiedConn{Conn: conn, trusted: l.trusted}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	return err == nil && l.Trusted != nil && l.Trusted(ap.Addr())
+}
+
+// proxiedConn reads the PROXY header before the first Read and reports the
+// client address from it.
+type proxiedConn struct {
+	net.Conn
+	trusted func(net.Addr) bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+
+	mu       sync.Mutex
+	deadline time.Time // read deadline set by the caller
+}
+
+func (c *proxiedConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	src, err := readHeader(c.Conn)
+	c.mu.Lock()
+	c.Conn.SetReadDeadline(c.deadline)
+	c.mu.Unlock()
+	if err != nil {
+		log.Printf("proxy protocol: %s: %v", c.Conn.RemoteAddr(), err)
+		c.Conn.Close()
+		c.err = err
+		return
+	}
+	if src != nil && c.trusted(c.Conn.RemoteAddr()) {
+		c.remote = src
+	}
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxiedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxiedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readHeader reads a PROXY protocol header from r, consuming nothing past
+// it. It returns the source address, or nil for headers that carry none
+// (v1 UNKNOWN, v2 LOCAL and non-IP families).
+func readHeader(r io.Reader) (net.Addr, error) {
+	buf := make([]byte, len(v2Signature))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if bytes.Equal(buf, v2Signature) {
+		return readV2(r)
+	}
+	if !bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	// Read byte by byte so the request that follows stays unread.
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= maxV1Header {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("reading header: %w", err)
+		}
+		buf = append(buf, b[0])
+	}
+	return parseV1(string(buf[:len(buf)-2]))
+}
+
+// parseV1 parses "PROXY TCP4|TCP6 src dst sport dport" or "PROXY UNKNOWN ...".
+func parseV1(line string) (net.Addr, error) {
+	f := strings.Split(line, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	ip, err := netip.ParseAddr(f[2])
+	if err != nil || ip.Is4() != (f[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", f[2])
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", f[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readV2 reads the rest of a v2 header after its signature.
+func readV2(r io.Reader) (net.Addr, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", hdr[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	switch hdr[0] & 0x0f {
+	case 0: // LOCAL: a health check from the proxy itself
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", hdr[0]&0x0f)
+	}
+
+	var size int
+	switch hdr[1] >> 4 {
+	case 1: // AF_INET
+		size = 4
+	case 2: // AF_INET6
+		size = 16
+	default:
+		return nil, nil
+	}
+	// Source and destination addresses, then source and destination ports.
+	if len(body) < 2*size+4 {
+		return nil, errors.New("v2 address block too short")
+	}
+	ip, _ := netip.AddrFromSlice(body[:size])
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), port)), nil
+}
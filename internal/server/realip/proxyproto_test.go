@@ -0,0 +1,148 @@
+package realip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{198, 51, 100, 7, 10, 0, 0, 1, 0x1f, 0x90, 0x01, 0xbb}
+	v6 := append(netip.MustParseAddr("2001:db8::7").AsSlice(), netip.MustParseAddr("2001:db8::1").AsSlice()...)
+	v6 = append(v6, 0x1f, 0x90, 0x01, 0xbb)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // source address; "" for none
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 198.51.100.7 10.0.0.1 8080 443\r\n"), "198.51.100.7:8080"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 8080 443\r\n"), "[2001:db8::7]:8080"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 TCP4", v2Header(1, 0x11, v4), "198.51.100.7:8080"},
+		{"v2 TCP6", v2Header(1, 0x21, v6), "[2001:db8::7]:8080"},
+		{"v2 TLVs after addresses", v2Header(1, 0x11, append(v4, 0x04, 0, 1, 0)), "198.51.100.7:8080"},
+		{"v2 LOCAL", v2Header(0, 0, nil), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.header, "GET / HTTP/1.1\r\n"...)))
+			addr, err := readHeader(r)
+			if err != nil {
+				t.Fatalf("readHeader: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("source = %q, want %q", got, tt.want)
+			}
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("request after header = %q", rest)
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 198.51.100.7\r\n",
+		"PROXY TCP4 2001:db8::7 10.0.0.1 8080 443\r\n",
+		"PROXY TCP4 198.51.100.7 10.0.0.1 99999 443\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		string(v2Header(1, 0x11, v4[:6])),
+	} {
+		if _, err := readHeader(strings.NewReader(bad)); err == nil {
+			t.Errorf("readHeader(%q): expected error", bad)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := true
+	ln := &Listener{Listener: inner, Trusted: func(a netip.Addr) bool { return trusted && a.IsLoopback() }}
+	defer ln.Close()
+
+	dial := func(header string) net.Addr {
+		t.Helper()
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte(header + "ping"))
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		if n, _ := conn.Read(buf); string(buf[:n]) != "ping" {
+			t.Errorf("data after header = %q", buf[:n])
+		}
+		return conn.RemoteAddr()
+	}
+
+	if got := dial("PROXY TCP4 198.51.100.7 10.0.0.1 8080 443\r\n").String(); got != "198.51.100.7:8080" {
+		t.Errorf("trusted peer: RemoteAddr = %s", got)
+	}
+	trusted = false
+	if got := dial("PROXY TCP4 198.51.100.7 10.0.0.1 8080 443\r\n").String(); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("untrusted peer: RemoteAddr = %s, want the peer", got)
+	}
+
+	// A client that sends nothing holds up neither Accept nor the next
+	// connection.
+	trusted = true
+	silent, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silentConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silentConn.Close()
+	start := time.Now()
+	if got := dial("PROXY TCP4 198.51.100.9 10.0.0.1 8080 443\r\n").String(); got != "198.51.100.9:8080" {
+		t.Errorf("after a silent connection: RemoteAddr = %s", got)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("next connection waited %v on the silent one", d)
+	}
+
+	// A connection without a header is closed on its first read.
+	c, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	bad, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bad.Read(make([]byte, 1)); err == nil {
+		t.Error("read from a connection without a header succeeded")
+	}
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("connection without a header was not closed")
+	}
+}
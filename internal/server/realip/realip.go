@@ -0,0 +1,144 @@
+// Package realip resolves the address of the client behind trusted reverse
+// proxies and load balancers, like the nginx realip module. The resolved
+// address replaces the request's RemoteAddr, so everything downstream (rate
+// limiting, ip_hash, logging, FastCGI and $remote_addr) sees the client
+// rather than the proxy in front of tinyproxy.
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type peerKey struct{}
+
+// Resolver picks the client address of a request. Its zero value and nil
+// trust no proxies and leave requests unchanged.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// New returns a Resolver that trusts X-Forwarded-For entries added by the
+// proxies in trusted.
+func New(trusted []netip.Prefix) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+// ParsePrefix parses a CIDR range or a single address, which is taken as a
+// range of one.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Trusted reports whether addr belongs to a trusted proxy.
+func (rv *Resolver) Trusted(addr netip.Addr) bool {
+	if rv == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range rv.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the client address of r. When r comes from a trusted
+// proxy, X-Forwarded-For is walked from the right, skipping trusted
+// proxies, and the first other address is the client. Only proxies can
+// append to the header, so entries left of the first untrusted one may be
+// forged and are ignored.
+func (rv *Resolver) ClientIP(r *http.Request) string {
+	peer := hostOf(r.RemoteAddr)
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !rv.Trusted(addr) {
+		return peer
+	}
+	hops := forwardedFor(r)
+	client := addr.Unmap()
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			break
+		}
+		client = hop.Unmap()
+		if !rv.Trusted(client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// Resolve returns r with RemoteAddr set to the client address. The address
+// of the connection's peer stays available from Peer.
+func (rv *Resolver) Resolve(r *http.Request) *http.Request {
+	ip := rv.ClientIP(r)
+	if ip == hostOf(r.RemoteAddr) {
+		return r
+	}
+	peer := r.RemoteAddr
+	r = r.WithContext(context.WithValue(r.Context(), peerKey{}, peer))
+	_, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		port = "0"
+	}
+	r.RemoteAddr = net.JoinHostPort(ip, port)
+	return r
+}
+
+// Peer returns the address of the connection r arrived on, which differs
+// from RemoteAddr when Resolve found a client behind a trusted proxy.
+func Peer(r *http.Request) string {
+	if peer, ok := r.Context().Value(peerKey{}).(string); ok {
+		return peer
+	}
+	return r.RemoteAddr
+}
+
+// ForwardedFor returns the X-Forwarded-For value to send upstream: the
+// entries r arrived with followed by the address of the connection's peer,
+// as nginx's $proxy_add_x_forwarded_for.
+func ForwardedFor(r *http.Request) string {
+	peer := hostOf(Peer(r))
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		return strings.Join(prior, ", ") + ", " + peer
+	}
+	return peer
+}
+
+// forwardedFor returns the X-Forwarded-For entries of r in order, across
+// repeated headers.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// hostOf strips the port from addr.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
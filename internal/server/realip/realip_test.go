@@ -0,0 +1,97 @@
+package realip
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func testResolver(t *testing.T, cidrs ...string) *Resolver {
+	t.Helper()
+	var trusted []netip.Prefix
+	for _, c := range cidrs {
+		p, err := ParsePrefix(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, p)
+	}
+	return New(trusted)
+}
+
+func TestClientIP(t *testing.T) {
+	rv := testResolver(t, "10.0.0.0/8", "192.0.2.1")
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"no header", "203.0.113.9:5000", nil, "203.0.113.9"},
+		{"untrusted peer spoofing", "203.0.113.9:5000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"trusted peer", "10.0.0.5:5000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"forged entries left of client", "10.0.0.5:5000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.5:5000", []string{"198.51.100.7, 192.0.2.1", "10.1.1.1"}, "198.51.100.7"},
+		{"all trusted", "10.0.0.5:5000", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"garbage entry", "10.0.0.5:5000", []string{"unknown, 10.9.9.9"}, "10.9.9.9"},
+		{"trusted peer without header", "10.0.0.5:5000", nil, "10.0.0.5"},
+		{"IPv6 peer", "[2001:db8::1]:443", []string{"1.2.3.4"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := rv.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.5:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	got := testResolver(t, "10.0.0.0/8").Resolve(r)
+	if got.RemoteAddr != "198.51.100.7:5000" {
+		t.Errorf("RemoteAddr = %q", got.RemoteAddr)
+	}
+	if p := Peer(got); p != "10.0.0.5:5000" {
+		t.Errorf("Peer = %q", p)
+	}
+	if v := ForwardedFor(got); v != "198.51.100.7, 10.0.0.5" {
+		t.Errorf("ForwardedFor = %q", v)
+	}
+	if r.RemoteAddr != "10.0.0.5:5000" {
+		t.Error("Resolve modified the original request")
+	}
+
+	// Without trusted proxies the header is ignored.
+	var none *Resolver
+	if got := none.Resolve(r); got != r {
+		t.Error("nil Resolver changed the request")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for in, want := range map[string]string{
+		"10.1.2.3/8":       "10.0.0.0/8",
+		"192.0.2.1":        "192.0.2.1/32",
+		"::ffff:192.0.2.1": "192.0.2.1/32",
+		"2001:db8::/32":    "2001:db8::/32",
+	} {
+		p, err := ParsePrefix(in)
+		if err != nil || p.String() != want {
+			t.Errorf("ParsePrefix(%q) = %v, %v; want %s", in, p, err, want)
+		}
+	}
+	for _, in := range []string{"10.0.0.0/33", "example.com", ""} {
+		if _, err := ParsePrefix(in); err == nil {
+			t.Errorf("ParsePrefix(%q): expected error", in)
+		}
+	}
+}
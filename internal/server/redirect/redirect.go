@@ -0,0 +1,49 @@
+// Package redirect implements the return and redirect directives and the
+// plain-HTTP to HTTPS upgrade.
+package redirect
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	"tinyproxy/internal/server/variables"
+)
+
+// IsRedirect reports whether code is a redirect status whose target is a URL.
+func IsRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Return answers r directly. For redirect codes target is the Location URL;
+// for any other code it is an optional plain-text body. $variables in target
+// are expanded against r.
+func Return(w http.ResponseWriter, r *http.Request, code int, target string) {
+	target = variables.Expand(target, r)
+	if IsRedirect(code) {
+		http.Redirect(w, r, target, code)
+		return
+	}
+	if target == "" {
+		w.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	io.WriteString(w, target)
+}
+
+// ToHTTPS permanently redirects r to the same host and URI over HTTPS.
+// An explicit :80 in the Host header is dropped; other ports are kept.
+func ToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, port, err := net.SplitHostPort(host); err == nil && port == "80" {
+		host = h
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,54 @@
+package redirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReturn_Redirect(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://www.example.com/docs?page=2", nil)
+	r.RequestURI = "/docs?page=2"
+	rr := httptest.NewRecorder()
+	Return(rr, r, http.StatusMovedPermanently, "https://example.com$request_uri")
+
+	if rr.Code != http.StatusMovedPermanently {
+		t.Errorf("status = %d, want 301", rr.Code)
+	}
+	if loc := rr.Header().Get("Location"); loc != "https://example.com/docs?page=2" {
+		t.Errorf("Location = %q", loc)
+	}
+}
+
+func TestReturn_Text(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	rr := httptest.NewRecorder()
+	Return(rr, r, http.StatusForbidden, "no access to $host")
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", rr.Code)
+	}
+	if body := rr.Body.String(); body != "no access to example.com" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestToHTTPS(t *testing.T) {
+	cases := []struct{ host, want string }{
+		{"example.com", "https://example.com/a?b=1"},
+		{"example.com:80", "https://example.com/a?b=1"},
+		{"localhost:8080", "https://localhost:8080/a?b=1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/a?b=1", nil)
+		r.Host = c.host
+		rr := httptest.NewRecorder()
+		ToHTTPS(rr, r)
+		if rr.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: status = %d, want 301", c.host, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != c.want {
+			t.Errorf("%s: Location = %q, want %q", c.host, loc, c.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package rewrite implements nginx-style rewrite rules: a regex matched
+// against the request path, a replacement with $N captures and $variables,
+// and an optional flag that controls what happens next.
+package rewrite
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"tinyproxy/internal/server/variables"
+)
+
+// Flags accepted after a rewrite replacement.
+const (
+	FlagNone      = ""          // rewrite and continue with the next rule
+	FlagLast      = "last"      // stop and match locations again with the new URI
+	FlagBreak     = "break"     // stop and serve the new URI from the current scope
+	FlagRedirect  = "redirect"  // answer with a 302
+	FlagPermanent = "permanent" // answer with a 301
+)
+
+// Rule is a single rewrite directive.
+type Rule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	Flag        string
+}
+
+// NewRule compiles a rewrite directive's arguments into a Rule.
+func NewRule(pattern, replacement, flag string) (Rule, error) {
+	switch flag {
+	case FlagNone, FlagLast, FlagBreak, FlagRedirect, FlagPermanent:
+	default:
+		return Rule{}, fmt.Errorf("unknown rewrite flag %q: must be last, break, redirect or permanent", flag)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid rewrite regex %q: %w", pattern, err)
+	}
+	return Rule{Pattern: re, Replacement: replacement, Flag: flag}, nil
+}
+
+// String renders the rule as written in the config.
+func (rl Rule) String() string {
+	s := "rewrite " + rl.Pattern.String() + " " + rl.Replacement
+	if rl.Flag != FlagNone {
+		s += " " + rl.Flag
+	}
+	return s
+}
+
+// Outcome says how the caller should continue after Apply.
+type Outcome int
+
+const (
+	// Unchanged means no rule matched.
+	Unchanged Outcome = iota
+	// Rewritten means the URI changed and locations should be matched again.
+	Rewritten
+	// Break means rewriting stopped and the current scope serves the request.
+	Break
+	// Redirect means the request should be answered with Code and Location.
+	Redirect
+)
+
+// Result is what Apply did to a request.
+type Result struct {
+	Outcome  Outcome
+	Code     int    // redirect status, for Outcome Redirect
+	Location string // redirect target, for Outcome Redirect
+}
+
+// Apply runs rules against r in order, rewriting r.URL in place. As in nginx,
+// the original query string is kept unless the replacement sets its own, in
+// which case the original is appended after it; a replacement ending in "?"
+// drops it. A replacement starting with http://, https:// or $scheme is a
+// redirect even without a flag.
+func Apply(rules []Rule, r *http.Request) Result {
+	res := Result{Outcome: Unchanged}
+	for _, rl := range rules {
+		m := rl.Pattern.FindStringSubmatchIndex(r.URL.Path)
+		if m == nil {
+			continue
+		}
+		target := expand(rl.Replacement, r.URL.Path, m, r)
+		path, query := splitQuery(target, r.URL.RawQuery)
+
+		if code := redirectCode(rl); code != 0 {
+			if query != "" {
+				path += "?" + query
+			}
+			return Result{Outcome: Redirect, Code: code, Location: path}
+		}
+
+		r.URL.Path = path
+		r.URL.RawPath = ""
+		r.URL.RawQuery = query
+		res.Outcome = Rewritten
+
+		switch rl.Flag {
+		case FlagLast:
+			return res
+		case FlagBreak:
+			res.Outcome = Break
+			return res
+		}
+	}
+	return res
+}
+
+// redirectCode returns the status a rule redirects with, or 0 for an
+// internal rewrite.
+func redirectCode(rl Rule) int {
+	switch rl.Flag {
+	case FlagPermanent:
+		return http.StatusMovedPermanently
+	case FlagRedirect:
+		return http.StatusFound
+	}
+	repl := rl.Replacement
+	if strings.HasPrefix(repl, "http://") || strings.HasPrefix(repl, "https://") || strings.HasPrefix(repl, "$scheme") {
+		return http.StatusFound
+	}
+	return 0
+}
+
+// splitQuery separates the replacement's path from its query string and
+// merges in the original query according to nginx rules.
+func splitQuery(target, orig string) (path, query string) {
+	if strings.HasSuffix(target, "?") {
+		path, query, _ = strings.Cut(strings.TrimSuffix(target, "?"), "?")
+		return path, query
+	}
+	path, query, ok := strings.Cut(target, "?")
+	if !ok {
+		return path, orig
+	}
+	if orig != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += orig
+	}
+	return path, query
+}
+
+// expand substitutes $N and ${N} with the captures in m, and expands the
+// literal text between them as request variables. Captured text is inserted
+// verbatim so a "$" in the path is never interpreted as a variable.
+func expand(repl, subject string, m []int, r *http.Request) string {
+	var b, lit strings.Builder
+	flush := func() {
+		b.WriteString(variables.Expand(lit.String(), r))
+		lit.Reset()
+	}
+	for i := 0; i < len(repl); i++ {
+		n, end := captureRef(repl, i)
+		if end == 0 {
+			lit.WriteByte(repl[i])
+			continue
+		}
+		flush()
+		if 2*n+1 < len(m) && m[2*n] >= 0 {
+			b.WriteString(subject[m[2*n]:m[2*n+1]])
+		}
+		i = end - 1
+	}
+	flush()
+	return b.String()
+}
+
+// captureRef parses a $N or ${N} capture reference at s[i], where N is a
+// single digit as in nginx. It returns the capture number and the index one
+// past the reference, or end 0 if s[i] does not start one.
+func captureRef(s string, i int) (n, end int) {
+	if s[i] != '$' || i+1 >= len(s) {
+		return 0, 0
+	}
+	j, braced := i+1, false
+	if s[j] == '{' {
+		j, braced = j+1, true
+	}
+	if j >= len(s) || s[j] < '0' || s[j] > '9' {
+		return 0, 0
+	}
+	n = int(s[j] - '0')
+	j++
+	if braced {
+		if j >= len(s) || s[j] != '}' {
+			return 0, 0
+		}
+		j++
+	}
+	return n, j
+}
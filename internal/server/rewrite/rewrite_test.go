@@ -0,0 +1,138 @@
+package rewrite
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func mustRule(t *testing.T, pattern, replacement, flag string) Rule {
+	t.Helper()
+	rl, err := NewRule(pattern, replacement, flag)
+	if err != nil {
+		t.Fatalf("NewRule(%q, %q, %q): %v", pattern, replacement, flag, err)
+	}
+	return rl
+}
+
+func TestApply(t *testing.T) {
+	cases := []struct {
+		name     string
+		rules    [][3]string
+		target   string
+		outcome  Outcome
+		wantPath string
+		wantArgs string
+		wantCode int
+		wantLoc  string
+	}{
+		{
+			name:     "captures, original args kept",
+			rules:    [][3]string{{`^/blog/(\d+)/(.*)$`, "/posts/$2/$1", "last"}},
+			target:   "/blog/2019/hello?ref=rss",
+			outcome:  Rewritten,
+			wantPath: "/posts/hello/2019",
+			wantArgs: "ref=rss",
+		},
+		{
+			name:     "replacement args come first",
+			rules:    [][3]string{{`^/user/(\w+)$`, "/profile.php?name=$1", "break"}},
+			target:   "/user/ada?tab=2",
+			outcome:  Break,
+			wantPath: "/profile.php",
+			wantArgs: "name=ada&tab=2",
+		},
+		{
+			name:     "trailing ? drops original args",
+			rules:    [][3]string{{`^/old$`, "/new?", ""}},
+			target:   "/old?utm=x",
+			outcome:  Rewritten,
+			wantPath: "/new",
+		},
+		{
+			name:     "no flag continues to the next rule",
+			rules:    [][3]string{{`^/a$`, "/b", ""}, {`^/b$`, "/c", ""}},
+			target:   "/a",
+			outcome:  Rewritten,
+			wantPath: "/c",
+		},
+		{
+			name:     "last stops the rule list",
+			rules:    [][3]string{{`^/a$`, "/b", "last"}, {`^/b$`, "/c", ""}},
+			target:   "/a",
+			outcome:  Rewritten,
+			wantPath: "/b",
+		},
+		{
+			name:     "no match",
+			rules:    [][3]string{{`^/a$`, "/b", ""}},
+			target:   "/z?q=1",
+			outcome:  Unchanged,
+			wantPath: "/z",
+			wantArgs: "q=1",
+		},
+		{
+			name:     "permanent",
+			rules:    [][3]string{{`^/docs/(.*)$`, "/manual/$1", "permanent"}},
+			target:   "/docs/install?v=2",
+			outcome:  Redirect,
+			wantCode: 301,
+			wantLoc:  "/manual/install?v=2",
+		},
+		{
+			name:     "absolute replacement redirects",
+			rules:    [][3]string{{`^/(.*)$`, "https://$host/$1", ""}},
+			target:   "/x",
+			outcome:  Redirect,
+			wantCode: 302,
+			wantLoc:  "https://example.com/x",
+		},
+		{
+			name:     "captured text is not expanded",
+			rules:    [][3]string{{`^/p/(.*)$`, "/q/$1", ""}},
+			target:   "/p/$host",
+			outcome:  Rewritten,
+			wantPath: "/q/$host",
+		},
+		{
+			name:     "braced capture and $10",
+			rules:    [][3]string{{`^/(a)$`, "/${1}x$10", ""}},
+			target:   "/a",
+			outcome:  Rewritten,
+			wantPath: "/axa0",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var rules []Rule
+			for _, r := range c.rules {
+				rules = append(rules, mustRule(t, r[0], r[1], r[2]))
+			}
+			req := httptest.NewRequest("GET", c.target, nil)
+			req.Host = "example.com"
+
+			res := Apply(rules, req)
+			if res.Outcome != c.outcome {
+				t.Fatalf("outcome = %d, want %d", res.Outcome, c.outcome)
+			}
+			if c.outcome == Redirect {
+				if res.Code != c.wantCode || res.Location != c.wantLoc {
+					t.Errorf("redirect = %d %q, want %d %q", res.Code, res.Location, c.wantCode, c.wantLoc)
+				}
+				return
+			}
+			if req.URL.Path != c.wantPath || req.URL.RawQuery != c.wantArgs {
+				t.Errorf("URL = %q ? %q, want %q ? %q", req.URL.Path, req.URL.RawQuery, c.wantPath, c.wantArgs)
+			}
+		})
+	}
+}
+
+func TestNewRule_Errors(t *testing.T) {
+	if _, err := NewRule(`^/(unclosed$`, "/x", ""); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+	if _, err := NewRule(`^/a$`, "/b", "forever"); err == nil {
+		t.Error("expected error for unknown flag")
+	}
+}
@@ -0,0 +1,140 @@
+package security
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"tinyproxy/internal/server/realip"
+)
+
+// AccessRule allows or denies the clients in Prefix, or every client when
+// All is set, like an nginx allow or deny directive. A rule with File stands
+// for the rules listed in that file, which are read when the list is loaded.
+type AccessRule struct {
+	Allow  bool
+	All    bool
+	Prefix netip.Prefix
+	File   string
+}
+
+// AccessConfig is the allow/deny list of a vhost or location. Rules are
+// checked in order and the first that matches the client decides; a client
+// no rule matches is allowed.
+type AccessConfig struct {
+	Rules []AccessRule
+}
+
+// ParseAccessRule parses an "allow" or "deny" rule for from, which is an
+// address, a CIDR range or "all".
+func ParseAccessRule(action, from string) (AccessRule, error) {
+	var r AccessRule
+	switch action {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("unknown access rule %q: must be allow or deny", action)
+	}
+	if from == "all" {
+		r.All = true
+		return r, nil
+	}
+	p, err := realip.ParsePrefix(from)
+	if err != nil {
+		return r, err
+	}
+	r.Prefix = p
+	return r, nil
+}
+
+// Access enforces a loaded allow/deny list.
+type Access struct {
+	rules []AccessRule
+}
+
+// NewAccess returns an Access enforcing rules, which must not refer to files.
+func NewAccess(rules []AccessRule) *Access {
+	return &Access{rules: rules}
+}
+
+// LoadAccess reads the list files cfg refers to and returns an Access
+// enforcing the combined rules.
+func LoadAccess(cfg AccessConfig) (*Access, error) {
+	var rules []AccessRule
+	for _, r := range cfg.Rules {
+		if r.File == "" {
+			rules = append(rules, r)
+			continue
+		}
+		fileRules, err := loadAccessFile(r.File)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	return NewAccess(rules), nil
+}
+
+// loadAccessFile reads a list of "allow <address|CIDR|all>" and
+// "deny <address|CIDR|all>" lines. Blank lines, # comments and a trailing
+// semicolon are ignored, so nginx include files can be used as they are.
+func loadAccessFile(path string) ([]AccessRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []AccessRule
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected allow or deny followed by an address", path, n)
+		}
+		r, err := ParseAccessRule(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, sc.Err()
+}
+
+// Allowed reports whether the rules let ip through.
+func (a *Access) Allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, r := range a.rules {
+		if r.All || r.Prefix.Contains(ip) {
+			return r.Allow
+		}
+	}
+	return true
+}
+
+// Wrap returns next guarded by the rules. Denied clients get 403.
+func (a *Access) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// RemoteAddr is the client address resolved by realip.
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		// An address that doesn't parse is only matched by "all".
+		ip, _ := netip.ParseAddr(host)
+		if !a.Allowed(ip) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
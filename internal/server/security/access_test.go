@@ -0,0 +1,93 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustRule(t *testing.T, action, from string) AccessRule {
+	t.Helper()
+	r, err := ParseAccessRule(action, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestAccess_Allowed(t *testing.T) {
+	a := NewAccess([]AccessRule{
+		mustRule(t, "deny", "10.1.2.3"),
+		mustRule(t, "allow", "10.0.0.0/8"),
+		mustRule(t, "allow", "2001:db8::/32"),
+		mustRule(t, "deny", "all"),
+	})
+	for ip, want := range map[string]bool{
+		"10.0.0.1":        true,
+		"10.1.2.3":        false, // denied before the range allowing it
+		"::ffff:10.0.0.1": true,
+		"2001:db8::1":     true,
+		"192.168.1.1":     false,
+		"2001:db9::1":     false,
+	} {
+		if got := a.Allowed(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// Without a matching rule, clients are allowed.
+	a = NewAccess([]AccessRule{mustRule(t, "deny", "192.0.2.0/24")})
+	if !a.Allowed(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("client matching no rule was denied")
+	}
+}
+
+func TestLoadAccess_File(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "office.list")
+	os.WriteFile(list, []byte("# office\nallow 192.0.2.0/24;\n\nallow 2001:db8::/32 # VPN\n"), 0o644)
+
+	a, err := LoadAccess(AccessConfig{Rules: []AccessRule{
+		{File: list},
+		mustRule(t, "deny", "all"),
+	}})
+	if err != nil {
+		t.Fatalf("LoadAccess: %v", err)
+	}
+	if !a.Allowed(netip.MustParseAddr("192.0.2.10")) || !a.Allowed(netip.MustParseAddr("2001:db8::5")) {
+		t.Error("addresses from the list file were denied")
+	}
+	if a.Allowed(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("address outside the list was allowed")
+	}
+
+	for _, bad := range []string{"allow\n", "permit 10.0.0.0/8\n", "allow 10.0.0.0/40\n"} {
+		os.WriteFile(list, []byte(bad), 0o644)
+		if _, err := LoadAccess(AccessConfig{Rules: []AccessRule{{File: list}}}); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+	if _, err := LoadAccess(AccessConfig{Rules: []AccessRule{{File: "/nonexistent/list"}}}); err == nil {
+		t.Error("missing file: expected error")
+	}
+}
+
+func TestAccess_Wrap(t *testing.T) {
+	a := NewAccess([]AccessRule{mustRule(t, "allow", "10.0.0.0/8"), mustRule(t, "deny", "all")})
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for remote, want := range map[string]int{
+		"10.0.0.1:5000":      http.StatusOK,
+		"203.0.113.9:5000":   http.StatusForbidden,
+		"[2001:db8::1]:5000": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("from %s: status %d, want %d", remote, rec.Code, want)
+		}
+	}
+}
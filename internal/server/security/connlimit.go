@@ -0,0 +1,277 @@
+package security
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ConnLimitConfig caps the requests a vhost processes at once, like nginx
+// limit_conn, and the connections a client keeps open to it. A zero limit
+// is no limit.
+type ConnLimitConfig struct {
+	PerIP      int
+	PerVHost   int
+	ConnsPerIP int // open connections per client IP, idle ones included
+	Status     int // response when a cap is exceeded; 503 when zero
+}
+
+// ConnLimiter counts in-flight requests per client IP and in total. As with
+// nginx limit_conn, each request on an HTTP/2 connection counts separately
+// and a request is counted until its response has been written.
+//
+// It also counts the open connections of each client IP that have made a
+// request to its scope, from that request until the connection closes.
+// Connections are only known when the server was set up with Conns.
+type ConnLimiter struct {
+	cfg ConnLimitConfig
+
+	mu        sync.Mutex
+	active    int
+	byIP      map[string]int
+	conns     map[*trackedConn]bool
+	connsByIP map[string]int
+}
+
+// NewConnLimiter creates a ConnLimiter enforcing cfg.
+func NewConnLimiter(cfg ConnLimitConfig) *ConnLimiter {
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusServiceUnavailable
+	}
+	return &ConnLimiter{
+		cfg:       cfg,
+		byIP:      make(map[string]int),
+		conns:     make(map[*trackedConn]bool),
+		connsByIP: make(map[string]int),
+	}
+}
+
+// Config returns the limits l enforces.
+func (l *ConnLimiter) Config() ConnLimitConfig {
+	return l.cfg
+}
+
+func (l *ConnLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.PerVHost > 0 && l.active >= l.cfg.PerVHost {
+		return false
+	}
+	if l.cfg.PerIP > 0 && l.byIP[ip] >= l.cfg.PerIP {
+		return false
+	}
+	l.active++
+	l.byIP[ip]++
+	return true
+}
+
+func (l *ConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// holdConn counts c, an open connection from ip, unless it is counted
+// already. It reports false when ip has as many open as allowed.
+func (l *ConnLimiter) holdConn(c *trackedConn, ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[c] {
+		return true
+	}
+	if l.cfg.ConnsPerIP > 0 && l.connsByIP[ip] >= l.cfg.ConnsPerIP {
+		return false
+	}
+	l.conns[c] = true
+	l.connsByIP[ip]++
+	c.onClose(func() { l.dropConn(c, ip) })
+	return true
+}
+
+func (l *ConnLimiter) dropConn(c *trackedConn, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, c)
+	if l.connsByIP[ip]--; l.connsByIP[ip] <= 0 {
+		delete(l.connsByIP, ip)
+	}
+}
+
+// Wrap returns next wrapped with the limits.
+func (l *ConnLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		// A connection from a trusted proxy carries many clients' requests,
+		// so only connections from the client itself are counted.
+		if c, ok := r.Context().Value(connKey{}).(*trackedConn); ok && c.ip() == ip && !l.holdConn(c, ip) {
+			// Closing the connection frees the client's slot for another.
+			w.Header().Set("Connection", "close")
+			l.refuse(w)
+			return
+		}
+		if !l.acquire(ip) {
+			l.refuse(w)
+			return
+		}
+		defer l.release(ip)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *ConnLimiter) refuse(w http.ResponseWriter) {
+	if l.cfg.Status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, http.StatusText(l.cfg.Status), l.cfg.Status)
+}
+
+// IPConns is the number of in-flight requests and open connections from
+// one client IP.
+type IPConns struct {
+	IP     string `json:"ip"`
+	Active int    `json:"active"`
+	Conns  int    `json:"conns"`
+}
+
+// ConnStats is a snapshot of a ConnLimiter.
+type ConnStats struct {
+	Scope      string    `json:"scope"`
+	Active     int       `json:"active"`
+	Conns      int       `json:"conns"`
+	PerVHost   int       `json:"per_vhost"`
+	PerIP      int       `json:"per_ip"`
+	ConnsPerIP int       `json:"conns_per_ip"`
+	TopIPs     []IPConns `json:"top_ips"`
+}
+
+// Stats returns the current counts, with the n busiest client IPs.
+func (l *ConnLimiter) Stats(scope string, n int) ConnStats {
+	l.mu.Lock()
+	st := ConnStats{
+		Scope:      scope,
+		Active:     l.active,
+		Conns:      len(l.conns),
+		PerVHost:   l.cfg.PerVHost,
+		PerIP:      l.cfg.PerIP,
+		ConnsPerIP: l.cfg.ConnsPerIP,
+	}
+	byIP := make(map[string]*IPConns)
+	entry := func(ip string) *IPConns {
+		if byIP[ip] == nil {
+			byIP[ip] = &IPConns{IP: ip}
+		}
+		return byIP[ip]
+	}
+	for ip, c := range l.byIP {
+		entry(ip).Active = c
+	}
+	for ip, c := range l.connsByIP {
+		entry(ip).Conns = c
+	}
+	l.mu.Unlock()
+
+	ips := make([]IPConns, 0, len(byIP))
+	for _, c := range byIP {
+		ips = append(ips, *c)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if ips[i].Active != ips[j].Active {
+			return ips[i].Active > ips[j].Active
+		}
+		if ips[i].Conns != ips[j].Conns {
+			return ips[i].Conns > ips[j].Conns
+		}
+		return ips[i].IP < ips[j].IP
+	})
+	if len(ips) > n {
+		ips = ips[:n]
+	}
+	st.TopIPs = ips
+	return st
+}
+
+// Conns tracks the open connections of an http.Server so that ConnLimiters
+// can count them. Set the server's ConnContext and ConnState to its methods.
+type Conns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*trackedConn
+}
+
+// NewConns creates an empty Conns.
+func NewConns() *Conns {
+	return &Conns{conns: make(map[net.Conn]*trackedConn)}
+}
+
+type connKey struct{}
+
+// trackedConn is an open connection and what to do when it closes.
+type trackedConn struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	closed  bool
+	closers []func()
+}
+
+// ip returns the address c comes from. It is read each time since a PROXY
+// protocol connection only knows it once its header has been read.
+func (c *trackedConn) ip() string {
+	addr := c.conn.RemoteAddr().String()
+	if ip, _, err := net.SplitHostPort(addr); err == nil {
+		return ip
+	}
+	return addr
+}
+
+// onClose arranges for f to run when c closes, or runs it now if c has.
+func (c *trackedConn) onClose(f func()) {
+	c.mu.Lock()
+	if !c.closed {
+		c.closers = append(c.closers, f)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	f()
+}
+
+// ConnContext records nc and returns ctx carrying it, for
+// http.Server.ConnContext.
+func (t *Conns) ConnContext(ctx context.Context, nc net.Conn) context.Context {
+	c := &trackedConn{conn: nc}
+	t.mu.Lock()
+	t.conns[nc] = c
+	t.mu.Unlock()
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// ConnState releases nc from the limiters counting it once it is closed or
+// hijacked, for http.Server.ConnState.
+func (t *Conns) ConnState(nc net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	t.mu.Lock()
+	c := t.conns[nc]
+	delete(t.conns, nc)
+	t.mu.Unlock()
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.closed = true
+	closers := c.closers
+	c.closers = nil
+	c.mu.Unlock()
+	for _, f := range closers {
+		f()
+	}
+}
@@ -0,0 +1,118 @@
+package security
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	l := NewConnLimiter(ConnLimitConfig{PerIP: 2, PerVHost: 3, Status: http.StatusTooManyRequests})
+	h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}))
+	get := func(ip string) int {
+		req := httptest.NewRequest("GET", "/upload", nil)
+		req.RemoteAddr = ip + ":40000"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Hold two requests from one client and one from another.
+	var done sync.WaitGroup
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			get(ip)
+		}()
+	}
+	started.Wait()
+
+	if code := get("10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Errorf("third request from 10.0.0.1: status %d, want 429", code)
+	}
+	if code := get("10.0.0.3"); code != http.StatusTooManyRequests {
+		t.Errorf("fourth request to vhost: status %d, want 429", code)
+	}
+	st := l.Stats("example.com", 10)
+	if st.Active != 3 || len(st.TopIPs) != 2 || st.TopIPs[0] != (IPConns{IP: "10.0.0.1", Active: 2}) {
+		t.Errorf("Stats = %+v", st)
+	}
+
+	close(release)
+	done.Wait()
+	if st := l.Stats("example.com", 10); st.Active != 0 || len(st.TopIPs) != 0 {
+		t.Errorf("after release: Stats = %+v", st)
+	}
+	started.Add(1)
+	if code := get("10.0.0.1"); code != http.StatusOK {
+		t.Errorf("after release: status %d, want 200", code)
+	}
+}
+
+func TestConnLimiter_Connections(t *testing.T) {
+	l := NewConnLimiter(ConnLimitConfig{ConnsPerIP: 1})
+	conns := NewConns()
+	srv := httptest.NewUnstartedServer(l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	srv.Config.ConnContext = conns.ConnContext
+	srv.Config.ConnState = conns.ConnState
+	srv.Start()
+	defer srv.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, bufio.NewReader(c)
+	}
+	get := func(c net.Conn, br *bufio.Reader) *http.Response {
+		if _, err := io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	// The first connection stays open, idle, after its request.
+	first, firstR := dial()
+	if resp := get(first, firstR); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first connection: status %d, want 200", resp.StatusCode)
+	}
+	second, secondR := dial()
+	defer second.Close()
+	resp := get(second, secondR)
+	if resp.StatusCode != http.StatusServiceUnavailable || !resp.Close {
+		t.Errorf("second connection: status %d, close %v; want 503 and closed", resp.StatusCode, resp.Close)
+	}
+	if st := l.Stats("example.com", 10); st.Conns != 1 || len(st.TopIPs) != 1 || st.TopIPs[0].Conns != 1 {
+		t.Errorf("Stats = %+v", st)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Stats("example.com", 10).Conns != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	third, thirdR := dial()
+	defer third.Close()
+	if resp := get(third, thirdR); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the first closed: status %d, want 200", resp.StatusCode)
+	}
+}
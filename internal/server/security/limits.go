@@ -4,9 +4,25 @@ import (
     "net/http"
 )
 
+// MaxBodySize rejects request bodies larger than size with 413, like nginx
+// client_max_body_size. A declared Content-Length over the limit is refused
+// before any of the body is read, so a client waiting on Expect:
+// 100-continue never sends it. Bodies without a length are cut off once
+// they pass the limit, and handlers reading them get an *http.MaxBytesError.
+// A size of 0 is no limit.
 func MaxBodySize(size int64) func(http.Handler) http.Handler {
     return func(next http.Handler) http.Handler {
+        if size <= 0 {
+            return next
+        }
         return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.ContentLength > size {
+                // The unread body isn't worth draining; don't reuse the
+                // connection for it.
+                w.Header().Set("Connection", "close")
+                http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+                return
+            }
             r.Body = http.MaxBytesReader(w, r.Body, size)
             next.ServeHTTP(w, r)
         })
@@ -0,0 +1,52 @@
+package security
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxBodySize(t *testing.T) {
+	var read int
+	var readErr error
+	h := MaxBodySize(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b []byte
+		b, readErr = io.ReadAll(r.Body)
+		read = len(b)
+	}))
+
+	// A declared length over the limit is refused unread.
+	read = -1
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 11))))
+	if rec.Code != http.StatusRequestEntityTooLarge || read != -1 {
+		t.Errorf("declared 11 bytes: status %d, handler read %d, want 413 and not called", rec.Code, read)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 10))))
+	if rec.Code != http.StatusOK || read != 10 || readErr != nil {
+		t.Errorf("10 bytes: status %d, read %d, %v", rec.Code, read, readErr)
+	}
+
+	// Without a length the body is cut off at the limit.
+	r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 11)))
+	r.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if tl, ok := readErr.(*http.MaxBytesError); !ok || tl.Limit != 10 {
+		t.Errorf("unknown length: read error %v, want *http.MaxBytesError", readErr)
+	}
+
+	// Zero is no limit.
+	h = MaxBodySize(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		read = len(b)
+	}))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 1<<20))))
+	if rec.Code != http.StatusOK || read != 1<<20 {
+		t.Errorf("no limit: status %d, read %d", rec.Code, read)
+	}
+}
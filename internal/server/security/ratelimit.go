@@ -1,84 +1,312 @@
 package security
 
 import (
-    "net"
-    "net/http"
-    "sync"
-    "time"
-    "golang.org/x/time/rate"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"tinyproxy/internal/server/auth"
 )
 
-// ipLimiter tracks per-IP rate limiters with automatic cleanup of stale entries.
-type ipLimiter struct {
+// Rate limit keys. Requests without the selected value are counted by
+// client address instead, so leaving it out doesn't escape the limit.
+const (
+	RateLimitKeyIP     = "ip"      // client address (the default)
+	RateLimitKeyHeader = "header"  // request header KeyName
+	RateLimitKeyCookie = "cookie"  // cookie KeyName
+	RateLimitKeyJWTSub = "jwt_sub" // sub claim of the validated JWT
+	RateLimitKeyAPIKey = "api_key" // X-API-Key header or api_key query parameter
+)
+
+// Rate limit stores.
+const (
+	RateLimitStoreMemory = "memory" // per process (the default)
+	RateLimitStoreRedis  = "redis"  // shared through RedisConfig
+)
+
+// RateLimitConfig limits each client to Requests per Window, like nginx
+// limit_req. A zero Requests is no limit.
+type RateLimitConfig struct {
+	Requests int
+	Window   time.Duration
+	// Burst is how many requests a client may make at once before the rate
+	// applies; zero means Requests.
+	Burst int
+	// Queue holds requests beyond the first Delay of a burst until the rate
+	// admits them, instead of serving the whole burst at once (nginx
+	// without nodelay).
+	Queue   bool
+	Delay   int
+	Key     string // one of the RateLimitKey constants; empty is ip
+	KeyName string // header or cookie name
+	Store   string // one of the RateLimitStore constants; empty is memory
+}
+
+// ParseRateLimitKey parses the key of a rate limit: "ip", "header <name>",
+// "cookie <name>", "jwt_sub" or "api_key".
+func ParseRateLimitKey(args []string) (key, name string, err error) {
+	if len(args) == 0 {
+		return "", "", fmt.Errorf("rate limit key requires ip, header, cookie, jwt_sub or api_key")
+	}
+	switch args[0] {
+	case RateLimitKeyIP, RateLimitKeyJWTSub, RateLimitKeyAPIKey:
+		if len(args) != 1 {
+			return "", "", fmt.Errorf("rate limit key %s takes no name", args[0])
+		}
+	case RateLimitKeyHeader, RateLimitKeyCookie:
+		if len(args) != 2 {
+			return "", "", fmt.Errorf("rate limit key %s requires a name", args[0])
+		}
+		name = args[1]
+	default:
+		return "", "", fmt.Errorf("unknown rate limit key %q: must be ip, header, cookie, jwt_sub or api_key", args[0])
+	}
+	return args[0], name, nil
+}
+
+// RateLimitStore keeps the counts of one RateLimiter. Counts kept in memory
+// are per process; a shared store such as Redis lets several instances
+// enforce one limit together.
+type RateLimitStore interface {
+	// Take counts a request for key. If the limit admits it within the
+	// store's maximum wait it returns how long the request must wait and
+	// true; otherwise it counts nothing and returns how much longer the
+	// client would have to wait and false.
+	Take(ctx context.Context, key string) (wait time.Duration, ok bool, err error)
+	// Stop releases the store. It may be called more than once.
+	Stop()
+}
+
+// rateParams are the generic cell rate parameters of a limit: one request
+// per interval, burst of them at once, and up to maxWait of queueing.
+type rateParams struct {
+	interval time.Duration
+	burst    int
+	maxWait  time.Duration
+}
+
+// newRateParams returns the parameters of cfg, or false when it has no
+// limit.
+func newRateParams(cfg RateLimitConfig) (rateParams, bool) {
+	if cfg.Requests <= 0 {
+		return rateParams{}, false
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.Requests
+	}
+	p := rateParams{interval: cfg.Window / time.Duration(cfg.Requests), burst: burst}
+	if cfg.Queue {
+		// The first Delay requests of a burst are admitted at once; the
+		// rest wait for the rate to admit them.
+		p.burst = min(max(cfg.Delay, 1), burst)
+		p.maxWait = time.Duration(burst-p.burst) * p.interval
+	}
+	return p, true
+}
+
+// keyLimiter is the in-memory RateLimitStore. It keeps a token bucket per
+// key and evicts idle ones.
+type keyLimiter struct {
 	mu       sync.Mutex
 	limiters map[string]*limiterEntry
 	rate     rate.Limit
 	burst    int
+	maxWait  time.Duration
+	idle     time.Duration // how long a bucket takes to refill completely
+	done     chan struct{}
+	stopOnce sync.Once
 }
- 
+
 type limiterEntry struct {
 	limiter  *rate.Limiter
 	lastSeen time.Time
 }
 
-func newIPLimiter(requests int, window time.Duration) *ipLimiter {
-	ipl := &ipLimiter{
+func newKeyLimiter(p rateParams) *keyLimiter {
+	kl := &keyLimiter{
 		limiters: make(map[string]*limiterEntry),
-		rate:     rate.Every(window / time.Duration(requests)),
-		burst:    requests,
+		rate:     rate.Every(p.interval),
+		burst:    p.burst,
+		maxWait:  p.maxWait,
+		// An emptied bucket, queued requests included, refills after this
+		// long; evicting it any sooner would reset the client's limit.
+		idle: time.Duration(p.burst)*p.interval + p.maxWait,
+		done: make(chan struct{}),
 	}
 	// Evict stale entries every 3 minutes to prevent memory leak
-	go ipl.cleanup(3 * time.Minute)
-	return ipl
-}
- 
-func (ipl *ipLimiter) getLimiter(ip string) *rate.Limiter {
-	ipl.mu.Lock()
-	defer ipl.mu.Unlock()
- 
-	entry, exists := ipl.limiters[ip]
+	go kl.cleanup(3 * time.Minute)
+	return kl
+}
+
+func (kl *keyLimiter) getLimiter(key string) *rate.Limiter {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	entry, exists := kl.limiters[key]
 	if !exists {
-		limiter := rate.NewLimiter(ipl.rate, ipl.burst)
-		ipl.limiters[ip] = &limiterEntry{limiter: limiter, lastSeen: time.Now()}
+		limiter := rate.NewLimiter(kl.rate, kl.burst)
+		kl.limiters[key] = &limiterEntry{limiter: limiter, lastSeen: time.Now()}
 		return limiter
 	}
 	entry.lastSeen = time.Now()
 	return entry.limiter
 }
- 
-func (ipl *ipLimiter) cleanup(interval time.Duration) {
+
+func (kl *keyLimiter) Take(_ context.Context, key string) (time.Duration, bool, error) {
+	now := time.Now()
+	res := kl.getLimiter(key).ReserveN(now, 1)
+	wait := res.DelayFrom(now)
+	if wait > kl.maxWait {
+		res.CancelAt(now)
+		return wait - kl.maxWait, false, nil
+	}
+	return wait, true, nil
+}
+
+func (kl *keyLimiter) cleanup(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-	for range ticker.C {
-		ipl.mu.Lock()
-		for ip, entry := range ipl.limiters {
-			if time.Since(entry.lastSeen) > 5*time.Minute {
-				delete(ipl.limiters, ip)
-			}
+	for {
+		select {
+		case <-kl.done:
+			return
+		case <-ticker.C:
 		}
-		ipl.mu.Unlock()
+		kl.prune(time.Now())
 	}
 }
 
-// RateLimit returns middleware that enforces per-IP rate limiting.
-func RateLimit(requests int, window time.Duration) func(http.Handler) http.Handler {
-	ipl := newIPLimiter(requests, window)
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				ip = r.RemoteAddr
-			}
-			// Trust X-Forwarded-For if behind a reverse proxy
-			if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-				ip = forwarded
-			}
-			if !ipl.getLimiter(ip).Allow() {
-				w.Header().Set("Retry-After", "60")
-				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+// prune drops the buckets that have been idle long enough to be full again,
+// so a new one for the same key starts in the same state.
+func (kl *keyLimiter) prune(now time.Time) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	for key, entry := range kl.limiters {
+		if now.Sub(entry.lastSeen) > kl.idle {
+			delete(kl.limiters, key)
+		}
+	}
+}
+
+func (kl *keyLimiter) Stop() {
+	kl.stopOnce.Do(func() { close(kl.done) })
+}
+
+// RateLimiter enforces a RateLimitConfig. Its state is shared by every
+// request it wraps, so one RateLimiter is created per vhost, location or
+// zone and kept until Stop is called.
+type RateLimiter struct {
+	cfg   RateLimitConfig
+	store RateLimitStore // nil when there is no limit
+}
+
+// NewRateLimiter creates a RateLimiter enforcing cfg with its counts kept in
+// memory.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	l := &RateLimiter{cfg: cfg}
+	if p, ok := newRateParams(cfg); ok {
+		l.store = newKeyLimiter(p)
+	}
+	return l
+}
+
+// NewRedisRateLimiter creates a RateLimiter enforcing cfg with its counts
+// kept in rs under name, so every instance using the same Redis server and
+// name shares them.
+func NewRedisRateLimiter(cfg RateLimitConfig, rs *RedisStore, name string) *RateLimiter {
+	l := &RateLimiter{cfg: cfg}
+	if p, ok := newRateParams(cfg); ok {
+		l.store = rs.limit(name, p)
+	}
+	return l
+}
+
+// Config returns the settings l enforces.
+func (l *RateLimiter) Config() RateLimitConfig {
+	return l.cfg
+}
+
+// Stop releases the limiter's store. It may be called more than once.
+func (l *RateLimiter) Stop() {
+	if l.store != nil {
+		l.store.Stop()
+	}
+}
+
+// AfterAuth reports whether the limiter's key is only known once the
+// request has been authenticated, so it must run after the auth checks.
+func (l *RateLimiter) AfterAuth() bool {
+	return l.cfg.Key == RateLimitKeyJWTSub
+}
+
+// key returns the value requests are counted by.
+func (l *RateLimiter) key(r *http.Request) string {
+	var k string
+	switch l.cfg.Key {
+	case RateLimitKeyHeader:
+		k = r.Header.Get(l.cfg.KeyName)
+	case RateLimitKeyCookie:
+		if c, err := r.Cookie(l.cfg.KeyName); err == nil {
+			k = c.Value
+		}
+	case RateLimitKeyJWTSub:
+		k = auth.Subject(r.Context())
+	case RateLimitKeyAPIKey:
+		if k = r.Header.Get("X-API-Key"); k == "" {
+			k = r.URL.Query().Get("api_key")
+		}
+	}
+	if k != "" {
+		return l.cfg.Key + ":" + k
+	}
+	// RemoteAddr is the client address resolved by realip, so
+	// X-Forwarded-For is only believed from trusted proxies.
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// Wrap returns next guarded by the limiter. Requests over the limit get 429
+// with a Retry-After of the time until the limiter would admit them. If the
+// store fails and is set to fail closed, requests get 503.
+func (l *RateLimiter) Wrap(next http.Handler) http.Handler {
+	if l.store == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait, ok, err := l.store.Take(r.Context(), l.key(r))
+		if err != nil {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			retry := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
 				return
 			}
-			next.ServeHTTP(w, r)
-		})
-	}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
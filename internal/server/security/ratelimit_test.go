@@ -0,0 +1,247 @@
+package security
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func rateLimited(cfg RateLimitConfig) func(r *http.Request) *httptest.ResponseRecorder {
+	h := NewRateLimiter(cfg).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	return func(r *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+}
+
+func requestFrom(ip string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = ip + ":40000"
+	return r
+}
+
+func TestRateLimiter_Burst(t *testing.T) {
+	do := rateLimited(RateLimitConfig{Requests: 1, Window: time.Minute, Burst: 3})
+	for i := 1; i <= 3; i++ {
+		if rec := do(requestFrom("10.0.0.1")); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, rec.Code)
+		}
+	}
+	rec := do(requestFrom("10.0.0.1"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request 4: status %d, want 429", rec.Code)
+	}
+	// The next token is a minute away.
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	if rec := do(requestFrom("10.0.0.2")); rec.Code != http.StatusOK {
+		t.Errorf("other client: status %d, want 200", rec.Code)
+	}
+}
+
+func TestRateLimiter_DefaultBurstIsRequests(t *testing.T) {
+	do := rateLimited(RateLimitConfig{Requests: 5, Window: time.Minute})
+	for i := 1; i <= 5; i++ {
+		if rec := do(requestFrom("10.0.0.1")); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, rec.Code)
+		}
+	}
+	rec := do(requestFrom("10.0.0.1"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request 6: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "12" {
+		t.Errorf("Retry-After = %q, want 12", got)
+	}
+}
+
+func TestRateLimiter_NoLimit(t *testing.T) {
+	do := rateLimited(RateLimitConfig{})
+	for i := 0; i < 1000; i++ {
+		if rec := do(requestFrom("10.0.0.1")); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, rec.Code)
+		}
+	}
+}
+
+func TestRateLimiter_Keys(t *testing.T) {
+	withHeader := func(ip, key string) *http.Request {
+		r := requestFrom(ip)
+		if key != "" {
+			r.Header.Set("X-Tenant", key)
+		}
+		return r
+	}
+	do := rateLimited(RateLimitConfig{Requests: 1, Window: time.Minute, Key: RateLimitKeyHeader, KeyName: "X-Tenant"})
+	if rec := do(withHeader("10.0.0.1", "acme")); rec.Code != http.StatusOK {
+		t.Fatalf("acme: status %d, want 200", rec.Code)
+	}
+	// The same tenant from another address shares the limit.
+	if rec := do(withHeader("10.0.0.2", "acme")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("acme from another address: status %d, want 429", rec.Code)
+	}
+	if rec := do(withHeader("10.0.0.1", "globex")); rec.Code != http.StatusOK {
+		t.Errorf("globex: status %d, want 200", rec.Code)
+	}
+	// Without the header the client address is the key.
+	if rec := do(withHeader("10.0.0.1", "")); rec.Code != http.StatusOK {
+		t.Errorf("no header: status %d, want 200", rec.Code)
+	}
+	if rec := do(withHeader("10.0.0.1", "")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("no header again: status %d, want 429", rec.Code)
+	}
+
+	do = rateLimited(RateLimitConfig{Requests: 1, Window: time.Minute, Key: RateLimitKeyAPIKey})
+	byQuery := httptest.NewRequest("GET", "/?api_key=k1", nil)
+	byHeader := httptest.NewRequest("GET", "/", nil)
+	byHeader.Header.Set("X-API-Key", "k1")
+	if rec := do(byQuery); rec.Code != http.StatusOK {
+		t.Errorf("api_key query: status %d, want 200", rec.Code)
+	}
+	if rec := do(byHeader); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("same key in X-API-Key: status %d, want 429", rec.Code)
+	}
+
+	do = rateLimited(RateLimitConfig{Requests: 1, Window: time.Minute, Key: RateLimitKeyCookie, KeyName: "session"})
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := requestFrom("10.0.0.1")
+		r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+		if rec := do(r); rec.Code != want {
+			t.Errorf("session cookie: status %d, want %d", rec.Code, want)
+		}
+	}
+}
+
+func TestRateLimiter_Queue(t *testing.T) {
+	// A token every 50ms; one request at once and two more queued.
+	do := rateLimited(RateLimitConfig{Requests: 20, Window: time.Second, Burst: 3, Queue: true, Delay: 1})
+
+	start := time.Now()
+	codes := make([]int, 4)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = do(requestFrom("10.0.0.1")).Code
+		}()
+	}
+	wg.Wait()
+
+	var ok, limited int
+	for _, c := range codes {
+		switch c {
+		case http.StatusOK:
+			ok++
+		case http.StatusTooManyRequests:
+			limited++
+		}
+	}
+	if ok != 3 || limited != 1 {
+		t.Errorf("statuses = %v, want three 200 and one 429", codes)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("queued requests finished after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestRateLimiter_QueueCanceled(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{Requests: 1, Window: time.Hour, Burst: 2, Queue: true})
+	called := 0
+	h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called++ }))
+
+	h.ServeHTTP(httptest.NewRecorder(), requestFrom("10.0.0.1"))
+	// The second request would wait an hour; a client that goes away
+	// stops waiting and the request is not served.
+	r := requestFrom("10.0.0.1")
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+	if called != 1 {
+		t.Errorf("handler called %d times, want 1", called)
+	}
+}
+
+func TestKeyLimiter_Prune(t *testing.T) {
+	// A window much longer than the sweep interval: the client's bucket
+	// must outlive several sweeps, or pruning would reset its limit.
+	p, _ := newRateParams(RateLimitConfig{Requests: 2, Window: time.Hour})
+	kl := newKeyLimiter(p)
+	defer kl.Stop()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, ok, _ := kl.Take(ctx, "ip:192.0.2.1"); !ok {
+			t.Fatalf("request %d rejected within the burst", i+1)
+		}
+	}
+
+	kl.prune(time.Now().Add(10 * time.Minute))
+	if _, ok, _ := kl.Take(ctx, "ip:192.0.2.1"); ok {
+		t.Error("limit reset by pruning before the bucket refilled")
+	}
+
+	kl.prune(time.Now().Add(time.Hour + time.Minute))
+	kl.mu.Lock()
+	n := len(kl.limiters)
+	kl.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d buckets left after a full window idle, want 0", n)
+	}
+}
+
+func TestRateLimiter_Stop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	limiters := make([]*RateLimiter, 50)
+	for i := range limiters {
+		limiters[i] = NewRateLimiter(RateLimitConfig{Requests: 100, Window: time.Minute})
+	}
+	if n := runtime.NumGoroutine(); n < before+50 {
+		t.Fatalf("goroutines = %d, want at least %d with 50 limiters", n, before+50)
+	}
+	for _, l := range limiters {
+		l.Stop()
+		l.Stop() // a second Stop is harmless
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("goroutines = %d after Stop, want %d", n, before)
+	}
+}
+
+func TestParseRateLimitKey(t *testing.T) {
+	for _, c := range []struct {
+		args      []string
+		key, name string
+	}{
+		{[]string{"ip"}, "ip", ""},
+		{[]string{"header", "X-Tenant"}, "header", "X-Tenant"},
+		{[]string{"cookie", "session"}, "cookie", "session"},
+		{[]string{"jwt_sub"}, "jwt_sub", ""},
+		{[]string{"api_key"}, "api_key", ""},
+	} {
+		key, name, err := ParseRateLimitKey(c.args)
+		if err != nil || key != c.key || name != c.name {
+			t.Errorf("ParseRateLimitKey(%v) = %q, %q, %v", c.args, key, name, err)
+		}
+	}
+	for _, args := range [][]string{nil, {"header"}, {"ip", "x"}, {"user"}} {
+		if _, _, err := ParseRateLimitKey(args); err == nil {
+			t.Errorf("ParseRateLimitKey(%v): expected error", args)
+		}
+	}
+	if !NewRateLimiter(RateLimitConfig{Requests: 1, Key: RateLimitKeyJWTSub}).AfterAuth() {
+		t.Error("jwt_sub limiter should run after auth")
+	}
+	if NewRateLimiter(RateLimitConfig{Requests: 1}).AfterAuth() {
+		t.Error("ip limiter should run before auth")
+	}
+}
@@ -0,0 +1,318 @@
+package security
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RedisConfig is the Redis server rate limits with store redis keep their
+// counts in, so several instances behind one load balancer share them.
+type RedisConfig struct {
+	Address  string // host:port; empty is no server
+	Password string
+	DB       int
+	// Timeout bounds each command, including the dial; zero is 100ms.
+	Timeout time.Duration
+	// FailClosed rejects requests with 503 when Redis can't be reached
+	// instead of admitting them unlimited.
+	FailClosed bool
+}
+
+// redisKeyPrefix namespaces the keys the rate limits write.
+const redisKeyPrefix = "tinyproxy:ratelimit:"
+
+// redisMaxIdle is how many idle connections a RedisStore keeps.
+const redisMaxIdle = 16
+
+// gcraScript admits a request under the generic cell rate algorithm: the
+// key holds the theoretical arrival time of the next request in
+// microseconds of server time, so every instance sees the same clock.
+// ARGV is the interval, the burst tolerance and the maximum wait, all in
+// microseconds. It returns {1, wait} when admitted and {0, retry} when not.
+const gcraScript = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local max_wait = tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local wait = tat - tolerance - now
+if wait < 0 then
+	wait = 0
+end
+if wait > max_wait then
+	return {0, wait - max_wait}
+end
+tat = tat + interval
+redis.call('SET', KEYS[1], string.format('%.0f', tat), 'PX', math.ceil((tat - now) / 1000) + 1)
+return {1, wait}
+`
+
+var gcraSHA = func() string {
+	sum := sha1.Sum([]byte(gcraScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisStore is a small pool of connections to the Redis server of a
+// RedisConfig. Connections are dialed when first needed, so a server that
+// is down only affects requests, not startup.
+type RedisStore struct {
+	cfg RedisConfig
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	closed bool
+
+	lastWarning atomic.Int64 // unix nanoseconds
+}
+
+// NewRedisStore returns a RedisStore for cfg.
+func NewRedisStore(cfg RedisConfig) *RedisStore {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 100 * time.Millisecond
+	}
+	return &RedisStore{cfg: cfg}
+}
+
+// Config returns the settings rs was created with.
+func (rs *RedisStore) Config() RedisConfig {
+	return rs.cfg
+}
+
+// Close closes the idle connections; connections in use are closed when
+// their command finishes. It may be called more than once.
+func (rs *RedisStore) Close() {
+	rs.mu.Lock()
+	idle := rs.idle
+	rs.idle, rs.closed = nil, true
+	rs.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+}
+
+// limit returns the RateLimitStore of one limit, named name.
+func (rs *RedisStore) limit(name string, p rateParams) RateLimitStore {
+	return &redisLimit{
+		rs:     rs,
+		prefix: redisKeyPrefix + name + ":",
+		args: []string{
+			strconv.FormatInt(p.interval.Microseconds(), 10),
+			strconv.FormatInt((time.Duration(p.burst-1) * p.interval).Microseconds(), 10),
+			strconv.FormatInt(p.maxWait.Microseconds(), 10),
+		},
+	}
+}
+
+type redisLimit struct {
+	rs     *RedisStore
+	prefix string
+	args   []string
+}
+
+func (rl *redisLimit) Take(ctx context.Context, key string) (time.Duration, bool, error) {
+	reply, err := rl.rs.eval(ctx, rl.prefix+key, rl.args)
+	if err == nil {
+		if vals, ok := reply.([]any); ok && len(vals) == 2 {
+			admitted, _ := vals[0].(int64)
+			wait, _ := vals[1].(int64)
+			return time.Duration(wait) * time.Microsecond, admitted == 1, nil
+		}
+		err = fmt.Errorf("unexpected reply %v", reply)
+	}
+	rl.rs.warn(err)
+	if rl.rs.cfg.FailClosed {
+		return 0, false, err
+	}
+	return 0, true, nil
+}
+
+// Stop does nothing: the counts live in Redis and the connections belong to
+// the RedisStore.
+func (rl *redisLimit) Stop() {}
+
+// warn logs a Redis error at most every ten seconds, so an outage doesn't
+// log every request.
+func (rs *RedisStore) warn(err error) {
+	now := time.Now().UnixNano()
+	last := rs.lastWarning.Load()
+	if now-last < int64(10*time.Second) || !rs.lastWarning.CompareAndSwap(last, now) {
+		return
+	}
+	policy := "admitting requests unlimited"
+	if rs.cfg.FailClosed {
+		policy = "rejecting requests"
+	}
+	log.Printf("WARNING: rate limit redis %s: %v; %s", rs.cfg.Address, err, policy)
+}
+
+// eval runs gcraScript by hash, loading it with EVAL the first time the
+// server doesn't know it.
+func (rs *RedisStore) eval(ctx context.Context, key string, args []string) (any, error) {
+	cmd := append([]string{"EVALSHA", gcraSHA, "1", key}, args...)
+	reply, err := rs.do(ctx, cmd...)
+	var rerr redisError
+	if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", gcraScript
+		reply, err = rs.do(ctx, cmd...)
+	}
+	return reply, err
+}
+
+// do sends one command and reads its reply.
+func (rs *RedisStore) do(ctx context.Context, args ...string) (any, error) {
+	c, err := rs.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(ctx, rs.cfg.Timeout, args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection is in an unknown state.
+		c.Close()
+		return nil, err
+	}
+	rs.put(c)
+	return reply, err
+}
+
+func (rs *RedisStore) get(ctx context.Context) (*redisConn, error) {
+	rs.mu.Lock()
+	if rs.closed {
+		rs.mu.Unlock()
+		return nil, errors.New("redis store closed")
+	}
+	if n := len(rs.idle); n > 0 {
+		c := rs.idle[n-1]
+		rs.idle = rs.idle[:n-1]
+		rs.mu.Unlock()
+		return c, nil
+	}
+	rs.mu.Unlock()
+	return rs.dial(ctx)
+}
+
+func (rs *RedisStore) put(c *redisConn) {
+	rs.mu.Lock()
+	if !rs.closed && len(rs.idle) < redisMaxIdle {
+		rs.idle = append(rs.idle, c)
+		c = nil
+	}
+	rs.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+func (rs *RedisStore) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{Timeout: rs.cfg.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", rs.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if rs.cfg.Password != "" {
+		if _, err := c.do(ctx, rs.cfg.Timeout, "AUTH", rs.cfg.Password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	}
+	if rs.cfg.DB != 0 {
+		if _, err := c.do(ctx, rs.cfg.Timeout, "SELECT", strconv.Itoa(rs.cfg.DB)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("select: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply from the server. The connection stays
+// usable after one.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn speaks RESP, the Redis protocol, over one connection.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) do(ctx context.Context, timeout time.Duration, args ...string) (any, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read reads one reply: a string, an int64, nil, a []any or a redisError.
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		vals := make([]any, n)
+		for i := range vals {
+			v, err := c.read()
+			var rerr redisError
+			if err != nil && !errors.As(err, &rerr) {
+				return nil, err
+			}
+			vals[i] = v
+		}
+		return vals, nil
+	}
+	return nil, fmt.Errorf("malformed redis reply %q", line)
+}
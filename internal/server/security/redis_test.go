@@ -0,0 +1,128 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func redisLimited(rs *RedisStore, cfg RateLimitConfig) func(r *http.Request) *httptest.ResponseRecorder {
+	h := NewRedisRateLimiter(cfg, rs, "test").Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	return func(r *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+}
+
+func TestRedisRateLimiter_Shared(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+	cfg := RedisConfig{Address: mr.Addr(), Password: "secret", DB: 2}
+	// Two instances share the counts of one limit.
+	rs1, rs2 := NewRedisStore(cfg), NewRedisStore(cfg)
+	defer rs1.Close()
+	defer rs2.Close()
+	limit := RateLimitConfig{Requests: 5, Window: time.Minute, Burst: 3}
+	do1, do2 := redisLimited(rs1, limit), redisLimited(rs2, limit)
+
+	for i, do := range []func(*http.Request) *httptest.ResponseRecorder{do1, do2, do1} {
+		if rec := do(requestFrom("10.0.0.1")); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, rec.Code)
+		}
+	}
+	rec := do2(requestFrom("10.0.0.1"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request 4: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "12" {
+		t.Errorf("Retry-After = %q, want 12", got)
+	}
+	if rec := do1(requestFrom("10.0.0.2")); rec.Code != http.StatusOK {
+		t.Errorf("other client: status %d, want 200", rec.Code)
+	}
+	mr.Select(2)
+	if !mr.Exists("tinyproxy:ratelimit:test:ip:10.0.0.1") {
+		t.Errorf("keys = %v, want the client's key in db 2", mr.Keys())
+	}
+}
+
+func TestRedisRateLimiter_Queue(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rs := NewRedisStore(RedisConfig{Address: mr.Addr()})
+	defer rs.Close()
+	// A request every 50ms; one at once and one more queued.
+	do := redisLimited(rs, RateLimitConfig{Requests: 20, Window: time.Second, Burst: 2, Queue: true, Delay: 1})
+
+	start := time.Now()
+	codes := make([]int, 3)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = do(requestFrom("10.0.0.1")).Code
+		}()
+	}
+	wg.Wait()
+	counts := map[int]int{}
+	for _, c := range codes {
+		counts[c]++
+	}
+	if counts[http.StatusOK] != 2 || counts[http.StatusTooManyRequests] != 1 {
+		t.Errorf("statuses = %v, want two 200 and one 429", codes)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("queued request finished after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestRedisRateLimiter_Unavailable(t *testing.T) {
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	limit := RateLimitConfig{Requests: 1, Window: time.Minute}
+
+	open := NewRedisStore(RedisConfig{Address: addr, Timeout: 50 * time.Millisecond})
+	defer open.Close()
+	do := redisLimited(open, limit)
+	for i := 1; i <= 3; i++ {
+		if rec := do(requestFrom("10.0.0.1")); rec.Code != http.StatusOK {
+			t.Errorf("fail open, request %d: status %d, want 200", i, rec.Code)
+		}
+	}
+
+	closed := NewRedisStore(RedisConfig{Address: addr, Timeout: 50 * time.Millisecond, FailClosed: true})
+	defer closed.Close()
+	if rec := redisLimited(closed, limit)(requestFrom("10.0.0.1")); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("fail closed: status %d, want 503", rec.Code)
+	}
+}
+
+func TestRedisStore_Reconnects(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rs := NewRedisStore(RedisConfig{Address: mr.Addr()})
+	defer rs.Close()
+	do := redisLimited(rs, RateLimitConfig{Requests: 1, Window: time.Minute})
+
+	if rec := do(requestFrom("10.0.0.1")); rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	// A restarted server drops the pooled connection and the script cache.
+	mr.Restart()
+	mr.FlushAll()
+	// The request on the dead connection fails open; later ones are
+	// counted again.
+	for i := 0; ; i++ {
+		if rec := do(requestFrom("10.0.0.1")); rec.Code == http.StatusTooManyRequests {
+			break
+		}
+		if i == 3 {
+			t.Fatal("no 429 after restart")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Package variables expands nginx-style $variables in config values against
+// the request being served.
+package variables
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"tinyproxy/internal/server/middleware"
+	"tinyproxy/internal/server/realip"
+)
+
+// Expand replaces $name and ${name} references in s with values taken from r.
+// Supported names:
+//
+//	$scheme $host $http_host $request_uri $uri $args $query_string $is_args
+//	$request_method $remote_addr $server_port $request_id
+//	$proxy_add_x_forwarded_for
+//	$http_<header> $cookie_<name> $arg_<name>
+//
+// Header names use underscores for dashes ($http_x_forwarded_for). Unknown
+// variables are left untouched so they can be expanded by a later stage.
+func Expand(s string, r *http.Request) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		name, end := scanName(s, i+1)
+		if name == "" {
+			b.WriteByte(s[i])
+			continue
+		}
+		val, ok := lookup(name, r)
+		if !ok {
+			b.WriteString(s[i:end])
+		} else {
+			b.WriteString(val)
+		}
+		i = end - 1
+	}
+	return b.String()
+}
+
+// Unknown returns the names of the variables referenced in s that Expand
+// does not support, such as regex captures or nginx-only variables.
+func Unknown(s string) []string {
+	var names []string
+	empty := &http.Request{Header: http.Header{}, URL: &url.URL{}}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			continue
+		}
+		name, end := scanName(s, i+1)
+		if name == "" {
+			continue
+		}
+		if _, ok := lookup(name, empty); !ok {
+			names = append(names, name)
+		}
+		i = end - 1
+	}
+	return names
+}
+
+// scanName reads a variable name starting at s[start] (just after the $).
+// It returns the name and the index one past the end of the reference.
+func scanName(s string, start int) (string, int) {
+	if s[start] == '{' {
+		if j := strings.IndexByte(s[start:], '}'); j > 1 {
+			return s[start+1 : start+j], start + j + 1
+		}
+		return "", start
+	}
+	j := start
+	for j < len(s) && isNameByte(s[j]) {
+		j++
+	}
+	return s[start:j], j
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func lookup(name string, r *http.Request) (string, bool) {
+	switch name {
+	case "scheme":
+		return Scheme(r), true
+	case "host":
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(host), true
+	case "http_host":
+		return r.Host, true
+	case "request_uri":
+		// RequestURI is the original request target and is not affected by
+		// rewrites; it is only absolute-form for forward-proxy requests.
+		if strings.HasPrefix(r.RequestURI, "/") {
+			return r.RequestURI, true
+		}
+		return r.URL.RequestURI(), true
+	case "uri":
+		return r.URL.Path, true
+	case "args", "query_string":
+		return r.URL.RawQuery, true
+	case "is_args":
+		if r.URL.RawQuery != "" {
+			return "?", true
+		}
+		return "", true
+	case "request_method":
+		return r.Method, true
+	case "remote_addr":
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return ip, true
+		}
+		return r.RemoteAddr, true
+	case "server_port":
+		if _, port, err := net.SplitHostPort(r.Host); err == nil {
+			return port, true
+		}
+		if r.TLS != nil {
+			return "443", true
+		}
+		return "80", true
+	case "proxy_add_x_forwarded_for":
+		return realip.ForwardedFor(r), true
+	case "request_id":
+		id, _ := r.Context().Value(middleware.RequestIDKey).(string)
+		return id, true
+	}
+
+	switch {
+	case strings.HasPrefix(name, "http_"):
+		return r.Header.Get(strings.ReplaceAll(name[len("http_"):], "_", "-")), true
+	case strings.HasPrefix(name, "cookie_"):
+		if c, err := r.Cookie(name[len("cookie_"):]); err == nil {
+			return c.Value, true
+		}
+		return "", true
+	case strings.HasPrefix(name, "arg_"):
+		return r.URL.Query().Get(name[len("arg_"):]), true
+	}
+	return "", false
+}
+
+// Scheme returns "https" for TLS requests and "http" otherwise.
+func Scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,43 @@
+package variables
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://www.example.com:8443/a/b?x=1&y=2", nil)
+	r.TLS = &tls.ConnectionState{}
+	r.RemoteAddr = "203.0.113.7:5555"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("Cookie", "session=abc")
+
+	cases := []struct{ in, want string }{
+		{"https://example.com$request_uri", "https://example.com/a/b?x=1&y=2"},
+		{"$scheme://$host$uri", "https://www.example.com/a/b"},
+		{"${host}:$server_port", "www.example.com:8443"},
+		{"$uri$is_args$args", "/a/b?x=1&y=2"},
+		{"$http_x_forwarded_for", "198.51.100.1"},
+		{"$cookie_session", "abc"},
+		{"$arg_y", "2"},
+		{"$remote_addr", "203.0.113.7"},
+		{"/new/$1", "/new/$1"},   // unknown variables are preserved
+		{"cost: 5$", "cost: 5$"}, // trailing dollar
+		{"no variables", "no variables"},
+	}
+	for _, c := range cases {
+		if got := Expand(c.in, r); got != c.want {
+			t.Errorf("Expand(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	got := Unknown("$scheme://$proxy_host$request_uri ${upstream_addr} $http_x_id $1")
+	want := []string{"proxy_host", "upstream_addr", "1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Unknown = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,210 @@
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// value is one inspected value and the variable it came from, e.g.
+// ARGS:q, for the log.
+type value struct {
+	name string
+	key  string // lower-cased collection key; empty for scalars
+	val  string
+}
+
+// transaction holds the values of one request, collected once for all
+// rules.
+type transaction struct {
+	argsGet  []value
+	argsPost []value
+	headers  []value
+	cookies  []value
+	files    []value
+	scalars  map[string]string
+}
+
+func newTransaction(r *http.Request, body []byte) *transaction {
+	tx := &transaction{
+		scalars: map[string]string{
+			"REQUEST_URI":      r.URL.RequestURI(),
+			"REQUEST_FILENAME": r.URL.Path,
+			"QUERY_STRING":     r.URL.RawQuery,
+			"REQUEST_METHOD":   r.Method,
+		},
+	}
+	// ParseQuery keeps what it can of a malformed query.
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	tx.argsGet = fromValues("ARGS_GET", query)
+	tx.headers = fromValues("REQUEST_HEADERS", url.Values(r.Header))
+	for _, c := range r.Cookies() {
+		tx.cookies = append(tx.cookies, value{"REQUEST_COOKIES", strings.ToLower(c.Name), c.Value})
+	}
+	if body != nil {
+		tx.parseBody(r.Header.Get("Content-Type"), body)
+	}
+	return tx
+}
+
+func fromValues(name string, vals map[string][]string) []value {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out []value
+	for _, k := range keys {
+		for _, v := range vals[k] {
+			out = append(out, value{name, strings.ToLower(k), v})
+		}
+	}
+	return out
+}
+
+// parseBody fills ARGS_POST, FILES and REQUEST_BODY from the part of the
+// body that was read. A body cut off at the limit yields what could be
+// parsed of it.
+func (tx *transaction) parseBody(contentType string, body []byte) {
+	mt, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		form, _ := url.ParseQuery(string(body))
+		tx.argsPost = fromValues("ARGS_POST", form)
+	case mt == "multipart/form-data":
+		// File contents aren't inspected, so neither is the raw body.
+		tx.parseMultipart(body, params["boundary"])
+		return
+	case isJSON(mt):
+		var doc any
+		if json.Unmarshal(body, &doc) == nil {
+			tx.argsPost = flattenJSON("json", doc, nil)
+		}
+	}
+	tx.scalars["REQUEST_BODY"] = string(body)
+}
+
+func (tx *transaction) parseMultipart(body []byte, boundary string) {
+	if boundary == "" {
+		return
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return
+		}
+		if name := p.FileName(); name != "" {
+			tx.files = append(tx.files, value{"FILES", strings.ToLower(p.FormName()), name})
+			continue
+		}
+		v, _ := io.ReadAll(p)
+		tx.argsPost = append(tx.argsPost, value{"ARGS_POST", strings.ToLower(p.FormName()), string(v)})
+	}
+}
+
+// flattenJSON turns the leaves of a JSON document into arguments named by
+// their path, e.g. json.user.name or json.items.0.
+func flattenJSON(prefix string, doc any, out []value) []value {
+	switch d := doc.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out = flattenJSON(prefix+"."+k, d[k], out)
+		}
+	case []any:
+		for i, v := range d {
+			out = flattenJSON(prefix+"."+strconv.Itoa(i), v, out)
+		}
+	case string:
+		out = append(out, value{"ARGS_POST", strings.ToLower(prefix), d})
+	case float64:
+		out = append(out, value{"ARGS_POST", strings.ToLower(prefix), strconv.FormatFloat(d, 'f', -1, 64)})
+	case bool:
+		out = append(out, value{"ARGS_POST", strings.ToLower(prefix), strconv.FormatBool(d)})
+	}
+	return out
+}
+
+func isJSON(mt string) bool {
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// inspectable reports whether a body of the media type is read: forms,
+// JSON, XML and text. Uploads of other types pass uninspected.
+func inspectable(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data" ||
+		isJSON(mt) || mt == "application/xml" || strings.HasSuffix(mt, "+xml") ||
+		strings.HasPrefix(mt, "text/")
+}
+
+// values returns the values of v.
+func (tx *transaction) values(name string) []value {
+	switch name {
+	case "ARGS":
+		return append(append([]value(nil), tx.argsGet...), tx.argsPost...)
+	case "ARGS_GET":
+		return tx.argsGet
+	case "ARGS_POST":
+		return tx.argsPost
+	case "ARGS_NAMES":
+		return names("ARGS_NAMES", tx.argsGet, tx.argsPost)
+	case "REQUEST_HEADERS":
+		return tx.headers
+	case "REQUEST_HEADERS_NAMES":
+		return names("REQUEST_HEADERS_NAMES", tx.headers)
+	case "REQUEST_COOKIES":
+		return tx.cookies
+	case "REQUEST_COOKIES_NAMES":
+		return names("REQUEST_COOKIES_NAMES", tx.cookies)
+	case "FILES":
+		return tx.files
+	}
+	if v, ok := tx.scalars[name]; ok {
+		return []value{{name: name, val: v}}
+	}
+	return nil
+}
+
+// names returns the keys of collections as values of the collection name.
+func names(name string, collections ...[]value) []value {
+	var out []value
+	for _, c := range collections {
+		for _, v := range c {
+			out = append(out, value{name, v.key, v.key})
+		}
+	}
+	return out
+}
+
+// readBody reads up to limit bytes of r's body for inspection and puts
+// them back in front of the rest, so the handler still gets all of it. It
+// returns nil when the body isn't inspected.
+func readBody(r *http.Request, limit int64) []byte {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 || !inspectable(r.Header.Get("Content-Type")) {
+		return nil
+	}
+	buf, _ := io.ReadAll(io.LimitReader(r.Body, limit))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	return buf
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,420 @@
+package waf
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Anomaly scores of the rule severities, as in the OWASP Core Rule Set.
+var severityScores = map[string]int{
+	"CRITICAL": 5,
+	"ERROR":    4,
+	"WARNING":  3,
+	"NOTICE":   2,
+}
+
+// Rule is one SecRule: when the operator matches any of the variables'
+// values, after the transformations, the request scores Severity.
+type Rule struct {
+	ID       int
+	Msg      string
+	Severity int  // anomaly score
+	Deny     bool // blocks the request on its own
+	File     string
+	Line     int
+
+	vars       []variable
+	op         func(string) bool
+	transforms []func(string) string
+}
+
+// variable selects the values a rule inspects: a collection, optionally
+// one key of it, or a key excluded from it.
+type variable struct {
+	name    string
+	key     string // lower case; empty is the whole collection
+	exclude bool
+}
+
+// ruleSet is the result of parsing rule files: the rules and the IDs
+// SecRuleRemoveById turned off.
+type ruleSet struct {
+	rules   []*Rule
+	removed []int
+}
+
+// parseRules parses a SecLang subset: SecRule with the variables,
+// operators, transformations and actions listed in the documentation, and
+// SecRuleRemoveById. Lines ending in a backslash continue on the next.
+func parseRules(r io.Reader, file string) (*ruleSet, error) {
+	set := &ruleSet{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	var line string
+	lineNo, start := 0, 0
+	for sc.Scan() {
+		lineNo++
+		text := strings.TrimSpace(sc.Text())
+		if line == "" {
+			start = lineNo
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+		}
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line += text
+		if err := set.parseLine(line, file, start); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, start, err)
+		}
+		line = ""
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if line != "" {
+		return nil, fmt.Errorf("%s:%d: unterminated line continuation", file, start)
+	}
+	return set, nil
+}
+
+func (set *ruleSet) parseLine(line, file string, lineNo int) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "SecRule":
+		if len(args) != 4 {
+			return fmt.Errorf("SecRule requires variables, an operator and actions")
+		}
+		rule, err := newRule(args[1], args[2], args[3])
+		if err != nil {
+			return err
+		}
+		rule.File, rule.Line = file, lineNo
+		set.rules = append(set.rules, rule)
+	case "SecRuleRemoveById":
+		if len(args) < 2 {
+			return fmt.Errorf("SecRuleRemoveById requires rule IDs")
+		}
+		for _, a := range args[1:] {
+			id, err := strconv.Atoi(a)
+			if err != nil {
+				return fmt.Errorf("invalid rule ID %q", a)
+			}
+			set.removed = append(set.removed, id)
+		}
+	default:
+		return fmt.Errorf("unsupported directive %q: only SecRule and SecRuleRemoveById are supported", args[0])
+	}
+	return nil
+}
+
+// splitArgs splits a directive into words. Double quotes group words, and
+// \" inside them is a literal quote; other backslashes are kept for the
+// regular expressions they usually belong to.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inWord, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(line) && line[i+1] == '"':
+			cur.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inWord {
+				args = append(args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+func newRule(vars, op, actions string) (*Rule, error) {
+	rule := &Rule{Severity: severityScores["CRITICAL"]}
+	for _, v := range strings.Split(vars, "|") {
+		parsed, err := parseVariable(v)
+		if err != nil {
+			return nil, err
+		}
+		rule.vars = append(rule.vars, parsed)
+	}
+	var err error
+	if rule.op, err = parseOperator(op); err != nil {
+		return nil, err
+	}
+	if err := rule.parseActions(actions); err != nil {
+		return nil, err
+	}
+	if rule.ID <= 0 {
+		return nil, fmt.Errorf("SecRule requires an id action")
+	}
+	return rule, nil
+}
+
+// collections are the variables a rule may inspect; keyed ones can be
+// narrowed with NAME:key.
+var collections = map[string]bool{
+	"ARGS":                  true,
+	"ARGS_GET":              true,
+	"ARGS_POST":             true,
+	"ARGS_NAMES":            true,
+	"REQUEST_HEADERS":       true,
+	"REQUEST_HEADERS_NAMES": true,
+	"REQUEST_COOKIES":       true,
+	"REQUEST_COOKIES_NAMES": true,
+	"FILES":                 true,
+	"REQUEST_URI":           false,
+	"REQUEST_FILENAME":      false,
+	"QUERY_STRING":          false,
+	"REQUEST_METHOD":        false,
+	"REQUEST_BODY":          false,
+}
+
+func parseVariable(s string) (variable, error) {
+	var v variable
+	if strings.HasPrefix(s, "!") {
+		v.exclude = true
+		s = s[1:]
+	}
+	name, key, hasKey := strings.Cut(s, ":")
+	keyed, ok := collections[name]
+	if !ok {
+		return v, fmt.Errorf("unsupported variable %q", name)
+	}
+	if hasKey && !keyed {
+		return v, fmt.Errorf("variable %s has no keys", name)
+	}
+	if v.exclude && key == "" {
+		return v, fmt.Errorf("excluding %s requires a key", name)
+	}
+	v.name, v.key = name, strings.ToLower(key)
+	return v, nil
+}
+
+// parseOperator compiles "@op argument", optionally negated with a leading
+// !. Without an @ the argument is a regular expression, as in ModSecurity.
+func parseOperator(s string) (func(string) bool, error) {
+	negate := false
+	if strings.HasPrefix(s, "!") {
+		negate = true
+		s = s[1:]
+	}
+	name, arg := "rx", s
+	if strings.HasPrefix(s, "@") {
+		name, arg, _ = strings.Cut(s[1:], " ")
+	}
+	var op func(string) bool
+	switch name {
+	case "rx":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid @rx: %w", err)
+		}
+		op = re.MatchString
+	case "pm":
+		phrases := strings.Fields(strings.ToLower(arg))
+		if len(phrases) == 0 {
+			return nil, fmt.Errorf("@pm requires phrases")
+		}
+		op = func(v string) bool {
+			v = strings.ToLower(v)
+			for _, p := range phrases {
+				if strings.Contains(v, p) {
+					return true
+				}
+			}
+			return false
+		}
+	case "contains":
+		op = func(v string) bool { return strings.Contains(v, arg) }
+	case "streq":
+		op = func(v string) bool { return v == arg }
+	case "beginsWith":
+		op = func(v string) bool { return strings.HasPrefix(v, arg) }
+	case "endsWith":
+		op = func(v string) bool { return strings.HasSuffix(v, arg) }
+	case "within":
+		op = func(v string) bool { return strings.Contains(arg, v) }
+	case "eq", "gt", "lt", "ge", "le":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("@%s requires an integer", name)
+		}
+		cmp := map[string]func(a int) bool{
+			"eq": func(a int) bool { return a == n },
+			"gt": func(a int) bool { return a > n },
+			"lt": func(a int) bool { return a < n },
+			"ge": func(a int) bool { return a >= n },
+			"le": func(a int) bool { return a <= n },
+		}[name]
+		op = func(v string) bool {
+			a, err := strconv.Atoi(strings.TrimSpace(v))
+			return err == nil && cmp(a)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported operator @%s", name)
+	}
+	if negate {
+		return func(v string) bool { return !op(v) }, nil
+	}
+	return op, nil
+}
+
+// ignoredActions are accepted for compatibility with existing rules but
+// change nothing: all rules run once the body has been read, and scoring is
+// built in rather than kept in variables.
+var ignoredActions = map[string]bool{
+	"phase": true, "tag": true, "ver": true, "rev": true, "maturity": true,
+	"accuracy": true, "capture": true, "logdata": true, "log": true,
+	"nolog": true, "auditlog": true, "noauditlog": true, "setvar": true,
+	"status": true, "pass": true, "block": true, "multiMatch": true,
+}
+
+func (rule *Rule) parseActions(s string) error {
+	for _, a := range splitActions(s) {
+		name, val, _ := strings.Cut(a, ":")
+		val = strings.Trim(val, "'")
+		switch {
+		case name == "id":
+			id, err := strconv.Atoi(val)
+			if err != nil || id <= 0 {
+				return fmt.Errorf("invalid rule id %q", val)
+			}
+			rule.ID = id
+		case name == "msg":
+			rule.Msg = val
+		case name == "severity":
+			score, ok := severityScores[strings.ToUpper(val)]
+			if !ok {
+				return fmt.Errorf("invalid severity %q: must be CRITICAL, ERROR, WARNING or NOTICE", val)
+			}
+			rule.Severity = score
+		case name == "deny" || name == "drop":
+			rule.Deny = true
+		case name == "t":
+			if val == "none" {
+				rule.transforms = nil
+				continue
+			}
+			t, ok := transforms[val]
+			if !ok {
+				return fmt.Errorf("unsupported transformation %q", val)
+			}
+			rule.transforms = append(rule.transforms, t)
+		case name == "chain":
+			return fmt.Errorf("chained rules are not supported")
+		case ignoredActions[name]:
+		default:
+			return fmt.Errorf("unsupported action %q", name)
+		}
+	}
+	return nil
+}
+
+// splitActions splits an action list at commas outside single quotes.
+func splitActions(s string) []string {
+	var out []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				out = append(out, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		out = append(out, last)
+	}
+	return out
+}
+
+var (
+	sqlComment = regexp.MustCompile(`/\*.*?\*/`)
+	unicodeEsc = regexp.MustCompile(`%u([0-9a-fA-F]{4})`)
+)
+
+// transforms normalise values before matching, so encoded payloads don't
+// slip past the operators.
+var transforms = map[string]func(string) string{
+	"lowercase": strings.ToLower,
+	"urlDecode": urlDecode,
+	"urlDecodeUni": func(s string) string {
+		s = unicodeEsc.ReplaceAllStringFunc(s, func(m string) string {
+			n, _ := strconv.ParseUint(m[2:], 16, 32)
+			return string(rune(n))
+		})
+		return urlDecode(s)
+	},
+	"htmlEntityDecode":   html.UnescapeString,
+	"compressWhitespace": func(s string) string { return strings.Join(strings.Fields(s), " ") },
+	"removeWhitespace":   func(s string) string { return strings.Join(strings.Fields(s), "") },
+	"removeNulls":        func(s string) string { return strings.ReplaceAll(s, "\x00", "") },
+	"replaceComments":    func(s string) string { return sqlComment.ReplaceAllString(s, " ") },
+	"normalizePath": func(s string) string {
+		s = strings.ReplaceAll(s, "\\", "/")
+		if s == "" {
+			return s
+		}
+		clean := path.Clean(s)
+		if strings.HasSuffix(s, "/") && clean != "/" {
+			clean += "/"
+		}
+		return clean
+	},
+}
+
+// urlDecode decodes percent escapes and plus signs, leaving malformed
+// escapes as they are rather than failing.
+func urlDecode(s string) string {
+	if d, err := url.QueryUnescape(s); err == nil {
+		return d
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '+':
+			b.WriteByte(' ')
+		case s[i] == '%' && i+2 < len(s):
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+			b.WriteByte('%')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
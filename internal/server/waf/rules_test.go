@@ -0,0 +1,107 @@
+package waf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	got, err := splitArgs(`SecRule ARGS "@rx a\"b\d" "id:1,msg:'x, y'"`)
+	want := []string{"SecRule", "ARGS", `@rx a"b\d`, "id:1,msg:'x, y'"}
+	if err != nil || !slices.Equal(got, want) {
+		t.Errorf("splitArgs = %q, %v; want %q", got, err, want)
+	}
+	if _, err := splitArgs(`SecRule ARGS "@rx a`); err == nil {
+		t.Error("unterminated quote: expected error")
+	}
+	if got := splitActions("id:1, msg:'a, b',t:lowercase"); !slices.Equal(got, []string{"id:1", "msg:'a, b'", "t:lowercase"}) {
+		t.Errorf("splitActions = %q", got)
+	}
+}
+
+func TestParseOperator(t *testing.T) {
+	for _, c := range []struct {
+		op, val string
+		want    bool
+	}{
+		{"@rx ^a+$", "aaa", true},
+		{"^a+$", "aab", false},
+		{"@pm foo bar", "xxBARxx", true},
+		{"@contains lo w", "hello world", true},
+		{"@streq GET", "GET", true},
+		{"@beginsWith /admin", "/admin/x", true},
+		{"@endsWith .php", "index.php", true},
+		{"@within GET HEAD", "HEAD", true},
+		{"!@within GET HEAD", "POST", true},
+		{"@gt 10", "11", true},
+		{"@le 10", "x", false},
+	} {
+		op, err := parseOperator(c.op)
+		if err != nil {
+			t.Errorf("%q: %v", c.op, err)
+			continue
+		}
+		if got := op(c.val); got != c.want {
+			t.Errorf("%q on %q = %v, want %v", c.op, c.val, got, c.want)
+		}
+	}
+	for _, op := range []string{"@rx (", "@detectSQLi", "@pm", "@eq x"} {
+		if _, err := parseOperator(op); err == nil {
+			t.Errorf("%q: expected error", op)
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	for _, c := range []struct{ name, in, want string }{
+		{"urlDecode", "a%20b+c%zz", "a b c%zz"},
+		{"urlDecodeUni", "%u003cscript%3e", "<script>"},
+		{"htmlEntityDecode", "&lt;b&gt;", "<b>"},
+		{"compressWhitespace", " a \t\n b ", "a b"},
+		{"removeWhitespace", "ja va\nscript", "javascript"},
+		{"removeNulls", "a\x00b", "ab"},
+		{"replaceComments", "UNION/**/SELECT", "UNION SELECT"},
+		{"normalizePath", `a\..\..\etc/./passwd`, "../etc/passwd"},
+		{"lowercase", "SeLeCt", "select"},
+	} {
+		if got := transforms[c.name](c.in); got != c.want {
+			t.Errorf("%s(%q) = %q, want %q", c.name, c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseRules_Errors(t *testing.T) {
+	for _, input := range []string{
+		`SecRule ARGS "@rx x" "msg:'no id'"`,
+		`SecRule ARGS "@rx x" "id:1,chain"`,
+		`SecRule ARGS "@rx x" "id:1,t:base64Decode"`,
+		`SecRule ARGS "@rx x" "id:1,severity:HIGH"`,
+		`SecRule ARGS "@rx x" "id:1,exec:/bin/sh"`,
+		`SecRule RESPONSE_BODY "@rx x" "id:1"`,
+		`SecRule REQUEST_URI:x "@rx x" "id:1"`,
+		`SecRule !ARGS "@rx x" "id:1"`,
+		`SecRule ARGS "@rx x"`,
+		`SecRuleEngine On`,
+		"SecRule ARGS \"@rx x\" \\",
+	} {
+		if _, err := parseRules(strings.NewReader(input), "test.conf"); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestRule_Exclusion(t *testing.T) {
+	set, err := parseRules(strings.NewReader(`SecRule ARGS|!ARGS:html "@rx <b>" "id:1"`), "test.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Engine{cfg: Config{Mode: ModeBlock, Threshold: 5, BodyLimit: 1024}, rules: set.rules}
+	if res := e.Inspect(query("html=<b>")()); len(res.Matches) != 0 {
+		t.Errorf("excluded argument matched: %v", res.Matches)
+	}
+	res := e.Inspect(query("text=<b>")())
+	if len(res.Matches) != 1 || res.Matches[0].Variable != "ARGS:text" {
+		t.Errorf("matches = %+v, want one in ARGS:text", res.Matches)
+	}
+}
